@@ -1,31 +1,71 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
+	"github.com/skamensky/email-archiver/pkg/backup"
 	"github.com/skamensky/email-archiver/pkg/client"
 	"github.com/skamensky/email-archiver/pkg/database"
+	"github.com/skamensky/email-archiver/pkg/dedupe"
+	"github.com/skamensky/email-archiver/pkg/encryption"
+	"github.com/skamensky/email-archiver/pkg/export"
 	"github.com/skamensky/email-archiver/pkg/models"
 	"github.com/skamensky/email-archiver/pkg/options"
+	"github.com/skamensky/email-archiver/pkg/query"
+	"github.com/skamensky/email-archiver/pkg/retention"
+	"github.com/skamensky/email-archiver/pkg/source"
 	"github.com/skamensky/email-archiver/pkg/utils"
+	"github.com/skamensky/email-archiver/pkg/verify"
 	"github.com/skamensky/email-archiver/pkg/web"
 	"github.com/urfave/cli/v2"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
-func setup(imapEventHandler func(event *models.MailboxEvent)) (models.ClientPool, error) {
+// the options set with command line flags by key, collected before any command runs
+var optionOverrides = map[string]string{}
 
-	err := godotenv.Load()
+// a global flag for every option that has one, they take precedence over the environment and the db
+func optionFlags() []cli.Flag {
+	flags := []cli.Flag{}
+	for _, definition := range options.Definitions {
+		if definition.Flag == "" {
+			continue
+		}
+		flags = append(flags, &cli.StringFlag{
+			Name:  definition.Flag,
+			Usage: fmt.Sprintf("%s (overrides %s)", definition.Usage, definition.Key),
+		})
+	}
+	return flags
+}
+
+func collectOptionFlags(cCtx *cli.Context) error {
+	for _, definition := range options.Definitions {
+		if definition.Flag != "" && cCtx.IsSet(definition.Flag) {
+			optionOverrides[definition.Key] = cCtx.String(definition.Flag)
+		}
+	}
+	return nil
+}
+
+func setup(imapEventHandler func(event *models.MailboxEvent)) (models.ClientPool, *options.Options, error) {
+
+	ops, _, err := setupDB()
 	if err != nil {
-		return nil, utils.JoinErrors("Error loading .env file", err)
+		return nil, nil, err
 	}
 
-	ops, err := options.New()
+	err = ops.ValidateImap()
 	if err != nil {
-		return nil, utils.JoinErrors("failed to setup options", err)
+		return nil, nil, utils.JoinErrors("failed to setup options", err)
 	}
 
 	pool := client.NewClientConnPool(ops, imapEventHandler)
@@ -33,17 +73,216 @@ func setup(imapEventHandler func(event *models.MailboxEvent)) (models.ClientPool
 	// make sure we can get a client
 	lClient, err := pool.Get()
 	if err != nil {
-		return nil, utils.JoinErrors("failed to get client", err)
+		return nil, nil, utils.JoinErrors("failed to get client", err)
 	}
 	defer pool.Put(lClient)
 
-	_, err = database.New(ops)
+	return pool, ops, nil
+
+}
+
+// for commands that only work on the local archive and don't need an imap connection
+func setupDB() (*options.Options, models.DB, error) {
+	ops, err := options.New(optionOverrides)
+	if err != nil {
+		return nil, nil, utils.JoinErrors("failed to setup options", err)
+	}
+
+	db, err := database.New(ops)
+	if err != nil {
+		return nil, nil, utils.JoinErrors("failed to setup database", err)
+	}
+
+	// the options stored in the db can only be read once it's open
+	ops, err = ops.WithStored(db)
+	if err != nil {
+		return nil, nil, utils.JoinErrors("failed to setup options", err)
+	}
+	return ops, db, nil
+}
+
+// validates and stores changes to the options stored in the archive, see options.Update
+func storeOptions(changes map[string]string) error {
+	if len(changes) == 0 {
+		return errors.New("no options given")
+	}
+	ops, db, err := setupDB()
+	if err != nil {
+		return err
+	}
+	updated, err := ops.Update(changes)
+	if err != nil {
+		return err
+	}
+	err = ops.CheckAccount(updated, db)
+	if err != nil {
+		return err
+	}
+	err = db.SetOptions(changes)
 	if err != nil {
-		return nil, utils.JoinErrors("failed to setup database", err)
+		return err
 	}
+	for _, value := range ops.Values() {
+		if _, ok := changes[value.Key]; ok && !value.Editable {
+			fmt.Printf("%s is set in the %s, which takes precedence over the stored value\n", value.Key, value.Source)
+		}
+	}
+	fmt.Println("done")
+	return nil
+}
+
+// prints import progress to stdout, progress events are only printed every so often
+func printEventHandler(event *models.MailboxEvent) {
+	switch event.EventType {
+	case models.MailboxDownloadProgress:
+		if event.TotalDownloaded%100 == 0 {
+			fmt.Printf("%s: %d/%d\n", event.Mailbox, event.TotalDownloaded, event.TotalToDownload)
+		}
+	case models.MailboxSyncWarning:
+		fmt.Printf("%s: warning: %s\n", event.Mailbox, event.Warning)
+	case models.MailboxDownloadError:
+		fmt.Printf("%s: error: %s\n", event.Mailbox, event.Error)
+	default:
+		fmt.Printf("%s: %s %d/%d\n", event.Mailbox, event.EventType, event.TotalDownloaded, event.TotalToDownload)
+	}
+}
+
+var selectionFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "sql",
+		Usage: "a sql query selecting rows from the email table, e.g. \"SELECT * FROM email WHERE from_host_1 = 'example.com'\"",
+	},
+	&cli.StringFlag{
+		Name:  "search",
+		Usage: "a full text search query",
+	},
+	&cli.StringFlag{
+		Name:  "query",
+		Usage: "a query like 'from:example.com has:attachment after:2021-01-01', see the search command",
+	},
+	&cli.StringFlag{
+		Name:  "saved",
+		Usage: "the name of a saved query, see the queries command",
+	},
+	&cli.StringSliceFlag{
+		Name:  "mailbox",
+		Usage: "export whole mailboxes, can be given multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name:  "header",
+		Usage: "only emails with this header, as \"List-Id: value\" (matches any part of the value, case insensitively) or just \"List-Id\", can be given multiple times",
+	},
+	&cli.StringFlag{
+		Name:  "after",
+		Usage: "only emails dated at or after this day (2020-01-31, UTC) or time (2020-01-31T12:00:00+02:00)",
+	},
+	&cli.StringFlag{
+		Name:  "before",
+		Usage: "only emails dated before this day (2020-01-31, UTC) or time (2020-01-31T12:00:00+02:00)",
+	},
+}
 
-	return pool, nil
+// one line per deletion, used both for the dry run report and while applying policies
+func printDeletion(prefix string, deletion models.RetentionDeletion) {
+	date := "undated"
+	if deletion.DateEpoch != 0 {
+		date = time.Unix(deletion.DateEpoch, 0).UTC().Format("2006-01-02")
+	}
+	where := "locally"
+	if deletion.Mailbox != "" {
+		where = fmt.Sprintf("from %s (uid %d)", deletion.Mailbox, deletion.Uid)
+	}
+	fmt.Printf("%s %s %s [%s] %s %q\n", prefix, date, where, deletion.Policy, deletion.OurId, deletion.Subject)
+}
 
+// one line per email of a duplicate report
+func printFingerprint(prefix string, fingerprint models.Fingerprint) {
+	date := "undated"
+	if fingerprint.DateEpoch != 0 {
+		date = time.Unix(fingerprint.DateEpoch, 0).UTC().Format("2006-01-02")
+	}
+	fmt.Printf("%s %s %s %q %s in %s\n", prefix, date, fingerprint.From, fingerprint.Subject, fingerprint.OurId, strings.Join(fingerprint.Mailboxes, ", "))
+}
+
+// one line per backup snapshot
+func printSnapshot(prefix string, snapshot backup.Snapshot) {
+	if snapshot.Problem != "" {
+		fmt.Printf("%s %s: damaged, %s\n", prefix, snapshot.Path, snapshot.Problem)
+		return
+	}
+	fmt.Printf("%s %s: db %.1f MB, %d blobs %.1f MB\n", prefix, snapshot.Path, float64(snapshot.DBSize)/1e6, snapshot.Blobs, float64(snapshot.BlobsSize)/1e6)
+}
+
+func selectionFromFlags(cCtx *cli.Context) (export.Selection, error) {
+	headers := []export.HeaderFilter{}
+	for _, header := range cCtx.StringSlice("header") {
+		headers = append(headers, export.ParseHeaderFilter(header))
+	}
+	after, err := export.ParseDate(cCtx.String("after"))
+	if err != nil {
+		return export.Selection{}, utils.JoinErrors("invalid --after", err)
+	}
+	before, err := export.ParseDate(cCtx.String("before"))
+	if err != nil {
+		return export.Selection{}, utils.JoinErrors("invalid --before", err)
+	}
+	return export.Selection{
+		SqlQuery:    cCtx.String("sql"),
+		SearchQuery: cCtx.String("search"),
+		Query:       cCtx.String("query"),
+		SavedQuery:  cCtx.String("saved"),
+		Mailboxes:   cCtx.StringSlice("mailbox"),
+		Headers:     headers,
+		After:       after,
+		Before:      before,
+	}, nil
+}
+
+var annotationTargetFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "id",
+		Usage: "the our_id of an email, can be given multiple times",
+	},
+	&cli.StringFlag{
+		Name:  "thread",
+		Usage: "the thread_id of a thread, see the threads api",
+	},
+}
+
+// the our_ids given with --id, of the emails in the --thread, or otherwise the ones selected by the selection flags if withSelection
+func annotationTargets(cCtx *cli.Context, db models.DB, withSelection bool) ([]string, error) {
+	ourIds := cCtx.StringSlice("id")
+	if cCtx.String("thread") != "" {
+		if len(ourIds) > 0 {
+			return nil, errors.New("only one of --id or --thread can be given")
+		}
+		threadEmailIds, err := db.GetThreadEmailIds(cCtx.String("thread"))
+		if err != nil {
+			return nil, err
+		}
+		if len(threadEmailIds) == 0 {
+			return nil, fmt.Errorf("there is no thread %s", cCtx.String("thread"))
+		}
+		return threadEmailIds, nil
+	}
+	if len(ourIds) > 0 {
+		return ourIds, nil
+	}
+	if !withSelection {
+		return nil, errors.New("one of --id or --thread is required")
+	}
+	selection, err := selectionFromFlags(cCtx)
+	if err != nil {
+		return nil, err
+	}
+	err = selection.Stream(db, func(email models.Email) error {
+		ourIds = append(ourIds, email.GetOurID())
+		return nil
+	})
+	if err != nil {
+		return nil, utils.JoinErrors("select the emails with --id, --thread or the selection flags", err)
+	}
+	return ourIds, nil
 }
 
 func main() {
@@ -51,13 +290,15 @@ func main() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
 	}()
 	app := &cli.App{
+		Flags:  optionFlags(),
+		Before: collectOptionFlags,
 		Commands: []*cli.Command{
 			{
 				Name:    "list",
 				Aliases: []string{"l"},
 				Usage:   "list mailboxes",
 				Action: func(*cli.Context) error {
-					pool, err := setup(nil)
+					pool, _, err := setup(nil)
 					if err != nil {
 						return err
 					}
@@ -78,7 +319,7 @@ func main() {
 				Aliases: []string{"d"},
 				Usage:   "download all mailboxes to a local db",
 				Action: func(cCtx *cli.Context) error {
-					imapClient, err := setup(nil)
+					imapClient, _, err := setup(nil)
 					if err != nil {
 						return err
 					}
@@ -90,16 +331,1161 @@ func main() {
 					return imapClient.DownloadMailboxes(mailboxes)
 				},
 			},
+			{
+				Name:  "history",
+				Usage: "list past syncs with what they downloaded and removed, their warnings and errors, newest first",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "list at most this many syncs",
+						Value: 20,
+					},
+					&cli.BoolFlag{
+						Name:  "failed",
+						Usage: "only list the syncs that failed",
+					},
+					&cli.BoolFlag{
+						Name:  "mailboxes",
+						Usage: "also list what every sync did in each mailbox, with its warnings",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the syncs as json",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.Int("limit") < 1 {
+						return errors.New("--limit must be at least 1")
+					}
+					_, db, err := setupDB()
+					if err != nil {
+						return err
+					}
+					runs, err := db.GetSyncRuns(cCtx.Int("limit"), cCtx.Bool("failed"))
+					if err != nil {
+						return err
+					}
+					if cCtx.Bool("json") {
+						fmt.Println(utils.MustJSON(runs))
+						return nil
+					}
+					for _, run := range runs {
+						duration := "unfinished"
+						if run.FinishedAt != 0 {
+							duration = (time.Duration(run.FinishedAt-run.StartedAt) * time.Second).String()
+						}
+						fmt.Printf("#%d %s %s (%s): %d mailboxes, %d added, %d removed, %.1f MB, %d warnings\n",
+							run.Id, time.Unix(run.StartedAt, 0).Format("2006-01-02 15:04:05"), run.Status, duration,
+							len(run.Mailboxes), run.Added, run.Removed, float64(run.Bytes)/1e6, run.Warnings)
+						if run.Error != "" {
+							fmt.Printf("  error: %s\n", run.Error)
+						}
+						if !cCtx.Bool("mailboxes") {
+							continue
+						}
+						for _, mailboxRun := range run.Mailboxes {
+							fmt.Printf("  %s: %d added, %d removed, %.1f MB, %d warnings\n",
+								mailboxRun.Mailbox, mailboxRun.Added, mailboxRun.Removed, float64(mailboxRun.Bytes)/1e6, mailboxRun.WarningCount)
+							for _, warning := range mailboxRun.Warnings {
+								fmt.Printf("    warning: %s\n", warning)
+							}
+							if mailboxRun.WarningCount > len(mailboxRun.Warnings) {
+								fmt.Printf("    and %d more warnings\n", mailboxRun.WarningCount-len(mailboxRun.Warnings))
+							}
+							if mailboxRun.Error != "" {
+								fmt.Printf("    error: %s\n", mailboxRun.Error)
+							}
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "import",
+				Usage: "import an mbox file, a maildir or a directory of .eml files into a local pseudo mailbox",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "path",
+						Usage:    "the mbox file, maildir or directory to import",
+						Required: true,
+					},
+					&cli.StringFlag{
+						Name:  "format",
+						Usage: "one of mbox, maildir or eml. detected from the path if not given",
+					},
+					&cli.StringFlag{
+						Name:  "mailbox",
+						Usage: "the pseudo mailbox to store the messages under, defaults to \"Imported/<file name>\"",
+					},
+					&cli.BoolFlag{
+						Name:  "takeout",
+						Usage: "the path is a Google Takeout mbox, map its X-Gmail-Labels onto gmail's imap mailboxes instead of using a pseudo mailbox",
+					},
+					&cli.StringFlag{
+						Name:  "gmail-prefix",
+						Usage: "the prefix of gmail's system mailboxes, \"[Google Mail]\" for some locales",
+						Value: "[Gmail]",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					ops, db, err := setupDB()
+					if err != nil {
+						return err
+					}
+					src, err := source.Open(cCtx.String("path"), source.Format(cCtx.String("format")))
+					if err != nil {
+						return err
+					}
+					if cCtx.Bool("takeout") {
+						imported, err := source.ImportTakeout(db, src, cCtx.String("gmail-prefix"), ops, printEventHandler)
+						if err != nil {
+							return utils.JoinErrors("failed to import takeout", err)
+						}
+						fmt.Printf("imported %d messages\n", imported)
+						return nil
+					}
+					mailboxName := cCtx.String("mailbox")
+					if mailboxName == "" {
+						mailboxName = "Imported/" + filepath.Base(filepath.Clean(cCtx.String("path")))
+					}
+					imported, err := source.Import(db, src, mailboxName, ops, printEventHandler)
+					if err != nil {
+						return utils.JoinErrors("failed to import", err)
+					}
+					fmt.Printf("imported %d messages into %s\n", imported, mailboxName)
+					return nil
+				},
+			},
+			{
+				Name:  "export",
+				Usage: "export emails from the local db",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "mbox",
+						Usage: "export to mboxrd files, using the original message bytes when they were kept",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "out",
+								Usage:    "output file, or output directory when --per-mailbox is set",
+								Required: true,
+							},
+							&cli.BoolFlag{
+								Name:  "per-mailbox",
+								Usage: "write one mbox file per mailbox instead of a single combined file",
+							},
+						}, selectionFlags...),
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							selection, err := selectionFromFlags(cCtx)
+							if err != nil {
+								return err
+							}
+							written, err := export.Mbox(db, selection, cCtx.String("out"), cCtx.Bool("per-mailbox"))
+							if err != nil {
+								return utils.JoinErrors("failed to export mbox", err)
+							}
+							fmt.Printf("exported %d messages to %s\n", written, cCtx.String("out"))
+							return nil
+						},
+					},
+					{
+						Name:  "maildir",
+						Usage: "export to a Maildir++ tree, with imap flags encoded in the file names",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "out",
+								Usage:    "root directory of the maildir",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "delimiter",
+								Usage: "the imap hierarchy delimiter used in mailbox names",
+								Value: "/",
+							},
+							&cli.StringFlag{
+								Name:  "multi-folder",
+								Usage: "how to store emails that are in several mailboxes, either \"link\" (hard links) or \"copy\"",
+								Value: string(export.MaildirHardLinks),
+							},
+						}, selectionFlags...),
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							selection, err := selectionFromFlags(cCtx)
+							if err != nil {
+								return err
+							}
+							written, linked, err := export.Maildir(db, selection, cCtx.String("out"), cCtx.String("delimiter"), export.MaildirMultiFolderMode(cCtx.String("multi-folder")))
+							if err != nil {
+								return utils.JoinErrors("failed to export maildir", err)
+							}
+							fmt.Printf("exported %d messages and %d hard links to %s\n", written, linked, cCtx.String("out"))
+							return nil
+						},
+					},
+					{
+						Name:  "table",
+						Usage: "export one row per email as csv, jsonl or parquet",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "output file, \"-\" writes to stdout",
+								Value: "-",
+							},
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "one of \"csv\", \"jsonl\" or \"parquet\"",
+								Value: string(export.TableFormatCSV),
+							},
+							&cli.StringFlag{
+								Name:  "columns",
+								Usage: fmt.Sprintf("comma separated list of columns, available columns are: %s", strings.Join(export.TableColumnNames(), ", ")),
+								Value: strings.Join(export.DefaultTableColumns, ","),
+							},
+						}, selectionFlags...),
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							selection, err := selectionFromFlags(cCtx)
+							if err != nil {
+								return err
+							}
+							out := os.Stdout
+							if cCtx.String("out") != "-" {
+								out, err = os.Create(cCtx.String("out"))
+								if err != nil {
+									return utils.JoinErrors("failed to create output file", err)
+								}
+								defer out.Close()
+							}
+							writer := bufio.NewWriter(out)
+							written, err := export.Table(db, selection, writer, export.TableFormat(cCtx.String("format")), strings.Split(cCtx.String("columns"), ","))
+							if err != nil {
+								return utils.JoinErrors("failed to export table", err)
+							}
+							err = writer.Flush()
+							if err != nil {
+								return utils.JoinErrors("failed to write output", err)
+							}
+							if out == os.Stdout {
+								return nil
+							}
+							fmt.Printf("exported %d rows to %s\n", written, cCtx.String("out"))
+							return out.Close()
+						},
+					},
+				},
+			},
+			{
+				Name:  "rekey",
+				Usage: "encrypt the archive, or change the passphrase or key file of an encrypted archive",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "new-passphrase",
+						Usage:   "the new passphrase, prefer setting it through the environment so it doesn't end up in the shell history",
+						EnvVars: []string{"NEW_ENCRYPTION_PASSPHRASE"},
+					},
+					&cli.StringFlag{
+						Name:    "new-key-file",
+						Usage:   "a file whose contents are the new key",
+						EnvVars: []string{"NEW_ENCRYPTION_KEY_FILE"},
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					keyMaterial, err := encryption.KeyMaterial(cCtx.String("new-passphrase"), cCtx.String("new-key-file"))
+					if err != nil {
+						return err
+					}
+					if keyMaterial == nil {
+						return errors.New("one of --new-passphrase or --new-key-file is required")
+					}
+					_, db, err := setupDB()
+					if err != nil {
+						return err
+					}
+					err = db.Rekey(keyMaterial)
+					if err != nil {
+						return utils.JoinErrors("failed to rekey", err)
+					}
+					fmt.Println("done, set ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE to the new key")
+					return nil
+				},
+			},
+			{
+				Name:  "migrate-db",
+				Usage: "copy a sqlite archive into postgres",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "from",
+						Usage: "the sqlite archive to copy, defaults to DB_PATH",
+					},
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "the postgres connection url, defaults to POSTGRES_URL",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					err := godotenv.Load()
+					if err != nil {
+						return utils.JoinErrors("Error loading .env file", err)
+					}
+					from := cCtx.String("from")
+					if from == "" {
+						from = os.Getenv("DB_PATH")
+					}
+					to := cCtx.String("to")
+					if to == "" {
+						to = os.Getenv("POSTGRES_URL")
+					}
+					if from == "" || to == "" {
+						return errors.New("both a sqlite archive (--from or DB_PATH) and a postgres url (--to or POSTGRES_URL) are required")
+					}
+					err = database.CopySQLiteToPostgres(from, to, func(table string, copied int) {
+						fmt.Printf("%s: %d rows\n", table, copied)
+					})
+					if err != nil {
+						return utils.JoinErrors("failed to copy archive", err)
+					}
+					fmt.Println("done, set DB_BACKEND=postgres to use the copy")
+					return nil
+				},
+			},
+			{
+				Name:  "db",
+				Usage: "manage the archive's schema",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "migrate",
+						Usage: "apply pending schema migrations, which also happens whenever the archive is opened",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only print the migrations that would be applied",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							ops, err := options.New(optionOverrides)
+							if err != nil {
+								return utils.JoinErrors("failed to setup options", err)
+							}
+							dryRun := cCtx.Bool("dry-run")
+							migrations, err := database.Migrate(ops, dryRun)
+							if err != nil {
+								return utils.JoinErrors("failed to migrate db", err)
+							}
+							if len(migrations) == 0 {
+								fmt.Println("already up to date")
+								return nil
+							}
+							for _, migration := range migrations {
+								if !dryRun {
+									fmt.Printf("applied %d: %s\n", migration.Version, migration.Description)
+									continue
+								}
+								fmt.Printf("pending %d: %s\n", migration.Version, migration.Description)
+								for _, statement := range migration.Statements {
+									fmt.Printf("\t%s;\n", statement)
+								}
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:      "search",
+				Usage:     "list the emails matching a query, newest first",
+				ArgsUsage: "'from:acme.com has:attachment larger:5M before:2021-01-01 in:INBOX is:unread \"exact phrase\" -label:Receipts'",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "limit",
+						Usage: "list at most this many emails, 0 lists all of them",
+						Value: 50,
+					},
+					&cli.BoolFlag{
+						Name:  "explain",
+						Usage: "print the sql condition the query compiles to instead of running it",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() == 0 {
+						return errors.New("a query is required, e.g. 'from:example.com after:2021-01-01'")
+					}
+					_, db, err := setupDB()
+					if err != nil {
+						return err
+					}
+					condition, params, err := query.Compile(strings.Join(cCtx.Args().Slice(), " "), db.Backend(), time.Now())
+					if err != nil {
+						return err
+					}
+					if cCtx.Bool("explain") {
+						fmt.Println(condition)
+						for i, param := range params {
+							fmt.Printf("%d: %v\n", i+1, param)
+						}
+						return nil
+					}
+					sqlQuery := fmt.Sprintf("SELECT * FROM email WHERE %s ORDER BY coalesce(date_epoch, 0) DESC", condition)
+					if cCtx.Int("limit") > 0 {
+						sqlQuery += " LIMIT ?"
+						params = append(params, cCtx.Int("limit"))
+					}
+					found := 0
+					err = db.StreamEmails(func(email models.Email) error {
+						found++
+						date := "undated"
+						if email.GetDateEpoch() != 0 {
+							date = time.Unix(email.GetDateEpoch(), 0).UTC().Format("2006-01-02")
+						}
+						from := email.GetFromMailbox1()
+						if email.GetFromHost1() != "" {
+							from += "@" + email.GetFromHost1()
+						}
+						fmt.Printf("%s %s %q %s\n", date, from, email.GetSubject(), email.GetOurID())
+						return nil
+					}, sqlQuery, params...)
+					if err != nil {
+						return utils.JoinErrors("failed to search", err)
+					}
+					fmt.Printf("%d emails\n", found)
+					return nil
+				},
+			},
+			{
+				Name:  "queries",
+				Usage: "manage saved queries, which can be exported with --saved, used by retention policies and are shown as smart folders when pinned",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "save",
+						Usage: "save a sql or search query under a name, replacing the query with the same name",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Usage:    "the name the query is saved under, e.g. for export --saved",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "sql",
+								Usage: "a sql query selecting rows from the email table",
+							},
+							&cli.StringFlag{
+								Name:  "query",
+								Usage: "a query like 'from:example.com has:attachment after:2021-01-01', see the search command",
+							},
+							&cli.BoolFlag{
+								Name:  "pin",
+								Usage: "show the query as a smart folder next to the mailboxes",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							if (cCtx.String("sql") == "") == (cCtx.String("query") == "") {
+								return errors.New("exactly one of --sql or --query must be given")
+							}
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							saved := models.SavedQuery{Name: cCtx.String("name"), Kind: models.SavedQuerySQL, Query: cCtx.String("sql"), Pinned: cCtx.Bool("pin")}
+							if cCtx.String("query") != "" {
+								saved.Kind = models.SavedQuerySearch
+								saved.Query = cCtx.String("query")
+							}
+							err = db.SaveQuery(saved)
+							if err != nil {
+								return err
+							}
+							count, err := export.Selection{SavedQuery: saved.Name}.Count(db)
+							if err != nil {
+								return err
+							}
+							fmt.Printf("saved %q, it matches %d emails\n", saved.Name, count)
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "list the saved queries with the number of emails they match",
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							savedQueries, err := db.GetSavedQueries()
+							if err != nil {
+								return err
+							}
+							for _, saved := range savedQueries {
+								matches := ""
+								count, err := export.Selection{SavedQuery: saved.Name}.Count(db)
+								if err != nil {
+									matches = fmt.Sprintf("error: %v", err)
+								} else {
+									matches = fmt.Sprintf("%d emails", count)
+								}
+								pinned := ""
+								if saved.Pinned {
+									pinned = " (pinned)"
+								}
+								fmt.Printf("%s%s [%s] %s: %s\n", saved.Name, pinned, saved.Kind, matches, saved.Query)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "delete",
+						Usage: "delete a saved query",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "name",
+								Required: true,
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							deleted, err := db.DeleteSavedQuery(cCtx.String("name"))
+							if err != nil {
+								return err
+							}
+							if !deleted {
+								return fmt.Errorf("there is no saved query called %q", cCtx.String("name"))
+							}
+							fmt.Println("done")
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "tags",
+				Usage: "manage private tags on archived emails, which are never sent to the server and can be searched with tag:",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "add",
+						Usage: "tag emails given by --id or --thread, or every email of a selection",
+						Flags: append(append([]cli.Flag{
+							&cli.StringSliceFlag{
+								Name:     "tag",
+								Usage:    "e.g. tax-2023, can be given multiple times",
+								Required: true,
+							},
+						}, annotationTargetFlags...), selectionFlags...),
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							ourIds, err := annotationTargets(cCtx, db, true)
+							if err != nil {
+								return err
+							}
+							err = db.AddTags(ourIds, cCtx.StringSlice("tag"))
+							if err != nil {
+								return err
+							}
+							fmt.Printf("tagged %d emails\n", len(ourIds))
+							return nil
+						},
+					},
+					{
+						Name:  "remove",
+						Usage: "remove tags from emails given by --id or --thread, or from every email of a selection",
+						Flags: append(append([]cli.Flag{
+							&cli.StringSliceFlag{
+								Name:     "tag",
+								Usage:    "can be given multiple times",
+								Required: true,
+							},
+						}, annotationTargetFlags...), selectionFlags...),
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							ourIds, err := annotationTargets(cCtx, db, true)
+							if err != nil {
+								return err
+							}
+							removed, err := db.RemoveTags(ourIds, cCtx.StringSlice("tag"))
+							if err != nil {
+								return err
+							}
+							fmt.Printf("removed %d tags\n", removed)
+							return nil
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "list every tag with the number of emails it's on",
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							tags, err := db.GetTags()
+							if err != nil {
+								return err
+							}
+							for _, tag := range tags {
+								fmt.Printf("%s: %d emails\n", tag.Name, tag.NumEmails)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "notes",
+				Usage: "manage private notes on archived emails, which are never sent to the server and can be searched with note:",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "set",
+						Usage: "set the note of an email, or of a thread which is the note of its first email",
+						Flags: append([]cli.Flag{
+							&cli.StringFlag{
+								Name:     "text",
+								Required: true,
+							},
+						}, annotationTargetFlags...),
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							ourIds, err := annotationTargets(cCtx, db, false)
+							if err != nil {
+								return err
+							}
+							if len(ourIds) > 1 && cCtx.String("thread") == "" {
+								return errors.New("a note is set on one email at a time")
+							}
+							// the note of a thread is the note of its first email
+							err = db.SetNote(ourIds[0], cCtx.String("text"))
+							if err != nil {
+								return err
+							}
+							fmt.Println("done")
+							return nil
+						},
+					},
+					{
+						Name:  "delete",
+						Usage: "delete the note of an email or thread",
+						Flags: annotationTargetFlags,
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							ourIds, err := annotationTargets(cCtx, db, false)
+							if err != nil {
+								return err
+							}
+							if cCtx.String("thread") != "" {
+								// the note of a thread is the note of its first email
+								ourIds = ourIds[:1]
+							}
+							for _, ourId := range ourIds {
+								err = db.SetNote(ourId, "")
+								if err != nil {
+									return err
+								}
+							}
+							fmt.Println("done")
+							return nil
+						},
+					},
+					{
+						Name:  "show",
+						Usage: "print the tags and notes of emails",
+						Flags: annotationTargetFlags,
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							ourIds, err := annotationTargets(cCtx, db, false)
+							if err != nil {
+								return err
+							}
+							annotations, err := db.GetAnnotations(ourIds)
+							if err != nil {
+								return err
+							}
+							for _, ourId := range ourIds {
+								annotation := annotations[ourId]
+								fmt.Printf("%s tags: %s\n", ourId, strings.Join(annotation.Tags, ", "))
+								if annotation.Note != nil {
+									fmt.Printf("%s note (updated %s): %s\n", ourId, time.Unix(annotation.Note.UpdatedAt, 0).UTC().Format("2006-01-02 15:04"), annotation.Note.Text)
+								}
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "options",
+				Usage: "manage the options stored in the archive, the environment and flags take precedence over them",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "list",
+						Usage: "list every option with its value and where it comes from",
+						Action: func(cCtx *cli.Context) error {
+							ops, _, err := setupDB()
+							if err != nil {
+								return err
+							}
+							for _, value := range ops.Values() {
+								shown := value.Value
+								if value.Secret && value.Source != options.SourceDefault {
+									shown = "(set)"
+								}
+								fmt.Printf("%s=%s [%s]\n", value.Key, shown, value.Source)
+							}
+							return nil
+						},
+					},
+					{
+						Name:      "set",
+						Usage:     "store options in the archive",
+						ArgsUsage: "KEY=VALUE...",
+						Action: func(cCtx *cli.Context) error {
+							changes := map[string]string{}
+							for _, arg := range cCtx.Args().Slice() {
+								kv := strings.SplitN(arg, "=", 2)
+								if len(kv) != 2 || kv[1] == "" {
+									return fmt.Errorf("expected KEY=VALUE, got %q", arg)
+								}
+								changes[strings.ToUpper(kv[0])] = kv[1]
+							}
+							return storeOptions(changes)
+						},
+					},
+					{
+						Name:      "unset",
+						Usage:     "remove options from the archive so that their defaults are used again",
+						ArgsUsage: "KEY...",
+						Action: func(cCtx *cli.Context) error {
+							changes := map[string]string{}
+							for _, key := range cCtx.Args().Slice() {
+								changes[strings.ToUpper(key)] = ""
+							}
+							return storeOptions(changes)
+						},
+					},
+				},
+			},
+			{
+				Name:  "fts",
+				Usage: "manage the full text index",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "rebuild",
+						Usage: "recreate the full text index from scratch, e.g. when searches fail because it is corrupt",
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							err = db.RebuildFTS()
+							if err != nil {
+								return utils.JoinErrors("failed to rebuild full text index", err)
+							}
+							fmt.Println("done")
+							return nil
+						},
+					},
+					{
+						Name:  "extract-attachments",
+						Usage: "make the attachments of emails archived before their text was indexed searchable, reads their raw messages from the blob store",
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							extracted, err := db.ExtractAttachmentTexts()
+							if err != nil {
+								return utils.JoinErrors("failed to extract attachment texts", err)
+							}
+							fmt.Printf("extracted the attachment texts of %d emails\n", extracted)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "retention",
+				Usage: "delete old emails from the server or the local archive according to retention policies",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "apply",
+						Usage: "apply the retention policies, every deletion is printed and logged in the retention_log table",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "policies",
+								Usage: "the json file with the retention policies",
+								Value: "retention.json",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only report what would be deleted",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							policies, err := retention.LoadPolicies(cCtx.String("policies"))
+							if err != nil {
+								return err
+							}
+							ops, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							deletions, err := retention.Plan(db, policies, time.Now())
+							if err != nil {
+								return err
+							}
+
+							if cCtx.Bool("dry-run") {
+								perPolicy := map[string]int{}
+								for _, deletion := range deletions {
+									printDeletion("would delete", deletion)
+									perPolicy[deletion.Policy]++
+								}
+								for _, policy := range policies {
+									fmt.Printf("policy %q (%s) would delete %d\n", policy.Name, policy.Action, perPolicy[policy.Name])
+								}
+								return nil
+							}
+
+							var pool models.ClientPool
+							if retention.NeedsServer(deletions) {
+								err = ops.ValidateImap()
+								if err != nil {
+									return utils.JoinErrors("deleting from the server needs an imap login", err)
+								}
+								pool = client.NewClientConnPool(ops, nil)
+								defer pool.Close()
+							}
+							deleted := 0
+							err = retention.Apply(db, pool, deletions, func(logged []models.RetentionDeletion) {
+								for _, deletion := range logged {
+									printDeletion("deleted", deletion)
+								}
+								deleted += len(logged)
+							})
+							fmt.Printf("deleted %d of %d\n", deleted, len(deletions))
+							return err
+						},
+					},
+				},
+			},
+			{
+				Name:  "dedupe",
+				Usage: "find emails that were archived more than once, e.g. because they were sent again or imported with different headers, and merge them",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "report",
+						Usage: "list the exact and near duplicates together with the email that would be kept, the oldest one",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "distance",
+								Usage: fmt.Sprintf("the number of bits the simhashes of near duplicates may differ in, up to %d. 0 only reports exact duplicates", dedupe.MaxDistance),
+								Value: 3,
+							},
+							&cli.BoolFlag{
+								Name:  "json",
+								Usage: "print the groups as json",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							_, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							groups, err := dedupe.Find(db, cCtx.Int("distance"))
+							if err != nil {
+								return err
+							}
+							if cCtx.Bool("json") {
+								fmt.Println(utils.MustJSON(groups))
+								return nil
+							}
+							perKind := map[dedupe.Kind]int{}
+							for _, group := range groups {
+								printFingerprint("keep", group.Keep)
+								for _, duplicate := range group.Duplicates {
+									prefix := "  exact"
+									if duplicate.Kind == dedupe.KindNear {
+										prefix = fmt.Sprintf("  near (%d bits)", duplicate.Distance)
+									}
+									printFingerprint(prefix, duplicate.Fingerprint)
+									perKind[duplicate.Kind]++
+								}
+							}
+							fmt.Printf("%d groups with %d exact and %d near duplicates\n", len(groups), perKind[dedupe.KindExact], perKind[dedupe.KindNear])
+							return nil
+						},
+					},
+					{
+						Name:  "merge",
+						Usage: "move the tags, notes and mailboxes of the duplicates to the email that is kept and purge the duplicates, every deletion is printed and logged in the retention_log table",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "distance",
+								Usage: fmt.Sprintf("also merge near duplicates whose simhashes differ in at most this many bits, up to %d. check them with dedupe report first", dedupe.MaxDistance),
+								Value: 0,
+							},
+							&cli.BoolFlag{
+								Name:  "server",
+								Usage: "also delete the exact duplicates from every mailbox they're in on the server",
+							},
+							&cli.BoolFlag{
+								Name:  "server-near",
+								Usage: "with --server, also delete the near duplicates from the server",
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "only report what would be deleted",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							ops, db, err := setupDB()
+							if err != nil {
+								return err
+							}
+							if cCtx.Bool("server-near") && !cCtx.Bool("server") {
+								return errors.New("--server-near only works together with --server")
+							}
+							groups, err := dedupe.Find(db, cCtx.Int("distance"))
+							if err != nil {
+								return err
+							}
+							deletions, err := dedupe.Plan(db, groups, cCtx.Bool("server"), cCtx.Bool("server-near"))
+							if err != nil {
+								return err
+							}
+
+							if cCtx.Bool("dry-run") {
+								for _, deletion := range deletions {
+									printDeletion("would delete", deletion)
+								}
+								fmt.Printf("would merge %d groups, deleting %d\n", len(groups), len(deletions))
+								return nil
+							}
+
+							var pool models.ClientPool
+							if retention.NeedsServer(deletions) {
+								err = ops.ValidateImap()
+								if err != nil {
+									return utils.JoinErrors("deleting from the server needs an imap login", err)
+								}
+								pool = client.NewClientConnPool(ops, nil)
+								defer pool.Close()
+							}
+							deleted := 0
+							err = dedupe.Merge(db, pool, groups, deletions, func(logged []models.RetentionDeletion) {
+								for _, deletion := range logged {
+									printDeletion("deleted", deletion)
+								}
+								deleted += len(logged)
+							})
+							fmt.Printf("deleted %d of %d\n", deleted, len(deletions))
+							return err
+						},
+					},
+				},
+			},
+			{
+				Name:  "verify",
+				Usage: "compare every synced mailbox with the server and report missing or stale uids, uids stuck pending, and emails with a parse error or no body",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "fix",
+						Usage: "download the missing emails and the broken ones that are still on the server again, then verify again",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print the report as json",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					pool, ops, err := setup(nil)
+					if err != nil {
+						return err
+					}
+					defer pool.Close()
+					db := database.GetDatabase()
+					report, err := verify.Run(db, pool, ops)
+					if err != nil {
+						return err
+					}
+					if cCtx.Bool("fix") {
+						err = verify.Fix(db, pool, report)
+						if err != nil {
+							return utils.JoinErrors("failed to fix the archive", err)
+						}
+						after, err := verify.Run(db, pool, ops)
+						if err != nil {
+							return err
+						}
+						verify.MarkFixed(report, after)
+					}
+
+					if cCtx.Bool("json") {
+						fmt.Println(utils.MustJSON(report))
+						return nil
+					}
+					for _, summary := range report.Mailboxes {
+						fmt.Printf("%s: %d messages on the server, %d uids on the server, %d uids locally, %d archived\n",
+							summary.Mailbox, summary.ServerMessages, summary.ServerUids, summary.LocalUids, summary.Archived)
+					}
+					fixed := 0
+					for _, discrepancy := range report.Discrepancies {
+						line := string(discrepancy.Kind)
+						if discrepancy.Mailbox != "" {
+							line += " " + discrepancy.Mailbox
+						}
+						if discrepancy.Uid != 0 {
+							line += fmt.Sprintf(" uid %d", discrepancy.Uid)
+						}
+						if discrepancy.OurId != "" {
+							line += " " + discrepancy.OurId
+						}
+						if discrepancy.Subject != "" {
+							line += fmt.Sprintf(" %q", discrepancy.Subject)
+						}
+						if discrepancy.Detail != "" {
+							line += ": " + discrepancy.Detail
+						}
+						if discrepancy.Fixed {
+							line += " (fixed)"
+							fixed++
+						}
+						fmt.Println(line)
+					}
+					if cCtx.Bool("fix") {
+						fmt.Printf("%d discrepancies, %d fixed\n", len(report.Discrepancies), fixed)
+					} else {
+						fmt.Printf("%d discrepancies\n", len(report.Discrepancies))
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "backup",
+				Usage: "take a consistent snapshot of the db and the blob store in BACKUP_DIR while the archive is in use, then remove the old snapshots BACKUP_KEEP_* doesn't keep",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "list",
+						Usage: "only list the snapshots, newest first",
+					},
+					&cli.BoolFlag{
+						Name:  "no-rotate",
+						Usage: "don't remove old snapshots",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.Bool("list") {
+						ops, err := options.New(optionOverrides)
+						if err != nil {
+							return utils.JoinErrors("failed to setup options", err)
+						}
+						snapshots, err := backup.List(ops.GetBackupDir())
+						if err != nil {
+							return err
+						}
+						for _, snapshot := range snapshots {
+							printSnapshot(snapshot.CreatedAt.Format(time.RFC3339), snapshot)
+						}
+						return nil
+					}
+					ops, db, err := setupDB()
+					if err != nil {
+						return err
+					}
+					snapshot, err := backup.Create(db, ops.GetBackupDir(), ops.GetBlobStorePath())
+					if err != nil {
+						return utils.JoinErrors("failed to back up", err)
+					}
+					printSnapshot("created", *snapshot)
+					if cCtx.Bool("no-rotate") {
+						return nil
+					}
+					removed, err := backup.Rotate(ops.GetBackupDir(), ops.GetBackupPolicy())
+					for _, snapshot := range removed {
+						printSnapshot("removed", snapshot)
+					}
+					return err
+				},
+			},
+			{
+				Name:  "restore-backup",
+				Usage: "check that a snapshot is intact and restore its db to DB_PATH and its blobs to BLOB_STORE_PATH. stop anything using the archive first",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:     "snapshot",
+						Usage:    "the name of a snapshot in BACKUP_DIR, see backup --list, or the path of one",
+						Required: true,
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "replace an existing db, which is kept next to it with .before-restore-<time> appended",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only check the snapshot",
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					// the db is replaced, so it must not be opened
+					ops, err := options.New(optionOverrides)
+					if err != nil {
+						return utils.JoinErrors("failed to setup options", err)
+					}
+					if ops.GetDBBackend() != models.SQLiteBackend {
+						return errors.New("only sqlite archives can be restored, restore postgres with pg_restore instead")
+					}
+					snapshotPath, err := backup.Resolve(ops.GetBackupDir(), cCtx.String("snapshot"))
+					if err != nil {
+						return err
+					}
+					if cCtx.Bool("dry-run") {
+						snapshot, err := backup.Verify(snapshotPath)
+						if err != nil {
+							return err
+						}
+						printSnapshot("verified", *snapshot)
+						return nil
+					}
+					snapshot, err := backup.Restore(snapshotPath, ops.GetDBPath(), ops.GetBlobStorePath(), cCtx.Bool("force"))
+					if err != nil {
+						return err
+					}
+					printSnapshot("restored", *snapshot)
+					return nil
+				},
+			},
 			{
 				Name:    "serve",
 				Aliases: []string{"s"},
 				Usage:   "serve the web ui",
 				Action: func(cCtx *cli.Context) error {
-					pool, err := setup(web.ImapEventHandler)
+					pool, ops, err := setup(web.ImapEventHandler)
 					if err != nil {
 						return err
 					}
-					return web.Start(pool)
+					return web.Start(pool, ops)
 				},
 			},
 		},
@@ -0,0 +1,480 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/database"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// snapshots are directories named after the time they were taken, to the millisecond so that two backups in the same
+	// second, e.g. a scheduled one and the backup command, don't collide
+	nameFormat = "20060102T150405.000Z"
+	// time.Parse accepts fractional seconds that aren't in the layout, so this also parses the names of older snapshots
+	parseFormat  = "20060102T150405Z"
+	manifestName = "manifest.json"
+	dbName       = "data.db"
+	blobsDir     = "blobs"
+	tmpPrefix    = ".tmp-"
+)
+
+// a file of a snapshot, relative to the snapshot directory
+type File struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Manifest lists every file of a snapshot so that restoring it can check that none of them changed
+type Manifest struct {
+	// unix seconds
+	CreatedAt int64  `json:"created_at"`
+	Files     []File `json:"files"`
+}
+
+type Snapshot struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+	// the size of the db and the number and size of the blobs, as listed by the manifest
+	DBSize    int64 `json:"db_size"`
+	Blobs     int   `json:"blobs"`
+	BlobsSize int64 `json:"blobs_size"`
+	// why the manifest can't be read, the snapshot can't be restored then but is still rotated
+	Problem string `json:"problem,omitempty"`
+}
+
+func readManifest(snapshotPath string) (*Manifest, error) {
+	raw, err := os.ReadFile(filepath.Join(snapshotPath, manifestName))
+	if err != nil {
+		return nil, utils.JoinErrors("failed to read manifest", err)
+	}
+	manifest := &Manifest{}
+	err = json.Unmarshal(raw, manifest)
+	return manifest, utils.JoinErrors("failed to unmarshal manifest", err)
+}
+
+func newSnapshot(name string, snapshotPath string, manifest *Manifest) Snapshot {
+	snapshot := Snapshot{Name: name, Path: snapshotPath, CreatedAt: time.Unix(manifest.CreatedAt, 0).UTC()}
+	// the name has the milliseconds the manifest doesn't, unless the snapshot was moved to another directory name
+	if createdAt, err := time.Parse(parseFormat, name); err == nil {
+		snapshot.CreatedAt = createdAt
+	}
+	for _, file := range manifest.Files {
+		if file.Path == dbName {
+			snapshot.DBSize = file.Size
+		} else {
+			snapshot.Blobs++
+			snapshot.BlobsSize += file.Size
+		}
+	}
+	return snapshot
+}
+
+// List returns the snapshots in dir, newest first. Unfinished snapshots are left out, damaged ones have a Problem
+func List(dir string) ([]Snapshot, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, utils.JoinErrors("failed to list backups", err)
+	}
+	snapshots := []Snapshot{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), tmpPrefix) {
+			continue
+		}
+		createdAt, err := time.Parse(parseFormat, entry.Name())
+		if err != nil {
+			continue
+		}
+		snapshotPath := filepath.Join(dir, entry.Name())
+		manifest, err := readManifest(snapshotPath)
+		if err != nil {
+			snapshots = append(snapshots, Snapshot{Name: entry.Name(), Path: snapshotPath, CreatedAt: createdAt, Problem: err.Error()})
+			continue
+		}
+		snapshots = append(snapshots, newSnapshot(entry.Name(), snapshotPath, manifest))
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.After(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+/*
+Create takes a snapshot of the archive in dir: a consistent copy of the db, taken while syncs keep running, and a copy of
+the blob store if blobStorePath is set. Blobs with the same sha256 as in the previous snapshot are hard linked to it
+instead of copied when the file system allows it. Blobs rewritten since, e.g. by encrypting the archive or a rekey, are
+replaced by a new file with another hash rather than changed in place, so they're copied.
+The snapshot is assembled in a temporary directory and only renamed into place once its manifest is written, so an
+interrupted backup never looks like a finished one.
+*/
+func Create(db models.DB, dir string, blobStorePath string) (*Snapshot, error) {
+	if dir == "" {
+		return nil, errors.New("missing BACKUP_DIR")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create backup directory", err)
+	}
+	previous, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now().UTC()
+	name := createdAt.Format(nameFormat)
+	tmpPath := filepath.Join(dir, tmpPrefix+name)
+	err = os.Mkdir(tmpPath, 0700)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create snapshot directory", err)
+	}
+	defer os.RemoveAll(tmpPath)
+
+	err = db.Snapshot(filepath.Join(tmpPath, dbName))
+	if err != nil {
+		return nil, err
+	}
+	dbFile, err := describe(tmpPath, dbName)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{CreatedAt: createdAt.Unix(), Files: []File{*dbFile}}
+
+	if blobStorePath != "" {
+		// by path, the blobs of the previous snapshot
+		previousBlobs := map[string]File{}
+		previousPath := ""
+		if len(previous) > 0 && previous[0].Problem == "" {
+			previousPath = previous[0].Path
+			previousManifest, err := readManifest(previousPath)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range previousManifest.Files {
+				previousBlobs[file.Path] = file
+			}
+		}
+		blobs, err := copyBlobs(blobStorePath, tmpPath, previousPath, previousBlobs)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to copy blobs", err)
+		}
+		manifest.Files = append(manifest.Files, blobs...)
+	}
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, utils.JoinErrors("failed to marshal manifest", err)
+	}
+	err = os.WriteFile(filepath.Join(tmpPath, manifestName), raw, 0600)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to write manifest", err)
+	}
+	snapshotPath := filepath.Join(dir, name)
+	err = os.Rename(tmpPath, snapshotPath)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to move snapshot into place", err)
+	}
+	snapshot := newSnapshot(name, snapshotPath, manifest)
+	return &snapshot, nil
+}
+
+// hashes the file at relPath in root
+func describe(root string, relPath string) (*File, error) {
+	file, err := os.Open(filepath.Join(root, relPath))
+	if err != nil {
+		return nil, utils.JoinErrors("failed to open file", err)
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return nil, utils.JoinErrors(fmt.Sprintf("failed to hash %s", relPath), err)
+	}
+	return &File{Path: filepath.ToSlash(relPath), Size: size, Sha256: hex.EncodeToString(hasher.Sum(nil))}, nil
+}
+
+// copies the blobs into the blobs directory of the snapshot, hard linking the ones that are unchanged since the previous snapshot
+func copyBlobs(blobStorePath string, snapshotPath string, previousPath string, previousBlobs map[string]File) ([]File, error) {
+	files := []File{}
+	err := filepath.WalkDir(blobStorePath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path == blobStorePath {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		// temporary files are blobs that are still being written
+		if entry.IsDir() || !strings.HasSuffix(path, ".eml") {
+			return nil
+		}
+		relBlobPath, err := filepath.Rel(blobStorePath, path)
+		if err != nil {
+			return err
+		}
+		file, err := describe(blobStorePath, relBlobPath)
+		if err != nil {
+			return err
+		}
+		file.Path = filepath.ToSlash(filepath.Join(blobsDir, relBlobPath))
+		target := filepath.Join(snapshotPath, file.Path)
+		err = os.MkdirAll(filepath.Dir(target), 0700)
+		if err != nil {
+			return utils.JoinErrors("failed to create blob directory", err)
+		}
+		linked := false
+		if previousFile, ok := previousBlobs[file.Path]; ok && previousFile.Sha256 == file.Sha256 {
+			linked = os.Link(filepath.Join(previousPath, file.Path), target) == nil
+		}
+		if !linked {
+			err = copyFile(path, target)
+			if err != nil {
+				return err
+			}
+		}
+		files = append(files, *file)
+		return nil
+	})
+	return files, err
+}
+
+// copies source to target through a temporary file, so that target is either complete or missing
+func copyFile(source string, target string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return utils.JoinErrors("failed to open file", err)
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(target), tmpPrefix+"*")
+	if err != nil {
+		return utils.JoinErrors("failed to create temporary file", err)
+	}
+	_, err = io.Copy(tmp, in)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return utils.JoinErrors(fmt.Sprintf("failed to copy %s", source), err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return utils.JoinErrors("failed to close file", err)
+	}
+	return utils.JoinErrors("failed to move file into place", os.Rename(tmp.Name(), target))
+}
+
+// Expired returns the snapshots the policy doesn't keep, snapshots must be sorted newest first as returned by List
+func Expired(snapshots []Snapshot, policy models.BackupPolicy) []Snapshot {
+	if policy == (models.BackupPolicy{}) {
+		return []Snapshot{}
+	}
+	kept := utils.NewSet([]string{})
+	for i, snapshot := range snapshots {
+		if i < policy.KeepLast {
+			kept.Add(snapshot.Name)
+		}
+	}
+	// keeps the newest snapshot of each of the newest count periods, period returns the period a snapshot is in
+	keepPerPeriod := func(count int, period func(time.Time) string) {
+		periods := utils.NewSet([]string{})
+		for _, snapshot := range snapshots {
+			if len(periods) >= count {
+				return
+			}
+			key := period(snapshot.CreatedAt)
+			if periods.Contains(key) {
+				continue
+			}
+			periods.Add(key)
+			kept.Add(snapshot.Name)
+		}
+	}
+	keepPerPeriod(policy.KeepDaily, func(createdAt time.Time) string {
+		return createdAt.Format("2006-01-02")
+	})
+	keepPerPeriod(policy.KeepWeekly, func(createdAt time.Time) string {
+		year, week := createdAt.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepPerPeriod(policy.KeepMonthly, func(createdAt time.Time) string {
+		return createdAt.Format("2006-01")
+	})
+
+	expired := []Snapshot{}
+	for _, snapshot := range snapshots {
+		if !kept.Contains(snapshot.Name) {
+			expired = append(expired, snapshot)
+		}
+	}
+	return expired
+}
+
+// Rotate removes the snapshots in dir the policy doesn't keep and returns them
+func Rotate(dir string, policy models.BackupPolicy) ([]Snapshot, error) {
+	snapshots, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	removed := []Snapshot{}
+	for _, snapshot := range Expired(snapshots, policy) {
+		err = os.RemoveAll(snapshot.Path)
+		if err != nil {
+			return removed, utils.JoinErrors(fmt.Sprintf("failed to remove snapshot %s", snapshot.Name), err)
+		}
+		removed = append(removed, snapshot)
+	}
+	return removed, nil
+}
+
+// Resolve returns the path of a snapshot given either its name in dir or its path
+func Resolve(dir string, snapshot string) (string, error) {
+	candidates := []string{snapshot}
+	if dir != "" && !strings.ContainsRune(snapshot, filepath.Separator) {
+		candidates = append([]string{filepath.Join(dir, snapshot)}, candidates...)
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(filepath.Join(candidate, manifestName)); err == nil {
+			return filepath.Abs(candidate)
+		}
+	}
+	return "", fmt.Errorf("there is no snapshot %s", snapshot)
+}
+
+// checks that every file of the snapshot is unchanged since it was taken
+func verifyFiles(snapshotPath string) (*Manifest, error) {
+	manifest, err := readManifest(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	hasDB := false
+	for _, expected := range manifest.Files {
+		actual, err := describe(snapshotPath, filepath.FromSlash(expected.Path))
+		if err != nil {
+			return nil, err
+		}
+		if actual.Size != expected.Size || actual.Sha256 != expected.Sha256 {
+			return nil, fmt.Errorf("%s changed since the snapshot was taken", expected.Path)
+		}
+		hasDB = hasDB || expected.Path == dbName
+	}
+	if !hasDB {
+		return nil, errors.New("the snapshot has no db")
+	}
+	return manifest, nil
+}
+
+// Verify checks that every file of the snapshot at snapshotPath is unchanged since it was taken and that a copy of its db isn't corrupt
+func Verify(snapshotPath string) (*Snapshot, error) {
+	manifest, err := verifyFiles(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", tmpPrefix+"*.db")
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create temporary file", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	err = copyFile(filepath.Join(snapshotPath, dbName), tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	err = database.CheckSQLiteIntegrity(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	snapshot := newSnapshot(filepath.Base(snapshotPath), snapshotPath, manifest)
+	return &snapshot, nil
+}
+
+/*
+Restore checks the snapshot at snapshotPath and copies its db to dbPath and its blobs to blobStorePath, which may only be
+empty if the snapshot has no blobs. Blobs that are already in the blob store are left alone, as are blobs that aren't in
+the snapshot. The archive must not be open while it's restored.
+An existing db is only replaced with force, it's kept next to the restored one with the time of the restore appended.
+*/
+func Restore(snapshotPath string, dbPath string, blobStorePath string, force bool) (*Snapshot, error) {
+	manifest, err := verifyFiles(snapshotPath)
+	if err != nil {
+		return nil, utils.JoinErrors("the snapshot failed verification", err)
+	}
+	snapshot := newSnapshot(filepath.Base(snapshotPath), snapshotPath, manifest)
+	if snapshot.Blobs > 0 && blobStorePath == "" {
+		return nil, errors.New("the snapshot has blobs, set BLOB_STORE_PATH to restore them")
+	}
+	_, err = os.Stat(dbPath)
+	exists := err == nil
+	if exists && !force {
+		return nil, fmt.Errorf("%s already exists, restore with force to replace it", dbPath)
+	}
+
+	// the copy is checked before it replaces anything
+	err = os.MkdirAll(filepath.Dir(dbPath), 0755)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create db directory", err)
+	}
+	stagedPath := dbPath + ".restoring"
+	defer os.Remove(stagedPath)
+	err = copyFile(filepath.Join(snapshotPath, dbName), stagedPath)
+	if err != nil {
+		return nil, err
+	}
+	err = database.CheckSQLiteIntegrity(stagedPath)
+	if err != nil {
+		return nil, utils.JoinErrors("the snapshot failed verification", err)
+	}
+	if exists {
+		suffix := ".before-restore-" + time.Now().UTC().Format(nameFormat)
+		// the -wal file holds committed changes that aren't in the db file yet, it moves together with the db
+		for _, fileSuffix := range []string{"", "-wal", "-shm"} {
+			err = os.Rename(dbPath+fileSuffix, dbPath+suffix+fileSuffix)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, utils.JoinErrors("failed to move the existing db aside", err)
+			}
+		}
+	}
+	err = os.Rename(stagedPath, dbPath)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to move the restored db into place", err)
+	}
+
+	for _, file := range manifest.Files {
+		if file.Path == dbName {
+			continue
+		}
+		relBlobPath, err := filepath.Rel(blobsDir, filepath.FromSlash(file.Path))
+		if err != nil {
+			return nil, err
+		}
+		target := filepath.Join(blobStorePath, relBlobPath)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to create blob directory", err)
+		}
+		err = copyFile(filepath.Join(snapshotPath, filepath.FromSlash(file.Path)), target)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &snapshot, nil
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skamensky/email-archiver/pkg/models"
+)
+
+// snapshots taken at the given times, which have to be newest first like List returns them
+func snapshotsAt(t *testing.T, times ...string) []Snapshot {
+	t.Helper()
+	snapshots := []Snapshot{}
+	for _, at := range times {
+		createdAt, err := time.Parse("2006-01-02 15:04", at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, Snapshot{Name: createdAt.Format(nameFormat), CreatedAt: createdAt})
+	}
+	return snapshots
+}
+
+func TestExpired(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    models.BackupPolicy
+		snapshots []string
+		expired   []string
+	}{
+		{"nothing is rotated without a policy", models.BackupPolicy{},
+			[]string{"2024-01-31 12:00", "2024-01-30 12:00"}, []string{}},
+		{"keep last", models.BackupPolicy{KeepLast: 2},
+			[]string{"2024-01-31 12:00", "2024-01-31 11:00", "2024-01-30 12:00", "2024-01-29 12:00"}, []string{"2024-01-30 12:00", "2024-01-29 12:00"}},
+		{"keep the newest of each day", models.BackupPolicy{KeepDaily: 2},
+			[]string{"2024-01-31 18:00", "2024-01-31 09:00", "2024-01-30 12:00", "2024-01-29 12:00"}, []string{"2024-01-31 09:00", "2024-01-29 12:00"}},
+		{"days without snapshots don't count", models.BackupPolicy{KeepDaily: 2},
+			[]string{"2024-01-31 12:00", "2024-01-20 12:00", "2024-01-10 12:00"}, []string{"2024-01-10 12:00"}},
+		// 2024-12-30 is in the first iso week of 2025
+		{"keep the newest of each iso week", models.BackupPolicy{KeepWeekly: 2},
+			[]string{"2025-01-02 12:00", "2024-12-30 12:00", "2024-12-27 12:00", "2024-12-20 12:00"}, []string{"2024-12-30 12:00", "2024-12-20 12:00"}},
+		{"keep the newest of each month", models.BackupPolicy{KeepMonthly: 2},
+			[]string{"2024-03-01 12:00", "2024-02-28 12:00", "2024-02-01 12:00", "2024-01-15 12:00"}, []string{"2024-02-01 12:00", "2024-01-15 12:00"}},
+		{"a snapshot kept by any rule is kept", models.BackupPolicy{KeepLast: 1, KeepDaily: 2, KeepMonthly: 3},
+			[]string{"2024-03-02 12:00", "2024-03-02 09:00", "2024-03-01 12:00", "2024-02-29 12:00", "2024-02-10 12:00", "2024-01-15 12:00", "2023-12-31 12:00"},
+			[]string{"2024-03-02 09:00", "2024-02-10 12:00", "2023-12-31 12:00"}},
+	}
+	for _, test := range tests {
+		expired := []string{}
+		for _, snapshot := range Expired(snapshotsAt(t, test.snapshots...), test.policy) {
+			expired = append(expired, snapshot.CreatedAt.Format("2006-01-02 15:04"))
+		}
+		if !reflect.DeepEqual(expired, test.expired) {
+			t.Errorf("%s: got %v expired, expected %v", test.name, expired, test.expired)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	dir := t.TempDir()
+	// two snapshots in the same second, one named before names had milliseconds, an unfinished and a damaged one
+	for name, manifest := range map[string]string{
+		"20240131T120000.500Z":             `{"created_at": 1706702400, "files": [{"path": "data.db", "size": 10}, {"path": "blobs/a", "size": 3}]}`,
+		"20240131T120000.100Z":             `{"created_at": 1706702400, "files": [{"path": "data.db", "size": 10}]}`,
+		"20240130T120000Z":                 `{"created_at": 1706616000, "files": []}`,
+		tmpPrefix + "20240201T120000.000Z": `{"created_at": 1706788800, "files": []}`,
+		"20240129T120000.000Z":             `{`,
+	} {
+		err := os.Mkdir(filepath.Join(dir, name), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filepath.Join(dir, name, manifestName), []byte(manifest), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type listed struct {
+		name    string
+		blobs   int
+		damaged bool
+	}
+	got := []listed{}
+	for _, snapshot := range snapshots {
+		got = append(got, listed{snapshot.Name, snapshot.Blobs, snapshot.Problem != ""})
+	}
+	expected := []listed{
+		{"20240131T120000.500Z", 1, false},
+		{"20240131T120000.100Z", 0, false},
+		{"20240130T120000Z", 0, false},
+		{"20240129T120000.000Z", 0, true},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+}
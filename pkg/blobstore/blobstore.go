@@ -0,0 +1,140 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/encryption"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Store keeps the original RFC 5322 bytes of every downloaded message on disk, one file per our_id.
+Files are sharded by the first two characters of the our_id so that no single directory gets too large.
+When cipher is set, blobs are encrypted on disk.
+*/
+type Store struct {
+	root   string
+	cipher *encryption.Cipher
+}
+
+// cipher can be nil to store blobs as plaintext
+func New(root string, cipher *encryption.Cipher) *Store {
+	return &Store{root: root, cipher: cipher}
+}
+
+func (store *Store) Root() string {
+	return store.root
+}
+
+func (store *Store) Path(ourId string) string {
+	shard := ourId
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return filepath.Join(store.root, shard, ourId+".eml")
+}
+
+// Put is a no-op if the blob already exists, since our_id is derived from the message contents
+func (store *Store) Put(ourId string, raw []byte) error {
+	path := store.Path(ourId)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return utils.JoinErrors("failed to create blob directory", err)
+	}
+	return store.write(path, raw)
+}
+
+func (store *Store) write(path string, raw []byte) error {
+	if store.cipher != nil {
+		var err error
+		raw, err = store.cipher.EncryptBytes(raw)
+		if err != nil {
+			return utils.JoinErrors("failed to encrypt blob", err)
+		}
+	}
+
+	// write to a temporary file first so a crash never leaves a truncated blob behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return utils.JoinErrors("failed to create temporary blob", err)
+	}
+	_, err = tmp.Write(raw)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return utils.JoinErrors("failed to write blob", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return utils.JoinErrors("failed to close blob", err)
+	}
+	return utils.JoinErrors("failed to move blob into place", os.Rename(tmp.Name(), path))
+}
+
+// Get returns nil, nil if the blob does not exist
+func (store *Store) Get(ourId string) ([]byte, error) {
+	raw, err := os.ReadFile(store.Path(ourId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, utils.JoinErrors("failed to read blob", err)
+	}
+	if !encryption.IsEncryptedBytes(raw) {
+		return raw, nil
+	}
+	if store.cipher == nil {
+		return nil, fmt.Errorf("blob %s is encrypted but no encryption key is configured", ourId)
+	}
+	raw, err = store.cipher.DecryptBytes(raw)
+	return raw, utils.JoinErrors("failed to decrypt blob", err)
+}
+
+// EncryptExisting encrypts every blob that was stored before encryption was enabled. Returns the number of blobs encrypted
+func (store *Store) EncryptExisting() (int, error) {
+	if store.cipher == nil {
+		return 0, errors.New("no encryption key is configured")
+	}
+	encrypted := 0
+	err := filepath.WalkDir(store.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path == store.root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, ".eml") {
+			return nil
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return utils.JoinErrors("failed to read blob", err)
+		}
+		if encryption.IsEncryptedBytes(raw) {
+			return nil
+		}
+		err = store.write(path, raw)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to encrypt %s", path), err)
+		}
+		encrypted++
+		return nil
+	})
+	return encrypted, err
+}
+
+func (store *Store) Delete(ourId string) error {
+	err := os.Remove(store.Path(ourId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return utils.JoinErrors("failed to delete blob", err)
+}
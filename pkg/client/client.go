@@ -97,7 +97,7 @@ func (clientWrap *Client) DownloadMailbox(mBox models.Mailbox) error {
 		return utils.JoinErrors("failed to select mailbox", err)
 	}
 	mBox.SetClient(clientWrap)
-	err = mBox.DownloadEmails()
+	_, err = mBox.DownloadEmails()
 	if err != nil {
 		clientWrap.Statuses() <- models.MailboxEvent{
 			Mailbox:   mBox.Name(),
@@ -164,7 +164,7 @@ func (clientWrap *Client) Statuses() chan<- models.MailboxEvent {
 }
 
 func (clientWrap *Client) Options() models.Options {
-	return clientWrap.parent.options
+	return clientWrap.parent.getOptions()
 }
 
 func (clientWrap *Client) UidFetch(uids []uint32, items []imap.FetchItem, ch chan *imap.Message) error {
@@ -227,6 +227,55 @@ func (clientWrap *Client) CopyToMailbox(fromMailbox models.Mailbox, toMailbox mo
 	return nil
 }
 
+/*
+flags the emails \Deleted and expunges them. Servers with UIDPLUS expunge only these uids with UID EXPUNGE. Other servers
+can only expunge every email flagged \Deleted, so nothing is deleted when emails other than these are flagged already.
+*/
+func (clientWrap *Client) DeleteFromMailbox(mailbox models.Mailbox, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+	err := clientWrap.Select(mailbox.Name(), false)
+	if err != nil {
+		return utils.JoinErrors("failed to select mailbox", err)
+	}
+	uidPlus, err := clientWrap.Support("UIDPLUS")
+	if err != nil {
+		return utils.JoinErrors("failed to get the capabilities of the server", err)
+	}
+	if !uidPlus {
+		flagged, err := clientWrap.UidSearch(&imap.SearchCriteria{WithFlags: []string{imap.DeletedFlag}})
+		if err != nil {
+			return utils.JoinErrors("failed to search for emails flagged as deleted", err)
+		}
+		others := utils.NewSet(flagged).Minus(utils.NewSet(uids))
+		if len(others) > 0 {
+			return fmt.Errorf("%d other emails in %s are flagged \\Deleted and the server doesn't support UIDPLUS, so expunging would delete them too. Expunge or unflag them first", len(others), mailbox.Name())
+		}
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	err = clientWrap.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil)
+	if err != nil {
+		return utils.JoinErrors("failed to flag emails as deleted", err)
+	}
+	if uidPlus {
+		// go-imap has no command for UID EXPUNGE (RFC 4315)
+		var status *imap.StatusResp
+		status, err = clientWrap.Execute(&imap.Command{Name: "UID EXPUNGE", Arguments: []interface{}{seqset}}, nil)
+		if err == nil {
+			err = status.Err()
+		}
+	} else {
+		err = clientWrap.Expunge(nil)
+	}
+	if err != nil {
+		return utils.JoinErrors("failed to expunge mailbox", err)
+	}
+	clientWrap.lastPing = time.Now()
+	return nil
+}
+
 func (clientWrap *Client) LastPing() time.Time {
 	return clientWrap.lastPing
 }
@@ -7,32 +7,40 @@ import (
 	"github.com/skamensky/email-archiver/pkg/mailbox"
 	"github.com/skamensky/email-archiver/pkg/models"
 	"github.com/skamensky/email-archiver/pkg/utils"
+	"sort"
 	"sync"
 	"time"
 )
 
 type ClientConnPool struct {
-	pool              chan models.Client
+	pool chan models.Client
+	// the MaxPoolSize the pool was created with, the capacity of pool can't change
+	size              int
 	poolMap           map[int]models.Client
 	checkoutMut       sync.Mutex
 	mailboxCacheMut   sync.Mutex
 	hydrateMailboxMut sync.Mutex
 	options           models.Options
-	statusesHandler   func(*models.MailboxEvent)
-	statuses          chan models.MailboxEvent
-	mailboxesCache    map[string]models.Mailbox
-	nextId            int
+	optionsMut        sync.RWMutex
+	// connections opened with options that were replaced since, they are logged out once they're idle
+	retired         utils.Set[int]
+	statusesHandler func(*models.MailboxEvent)
+	statuses        chan models.MailboxEvent
+	mailboxesCache  map[string]models.Mailbox
+	nextId          int
 }
 
 func NewClientConnPool(options models.Options, statusHandler func(*models.MailboxEvent)) models.ClientPool {
 	pool := &ClientConnPool{
 		pool:              make(chan models.Client, options.GetMaxPoolSize()),
+		size:              options.GetMaxPoolSize(),
 		options:           options,
 		mailboxesCache:    make(map[string]models.Mailbox),
 		hydrateMailboxMut: sync.Mutex{},
 		statuses:          make(chan models.MailboxEvent),
 		nextId:            1,
 		poolMap:           make(map[int]models.Client),
+		retired:           utils.NewSet([]int{}),
 	}
 	if statusHandler == nil {
 		pool.statusesHandler = func(event *models.MailboxEvent) {}
@@ -53,6 +61,44 @@ func (clientPool *ClientConnPool) SetEventHandler(handler func(*models.MailboxEv
 	clientPool.statusesHandler = handler
 }
 
+func (clientPool *ClientConnPool) getOptions() models.Options {
+	clientPool.optionsMut.RLock()
+	defer clientPool.optionsMut.RUnlock()
+	return clientPool.options
+}
+
+/*
+SetOptions makes the pool use options from now on. Idle connections are logged out right away, the ones in use keep
+working and are replaced the next time they're checked out, so a running sync isn't interrupted.
+The pool keeps the MaxPoolSize it was created with, a new one takes effect after a restart. The mailboxes cache is
+emptied when options log in to another account, so its mailboxes aren't mixed up with the ones of the previous account.
+*/
+func (clientPool *ClientConnPool) SetOptions(options models.Options) {
+	clientPool.checkoutMut.Lock()
+	defer clientPool.checkoutMut.Unlock()
+	clientPool.optionsMut.Lock()
+	previous := clientPool.options
+	clientPool.options = options
+	clientPool.optionsMut.Unlock()
+	if previous.GetImapServer() != options.GetImapServer() || previous.GetEmail() != options.GetEmail() {
+		clientPool.mailboxCacheMut.Lock()
+		clientPool.mailboxesCache = make(map[string]models.Mailbox)
+		clientPool.mailboxCacheMut.Unlock()
+	}
+	for {
+		select {
+		case client := <-clientPool.pool:
+			delete(clientPool.poolMap, client.Id())
+			client.Logout()
+		default:
+			for id := range clientPool.poolMap {
+				clientPool.retired.Add(id)
+			}
+			return
+		}
+	}
+}
+
 func (clientPool *ClientConnPool) Get() (models.Client, error) {
 	clientPool.checkoutMut.Lock()
 
@@ -61,12 +107,13 @@ func (clientPool *ClientConnPool) Get() (models.Client, error) {
 	select {
 	case client := <-clientPool.pool:
 		defer clientPool.checkoutMut.Unlock()
-		if time.Since(client.LastPing()) > ttl {
+		if time.Since(client.LastPing()) > ttl || clientPool.retired.Contains(client.Id()) {
 			utils.DebugPrintln(fmt.Sprintf("client %d is stale, logging out", nextId))
 			client.Logout()
-			delete(clientPool.poolMap, nextId)
+			delete(clientPool.poolMap, client.Id())
+			delete(clientPool.retired, client.Id())
 			var err error
-			client, err = newClient(clientPool.options, nextId, clientPool)
+			client, err = newClient(clientPool.getOptions(), nextId, clientPool)
 			clientPool.poolMap[nextId] = client
 			clientPool.nextId++
 			if err != nil {
@@ -77,7 +124,7 @@ func (clientPool *ClientConnPool) Get() (models.Client, error) {
 	default:
 
 		// lazy create new connection if we haven't reached max pool size
-		if len(clientPool.poolMap) < clientPool.options.GetMaxPoolSize() {
+		if len(clientPool.poolMap) < clientPool.size {
 
 			// we unlock before connecting so that other goroutines can create connections in parallel
 			// by setting the nextId to nil, we essentially up the counter so that our comparison to max pool size is
@@ -86,7 +133,7 @@ func (clientPool *ClientConnPool) Get() (models.Client, error) {
 			clientPool.nextId++
 			clientPool.checkoutMut.Unlock()
 
-			client, err := newClient(clientPool.options, nextId, clientPool)
+			client, err := newClient(clientPool.getOptions(), nextId, clientPool)
 			if err != nil {
 				return nil, err
 			}
@@ -251,73 +298,126 @@ func (clientPool *ClientConnPool) HydrateMailboxCache() error {
 }
 
 func (clientPool *ClientConnPool) SyncMailboxMessageStates(mailboxes []models.Mailbox) error {
-	errChan := make(chan error, len(mailboxes))
+	_, err := clientPool.syncMessageStates(mailboxes)
+	return err
+}
+
+// returns the number of uids that were gone from the server by mailbox
+func (clientPool *ClientConnPool) syncMessageStates(mailboxes []models.Mailbox) (map[string]int, error) {
+	type syncResult struct {
+		mailbox string
+		removed int
+		err     error
+	}
+	resultChan := make(chan syncResult, len(mailboxes))
 
 	for _, m := range mailboxes {
 
-		go func(mbox models.Mailbox, pool *ClientConnPool, errChan chan error) {
+		go func(mbox models.Mailbox, pool *ClientConnPool, resultChan chan syncResult) {
 			client, err := pool.Get()
 			defer clientPool.Put(client)
 			utils.DebugPrintln(fmt.Sprintf("[client_id=%v]", client.Id()), "Syncing message states for mailbox: "+mbox.Name())
 			if err != nil {
-				errChan <- utils.JoinErrors(fmt.Sprintf("failed to get client for mailbox %s", mbox.Name()), err)
+				resultChan <- syncResult{err: utils.JoinErrors(fmt.Sprintf("failed to get client for mailbox %s", mbox.Name()), err)}
 				return
 			}
 			_, err = client.RawSelect(mbox.Name(), true)
 			if err != nil {
-				errChan <- utils.JoinErrors(fmt.Sprintf("failed to select mailbox %s", mbox.Name()), err)
+				resultChan <- syncResult{err: utils.JoinErrors(fmt.Sprintf("failed to select mailbox %s", mbox.Name()), err)}
 				return
 			}
 			mbox.SetClient(client)
-			err = mbox.SyncToLocalState()
+			removed, err := mbox.SyncToLocalState()
 			if err != nil {
-				errChan <- utils.JoinErrors(fmt.Sprintf("failed to sync mailbox %s", mbox.Name()), err)
+				resultChan <- syncResult{err: utils.JoinErrors(fmt.Sprintf("failed to sync mailbox %s", mbox.Name()), err)}
 				return
 			}
-			errChan <- nil
-		}(m, clientPool, errChan)
+			resultChan <- syncResult{mailbox: mbox.Name(), removed: removed}
+		}(m, clientPool, resultChan)
 	}
 
+	removed := map[string]int{}
 	for i := 0; i < len(mailboxes); i++ {
-		err := <-errChan
-		if err != nil {
-			return utils.JoinErrors("failed to sync mailbox", err)
+		result := <-resultChan
+		if result.err != nil {
+			return removed, utils.JoinErrors("failed to sync mailbox", result.err)
 		}
+		removed[result.mailbox] = result.removed
 	}
 
-	return nil
+	return removed, nil
 }
 
+/*
+DownloadMailboxes syncs the mailboxes with the server and downloads their new messages. Every call is logged as a sync
+run in the sync_run table, with what it did in every mailbox and the error it failed with.
+*/
 func (pool *ClientConnPool) DownloadMailboxes(sourceMailboxes []models.Mailbox) error {
+	db := database.GetDatabase()
+	run := models.SyncRun{StartedAt: time.Now().Unix(), Status: models.SyncRunRunning, Mailboxes: []models.SyncRunMailbox{}}
+	for _, mbox := range sourceMailboxes {
+		run.Mailboxes = append(run.Mailboxes, models.SyncRunMailbox{Mailbox: mbox.Name(), Warnings: []string{}})
+	}
+	sort.Slice(run.Mailboxes, func(i, j int) bool {
+		return run.Mailboxes[i].Mailbox < run.Mailboxes[j].Mailbox
+	})
+	var err error
+	run.Id, err = db.StartSyncRun(run)
+	if err != nil {
+		return err
+	}
+
+	err = pool.downloadMailboxes(sourceMailboxes, &run)
 
-	err := pool.SyncMailboxMessageStates(sourceMailboxes)
+	run.FinishedAt = time.Now().Unix()
+	run.Status = models.SyncRunSucceeded
+	if err != nil {
+		run.Status = models.SyncRunFailed
+		run.Error = err.Error()
+	}
+	for _, mailboxRun := range run.Mailboxes {
+		run.Added += mailboxRun.Added
+		run.Removed += mailboxRun.Removed
+		run.Bytes += mailboxRun.Bytes
+		run.Warnings += mailboxRun.WarningCount
+	}
+	finishErr := db.FinishSyncRun(run)
+	if err != nil {
+		return err
+	}
+	return finishErr
+}
+
+// stores what was done in every mailbox in run
+func (pool *ClientConnPool) downloadMailboxes(sourceMailboxes []models.Mailbox, run *models.SyncRun) error {
+	mailboxRun := func(name string) *models.SyncRunMailbox {
+		for i := range run.Mailboxes {
+			if run.Mailboxes[i].Mailbox == name {
+				return &run.Mailboxes[i]
+			}
+		}
+		return &models.SyncRunMailbox{}
+	}
+
+	removed, err := pool.syncMessageStates(sourceMailboxes)
+	for name, count := range removed {
+		mailboxRun(name).Removed = count
+	}
 	if err != nil {
 		return utils.JoinErrors("failed to sync mailbox message states", err)
 	}
 
 	type mailboxDownloadResult struct {
-		mbox models.Mailbox
-		err  error
+		mbox  models.Mailbox
+		stats models.SyncRunMailbox
+		err   error
 	}
 
 	mailboxNameToInfo := map[string]models.Mailbox{}
-	skipMailboxes := utils.NewSet(pool.options.GetSkipMailboxes())
-	limitToMailboxes := utils.NewSet(pool.options.GetLimitToMailboxes())
-	allMailboxes := utils.NewSet([]string{})
-	unselectableMailboxes := utils.NewSet([]string{})
-
 	for _, m := range sourceMailboxes {
-		if m.HasAttribute("\\Noselect") {
-			unselectableMailboxes.Add(m.Name())
-		}
-		allMailboxes.Add(m.Name())
 		mailboxNameToInfo[m.Name()] = m
 	}
-	finalMailboxes := allMailboxes.Minus(unselectableMailboxes)
-	if len(limitToMailboxes) > 0 {
-		finalMailboxes = finalMailboxes.Intersection(limitToMailboxes)
-	}
-	finalMailboxes = finalMailboxes.Minus(skipMailboxes)
+	finalMailboxes := MailboxesToSync(pool.getOptions(), sourceMailboxes)
 
 	for _, m := range finalMailboxes.ToSlice() {
 		pool.Statuses() <- models.MailboxEvent{
@@ -350,17 +450,24 @@ func (pool *ClientConnPool) DownloadMailboxes(sourceMailboxes []models.Mailbox)
 				return
 			}
 			utils.DebugPrintln(fmt.Sprintf("[client_id=%v]", client.Id()), "downloading mailbox", mbox.Name())
-			err = mbox.DownloadEmails()
+			stats, err := mbox.DownloadEmails()
 			resultChan <- mailboxDownloadResult{
-				mbox: mbox,
-				err:  err,
+				mbox:  mbox,
+				stats: stats,
+				err:   err,
 			}
 		}(mailboxNameToInfo[mbName], pool, resultChan)
 	}
 
 	for i := 0; i < len(finalMailboxes); i++ {
 		result := <-resultChan
+		stats := mailboxRun(result.mbox.Name())
+		stats.Added = result.stats.Added
+		stats.Bytes = result.stats.Bytes
+		stats.WarningCount = result.stats.WarningCount
+		stats.Warnings = append(stats.Warnings, result.stats.Warnings...)
 		if result.err != nil {
+			stats.Error = result.err.Error()
 			pool.Statuses() <- models.MailboxEvent{
 				Mailbox:   result.mbox.Name(),
 				EventType: models.MailboxDownloadError,
@@ -381,5 +488,43 @@ func (pool *ClientConnPool) DownloadMailboxes(sourceMailboxes []models.Mailbox)
 		return utils.JoinErrors("failed to update full text search", err)
 	}
 
+	err = database.GetDatabase().UpdateThreads()
+	if err != nil {
+		return utils.JoinErrors("failed to update threads", err)
+	}
+
+	return nil
+}
+
+// MailboxesToSync returns the names of the mailboxes that are downloaded, the selectable ones minus SKIP_MAILBOXES,
+// limited to LIMIT_TO_MAILBOXES if it's set
+func MailboxesToSync(options models.Options, mailboxes []models.Mailbox) utils.Set[string] {
+	skipMailboxes := utils.NewSet(options.GetSkipMailboxes())
+	limitToMailboxes := utils.NewSet(options.GetLimitToMailboxes())
+	allMailboxes := utils.NewSet([]string{})
+	unselectableMailboxes := utils.NewSet([]string{})
+
+	for _, m := range mailboxes {
+		if m.HasAttribute("\\Noselect") {
+			unselectableMailboxes.Add(m.Name())
+		}
+		allMailboxes.Add(m.Name())
+	}
+	finalMailboxes := allMailboxes.Minus(unselectableMailboxes)
+	if len(limitToMailboxes) > 0 {
+		finalMailboxes = finalMailboxes.Intersection(limitToMailboxes)
+	}
+	return finalMailboxes.Minus(skipMailboxes)
+}
+
+// CheckLogin connects to the imap server and logs in with options, e.g. to validate them before a running pool uses them
+func CheckLogin(options models.Options) error {
+	pool := NewClientConnPool(options, nil)
+	defer pool.Close()
+	client, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	pool.Put(client)
 	return nil
 }
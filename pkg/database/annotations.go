@@ -0,0 +1,205 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"strings"
+	"time"
+)
+
+// keeps the full text index in step with the tags and notes it indexes, which works differently per backend
+type reindexer struct {
+	// called before the tags or note of the email change
+	unindex func(tx *sqlx.Tx, ourId string) error
+	// called after they changed
+	index func(tx *sqlx.Tx, ourId string) error
+}
+
+// tags are lower cased so that tag:Tax-2023 and tag:tax-2023 are the same, and can't contain spaces so they can be written in queries unquoted
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, errors.New("no tags given")
+	}
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			return nil, errors.New("tags can't be empty")
+		}
+		if strings.ContainsAny(tag, " \t\r\n") {
+			return nil, fmt.Errorf("tag %q contains spaces", tag)
+		}
+		normalized = append(normalized, tag)
+	}
+	return normalized, nil
+}
+
+func checkEmailExists(tx *sqlx.Tx, ourId string) error {
+	exists := false
+	err := tx.Get(&exists, tx.Rebind("SELECT EXISTS (SELECT 1 FROM email WHERE our_id = ?)"), ourId)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to look up email %s", ourId), err)
+	}
+	if !exists {
+		return fmt.Errorf("there is no email with our_id %s", ourId)
+	}
+	return nil
+}
+
+// runs change for every email in ourIds in a single transaction, reindexing each of them
+func annotate(db *sqlx.DB, ourIds []string, reindex reindexer, change func(tx *sqlx.Tx, ourId string) error) error {
+	if len(ourIds) == 0 {
+		return errors.New("no emails given")
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+	for _, ourId := range ourIds {
+		err = checkEmailExists(tx, ourId)
+		if err != nil {
+			return err
+		}
+		err = reindex.unindex(tx, ourId)
+		if err != nil {
+			return err
+		}
+		err = change(tx, ourId)
+		if err != nil {
+			return err
+		}
+		err = reindex.index(tx, ourId)
+		if err != nil {
+			return err
+		}
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
+
+func addTags(db *sqlx.DB, ourIds []string, tags []string, reindex reindexer) error {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	return annotate(db, ourIds, reindex, func(tx *sqlx.Tx, ourId string) error {
+		for _, tag := range tags {
+			_, err := tx.Exec(tx.Rebind("INSERT INTO tag (our_id, name, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING"), ourId, tag, now)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to tag %s", ourId), err)
+			}
+		}
+		return nil
+	})
+}
+
+func removeTags(db *sqlx.DB, ourIds []string, tags []string, reindex reindexer) (int, error) {
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return 0, err
+	}
+	removed := int64(0)
+	err = annotate(db, ourIds, reindex, func(tx *sqlx.Tx, ourId string) error {
+		for _, tag := range tags {
+			result, err := tx.Exec(tx.Rebind("DELETE FROM tag WHERE our_id = ? AND name = ?"), ourId, tag)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to untag %s", ourId), err)
+			}
+			deleted, err := result.RowsAffected()
+			if err != nil {
+				return utils.JoinErrors("failed to get the number of removed tags", err)
+			}
+			removed += deleted
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(removed), nil
+}
+
+func getTags(db *sqlx.DB) ([]models.Tag, error) {
+	tags := []models.Tag{}
+	err := db.Select(&tags, "SELECT name, count(*) AS num_emails FROM tag GROUP BY name ORDER BY name")
+	return tags, utils.JoinErrors("failed to get tags", err)
+}
+
+// encrypt is applied to the text before it's stored, since a note can be as sensitive as the email it's about
+func setNote(db *sqlx.DB, ourId string, text string, encrypt func(string) (string, error), reindex reindexer) error {
+	now := time.Now().Unix()
+	return annotate(db, []string{ourId}, reindex, func(tx *sqlx.Tx, ourId string) error {
+		if strings.TrimSpace(text) == "" {
+			_, err := tx.Exec(tx.Rebind("DELETE FROM note WHERE our_id = ?"), ourId)
+			return utils.JoinErrors(fmt.Sprintf("failed to remove the note of %s", ourId), err)
+		}
+		stored, err := encrypt(text)
+		if err != nil {
+			return utils.JoinErrors("failed to encrypt note", err)
+		}
+		_, err = tx.Exec(tx.Rebind(`INSERT INTO note (our_id, text, created_at, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (our_id) DO UPDATE SET text = excluded.text, updated_at = excluded.updated_at`), ourId, stored, now, now)
+		return utils.JoinErrors(fmt.Sprintf("failed to set the note of %s", ourId), err)
+	})
+}
+
+// decrypt is nil when notes are never encrypted
+func getAnnotations(db *sqlx.DB, ourIds []string, decrypt func(string) (string, error)) (map[string]models.Annotations, error) {
+	annotations := map[string]models.Annotations{}
+	err := inBatches(ourIds, func(batch []string) error {
+		query, args, err := sqlx.In("SELECT our_id, name FROM tag WHERE our_id IN (?) ORDER BY our_id, name", batch)
+		if err != nil {
+			return err
+		}
+		tags := []struct {
+			OurId string `db:"our_id"`
+			Name  string `db:"name"`
+		}{}
+		err = db.Select(&tags, db.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			annotation := annotations[tag.OurId]
+			annotation.Tags = append(annotation.Tags, tag.Name)
+			annotations[tag.OurId] = annotation
+		}
+
+		query, args, err = sqlx.In("SELECT our_id, text, created_at, updated_at FROM note WHERE our_id IN (?)", batch)
+		if err != nil {
+			return err
+		}
+		notes := []models.Note{}
+		err = db.Select(&notes, db.Rebind(query), args...)
+		if err != nil {
+			return err
+		}
+		for i := range notes {
+			note := notes[i]
+			if decrypt != nil {
+				note.Text, err = decrypt(note.Text)
+				if err != nil {
+					return err
+				}
+			}
+			annotation := annotations[note.OurId]
+			annotation.Note = &note
+			annotations[note.OurId] = annotation
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get tags and notes", err)
+	}
+	for ourId, annotation := range annotations {
+		if annotation.Tags == nil {
+			annotation.Tags = []string{}
+			annotations[ourId] = annotation
+		}
+	}
+	return annotations, nil
+}
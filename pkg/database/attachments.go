@@ -0,0 +1,77 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/blobstore"
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"time"
+)
+
+/*
+extracts the attachment texts of emails archived before they were stored, the same way for sqlite and postgres.
+Newly archived emails get their texts when they are parsed, older ones are parsed again from their raw message in the
+blob store. Emails with attachment_text rows are done, so an interrupted run picks up where it stopped.
+decrypt is nil when the attachments column is never encrypted. store saves the texts of one email and reindexes it.
+*/
+func extractAttachmentTexts(db *sqlx.DB, blobs *blobstore.Store, options models.Options, decrypt func(string) (string, error), store func(ourId string, texts []models.AttachmentText) error) (int, error) {
+	if blobs == nil {
+		return 0, errors.New("the attachments of archived emails are read from their raw messages, set BLOB_STORE_PATH")
+	}
+
+	type pendingEmail struct {
+		OurId       string         `db:"our_id"`
+		Attachments sql.NullString `db:"attachments"`
+	}
+	extracted := 0
+	lastOurId := ""
+	for {
+		batch := []pendingEmail{}
+		err := db.Select(&batch, db.Rebind(`SELECT our_id, attachments FROM email
+			WHERE our_id > ? AND NOT EXISTS (SELECT 1 FROM attachment_text WHERE attachment_text.our_id = email.our_id)
+			ORDER BY our_id LIMIT ?`), lastOurId, encryptionBatchSize)
+		if err != nil {
+			return extracted, utils.JoinErrors("failed to get emails without attachment texts", err)
+		}
+		if len(batch) == 0 {
+			return extracted, nil
+		}
+		lastOurId = batch[len(batch)-1].OurId
+
+		for _, pending := range batch {
+			attachmentsJson := pending.Attachments.String
+			if decrypt != nil && attachmentsJson != "" {
+				attachmentsJson, err = decrypt(attachmentsJson)
+				if err != nil {
+					return extracted, err
+				}
+			}
+			attachments := []models.AttachmentMetaData{}
+			// most emails don't have attachments, there's no need to read their blobs
+			if json.Unmarshal([]byte(attachmentsJson), &attachments) != nil || len(attachments) == 0 {
+				continue
+			}
+			raw, err := blobs.Get(pending.OurId)
+			if err != nil {
+				return extracted, err
+			}
+			// archived before raw messages were kept
+			if raw == nil {
+				continue
+			}
+			texts := email.NewFromRaw(raw, nil, 0, time.Time{}, options).GetAttachmentTexts()
+			if len(texts) == 0 {
+				continue
+			}
+			err = store(pending.OurId, texts)
+			if err != nil {
+				return extracted, err
+			}
+			extracted++
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"strings"
+)
+
+// the number of problems PRAGMA integrity_check reports at most
+const maxIntegrityErrors = 10
+
+/*
+Snapshot copies the db to path with sqlite's online backup API, over a read connection: the copy is the last committed
+state, and since the db is in WAL mode a sync keeps writing meanwhile. The copy uses a rollback journal, so that it's a
+single file whenever it isn't open.
+*/
+func (dbWrap *DB) Snapshot(path string) error {
+	_, err := os.Stat(path)
+	if err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	ctx := context.Background()
+	source, err := dbWrap.reader.Conn(ctx)
+	if err != nil {
+		return utils.JoinErrors("failed to get a read connection", err)
+	}
+	defer source.Close()
+	target, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		return utils.JoinErrors("failed to create snapshot", err)
+	}
+	defer target.Close()
+	targetConn, err := target.Conn(ctx)
+	if err != nil {
+		return utils.JoinErrors("failed to create snapshot", err)
+	}
+	defer targetConn.Close()
+
+	err = targetConn.Raw(func(targetDriverConn interface{}) error {
+		return source.Raw(func(sourceDriverConn interface{}) error {
+			backup, err := targetDriverConn.(*sqlite3.SQLiteConn).Backup("main", sourceDriverConn.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// all pages in one step, which holds a single read transaction so that the copy is consistent
+			done, err := backup.Step(-1)
+			if err == nil && !done {
+				err = errors.New("the backup stopped before copying every page")
+			}
+			return utils.JoinErrors("failed to copy the db", errors.Join(err, backup.Finish()))
+		})
+	})
+	if err != nil {
+		return err
+	}
+	_, err = targetConn.ExecContext(ctx, "PRAGMA journal_mode = DELETE")
+	return utils.JoinErrors("failed to switch the snapshot to a rollback journal", err)
+}
+
+func (pgWrap *PostgresDB) Snapshot(path string) error {
+	return errors.New("snapshots are only supported by the sqlite backend, back up postgres with pg_dump instead")
+}
+
+/*
+CheckSQLiteIntegrity checks that the sqlite archive at path is an archive and isn't corrupt, including its full text
+index. Checking the index needs a connection that can write, although nothing is written, so check a copy of archives
+that must not change.
+*/
+func CheckSQLiteIntegrity(path string) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to open sqlite archive %s", path), err)
+	}
+	db, err := sqlx.Connect("sqlite3", fmt.Sprintf("file:%s?mode=rw", path))
+	if err != nil {
+		return utils.JoinErrors("failed to open sqlite archive", err)
+	}
+	defer db.Close()
+
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		return fmt.Errorf("%s is not an archive", path)
+	}
+	problems := []string{}
+	err = db.Select(&problems, fmt.Sprintf("PRAGMA integrity_check(%d)", maxIntegrityErrors))
+	if err != nil {
+		return utils.JoinErrors("failed to check integrity", err)
+	}
+	if len(problems) != 1 || problems[0] != "ok" {
+		return fmt.Errorf("%s is corrupt: %s", path, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"strings"
+)
+
+// tables that are rebuilt, only used while syncing or tied to the sqlite schema, they are not copied
+var uncopiedTables = utils.NewSet([]string{"message_staging", "encryption_key", "schema_version"})
+
+const copyBatchSize = 1000
+
+/*
+CopySQLiteToPostgres copies a sqlite archive into postgres, creating the postgres schema if needed.
+Every table that exists in both databases is copied, in the order the tables were created in sqlite, with the columns
+they have in common. Rows that already exist in postgres are skipped, so an interrupted copy can simply be rerun.
+The full text index is rebuilt at the end. progress is called after every batch with the number of rows copied so far.
+Blobs are not touched, point BLOB_STORE_PATH of the postgres setup at the same directory.
+*/
+func CopySQLiteToPostgres(sqlitePath string, postgresUrl string, progress func(table string, copied int)) error {
+	_, err := os.Stat(sqlitePath)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to open sqlite archive %s", sqlitePath), err)
+	}
+	source, err := sqlx.Connect("sqlite3", sqlitePath)
+	if err != nil {
+		return utils.JoinErrors("failed to open sqlite archive", err)
+	}
+	defer source.Close()
+
+	encrypted := false
+	err = source.Get(&encrypted, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'encryption_key')")
+	if err != nil {
+		return utils.JoinErrors("failed to check whether the archive is encrypted", err)
+	}
+	if encrypted {
+		hasKey := false
+		err = source.Get(&hasKey, "SELECT EXISTS (SELECT 1 FROM encryption_key)")
+		if err != nil {
+			return utils.JoinErrors("failed to check whether the archive is encrypted", err)
+		}
+		if hasKey {
+			return errors.New("the sqlite archive is encrypted, which the postgres backend doesn't support")
+		}
+	}
+
+	target, err := openPostgres(postgresUrl)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	tables := []string{}
+	// virtual tables and their shadow tables (email_fts, email_fts_data...) have no place in postgres
+	err = source.Select(&tables, "SELECT name FROM sqlite_master WHERE type = 'table' AND sql NOT LIKE 'CREATE VIRTUAL TABLE%' AND name NOT LIKE '%fts%' AND name NOT LIKE 'sqlite_%' ORDER BY rowid")
+	if err != nil {
+		return utils.JoinErrors("failed to list sqlite tables", err)
+	}
+	for _, table := range tables {
+		if uncopiedTables.Contains(table) {
+			continue
+		}
+		err = copyTable(source, target, table, progress)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to copy table %s", table), err)
+		}
+	}
+
+	return (&PostgresDB{db: target}).UpdateFTS()
+}
+
+func copyTable(source *sqlx.DB, target *sqlx.DB, table string, progress func(table string, copied int)) error {
+	sourceColumns := []string{}
+	err := source.Select(&sourceColumns, "SELECT name FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return utils.JoinErrors("failed to get sqlite columns", err)
+	}
+
+	type targetColumn struct {
+		Name     string `db:"column_name"`
+		DataType string `db:"data_type"`
+	}
+	targetColumns := []targetColumn{}
+	err = target.Select(&targetColumns, "SELECT column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1", table)
+	if err != nil {
+		return utils.JoinErrors("failed to get postgres columns", err)
+	}
+	if len(targetColumns) == 0 {
+		utils.DebugPrintln("table", table, "does not exist in postgres, skipping it")
+		return nil
+	}
+	targetTypes := map[string]string{}
+	for _, column := range targetColumns {
+		targetTypes[column.Name] = column.DataType
+	}
+
+	columns := []string{}
+	placeholders := []string{}
+	for _, column := range sourceColumns {
+		if _, ok := targetTypes[column]; ok {
+			columns = append(columns, column)
+			placeholders = append(placeholders, fmt.Sprintf("$%d", len(columns)))
+		}
+	}
+
+	rows, err := source.Queryx(fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table))
+	if err != nil {
+		return utils.JoinErrors("failed to read sqlite rows", err)
+	}
+	defer rows.Close()
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING", table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	copied := 0
+	tx, err := target.Begin()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer func() {
+		tx.Rollback()
+	}()
+
+	for rows.Next() {
+		values, err := rows.SliceScan()
+		if err != nil {
+			return utils.JoinErrors("failed to scan sqlite row", err)
+		}
+		for i, value := range values {
+			if asBytes, ok := value.([]byte); ok {
+				value = string(asBytes)
+			}
+			asString, ok := value.(string)
+			if !ok {
+				values[i] = value
+				continue
+			}
+			if targetTypes[columns[i]] == "jsonb" {
+				if asString == "" {
+					values[i] = nil
+				} else {
+					values[i] = pgJSON(asString)
+				}
+			} else {
+				values[i] = pgText(asString)
+			}
+		}
+		_, err = tx.Exec(insert, values...)
+		if err != nil {
+			return utils.JoinErrors("failed to insert row", err)
+		}
+		copied++
+		if copied%copyBatchSize == 0 {
+			err = tx.Commit()
+			if err != nil {
+				return utils.JoinErrors("failed to commit transaction", err)
+			}
+			progress(table, copied)
+			tx, err = target.Begin()
+			if err != nil {
+				return utils.JoinErrors("failed to begin transaction", err)
+			}
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return utils.JoinErrors("failed to read sqlite rows", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.JoinErrors("failed to commit transaction", err)
+	}
+	progress(table, copied)
+
+	// copying ids into a serial column doesn't advance its sequence, rows inserted later would reuse them
+	if targetTypes["id"] == "bigint" {
+		_, err = target.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence($1, 'id'), (SELECT max(id) FROM %s))", table), table)
+		if err != nil {
+			return utils.JoinErrors("failed to advance id sequence", err)
+		}
+	}
+	return nil
+}
@@ -5,23 +5,48 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/blobstore"
 	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/encryption"
 	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/query"
 	"github.com/skamensky/email-archiver/pkg/utils"
-	"os"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
+/*
+DB is the sqlite backend. It keeps two handles open for its whole lifetime: writer has a single connection, so writes
+are serialized by database/sql instead of a lock and a transaction holds it until it's done, and reader is a pool of
+read only connections. The db is in WAL mode, so reads see the last committed state and proceed while a sync is writing.
+*/
 type DB struct {
 	options models.Options
+	writer  *sqlx.DB
+	reader  *sqlx.DB
+	blobs   *blobstore.Store
+	// both nil unless the archive is encrypted
+	dataKey  []byte
+	cipher   *encryption.Cipher
+	syncRuns liveSyncRuns
 }
 
-var dATABASE *DB
-var mutex = &sync.Mutex{}
+var dATABASE models.DB
+
+// how long a connection waits for a lock held by another process (e.g. an import while serve is running) before failing
+const busyTimeoutMillis = 10000
+
+// the columns of email_fts, as named in the email_fts_content view it indexes
+const ftsColumns = "our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, tags, note"
+
+// adds an email to email_fts, once its addresses, attachment texts, tags and note are stored
+var indexEmailQuery = fmt.Sprintf("INSERT INTO email_fts (rowid, %[1]s) SELECT email_rowid, %[1]s FROM email_fts_content WHERE our_id = ?", ftsColumns)
 
 var tableToColumns = map[string][]string{}
+var tableToColumnsMutex = &sync.Mutex{}
 
 func GetDatabase() models.DB {
 	if dATABASE != nil {
@@ -33,6 +58,8 @@ func GetDatabase() models.DB {
 
 // gets columns in order of definition
 func (dbWrap *DB) getTableColumns(tableName string) ([]string, error) {
+	tableToColumnsMutex.Lock()
+	defer tableToColumnsMutex.Unlock()
 	if tableToColumns == nil {
 		tableToColumns = map[string][]string{}
 	}
@@ -43,13 +70,7 @@ func (dbWrap *DB) getTableColumns(tableName string) ([]string, error) {
 		return columns, nil
 	}
 
-	db, err := dbWrap.getDB()
-
-	if err != nil {
-		return nil, utils.JoinErrors("failed to open db", err)
-	}
-
-	rows, err := db.Query(fmt.Sprintf("select name from pragma_table_info('%v') order by cid", tableName))
+	rows, err := dbWrap.reader.Query(fmt.Sprintf("select name from pragma_table_info('%v') order by cid", tableName))
 	if err != nil {
 		return nil, utils.JoinErrors("failed to get columns", err)
 	}
@@ -75,142 +96,60 @@ func New(options models.Options) (models.DB, error) {
 	if dATABASE != nil {
 		return dATABASE, nil
 	}
+	if options.GetDBBackend() == models.PostgresBackend {
+		pgWrap, err := newPostgres(options)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to initialize postgres", err)
+		}
+		dATABASE = pgWrap
+		return dATABASE, nil
+	}
 	db := &DB{
 		options: options,
 	}
-	err := db.initDB()
+	if options.GetBlobStorePath() != "" {
+		db.blobs = blobstore.New(options.GetBlobStorePath(), nil)
+	}
+	err := db.open()
 	if err != nil {
 		return nil, utils.JoinErrors("failed to initialize db", err)
 	}
+	err = db.setupEncryption()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to set up encryption", err)
+	}
 
 	dATABASE = db
 
 	return dATABASE, nil
 }
 
-func (dbWrap *DB) getDB() (*sqlx.DB, error) {
-	db, err := sqlx.Connect("sqlite3", dbWrap.options.GetDBPath())
-
+// creates the db if it doesn't exist, applies any pending migrations and opens the reader pool
+func (dbWrap *DB) open() error {
+	// immediate transactions take the write lock up front, so two processes writing at once wait on each other
+	// instead of deadlocking when their deferred transactions both try to upgrade
+	writer, err := sqlx.Connect("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=%d&_txlock=immediate", dbWrap.options.GetDBPath(), busyTimeoutMillis))
 	if err != nil {
-		return nil, utils.JoinErrors("failed to open db", err)
-	}
-	return db, nil
-}
-
-func (dbWrap *DB) initDB() error {
-	_, err := os.Stat(dbWrap.options.GetDBPath())
-	if err == nil {
-		return nil
+		return utils.JoinErrors("failed to open db for writing", err)
 	}
+	writer.SetMaxOpenConns(1)
+	dbWrap.writer = writer
 
-	utils.DebugPrintln("DB", dbWrap.options.GetDBPath(), "does not exist, initializing DB")
-
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
-	_, err = db.Exec("DROP TABLE IF EXISTS email")
-	if err != nil {
-		return utils.JoinErrors("failed to drop table emails", err)
-	}
-	_, err = db.Exec(`
-		CREATE TABLE email (
-			our_id text primary key,
-			parse_warning text,
-			parse_error text,
-			envelope text,
-			flags text,
-			mailboxes text,
-			text_content text,
-			html_content text,
-			attachments text,
-			message_id text,
-			date text,
-			subject text,
-			from_name_1 text,
-			from_mailbox_1 text,
-			from_host_1 text,
-			sender_name_1 text,
-			sender_mailbox_1 text,
-			sender_host_1 text,
-			reply_to_name_1 text,
-			reply_to_mailbox_1 text,
-			reply_to_host_1 text,
-			to_name_1 text,
-			to_mailbox_1 text,
-			to_host_1 text,
-			cc_name_1 text,
-			cc_mailbox_1 text,
-			cc_host_1 text,
-			bcc_name_1 text,
-			bcc_mailbox_1 text,
-			bcc_host_1 text,
-			in_reply_to text
-		);`)
+	_, err = applyMigrations(writer, sqliteMigrations)
 	if err != nil {
-		return utils.JoinErrors("failed to create table email", err)
+		return err
 	}
 
-	_, err = db.Exec("DROP TABLE IF EXISTS message_to_mailbox")
+	reader, err := sqlx.Connect("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d&_query_only=true", dbWrap.options.GetDBPath(), busyTimeoutMillis))
 	if err != nil {
-		return utils.JoinErrors("failed to drop table mailbox", err)
+		return utils.JoinErrors("failed to open db for reading", err)
 	}
-
-	_, err = db.Exec("CREATE TABLE message_to_mailbox (mailbox_name text, our_id text, uid int, pending_sync integer, primary key (mailbox_name, uid))")
-	if err != nil {
-		return utils.JoinErrors("failed to create message_to_mailbox table", err)
-	}
-	// index on email_id so our updates are faster
-	_, err = db.Exec("CREATE INDEX our_id_index ON message_to_mailbox (our_id)")
-	if err != nil {
-		return utils.JoinErrors("failed to create our_id_index index", err)
-	}
-
-	// essentially a list of uids
-	_, err = db.Exec("DROP TABLE IF EXISTS message_staging")
-	if err != nil {
-		return utils.JoinErrors("failed to drop table message_staging", err)
-	}
-	_, err = db.Exec("CREATE TABLE message_staging(uid int,mailbox_name text,primary key (mailbox_name, uid))")
-	if err != nil {
-		return utils.JoinErrors("failed to create message_staging table", err)
-	}
-
-	_, err = db.Exec("DROP TABLE IF EXISTS email_fts")
-	if err != nil {
-		return utils.JoinErrors("failed to drop table email_fts", err)
-	}
-
-	_, err = db.Exec("CREATE VIRTUAL TABLE email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, content=email);")
-	if err != nil {
-		return utils.JoinErrors("failed to create email_fts table", err)
-	}
-
-	_, err = db.Exec("DROP TABLE IF EXISTS mailbox")
-	if err != nil {
-		return utils.JoinErrors("failed to drop table mailbox", err)
-	}
-
-	_, err = db.Exec("create table persisted_frontend_state (  state text, id text primary key default 'state_id' );")
-	if err != nil {
-		return utils.JoinErrors("failed to create persisted_frontend_state table", err)
-	}
-
-	_, err = db.Exec("CREATE TABLE mailbox (name text primary key,attributes text,last_synced int, num_emails int)")
-	return utils.JoinErrors("failed to create mailbox table", err)
-
+	reader.SetMaxOpenConns(runtime.NumCPU() + 1)
+	dbWrap.reader = reader
+	return nil
 }
 
 func (dbWrap *DB) SaveMailboxRecord(mailbox models.MailboxRecord) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
-
 	// now utc:
 	now := time.Now().UTC().Unix()
 	attributesAsJson, err := json.Marshal(mailbox.Attributes)
@@ -219,23 +158,15 @@ func (dbWrap *DB) SaveMailboxRecord(mailbox models.MailboxRecord) error {
 		return utils.JoinErrors("failed to marshal attributes", err)
 	}
 
-	_, err = db.Exec("INSERT INTO mailbox (name,attributes,last_synced) VALUES (?, ?, ? ) ON CONFLICT(name) DO UPDATE SET attributes = ?, last_synced = ?", mailbox.Name, string(attributesAsJson), now, string(attributesAsJson), now)
+	_, err = dbWrap.writer.Exec("INSERT INTO mailbox (name,attributes,last_synced) VALUES (?, ?, ? ) ON CONFLICT(name) DO UPDATE SET attributes = ?, last_synced = ?", mailbox.Name, string(attributesAsJson), now, string(attributesAsJson), now)
 	return utils.JoinErrors("failed to insert mailbox record", err)
 }
 
 func (dbWrap *DB) GetMailboxRecord(mailbox models.Mailbox) (models.MailboxRecord, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return models.MailboxRecord{}, utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
-
 	var lastSynced sql.NullInt64
 	var attributes sql.NullString
 
-	err = db.QueryRow("SELECT attributes,last_synced FROM folder WHERE name = ?", mailbox.Name()).Scan(&lastSynced, &attributes)
+	err := dbWrap.reader.QueryRow("SELECT attributes,last_synced FROM mailbox WHERE name = ?", mailbox.Name()).Scan(&attributes, &lastSynced)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return models.MailboxRecord{}, nil
@@ -263,15 +194,7 @@ func (dbWrap *DB) GetMailboxRecord(mailbox models.Mailbox) (models.MailboxRecord
 }
 
 func (dbWrap *DB) GetAllMailboxRecords() ([]models.MailboxRecord, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return nil, utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
-
-	rows, err := db.Query("SELECT name, attributes, last_synced,num_emails FROM mailbox")
+	rows, err := dbWrap.reader.Query("SELECT name, attributes, last_synced,num_emails FROM mailbox")
 	if err != nil {
 		return nil, utils.JoinErrors("failed to get all mailbox records", err)
 	}
@@ -310,29 +233,21 @@ func (dbWrap *DB) GetAllMailboxRecords() ([]models.MailboxRecord, error) {
 	return records, nil
 }
 
-func (dbWrap *DB) AddEmails(mailbox string, emails []models.Email) error {
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	db, err := dbWrap.getDB()
+func (dbWrap *DB) AddEmails(mailbox string, emails []models.Email) (int, error) {
+	tx, err := dbWrap.writer.Beginx()
 	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+		return 0, utils.JoinErrors("failed to begin transaction", err)
 	}
-	defer db.Close()
+	defer tx.Rollback()
 
-	tx, err := db.Beginx()
-	if err != nil {
-		return utils.JoinErrors("failed to begin transaction", err)
-	}
-
-	insertEmailStmnt, err := tx.Prepare(`INSERT INTO email (our_id,parse_warning ,parse_error ,envelope ,flags ,text_content ,html_content ,attachments ,message_id ,date ,subject ,from_name_1 ,from_mailbox_1 ,from_host_1 ,sender_name_1 ,sender_mailbox_1 ,sender_host_1 ,reply_to_name_1 ,reply_to_mailbox_1 ,reply_to_host_1 ,to_name_1 ,to_mailbox_1 ,to_host_1 ,cc_name_1 ,cc_mailbox_1 ,cc_host_1 ,bcc_name_1 ,bcc_mailbox_1 ,bcc_host_1 ,in_reply_to )
-		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+	insertEmailStmnt, err := tx.Prepare(`INSERT INTO email (our_id,parse_warning ,parse_error ,envelope ,flags ,text_content ,html_content ,attachments ,message_id ,date ,subject ,from_name_1 ,from_mailbox_1 ,from_host_1 ,sender_name_1 ,sender_mailbox_1 ,sender_host_1 ,reply_to_name_1 ,reply_to_mailbox_1 ,reply_to_host_1 ,to_name_1 ,to_mailbox_1 ,to_host_1 ,cc_name_1 ,cc_mailbox_1 ,cc_host_1 ,bcc_name_1 ,bcc_mailbox_1 ,bcc_host_1 ,in_reply_to ,date_epoch ,date_offset ,internal_date_epoch ,message_references ,gmail_thread_id ,body_hash ,body_simhash )
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
 		
 		ON CONFLICT (our_id) DO NOTHING
 	`)
 
 	if err != nil {
-		return utils.JoinErrors("failed to prepare insert statement", err)
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
 	}
 	defer insertEmailStmnt.Close()
 
@@ -343,42 +258,281 @@ func (dbWrap *DB) AddEmails(mailbox string, emails []models.Email) error {
 	`)
 
 	if err != nil {
-		return utils.JoinErrors("failed to prepare insert statement", err)
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertFolderStmnt.Close()
+
+	insertAddressStmnt, err := tx.Prepare("INSERT INTO email_address (our_id, role, position, name, mailbox, host, address) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING")
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertAddressStmnt.Close()
+
+	insertHeaderStmnt, err := tx.Prepare("INSERT INTO header (our_id, position, name, value) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING")
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertHeaderStmnt.Close()
+
+	insertAttachmentTextStmnt, err := tx.Prepare("INSERT INTO attachment_text (our_id, position, file_name, text) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING")
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertAttachmentTextStmnt.Close()
+
+	indexStmnt, err := tx.Prepare(indexEmailQuery)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
 	}
+	defer indexStmnt.Close()
 
+	added := 0
+	raws := map[string][]byte{}
 	for _, mail := range emails {
-		_, err = insertEmailStmnt.Exec(mail.GetOurID(), mail.GetParseWarning(), mail.GetParseError(), utils.MustJSON(mail.GetEnvelope()), utils.MustJSON(mail.GetFlags()), mail.GetTextContent(), mail.GetHTMLContent(), utils.MustJSON(mail.GetAttachments()), mail.GetMessageId(), mail.GetDate(), mail.GetSubject(), mail.GetFromName1(), mail.GetFromMailbox1(), mail.GetFromHost1(), mail.GetSenderName1(), mail.GetSenderMailbox1(), mail.GetSenderHost1(), mail.GetReplyToName1(), mail.GetReplyToMailbox1(), mail.GetReplyToHost1(), mail.GetToName1(), mail.GetToMailbox1(), mail.GetToHost1(), mail.GetCcName1(), mail.GetCcMailbox1(), mail.GetCcHost1(), mail.GetBccName1(), mail.GetBccMailbox1(), mail.GetBccHost1(), mail.GetInReplyTo())
+		ourId, parseWarning, err := collisionFreeOurId(tx, mail)
 		if err != nil {
-			return utils.JoinErrors("failed to insert email", err)
+			return 0, err
+		}
+		encrypted := []string{}
+		for _, value := range []string{mail.GetTextContent(), mail.GetHTMLContent(), utils.MustJSON(mail.GetAttachments())} {
+			value, err = dbWrap.encrypt(value)
+			if err != nil {
+				return 0, utils.JoinErrors(fmt.Sprintf("failed to encrypt email %s", ourId), err)
+			}
+			encrypted = append(encrypted, value)
 		}
-		_, err = insertFolderStmnt.Exec(mailbox, mail.GetOurID(), mail.GetUID())
+		inserted, err := insertEmailStmnt.Exec(ourId, parseWarning, mail.GetParseError(), utils.MustJSON(mail.GetEnvelope()), utils.MustJSON(mail.GetFlags()), encrypted[0], encrypted[1], encrypted[2], mail.GetMessageId(), mail.GetDate(), mail.GetSubject(), mail.GetFromName1(), mail.GetFromMailbox1(), mail.GetFromHost1(), mail.GetSenderName1(), mail.GetSenderMailbox1(), mail.GetSenderHost1(), mail.GetReplyToName1(), mail.GetReplyToMailbox1(), mail.GetReplyToHost1(), mail.GetToName1(), mail.GetToMailbox1(), mail.GetToHost1(), mail.GetCcName1(), mail.GetCcMailbox1(), mail.GetCcHost1(), mail.GetBccName1(), mail.GetBccMailbox1(), mail.GetBccHost1(), mail.GetInReplyTo(), epochOrNull(mail.GetDateEpoch()), dateOffsetOrNull(mail), epochOrNull(mail.GetInternalDateEpoch()), mail.GetReferences(), mail.GetGmailThreadId(), mail.GetBodyHash(), mail.GetBodySimhash())
 		if err != nil {
-			return utils.JoinErrors("failed to insert folder", err)
+			return 0, utils.JoinErrors("failed to insert email", err)
+		}
+		isNew, err := inserted.RowsAffected()
+		if err != nil {
+			return 0, utils.JoinErrors("failed to insert email", err)
+		}
+		added += int(isNew)
+		_, err = insertFolderStmnt.Exec(mailbox, ourId, mail.GetUID())
+		if err != nil {
+			return 0, utils.JoinErrors("failed to insert folder", err)
+		}
+		for _, address := range mail.GetAddresses() {
+			_, err = insertAddressStmnt.Exec(ourId, address.Role, address.Position, address.Name, address.Mailbox, address.Host, address.Address)
+			if err != nil {
+				return 0, utils.JoinErrors("failed to insert address", err)
+			}
+		}
+		for _, header := range mail.GetHeaders() {
+			_, err = insertHeaderStmnt.Exec(ourId, header.Position, header.Name, header.Value)
+			if err != nil {
+				return 0, utils.JoinErrors("failed to insert header", err)
+			}
+		}
+		for _, attachmentText := range mail.GetAttachmentTexts() {
+			text := attachmentText.Text
+			if text != "" {
+				text, err = dbWrap.encrypt(text)
+				if err != nil {
+					return 0, utils.JoinErrors("failed to encrypt attachment text", err)
+				}
+			}
+			_, err = insertAttachmentTextStmnt.Exec(ourId, attachmentText.Position, attachmentText.FileName, text)
+			if err != nil {
+				return 0, utils.JoinErrors("failed to insert attachment text", err)
+			}
+		}
+		// after the addresses and attachment texts, which are part of the index. emails that were already stored are already indexed
+		if isNew == 1 {
+			_, err = indexStmnt.Exec(ourId)
+			if err != nil {
+				return 0, utils.JoinErrors("failed to index email", err)
+			}
+		}
+		if dbWrap.blobs != nil && mail.GetRaw() != nil {
+			raws[ourId] = mail.GetRaw()
 		}
 	}
 
 	err = tx.Commit()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to commit transaction", err)
+	}
+	// only once the emails are stored, a failed commit shouldn't leave blobs of emails that don't exist behind
+	for ourId, raw := range raws {
+		err = dbWrap.blobs.Put(ourId, raw)
+		if err != nil {
+			return 0, utils.JoinErrors("failed to store raw message", err)
+		}
+	}
+	return added, nil
+}
+
+func (dbWrap *DB) ReplaceEmail(mail models.Email) error {
+	tx, err := dbWrap.writer.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	ourId := mail.GetOurID()
+	err = checkEmailExists(tx, ourId)
+	if err != nil {
+		return err
+	}
+	err = unindexEmail(tx, ourId)
+	if err != nil {
+		return err
+	}
+	encrypted := []string{}
+	for _, value := range []string{mail.GetTextContent(), mail.GetHTMLContent(), utils.MustJSON(mail.GetAttachments())} {
+		value, err = dbWrap.encrypt(value)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to encrypt email %s", ourId), err)
+		}
+		encrypted = append(encrypted, value)
+	}
+	_, err = tx.Exec("UPDATE email SET parse_warning = ?, parse_error = ?, text_content = ?, html_content = ?, attachments = ?, body_hash = ?, body_simhash = ? WHERE our_id = ?",
+		mail.GetParseWarning(), mail.GetParseError(), encrypted[0], encrypted[1], encrypted[2], mail.GetBodyHash(), mail.GetBodySimhash(), ourId)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to update email %s", ourId), err)
+	}
+	for _, table := range []string{"header", "attachment_text"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE our_id = ?", table), ourId)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to remove the old rows of %s from %s", ourId, table), err)
+		}
+	}
+	for _, header := range mail.GetHeaders() {
+		_, err = tx.Exec("INSERT INTO header (our_id, position, name, value) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING", ourId, header.Position, header.Name, header.Value)
+		if err != nil {
+			return utils.JoinErrors("failed to insert header", err)
+		}
+	}
+	for _, attachmentText := range mail.GetAttachmentTexts() {
+		text := attachmentText.Text
+		if text != "" {
+			text, err = dbWrap.encrypt(text)
+			if err != nil {
+				return utils.JoinErrors("failed to encrypt attachment text", err)
+			}
+		}
+		_, err = tx.Exec("INSERT INTO attachment_text (our_id, position, file_name, text) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING", ourId, attachmentText.Position, attachmentText.FileName, text)
+		if err != nil {
+			return utils.JoinErrors("failed to insert attachment text", err)
+		}
+	}
+	_, err = tx.Exec(indexEmailQuery, ourId)
+	if err != nil {
+		return utils.JoinErrors("failed to index email", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.JoinErrors("failed to commit transaction", err)
+	}
+	if dbWrap.blobs != nil && mail.GetRaw() != nil {
+		return utils.JoinErrors("failed to store raw message", dbWrap.blobs.Put(ourId, mail.GetRaw()))
+	}
+	return nil
+}
 
+// unknown timestamps are stored as NULL rather than as 1970
+func epochOrNull(epoch int64) interface{} {
+	if epoch == 0 {
+		return nil
+	}
+	return epoch
+}
+
+func dateOffsetOrNull(mail models.Email) interface{} {
+	if mail.GetDateEpoch() == 0 {
+		return nil
+	}
+	return mail.GetDateOffset()
+}
+
+/*
+returns the our_id and parse warning to store mail with. our_ids only hash the envelope, so two different emails with the
+same envelope collide. Instead of dropping the second one, it's stored under an our_id that includes its body hash, with a
+parse warning naming the email it collided with. The same email stored again keeps its our_id, as do emails whose stored
+copy hasn't been hashed yet, since there is nothing to compare them with.
+*/
+func collisionFreeOurId(tx *sqlx.Tx, mail models.Email) (string, string, error) {
+	ourId := mail.GetOurID()
+	if mail.GetBodyHash() == "" {
+		return ourId, mail.GetParseWarning(), nil
+	}
+	stored := []sql.NullString{}
+	err := tx.Select(&stored, tx.Rebind("SELECT body_hash FROM email WHERE our_id = ?"), ourId)
+	if err != nil {
+		return "", "", utils.JoinErrors(fmt.Sprintf("failed to check %s for a collision", ourId), err)
+	}
+	if len(stored) == 0 || stored[0].String == "" || stored[0].String == mail.GetBodyHash() {
+		return ourId, mail.GetParseWarning(), nil
+	}
+	utils.DebugPrintln("our_id", ourId, "is taken by an email with a different body, storing it with its body hash")
+	warnings := []string{}
+	if mail.GetParseWarning() != "" {
+		warnings = append(warnings, mail.GetParseWarning())
+	}
+	warnings = append(warnings, fmt.Sprintf("has the same envelope as %s but a different body", ourId))
+	return email.CollidingOurId(ourId, mail.GetBodyHash()), strings.Join(warnings, "; "), nil
+}
+
+// adds emails that are already stored to a mailbox, e.g. when one imported message maps to several gmail labels
+func (dbWrap *DB) AddMailboxMemberships(mailbox string, ourIdToUid map[string]uint32) error {
+	tx, err := dbWrap.writer.Begin()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	insertFolderStmnt, err := tx.Prepare(`
+		INSERT INTO message_to_mailbox (mailbox_name, our_id, uid,pending_sync)
+		VALUES (?, ?, ?, 0)
+		ON CONFLICT (mailbox_name, uid) DO UPDATE SET our_id = excluded.our_id, pending_sync = 0
+	`)
+	if err != nil {
+		return utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertFolderStmnt.Close()
+
+	for ourId, uid := range ourIdToUid {
+		_, err = insertFolderStmnt.Exec(mailbox, ourId, uid)
+		if err != nil {
+			return utils.JoinErrors("failed to insert folder", err)
+		}
+	}
+
+	err = tx.Commit()
 	return utils.JoinErrors("failed to commit transaction", err)
 }
 
+/*
+sets deleted_on_server_at of the emails whose every mailbox membership is marked as removed, to when the last one was,
+and clears it for the others. Emails without any membership were removed from the server before their mailboxes were
+kept, they're marked as deleted when this first notices them, the time is passed twice. Only the rows that change are
+written, since this runs after every sync.
+*/
+var updateDeletedOnServerQuery = fmt.Sprintf(`
+	UPDATE email
+	SET deleted_on_server_at = (%[1]s)
+	WHERE deleted_on_server_at IS DISTINCT FROM (%[1]s)`,
+	"SELECT CASE WHEN count(*) = count(removed_at) THEN coalesce(max(removed_at), email.deleted_on_server_at, ?) END FROM message_to_mailbox WHERE message_to_mailbox.our_id = email.our_id")
+
 func (dbWrap *DB) AggregateFolders() error {
 
 	// TODO add a column 'numberOfMessages' to the mailbox table and update it here.
 
-	mutex.Lock()
-	defer mutex.Unlock()
-	db, err := dbWrap.getDB()
+	tx, err := dbWrap.writer.Begin()
 	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+		return utils.JoinErrors("failed to begin transaction", err)
 	}
+	defer tx.Rollback()
 
-	_, err = db.Exec(`
+	_, err = tx.Exec(`
 		UPDATE mailbox
 		SET num_emails = (
 		SELECT COUNT(*)
 		FROM message_to_mailbox
-		WHERE message_to_mailbox.mailbox_name = mailbox.name
+		WHERE message_to_mailbox.mailbox_name = mailbox.name AND removed_at IS NULL
 		)
 	`)
 
@@ -386,33 +540,41 @@ func (dbWrap *DB) AggregateFolders() error {
 		return utils.JoinErrors("failed to update mailbox table", err)
 	}
 
-	// update emails table, folders will be a json list of folders.
-	_, err = db.Exec(`
+	now := time.Now().Unix()
+	_, err = tx.Exec(updateDeletedOnServerQuery, now, now)
+	if err != nil {
+		return utils.JoinErrors("failed to update deleted emails", err)
+	}
+
+	// update emails table, folders will be a json list of folders. needs deleted_on_server_at to be up to date
+	_, err = tx.Exec(fmt.Sprintf(`
 		update email
 		set mailboxes = subtable.mailboxes
 		FROM
 			(
 				select json_group_array(mailbox_name) mailboxes, our_id
 				FROM message_to_mailbox
+				WHERE %s
 				GROUP BY our_id
 			) subtable
 		WHERE email.our_id = subtable.our_id;
-	`)
+	`, query.CurrentMembershipCondition))
+	if err != nil {
+		return utils.JoinErrors("failed to update email table", err)
+	}
+	_, err = tx.Exec(`UPDATE email SET mailboxes = '[]'
+		WHERE coalesce(mailboxes, '') != '[]' AND NOT EXISTS (SELECT 1 FROM message_to_mailbox WHERE message_to_mailbox.our_id = email.our_id)`)
+	if err != nil {
+		return utils.JoinErrors("failed to clear the mailboxes of emails that are in none", err)
+	}
 
-	return utils.JoinErrors("failed to update email table", err)
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
 
 }
 
 func (dbWrap *DB) GetMessagesPendingSync(mailbox models.Mailbox) ([]uint32, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return nil, utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
 	pendingUIDs := []uint32{}
-	rows, err := db.Query("SELECT uid FROM message_to_mailbox WHERE pending_sync = 1 AND mailbox_name = ?", mailbox.Name())
+	rows, err := dbWrap.reader.Query("SELECT uid FROM message_to_mailbox WHERE pending_sync = 1 AND mailbox_name = ? AND removed_at IS NULL", mailbox.Name())
 	if err != nil {
 		return nil, utils.JoinErrors("failed to get messages pending sync", err)
 	}
@@ -428,6 +590,25 @@ func (dbWrap *DB) GetMessagesPendingSync(mailbox models.Mailbox) ([]uint32, erro
 	return pendingUIDs, nil
 }
 
+func (dbWrap *DB) GetMailboxUids(mailbox string) (map[string]uint32, error) {
+	rows, err := dbWrap.reader.Query("SELECT our_id, uid FROM message_to_mailbox WHERE mailbox_name = ? AND our_id IS NOT NULL AND removed_at IS NULL", mailbox)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get mailbox uids", err)
+	}
+	defer rows.Close()
+	ourIdToUid := map[string]uint32{}
+	for rows.Next() {
+		var ourId string
+		var uid uint32
+		err = rows.Scan(&ourId, &uid)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to scan row", err)
+		}
+		ourIdToUid[ourId] = uid
+	}
+	return ourIdToUid, utils.JoinErrors("failed to get mailbox uids", rows.Err())
+}
+
 // useful for debugging, let's keep it around.
 func (dbWrap *DB) debugPrintMessageToMailboxTable(mailboxName string, querier sqlx.Queryer) {
 	vals, err := querier.Query("SELECT uid,pending_sync FROM message_to_mailbox WHERE mailbox_name = ?", mailboxName)
@@ -450,36 +631,36 @@ func (dbWrap *DB) debugPrintMessageToMailboxTable(mailboxName string, querier sq
 
 }
 
-func (dbWrap *DB) UpdateLocalMailboxState(mailbox models.Mailbox, allUids []uint32) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	err := dbWrap.RemoveOrphanedEmailsFromMailbox(mailbox, allUids)
+// runs in a single transaction, so readers never see a mailbox whose orphaned emails were removed but whose new uids are missing
+func (dbWrap *DB) UpdateLocalMailboxState(mailbox models.Mailbox, allUids []uint32, keepDeleted bool) (int, error) {
+	tx, err := dbWrap.writer.Beginx()
 	if err != nil {
-		return utils.JoinErrors("failed to remove orphaned emails", err)
+		return 0, utils.JoinErrors("failed to begin transaction", err)
 	}
+	defer tx.Rollback()
 
-	err = dbWrap.AddMissingEmailsToMailbox(mailbox, allUids)
-
-	return err
-}
+	removed, err := removeOrphanedEmailsFromMailbox(tx, mailbox, allUids, keepDeleted)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to remove orphaned emails", err)
+	}
 
-// caller must hold mutex
-func (dbWrap *DB) AddMissingEmailsToMailbox(mailbox models.Mailbox, allUids []uint32) error {
-	db, err := dbWrap.getDB()
+	err = addMissingEmailsToMailbox(tx, mailbox, allUids)
 	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+		return 0, err
 	}
-	defer db.Close()
 
-	tx, err := db.Begin()
+	return removed, utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
 
+func addMissingEmailsToMailbox(tx *sqlx.Tx, mailbox models.Mailbox, allUids []uint32) error {
+	// if the email is already in the db, we don't need to add it again, the last value of pending_sync will be preserved (usually 0).
+	// a removed uid that is back on the server is downloaded again, since the server may have reused it for another email
+	insertStmt, err := tx.Prepare(`INSERT INTO message_to_mailbox (mailbox_name, uid, pending_sync) VALUES (?, ?, 1)
+		ON CONFLICT (mailbox_name, uid) DO UPDATE SET removed_at = NULL, pending_sync = 1 WHERE message_to_mailbox.removed_at IS NOT NULL`)
 	if err != nil {
-		return utils.JoinErrors("failed to begin transaction", err)
+		return utils.JoinErrors("failed to prepare insert statement", err)
 	}
-
-	// if the email is already in the db, we don't need to add it again, the last value of pending_sync will be preserved (usually 0)
-	insertStmt, err := tx.Prepare("INSERT INTO message_to_mailbox (mailbox_name, uid, pending_sync) VALUES (?, ?, 1) ON CONFLICT DO NOTHING ")
+	defer insertStmt.Close()
 
 	for _, uid := range allUids {
 		_, err = insertStmt.Exec(mailbox.Name(), uid)
@@ -487,54 +668,60 @@ func (dbWrap *DB) AddMissingEmailsToMailbox(mailbox models.Mailbox, allUids []ui
 			return utils.JoinErrors("failed to insert uid", err)
 		}
 	}
-
-	err = tx.Commit()
-	return utils.JoinErrors("failed to commit transaction", err)
+	return nil
 }
 
-// caller must lock mutex
-func (dbWrap *DB) RemoveOrphanedEmailsFromMailbox(mailbox models.Mailbox, allUids []uint32) error {
-
-	err := dbWrap.clearStaging(mailbox)
+// returns the number of uids removed, with keepDeleted the ones of downloaded emails are only marked as removed
+func removeOrphanedEmailsFromMailbox(tx *sqlx.Tx, mailbox models.Mailbox, allUids []uint32, keepDeleted bool) (int, error) {
+	_, err := tx.Exec("DELETE FROM message_staging WHERE mailbox_name = ?", mailbox.Name())
 	if err != nil {
-		return utils.JoinErrors("failed to truncate staging events", err)
+		return 0, utils.JoinErrors("failed to truncate message_staging", err)
 	}
-	err = dbWrap.addStagingMessages(allUids, mailbox)
 
+	err = addStagingMessages(tx, allUids, mailbox)
 	if err != nil {
-		return utils.JoinErrors("failed to add mailbox message events", err)
+		return 0, utils.JoinErrors("failed to add mailbox message events", err)
 	}
 
-	db, err := dbWrap.getDB()
+	// the made up uids of a takeout import were never on the server, so they aren't counted as removed or kept as
+	// removed, the real uids of their emails take their place
+	_, err = tx.Exec("DELETE FROM message_to_mailbox WHERE mailbox_name = ? AND uid >= ?", mailbox.Name(), models.TakeoutUidFloor)
 	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+		return 0, utils.JoinErrors("failed to remove takeout uids", err)
 	}
-	defer db.Close()
 
-	// after this runs, message_to_mailbox will not contain uids that are not in the mailbox.
-	_, err = db.Exec("DELETE FROM message_to_mailbox WHERE mailbox_name = ? AND uid NOT IN (SELECT uid FROM message_staging where mailbox_name = ?)", mailbox.Name(), mailbox.Name())
-	if err != nil {
-		return utils.JoinErrors("failed to remove orphaned emails using staging", err)
-	}
-	return nil
-}
-
-// caller must hold mutex
-func (dbWrap *DB) addStagingMessages(uids []uint32, mailbox models.Mailbox) error {
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+	tombstoned := int64(0)
+	deleteQuery := "DELETE FROM message_to_mailbox WHERE mailbox_name = ? AND removed_at IS NULL AND uid NOT IN (SELECT uid FROM message_staging where mailbox_name = ?)"
+	if keepDeleted {
+		result, err := tx.Exec("UPDATE message_to_mailbox SET removed_at = ? WHERE mailbox_name = ? AND removed_at IS NULL AND our_id IS NOT NULL AND uid NOT IN (SELECT uid FROM message_staging where mailbox_name = ?)",
+			time.Now().Unix(), mailbox.Name(), mailbox.Name())
+		if err != nil {
+			return 0, utils.JoinErrors("failed to mark orphaned emails as removed using staging", err)
+		}
+		tombstoned, err = result.RowsAffected()
+		if err != nil {
+			return 0, utils.JoinErrors("failed to count orphaned emails", err)
+		}
+		// uids that were never downloaded have nothing to remember
+		deleteQuery += " AND our_id IS NULL"
 	}
-	defer db.Close()
-
-	tx, err := db.Begin()
 
+	// after this runs, message_to_mailbox will only contain uids that are not in the mailbox if they're marked as removed.
+	result, err := tx.Exec(deleteQuery, mailbox.Name(), mailbox.Name())
 	if err != nil {
-		return utils.JoinErrors("failed to begin transaction", err)
+		return 0, utils.JoinErrors("failed to remove orphaned emails using staging", err)
 	}
+	removed, err := result.RowsAffected()
+	return int(tombstoned + removed), utils.JoinErrors("failed to count orphaned emails", err)
+}
 
+func addStagingMessages(tx *sqlx.Tx, uids []uint32, mailbox models.Mailbox) error {
 	// if the email is already in the db, we don't need to add it again
 	insertStmt, err := tx.Prepare("INSERT INTO message_staging (uid,mailbox_name) VALUES (?,?) ON CONFLICT DO NOTHING ")
+	if err != nil {
+		return utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertStmt.Close()
 
 	for _, uid := range uids {
 		_, err = insertStmt.Exec(uid, mailbox.Name())
@@ -542,73 +729,139 @@ func (dbWrap *DB) addStagingMessages(uids []uint32, mailbox models.Mailbox) erro
 			return utils.JoinErrors("failed to insert uid", err)
 		}
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		return utils.JoinErrors("failed to commit transaction", err)
-	}
 	return nil
 }
 
-func (dbWrap *DB) clearStaging(mailbox models.Mailbox) error {
-	db, err := dbWrap.getDB()
+func (dbWrap *DB) GetEmails(sqlQuery string, params ...interface{}) ([]models.Email, error) {
+	emails := []models.Email{}
+	err := dbWrap.StreamEmails(func(mail models.Email) error {
+		emails = append(emails, mail)
+		return nil
+	}, sqlQuery, params...)
 	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+		return nil, err
 	}
-	_, err = db.Exec("DELETE FROM message_staging WHERE mailbox_name = ?", mailbox.Name())
-	return utils.JoinErrors("failed to truncate message_staging", err)
+	return emails, nil
 }
 
-func (dbWrap *DB) GetEmails(sqlQuery string, params ...interface{}) ([]models.Email, error) {
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return nil, utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
+// like GetEmails, but hands the emails to handle one by one instead of loading the whole result into memory
+func (dbWrap *DB) StreamEmails(handle func(models.Email) error, sqlQuery string, params ...interface{}) error {
 	utils.DebugPrintln(fmt.Sprintf("executing query: %s", sqlQuery))
-	emails := []models.Email{}
 
-	rows, err := db.Queryx(sqlQuery, params...)
+	rows, err := dbWrap.reader.Queryx(sqlQuery, params...)
 
 	if err != nil {
-		return nil, utils.JoinErrors("failed to execute query", err)
+		return utils.JoinErrors("failed to execute query", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
-		mail, err := email.NewFromDBRecord(rows)
+		rowData := make(map[string]interface{})
+		err = rows.MapScan(rowData)
+		if err != nil {
+			return utils.JoinErrors("failed to scan row", err)
+		}
+		err = dbWrap.decryptRow(rowData)
+		if err != nil {
+			return utils.JoinErrors("failed to decrypt email", err)
+		}
+		err = resolveMatchedAttachments(rowData)
+		if err != nil {
+			return err
+		}
+		mail, err := email.NewFromRowData(rowData)
 		if err != nil {
 			utils.DebugPrintln("failed to create email from db record")
-			return nil, utils.JoinErrors("failed to create email from db record", err)
+			return utils.JoinErrors("failed to create email from db record", err)
+		}
+		err = handle(mail)
+		if err != nil {
+			return err
 		}
-		emails = append(emails, mail)
 	}
-	return emails, nil
+	return utils.JoinErrors("failed to iterate over query results", rows.Err())
+}
+
+func (dbWrap *DB) FullTextSearch(highlight string, condition string, params ...interface{}) ([]models.Email, error) {
+	if highlight == "" {
+		return dbWrap.GetEmails(fmt.Sprintf("SELECT * FROM email WHERE %s ORDER BY coalesce(date_epoch, 0) DESC", condition), params...)
+	}
+	sqlQuery, err := dbWrap.fullTextSearchQuery()
+	if err != nil {
+		return nil, err
+	}
+	// the subquery keeps the columns of the condition from being ambiguous between email and email_fts
+	highlighted, err := dbWrap.GetEmails(fmt.Sprintf("%s AND email.our_id IN (SELECT our_id FROM email WHERE %s)", sqlQuery, condition), append([]interface{}{highlight}, params...)...)
+	if err != nil {
+		return nil, err
+	}
+	// e.g. the from:acme side of `invoice OR from:acme`
+	rest, err := dbWrap.GetEmails(fmt.Sprintf("SELECT * FROM email WHERE (%s) AND rowid NOT IN (SELECT rowid FROM email_fts WHERE email_fts MATCH ?)", condition), append(append([]interface{}{}, params...), highlight)...)
+	if err != nil {
+		return nil, err
+	}
+	return newestFirst(append(highlighted, rest...)), nil
+}
+
+func newestFirst(emails []models.Email) []models.Email {
+	sort.SliceStable(emails, func(i, j int) bool {
+		return emails[i].GetDateEpoch() > emails[j].GetDateEpoch()
+	})
+	return emails
+}
+
+func (dbWrap *DB) StreamFullTextSearch(searchTerm string, handle func(models.Email) error) error {
+	sqlQuery, err := dbWrap.fullTextSearchQuery()
+	if err != nil {
+		return err
+	}
+	return dbWrap.StreamEmails(handle, sqlQuery, searchTerm)
 }
 
-func (dbWrap *DB) FullTextSearch(searchTerm string) ([]models.Email, error) {
+func (dbWrap *DB) fullTextSearchQuery() (string, error) {
 	allEmailColumns, err := dbWrap.getTableColumns("email")
 	if err != nil {
-		return nil, utils.JoinErrors("failed to get email table columns", err)
+		return "", utils.JoinErrors("failed to get email table columns", err)
 	}
 
 	searchFieldsInOrder, err := dbWrap.getTableColumns("email_fts")
 	if err != nil {
-		return nil, utils.JoinErrors("failed to get email_fts table columns", err)
+		return "", utils.JoinErrors("failed to get email_fts table columns", err)
 	}
 
-	emailColumnsToSelect := utils.NewSet(allEmailColumns).Minus(utils.NewSet(searchFieldsInOrder)).ToSlice()
-	emailColumnsToSelectEmaiLPrepended := []string{}
-	for _, col := range emailColumnsToSelect {
-		emailColumnsToSelectEmaiLPrepended = append(emailColumnsToSelectEmaiLPrepended, fmt.Sprintf("email.%s AS %s", col, col))
+	emailColumns := utils.NewSet(allEmailColumns)
+	// encrypted values aren't indexed, so there is nothing to highlight in them
+	unindexed := utils.NewSet([]string{})
+	if dbWrap.cipher != nil {
+		unindexed = utils.NewSet(encryptedColumns)
 	}
-
+	highlighted := utils.NewSet([]string{"our_id"})
 	emailFtsColumns := []string{"email_fts.our_id as our_id"}
 	for index, col := range searchFieldsInOrder[1:] {
+		// only searched, e.g. addresses, which has its own table
+		if !emailColumns.Contains(col) || unindexed.Contains(col) {
+			continue
+		}
 		// the reason we are generating this is because I was already hit by a bug from misnumbering the columns
 
 		//highlight(email_fts, 1, '<span class="bg-yellow-200 text-black">', '</span>') as text_content,
 		emailFtsColumns = append(emailFtsColumns, fmt.Sprintf(`highlight(email_fts, %d, '<span class="bg-yellow-200 text-black">', '</span>') as %s`, index+1, col))
+		highlighted.Add(col)
+	}
+
+	emailColumnsToSelectEmaiLPrepended := []string{}
+	for _, col := range emailColumns.Minus(highlighted).ToSlice() {
+		emailColumnsToSelectEmaiLPrepended = append(emailColumnsToSelectEmaiLPrepended, fmt.Sprintf("email.%s AS %s", col, col))
+	}
+	for index, col := range searchFieldsInOrder {
+		if col != "attachment_text" {
+			continue
+		}
+		// turned into matched_attachments by resolveMatchedAttachments
+		emailColumnsToSelectEmaiLPrepended = append(emailColumnsToSelectEmaiLPrepended,
+			fmt.Sprintf("highlight(email_fts, %d, char(2), char(3)) AS attachment_text_highlight", index),
+			"(SELECT json_group_array(file_name ORDER BY position) FROM attachment_text WHERE attachment_text.our_id = email.our_id AND text != '' AND text NOT LIKE 'enc:v1:%') AS attachment_text_names",
+		)
 	}
 
 	// the goal of this sql sqlQuery is to match select * from email but filter on matched results using full text search
@@ -621,45 +874,239 @@ func (dbWrap *DB) FullTextSearch(searchTerm string) ([]models.Email, error) {
 		WHERE email_fts MATCH ?
 		`, strings.Join(append(emailFtsColumns, emailColumnsToSelectEmaiLPrepended...), ",\n\t\t\t"))
 
-	return dbWrap.GetEmails(sqlQuery, searchTerm)
+	return sqlQuery, nil
+}
+
+func (dbWrap *DB) UpdateThreads() error {
+	return updateThreads(dbWrap.writer)
+}
+
+func (dbWrap *DB) GetThreads(limit int, offset int) ([]models.Thread, error) {
+	return getThreads(dbWrap.reader, limit, offset)
+}
+
+func (dbWrap *DB) GetOptions() (map[string]string, error) {
+	return getOptions(dbWrap.reader, dbWrap.decrypt)
+}
+
+func (dbWrap *DB) SetOptions(options map[string]string) error {
+	return setOptions(dbWrap.writer, options, dbWrap.encrypt)
+}
+
+func (dbWrap *DB) GetThreadEmailIds(threadId string) ([]string, error) {
+	return getThreadEmailIds(dbWrap.reader, threadId)
+}
+
+// the email_fts row of an email has to be replaced whenever its tags or note change
+var sqliteReindexer = reindexer{
+	unindex: unindexEmail,
+	index: func(tx *sqlx.Tx, ourId string) error {
+		_, err := tx.Exec(indexEmailQuery, ourId)
+		return utils.JoinErrors(fmt.Sprintf("failed to index %s", ourId), err)
+	},
+}
+
+func (dbWrap *DB) AddTags(ourIds []string, tags []string) error {
+	return addTags(dbWrap.writer, ourIds, tags, sqliteReindexer)
+}
+
+func (dbWrap *DB) RemoveTags(ourIds []string, tags []string) (int, error) {
+	return removeTags(dbWrap.writer, ourIds, tags, sqliteReindexer)
+}
+
+func (dbWrap *DB) GetTags() ([]models.Tag, error) {
+	return getTags(dbWrap.reader)
+}
+
+func (dbWrap *DB) SetNote(ourId string, text string) error {
+	return setNote(dbWrap.writer, ourId, text, dbWrap.encrypt, sqliteReindexer)
+}
+
+func (dbWrap *DB) GetAnnotations(ourIds []string) (map[string]models.Annotations, error) {
+	return getAnnotations(dbWrap.reader, ourIds, dbWrap.decrypt)
+}
+
+func (dbWrap *DB) GetMailboxMemberships(mailbox string) ([]models.MailboxMembership, error) {
+	return getMailboxMemberships(dbWrap.reader, mailbox)
+}
+
+func (dbWrap *DB) MarkPendingSync(mailbox string, uids []uint32) error {
+	return markPendingSync(dbWrap.writer, mailbox, uids)
+}
+
+func (dbWrap *DB) UpdateBodyHashes() (int, error) {
+	return updateBodyHashes(dbWrap.writer, dbWrap.decrypt)
+}
+
+func (dbWrap *DB) GetFingerprints() ([]models.Fingerprint, error) {
+	return getFingerprints(dbWrap.reader)
+}
+
+func (dbWrap *DB) MergeDuplicates(keep string, duplicates []string) error {
+	return mergeDuplicates(dbWrap.writer, keep, duplicates, dbWrap.encrypt, dbWrap.decrypt, sqliteReindexer)
+}
+
+func (dbWrap *DB) SaveQuery(saved models.SavedQuery) error {
+	return saveQuery(dbWrap.writer, saved)
+}
+
+func (dbWrap *DB) GetSavedQueries() ([]models.SavedQuery, error) {
+	return getSavedQueries(dbWrap.reader)
+}
+
+func (dbWrap *DB) GetSavedQuery(name string) (*models.SavedQuery, error) {
+	return getSavedQuery(dbWrap.reader, name)
+}
+
+func (dbWrap *DB) DeleteSavedQuery(name string) (bool, error) {
+	return deleteSavedQuery(dbWrap.writer, name)
+}
+
+func (dbWrap *DB) CountEmails(sqlQuery string, params ...interface{}) (int, error) {
+	return countEmails(dbWrap.reader, sqlQuery, params...)
+}
+
+func (dbWrap *DB) StartSyncRun(run models.SyncRun) (int64, error) {
+	return startSyncRun(dbWrap.writer, &dbWrap.syncRuns, run)
+}
+
+func (dbWrap *DB) FinishSyncRun(run models.SyncRun) error {
+	return finishSyncRun(dbWrap.writer, &dbWrap.syncRuns, run)
+}
+
+func (dbWrap *DB) GetSyncRuns(limit int, failedOnly bool) ([]models.SyncRun, error) {
+	return getSyncRuns(dbWrap.reader, limit, failedOnly)
+}
+
+func (dbWrap *DB) ApplyRetention(deletions []models.RetentionDeletion, keepDeleted bool) error {
+	return applyRetention(dbWrap.writer, dbWrap.blobs, deletions, keepDeleted)
 }
 
+/*
+replaces the attachment_text_highlight and attachment_text_names columns selected by full text searches with
+matched_attachments, the names of the attachments with a highlighted match in their text. The texts are separated by
+form feeds in the index, in the same order as the names.
+*/
+func resolveMatchedAttachments(rowData map[string]interface{}) error {
+	highlight, ok := rowData["attachment_text_highlight"]
+	if !ok {
+		return nil
+	}
+	names := []string{}
+	if namesJson, ok := rowData["attachment_text_names"].(string); ok {
+		err := json.Unmarshal([]byte(namesJson), &names)
+		if err != nil {
+			return utils.JoinErrors("failed to unmarshal attachment names", err)
+		}
+	}
+	delete(rowData, "attachment_text_highlight")
+	delete(rowData, "attachment_text_names")
+	highlighted, ok := highlight.(string)
+	if !ok {
+		return nil
+	}
+
+	matched := []string{}
+	for index, text := range strings.Split(highlighted, "\f") {
+		if index < len(names) && strings.Contains(text, "\x02") {
+			matched = append(matched, names[index])
+		}
+	}
+	rowData["matched_attachments"] = utils.MustJSON(matched)
+	return nil
+}
+
+// indexes the emails that aren't indexed yet. AddEmails indexes new emails as it stores them, so this usually has nothing to do
 func (dbWrap *DB) UpdateFTS() error {
-	db, err := dbWrap.getDB()
+	// fts5 keeps a row per indexed email in its docsize shadow table
+	_, err := dbWrap.writer.Exec(fmt.Sprintf(`INSERT INTO email_fts (rowid, %[1]s)
+		SELECT email_rowid, %[1]s FROM email_fts_content WHERE email_rowid NOT IN (SELECT id FROM email_fts_docsize)`, ftsColumns))
+	return utils.JoinErrors("failed to update email_fts", err)
+}
+
+// an external content index has to be handed the indexed values to remove an email, so this has to run before they change
+func unindexEmail(tx *sqlx.Tx, ourId string) error {
+	_, err := tx.Exec(fmt.Sprintf(`INSERT INTO email_fts (email_fts, rowid, %[1]s)
+		SELECT 'delete', email_rowid, %[1]s FROM email_fts_content WHERE our_id = ? AND email_rowid IN (SELECT id FROM email_fts_docsize)`, ftsColumns), ourId)
+	return utils.JoinErrors(fmt.Sprintf("failed to remove %s from the full text index", ourId), err)
+}
+
+func (dbWrap *DB) ExtractAttachmentTexts() (int, error) {
+	decrypt := func(value string) (string, error) {
+		row := map[string]interface{}{"attachments": value}
+		err := dbWrap.decryptRow(row)
+		return row["attachments"].(string), err
+	}
+	return extractAttachmentTexts(dbWrap.writer, dbWrap.blobs, dbWrap.options, decrypt, func(ourId string, texts []models.AttachmentText) error {
+		tx, err := dbWrap.writer.Beginx()
+		if err != nil {
+			return utils.JoinErrors("failed to begin transaction", err)
+		}
+		defer tx.Rollback()
+
+		err = unindexEmail(tx, ourId)
+		if err != nil {
+			return err
+		}
+		for _, attachmentText := range texts {
+			text := attachmentText.Text
+			if text != "" {
+				text, err = dbWrap.encrypt(text)
+				if err != nil {
+					return utils.JoinErrors("failed to encrypt attachment text", err)
+				}
+			}
+			_, err = tx.Exec("INSERT INTO attachment_text (our_id, position, file_name, text) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING", ourId, attachmentText.Position, attachmentText.FileName, text)
+			if err != nil {
+				return utils.JoinErrors("failed to insert attachment text", err)
+			}
+		}
+		_, err = tx.Exec(indexEmailQuery, ourId)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to index %s", ourId), err)
+		}
+		return utils.JoinErrors("failed to commit transaction", tx.Commit())
+	})
+}
+
+// recreates the full text index from scratch, to recover from a corrupt index or to drop the tokens of encrypted values
+func (dbWrap *DB) RebuildFTS() error {
+	// searches keep using the old index until the new one is committed
+	tx, err := dbWrap.writer.Begin()
 	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
+		return utils.JoinErrors("failed to begin transaction", err)
 	}
+	defer tx.Rollback()
 
 	// the reason we drop and recreate the table is because whenever I tried deleting I got '[SQLITE_CORRUPT_VTAB] Content in the virtual table is corrupt (database disk image is malformed)
 
-	_, err = db.Exec("DROP TABLE IF EXISTS email_fts")
+	_, err = tx.Exec("DROP TABLE IF EXISTS email_fts")
 	if err != nil {
 		return utils.JoinErrors("failed to drop email_fts", err)
 	}
 
-	_, err = db.Exec("CREATE VIRTUAL TABLE email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, content=email)")
+	_, err = tx.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE email_fts USING fts5(%s, content=email_fts_content, content_rowid=email_rowid)", strings.Replace(ftsColumns, "our_id", "our_id unindexed", 1)))
 
 	if err != nil {
 		return utils.JoinErrors("failed to recreate email_fts", err)
 	}
 
-	_, err = db.Exec("INSERT INTO email_fts(our_id,text_content, subject, from_name_1, from_mailbox_1, from_host_1) SELECT our_id,text_content, subject, from_name_1, from_mailbox_1, from_host_1 FROM email")
+	_, err = tx.Exec("INSERT INTO email_fts (email_fts) VALUES ('rebuild')")
 	if err != nil {
 		return utils.JoinErrors("failed to insert into email_fts", err)
 	}
 
-	return nil
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
+
+func (dbWrap *DB) Backend() string {
+	return models.SQLiteBackend
 }
-func (dbWrap *DB) GetFrontendState() (string, error) {
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return "", utils.JoinErrors("failed to open db", err)
-	}
-	defer db.Close()
 
+func (dbWrap *DB) GetFrontendState() (string, error) {
 	var frontendState string
 
-	err = db.QueryRow("SELECT state FROM persisted_frontend_state").Scan(&frontendState)
+	err := dbWrap.reader.QueryRow("SELECT state FROM persisted_frontend_state").Scan(&frontendState)
 
 	if err != nil {
 		return "", utils.JoinErrors("failed to get frontend state", err)
@@ -669,17 +1116,17 @@ func (dbWrap *DB) GetFrontendState() (string, error) {
 }
 
 func (dbWrap *DB) SetFrontendState(state string) error {
-	db, err := dbWrap.getDB()
-	if err != nil {
-		return utils.JoinErrors("failed to open db", err)
-	}
-
-	_, err = db.Exec("INSERT INTO persisted_frontend_state(state,id) VALUES(?,'state_id') ON CONFLICT(id) DO UPDATE SET state = ?", state, state)
+	_, err := dbWrap.writer.Exec("INSERT INTO persisted_frontend_state(state,id) VALUES(?,'state_id') ON CONFLICT(id) DO UPDATE SET state = ?", state, state)
 
 	if err != nil {
 		return utils.JoinErrors("failed to set frontend state", err)
 	}
-
-	defer db.Close()
 	return nil
 }
+
+func (dbWrap *DB) GetRawMessage(ourId string) ([]byte, error) {
+	if dbWrap.blobs == nil {
+		return nil, nil
+	}
+	return dbWrap.blobs.Get(ourId)
+}
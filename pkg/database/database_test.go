@@ -0,0 +1,261 @@
+package database
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/options"
+	"github.com/skamensky/email-archiver/pkg/source"
+)
+
+const invoiceEml = `From: Acme Billing <billing@acme.com>
+To: Jane Doe <jane@example.com>
+Subject: Your invoice
+Date: Tue, 02 Jan 2024 10:00:00 +0000
+Message-ID: <invoice@acme.com>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="b"
+
+--b
+Content-Type: text/plain; charset=utf-8
+
+The invoice for December is attached.
+--b
+Content-Type: text/plain; charset=utf-8
+Content-Disposition: attachment; filename="december.txt"
+
+invoice number 42, due in 30 days
+--b--
+`
+
+const lunchEml = `From: Bob <bob@example.com>
+To: Jane Doe <jane@example.com>
+Subject: Lunch about the invoice
+Date: Wed, 03 Jan 2024 12:00:00 +0000
+Message-ID: <lunch@example.com>
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+
+Lunch tomorrow?
+`
+
+func crlf(content string) []byte {
+	return []byte(strings.ReplaceAll(content, "\n", "\r\n"))
+}
+
+// imports emls in order into the Imported mailbox, the way the import command does
+func importEmls(t *testing.T, db models.DB, opts models.Options, expectedAdded int, emls ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	for i, content := range emls {
+		err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.eml", i)), crlf(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	added, err := source.Import(db, source.NewEml(dir), "Imported", opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != expectedAdded {
+		t.Fatalf("imported %d emails, expected %d", added, expectedAdded)
+	}
+}
+
+// opens a new sqlite archive that is closed after the test
+func newTestDB(t *testing.T) (*DB, models.Options) {
+	t.Helper()
+	opts, err := options.New(map[string]string{"DB_PATH": filepath.Join(t.TempDir(), "test.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &DB{options: opts}
+	err = db.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.writer.Close()
+		db.reader.Close()
+	})
+	return db, opts
+}
+
+// no message-id, so two receipts sent in the same second have the same envelope
+const receiptEml = `From: Shop <noreply@shop.com>
+To: Jane Doe <jane@example.com>
+Subject: Your receipt
+Date: Thu, 04 Jan 2024 09:00:00 +0000
+Content-Type: text/plain; charset=utf-8
+
+%s
+`
+
+func TestAddEmailsCollision(t *testing.T) {
+	db, opts := newTestDB(t)
+	coffee := fmt.Sprintf(receiptEml, "1 coffee, 3 EUR")
+	cake := fmt.Sprintf(receiptEml, "1 cake, 4 EUR")
+	// the second coffee is a duplicate
+	importEmls(t, db, opts, 2, coffee, cake, coffee)
+
+	ourId := email.OurIdFromRaw(crlf(coffee))
+	cakeId := email.CollidingOurId(ourId, email.NewFromRaw(crlf(cake), nil, 0, time.Time{}, opts).GetBodyHash())
+	type row struct {
+		OurId        string `db:"our_id"`
+		Text         string `db:"text_content"`
+		ParseWarning string `db:"parse_warning"`
+	}
+	rows := []row{}
+	err := db.reader.Select(&rows, "SELECT our_id, text_content, parse_warning FROM email ORDER BY our_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []row{
+		{ourId, "1 coffee, 3 EUR", ""},
+		{cakeId, "1 cake, 4 EUR", fmt.Sprintf("has the same envelope as %s but a different body", ourId)},
+	}
+	for i := range rows {
+		rows[i].Text = strings.TrimSpace(rows[i].Text)
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("got %+v, expected %+v", rows, expected)
+	}
+
+	importEmls(t, db, opts, 0, coffee, cake)
+
+	// the same cake downloaded over imap joins the stored one
+	added, err := db.AddEmails("INBOX", []models.Email{email.NewFromRaw(crlf(cake), nil, 7, time.Time{}, opts)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 0 {
+		t.Errorf("added %d emails, expected 0", added)
+	}
+	uids, err := db.GetMailboxUids("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, map[string]uint32{cakeId: 7}) {
+		t.Errorf("got INBOX uids %v, expected %v", uids, map[string]uint32{cakeId: 7})
+	}
+}
+
+// only the name of a mailbox is needed to update its local state
+type namedMailbox struct {
+	models.Mailbox
+	name string
+}
+
+func (mailbox namedMailbox) Name() string {
+	return mailbox.name
+}
+
+func TestUpdateLocalMailboxStateTakeout(t *testing.T) {
+	tests := []struct {
+		keepDeleted bool
+		// uid 5 is gone from the server, takeout memberships never count
+		removed int
+		// uid and whether it's marked as removed
+		remaining map[uint32]bool
+	}{
+		{false, 1, map[uint32]bool{6: false}},
+		{true, 1, map[uint32]bool{5: true, 6: false}},
+	}
+	for _, test := range tests {
+		db, opts := newTestDB(t)
+		invoice := email.NewFromRaw(crlf(invoiceEml), nil, 5, time.Time{}, opts)
+		lunch := email.NewFromRaw(crlf(lunchEml), nil, 1, time.Time{}, opts)
+		_, err := db.AddEmails("INBOX", []models.Email{invoice})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.AddEmails("Imported", []models.Email{lunch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.AddMailboxMemberships("INBOX", map[string]uint32{lunch.GetOurID(): models.TakeoutUidFloor + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		removed, err := db.UpdateLocalMailboxState(namedMailbox{name: "INBOX"}, []uint32{6}, test.keepDeleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != test.removed {
+			t.Errorf("keepDeleted %v: removed %d, expected %d", test.keepDeleted, removed, test.removed)
+		}
+		rows := []struct {
+			Uid     uint32 `db:"uid"`
+			Removed bool   `db:"removed"`
+		}{}
+		err = db.reader.Select(&rows, "SELECT uid, removed_at IS NOT NULL AS removed FROM message_to_mailbox WHERE mailbox_name = 'INBOX'")
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining := map[uint32]bool{}
+		for _, row := range rows {
+			remaining[row.Uid] = row.Removed
+		}
+		if !reflect.DeepEqual(remaining, test.remaining) {
+			t.Errorf("keepDeleted %v: got %v, expected %v", test.keepDeleted, remaining, test.remaining)
+		}
+	}
+}
+
+/*
+starts runs through db and through other, which stands in for the next process using the same db. The runs db left
+running were interrupted as far as other knows, the ones it started itself are still going
+*/
+func checkSyncRunsInterrupted(t *testing.T, db models.DB, other models.DB) {
+	t.Helper()
+	start := func(db models.DB) int64 {
+		t.Helper()
+		id, err := db.StartSyncRun(models.SyncRun{StartedAt: time.Now().Unix(), Status: models.SyncRunRunning, Mailboxes: []models.SyncRunMailbox{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	killed := start(db)
+	start(db)
+	finished := start(db)
+	err := db.FinishSyncRun(models.SyncRun{Id: finished, FinishedAt: time.Now().Unix(), Status: models.SyncRunSucceeded, Mailboxes: []models.SyncRunMailbox{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start(other)
+	start(other)
+
+	runs, err := other.GetSyncRuns(10, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, run := range runs {
+		got = append(got, fmt.Sprintf("%d %s %s", run.Id-killed, run.Status, run.Error))
+	}
+	expected := []string{"4 running ", "3 running ", "2 succeeded ", "1 failed interrupted", "0 failed interrupted"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+func TestSyncRunsInterrupted(t *testing.T) {
+	db, opts := newTestDB(t)
+	other := &DB{options: opts}
+	err := other.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.writer.Close()
+	defer other.reader.Close()
+	checkSyncRunsInterrupted(t, db, other)
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"strings"
+	"time"
+)
+
+const bodyHashBatchSize = 500
+
+// hashes the emails stored before the body_hash column existed. decrypt is nil when bodies are never encrypted
+func updateBodyHashes(db *sqlx.DB, decrypt func(string) (string, error)) (int, error) {
+	type contents struct {
+		OurId       string         `db:"our_id"`
+		TextContent sql.NullString `db:"text_content"`
+		Attachments sql.NullString `db:"attachments"`
+	}
+	hashed := 0
+	for {
+		batch := []contents{}
+		err := db.Select(&batch, db.Rebind("SELECT our_id, text_content, attachments FROM email WHERE body_hash IS NULL ORDER BY our_id LIMIT ?"), bodyHashBatchSize)
+		if err != nil {
+			return hashed, utils.JoinErrors("failed to read emails", err)
+		}
+		if len(batch) == 0 {
+			return hashed, nil
+		}
+		tx, err := db.Beginx()
+		if err != nil {
+			return hashed, utils.JoinErrors("failed to begin transaction", err)
+		}
+		for _, row := range batch {
+			text := row.TextContent.String
+			attachmentsJson := row.Attachments.String
+			if decrypt != nil {
+				text, err = decrypt(text)
+				if err == nil {
+					attachmentsJson, err = decrypt(attachmentsJson)
+				}
+				if err != nil {
+					tx.Rollback()
+					return hashed, utils.JoinErrors(fmt.Sprintf("failed to decrypt email %s", row.OurId), err)
+				}
+			}
+			attachments := []models.AttachmentMetaData{}
+			if attachmentsJson != "" {
+				err = json.Unmarshal([]byte(attachmentsJson), &attachments)
+				if err != nil {
+					tx.Rollback()
+					return hashed, utils.JoinErrors(fmt.Sprintf("failed to unmarshal the attachments of %s", row.OurId), err)
+				}
+			}
+			bodyHash, simhash := email.Fingerprints(text, attachments)
+			_, err = tx.Exec(tx.Rebind("UPDATE email SET body_hash = ?, body_simhash = ? WHERE our_id = ?"), bodyHash, simhash, row.OurId)
+			if err != nil {
+				tx.Rollback()
+				return hashed, utils.JoinErrors(fmt.Sprintf("failed to store the body hash of %s", row.OurId), err)
+			}
+		}
+		err = tx.Commit()
+		if err != nil {
+			return hashed, utils.JoinErrors("failed to commit transaction", err)
+		}
+		hashed += len(batch)
+	}
+}
+
+func getFingerprints(db *sqlx.DB) ([]models.Fingerprint, error) {
+	rows := []struct {
+		models.Fingerprint
+		Mailboxes string `db:"mailboxes"`
+	}{}
+	err := db.Select(&rows, `SELECT our_id, body_hash, coalesce(body_simhash, '') AS body_simhash, coalesce(message_id, '') AS message_id,
+		coalesce(subject, '') AS subject, coalesce(date_epoch, 0) AS date_epoch, coalesce(mailboxes, '[]') AS mailboxes,
+		coalesce((SELECT address FROM email_address WHERE email_address.our_id = email.our_id AND role = 'from' ORDER BY position LIMIT 1), '') AS from_address
+		FROM email WHERE body_hash IS NOT NULL AND body_hash != '' ORDER BY our_id`)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get body hashes", err)
+	}
+	fingerprints := []models.Fingerprint{}
+	for _, row := range rows {
+		fingerprint := row.Fingerprint
+		fingerprint.Mailboxes = []string{}
+		err = json.Unmarshal([]byte(row.Mailboxes), &fingerprint.Mailboxes)
+		if err != nil {
+			return nil, utils.JoinErrors(fmt.Sprintf("failed to unmarshal the mailboxes of %s", row.OurId), err)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, nil
+}
+
+/*
+moves everything that isn't part of the message itself from the duplicates to keep, in a single transaction: the tags,
+the notes, which are appended to the note of keep, and the mailbox memberships, so that a sync doesn't download the
+duplicates again while they're still on the server.
+*/
+func mergeDuplicates(db *sqlx.DB, keep string, duplicates []string, encrypt func(string) (string, error), decrypt func(string) (string, error), reindex reindexer) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	ourIds := append([]string{keep}, duplicates...)
+	for _, ourId := range ourIds {
+		err = checkEmailExists(tx, ourId)
+		if err != nil {
+			return err
+		}
+		err = reindex.unindex(tx, ourId)
+		if err != nil {
+			return err
+		}
+	}
+
+	notes := []string{}
+	for _, ourId := range ourIds {
+		text := ""
+		err = tx.Get(&text, tx.Rebind("SELECT text FROM note WHERE our_id = ?"), ourId)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to get the note of %s", ourId), err)
+		}
+		if decrypt != nil {
+			text, err = decrypt(text)
+			if err != nil {
+				return utils.JoinErrors("failed to decrypt note", err)
+			}
+		}
+		if !utils.NewSet(notes).Contains(text) {
+			notes = append(notes, text)
+		}
+	}
+
+	for _, duplicate := range duplicates {
+		_, err = tx.Exec(tx.Rebind("INSERT INTO tag (our_id, name, created_at) SELECT ?, name, created_at FROM tag WHERE our_id = ? ON CONFLICT DO NOTHING"), keep, duplicate)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to move the tags of %s", duplicate), err)
+		}
+		for _, statement := range []string{"DELETE FROM tag WHERE our_id = ?", "DELETE FROM note WHERE our_id = ?"} {
+			_, err = tx.Exec(tx.Rebind(statement), duplicate)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to remove the tags and note of %s", duplicate), err)
+			}
+		}
+		_, err = tx.Exec(tx.Rebind("UPDATE message_to_mailbox SET our_id = ? WHERE our_id = ?"), keep, duplicate)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to move the mailboxes of %s", duplicate), err)
+		}
+	}
+
+	if len(notes) > 0 {
+		stored, err := encrypt(strings.Join(notes, "\n\n"))
+		if err != nil {
+			return utils.JoinErrors("failed to encrypt note", err)
+		}
+		now := time.Now().Unix()
+		_, err = tx.Exec(tx.Rebind(`INSERT INTO note (our_id, text, created_at, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (our_id) DO UPDATE SET text = excluded.text, updated_at = excluded.updated_at`), keep, stored, now, now)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to set the note of %s", keep), err)
+		}
+	}
+
+	for _, ourId := range ourIds {
+		err = reindex.index(tx, ourId)
+		if err != nil {
+			return err
+		}
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
@@ -0,0 +1,325 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/blobstore"
+	"github.com/skamensky/email-archiver/pkg/encryption"
+	"github.com/skamensky/email-archiver/pkg/utils"
+)
+
+// the columns holding message contents, everything else is left in plaintext so it can still be filtered on
+var encryptedColumns = []string{"text_content", "html_content", "attachments"}
+
+const encryptionBatchSize = 500
+
+/*
+sets up dbWrap.cipher from the key stored in the db and the configured passphrase or key file.
+A new, empty archive is encrypted as soon as a key is configured. Existing plaintext archives have to be encrypted
+explicitly with Rekey, so that a typo in the environment never leaves an archive half encrypted.
+*/
+func (dbWrap *DB) setupEncryption() error {
+	db := dbWrap.writer
+	keyMaterial, err := encryption.KeyMaterial(dbWrap.options.GetEncryptionPassphrase(), dbWrap.options.GetEncryptionKeyFile())
+	if err != nil {
+		return err
+	}
+
+	wrapped, err := getWrappedKey(db)
+	if err != nil {
+		return err
+	}
+
+	if wrapped == nil {
+		if keyMaterial == nil {
+			return nil
+		}
+		var hasEmails bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM email)").Scan(&hasEmails)
+		if err != nil {
+			return utils.JoinErrors("failed to check for existing emails", err)
+		}
+		if hasEmails {
+			return fmt.Errorf("%s is not encrypted yet. unset ENCRYPTION_PASSPHRASE and ENCRYPTION_KEY_FILE, run the rekey command to encrypt the existing emails, then set them again", dbWrap.options.GetDBPath())
+		}
+		dataKey, err := encryption.NewDataKey()
+		if err != nil {
+			return err
+		}
+		err = saveWrappedKey(db, dataKey, keyMaterial)
+		if err != nil {
+			return err
+		}
+		return dbWrap.useDataKey(dataKey)
+	}
+
+	if keyMaterial == nil {
+		return fmt.Errorf("%s is encrypted, set ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE", dbWrap.options.GetDBPath())
+	}
+	dataKey, err := encryption.Unwrap(*wrapped, keyMaterial)
+	if errors.Is(err, encryption.ErrWrongKey) {
+		return fmt.Errorf("failed to unlock %s: %w", dbWrap.options.GetDBPath(), err)
+	}
+	if err != nil {
+		return utils.JoinErrors("failed to unwrap data key", err)
+	}
+	return dbWrap.useDataKey(dataKey)
+}
+
+func (dbWrap *DB) useDataKey(dataKey []byte) error {
+	cipher, err := encryption.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+	dbWrap.dataKey = dataKey
+	dbWrap.cipher = cipher
+	if dbWrap.blobs != nil {
+		dbWrap.blobs = blobstore.New(dbWrap.blobs.Root(), cipher)
+	}
+	return nil
+}
+
+// returns nil if the archive is not encrypted
+func getWrappedKey(querier sqlx.Queryer) (*encryption.WrappedKey, error) {
+	var wrappedJson string
+	err := querier.QueryRowx("SELECT wrapped_key FROM encryption_key WHERE id = 'key_id'").Scan(&wrappedJson)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get encryption key", err)
+	}
+	wrapped := &encryption.WrappedKey{}
+	err = json.Unmarshal([]byte(wrappedJson), wrapped)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to unmarshal encryption key", err)
+	}
+	return wrapped, nil
+}
+
+func saveWrappedKey(execer sqlx.Execer, dataKey []byte, keyMaterial []byte) error {
+	wrapped, err := encryption.Wrap(dataKey, keyMaterial)
+	if err != nil {
+		return utils.JoinErrors("failed to wrap data key", err)
+	}
+	wrappedJson := utils.MustJSON(wrapped)
+	_, err = execer.Exec("INSERT INTO encryption_key(wrapped_key,id) VALUES(?,'key_id') ON CONFLICT(id) DO UPDATE SET wrapped_key = ?", wrappedJson, wrappedJson)
+	return utils.JoinErrors("failed to save encryption key", err)
+}
+
+// returns value unchanged if encryption is not enabled
+func (dbWrap *DB) encrypt(value string) (string, error) {
+	if dbWrap.cipher == nil {
+		return value, nil
+	}
+	return dbWrap.cipher.EncryptString(value)
+}
+
+// returns plaintext values unchanged
+func (dbWrap *DB) decrypt(value string) (string, error) {
+	if !encryption.IsEncryptedString(value) {
+		return value, nil
+	}
+	if dbWrap.cipher == nil {
+		return "", errors.New("the value is encrypted but no encryption key is configured")
+	}
+	return dbWrap.cipher.DecryptString(value)
+}
+
+// decrypts the encrypted columns of a row in place
+func (dbWrap *DB) decryptRow(rowData map[string]interface{}) error {
+	for _, column := range encryptedColumns {
+		value, ok := rowData[column].(string)
+		if !ok || !encryption.IsEncryptedString(value) {
+			continue
+		}
+		if dbWrap.cipher == nil {
+			return fmt.Errorf("%s is encrypted but no encryption key is configured", column)
+		}
+		decrypted, err := dbWrap.cipher.DecryptString(value)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to decrypt %s", column), err)
+		}
+		rowData[column] = decrypted
+	}
+	return nil
+}
+
+/*
+Rekey protects the archive with a new passphrase or key file.
+If the archive is already encrypted only the data key is re-wrapped, which is instant. Otherwise a data key is created
+and every existing email and blob is encrypted, after which the full text index is rebuilt and the db is vacuumed so no
+plaintext copies are left behind.
+*/
+func (dbWrap *DB) Rekey(newKeyMaterial []byte) error {
+	if len(newKeyMaterial) == 0 {
+		return errors.New("the new passphrase or key file is empty")
+	}
+	db := dbWrap.writer
+	if dbWrap.cipher != nil {
+		err := saveWrappedKey(db, dbWrap.dataKey, newKeyMaterial)
+		if err != nil {
+			return err
+		}
+		// picks up blobs left over from an interrupted rekey
+		return dbWrap.encryptBlobs()
+	}
+
+	dataKey, err := encryption.NewDataKey()
+	if err != nil {
+		return err
+	}
+	cipher, err := encryption.NewCipher(dataKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	type contents struct {
+		OurId       string         `db:"our_id"`
+		TextContent sql.NullString `db:"text_content"`
+		HTMLContent sql.NullString `db:"html_content"`
+		Attachments sql.NullString `db:"attachments"`
+	}
+	lastOurId := ""
+	for {
+		batch := []contents{}
+		err = tx.Select(&batch, "SELECT our_id, text_content, html_content, attachments FROM email WHERE our_id > ? ORDER BY our_id LIMIT ?", lastOurId, encryptionBatchSize)
+		if err != nil {
+			return utils.JoinErrors("failed to read emails", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, row := range batch {
+			for _, value := range []*sql.NullString{&row.TextContent, &row.HTMLContent, &row.Attachments} {
+				if !value.Valid {
+					continue
+				}
+				value.String, err = cipher.EncryptString(value.String)
+				if err != nil {
+					return utils.JoinErrors(fmt.Sprintf("failed to encrypt email %s", row.OurId), err)
+				}
+			}
+			_, err = tx.Exec("UPDATE email SET text_content = ?, html_content = ?, attachments = ? WHERE our_id = ?", row.TextContent, row.HTMLContent, row.Attachments, row.OurId)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to update email %s", row.OurId), err)
+			}
+		}
+		lastOurId = batch[len(batch)-1].OurId
+	}
+
+	err = encryptAttachmentTexts(tx, cipher)
+	if err != nil {
+		return err
+	}
+	// the stored options include the imap password
+	err = encryptTextColumn(tx, cipher, "option", "name", "value")
+	if err != nil {
+		return err
+	}
+	err = encryptTextColumn(tx, cipher, "note", "our_id", "text")
+	if err != nil {
+		return err
+	}
+
+	err = saveWrappedKey(tx, dataKey, newKeyMaterial)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.JoinErrors("failed to commit transaction", err)
+	}
+
+	err = dbWrap.useDataKey(dataKey)
+	if err != nil {
+		return err
+	}
+	err = dbWrap.encryptBlobs()
+	if err != nil {
+		return err
+	}
+
+	// the index holds the plaintext tokens of the bodies, and freed pages may still hold the old plaintext values
+	err = dbWrap.RebuildFTS()
+	if err != nil {
+		return utils.JoinErrors("failed to rebuild full text index", err)
+	}
+	_, err = db.Exec("VACUUM")
+	return utils.JoinErrors("failed to vacuum db", err)
+}
+
+// the text extracted from attachments is as sensitive as the attachments themselves
+func encryptAttachmentTexts(tx *sqlx.Tx, cipher *encryption.Cipher) error {
+	type attachmentText struct {
+		RowId int64  `db:"rowid"`
+		Text  string `db:"text"`
+	}
+	lastRowId := int64(0)
+	for {
+		batch := []attachmentText{}
+		err := tx.Select(&batch, "SELECT rowid, text FROM attachment_text WHERE rowid > ? AND text != '' ORDER BY rowid LIMIT ?", lastRowId, encryptionBatchSize)
+		if err != nil {
+			return utils.JoinErrors("failed to read attachment texts", err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		for _, row := range batch {
+			encrypted, err := cipher.EncryptString(row.Text)
+			if err != nil {
+				return utils.JoinErrors("failed to encrypt attachment text", err)
+			}
+			_, err = tx.Exec("UPDATE attachment_text SET text = ? WHERE rowid = ?", encrypted, row.RowId)
+			if err != nil {
+				return utils.JoinErrors("failed to update attachment text", err)
+			}
+		}
+		lastRowId = batch[len(batch)-1].RowId
+	}
+}
+
+// encrypts every value of a text column of a small table, keyed by keyColumn
+func encryptTextColumn(tx *sqlx.Tx, cipher *encryption.Cipher, table string, keyColumn string, column string) error {
+	type row struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	rows := []row{}
+	err := tx.Select(&rows, fmt.Sprintf("SELECT %s AS key, %s AS value FROM %s", keyColumn, column, table))
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to read %s", table), err)
+	}
+	for _, row := range rows {
+		encrypted, err := cipher.EncryptString(row.Value)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to encrypt %s", table), err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, column, keyColumn), encrypted, row.Key)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to update %s", table), err)
+		}
+	}
+	return nil
+}
+
+func (dbWrap *DB) encryptBlobs() error {
+	if dbWrap.blobs == nil {
+		return nil
+	}
+	encrypted, err := dbWrap.blobs.EncryptExisting()
+	if err != nil {
+		return utils.JoinErrors("failed to encrypt blobs", err)
+	}
+	utils.DebugPrintln("encrypted", encrypted, "blobs")
+	return nil
+}
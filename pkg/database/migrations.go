@@ -0,0 +1,614 @@
+package database
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"time"
+)
+
+/*
+Migration is one step of the schema history. Migrations are applied in order of Version, each in its own transaction
+together with its schema_version row, so a failed migration leaves the archive at the previous version.
+To change the schema, append a migration to sqliteMigrations and postgresMigrations, never edit an existing one.
+*/
+type Migration struct {
+	Version     int
+	Description string
+	Statements  []string
+}
+
+// arbitrary, but must be the same for every process migrating the same postgres db
+const postgresMigrationLockId = 7355608
+
+// version 1 is the schema that archives created before versioning already have, hence the IF NOT EXISTS
+var sqliteMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS email (
+				our_id text primary key,
+				parse_warning text,
+				parse_error text,
+				envelope text,
+				flags text,
+				mailboxes text,
+				text_content text,
+				html_content text,
+				attachments text,
+				message_id text,
+				date text,
+				subject text,
+				from_name_1 text,
+				from_mailbox_1 text,
+				from_host_1 text,
+				sender_name_1 text,
+				sender_mailbox_1 text,
+				sender_host_1 text,
+				reply_to_name_1 text,
+				reply_to_mailbox_1 text,
+				reply_to_host_1 text,
+				to_name_1 text,
+				to_mailbox_1 text,
+				to_host_1 text,
+				cc_name_1 text,
+				cc_mailbox_1 text,
+				cc_host_1 text,
+				bcc_name_1 text,
+				bcc_mailbox_1 text,
+				bcc_host_1 text,
+				in_reply_to text
+			)`,
+			"CREATE TABLE IF NOT EXISTS message_to_mailbox (mailbox_name text, our_id text, uid int, pending_sync integer, primary key (mailbox_name, uid))",
+			// index on email_id so our updates are faster
+			"CREATE INDEX IF NOT EXISTS our_id_index ON message_to_mailbox (our_id)",
+			// essentially a list of uids
+			"CREATE TABLE IF NOT EXISTS message_staging(uid int,mailbox_name text,primary key (mailbox_name, uid))",
+			"CREATE VIRTUAL TABLE IF NOT EXISTS email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, content=email)",
+			"CREATE TABLE IF NOT EXISTS persisted_frontend_state (state text, id text primary key default 'state_id')",
+			"CREATE TABLE IF NOT EXISTS mailbox (name text primary key,attributes text,last_synced int, num_emails int)",
+		},
+	},
+	{
+		Version:     2,
+		Description: "encryption key",
+		Statements: []string{
+			"CREATE TABLE IF NOT EXISTS encryption_key (wrapped_key text, id text primary key default 'key_id')",
+		},
+	},
+	{
+		Version:     3,
+		Description: "email_address table",
+		Statements: []string{
+			"CREATE TABLE email_address (our_id text, role text, position int, name text, mailbox text, host text, address text, primary key (our_id, role, position))",
+			"CREATE INDEX email_address_address_index ON email_address (address)",
+			"CREATE INDEX email_address_host_index ON email_address (host)",
+			// the envelope holds every address, so existing emails can be backfilled without downloading them again
+			`INSERT INTO email_address (our_id, role, position, name, mailbox, host, address)
+			SELECT our_id, role, position, name, mailbox, host, lower(CASE WHEN coalesce(host, '') = '' THEN coalesce(mailbox, '') ELSE coalesce(mailbox, '') || '@' || host END)
+			FROM (
+				SELECT
+					email.our_id AS our_id,
+					roles.role AS role,
+					addresses.key + 1 AS position,
+					json_extract(addresses.value, '$.PersonalName') AS name,
+					json_extract(addresses.value, '$.MailboxName') AS mailbox,
+					json_extract(addresses.value, '$.HostName') AS host
+				FROM email
+				JOIN (
+					SELECT 'from' AS role, '$.From' AS path UNION ALL
+					SELECT 'sender', '$.Sender' UNION ALL
+					SELECT 'reply_to', '$.ReplyTo' UNION ALL
+					SELECT 'to', '$.To' UNION ALL
+					SELECT 'cc', '$.Cc' UNION ALL
+					SELECT 'bcc', '$.Bcc'
+				) roles
+				JOIN json_each(email.envelope, roles.path) addresses
+				WHERE json_valid(email.envelope) AND addresses.type = 'object'
+			)`,
+			// the index reads the addresses through a view, since they aren't columns of the email table
+			`CREATE VIEW email_fts_content AS
+			SELECT
+				email.rowid AS email_rowid, our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1,
+				(SELECT group_concat(trim(coalesce(name, '') || ' ' || address), ' ') FROM email_address WHERE email_address.our_id = email.our_id) AS addresses
+			FROM email`,
+			"DROP TABLE IF EXISTS email_fts",
+			"CREATE VIRTUAL TABLE email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, content=email_fts_content, content_rowid=email_rowid)",
+			`INSERT INTO email_fts (rowid, our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses)
+			SELECT email_rowid, our_id, CASE WHEN text_content LIKE 'enc:v1:%' THEN NULL ELSE text_content END, subject, from_name_1, from_mailbox_1, from_host_1, addresses FROM email_fts_content`,
+		},
+	},
+	{
+		Version:     4,
+		Description: "header table",
+		Statements: []string{
+			"CREATE TABLE header (our_id text, position int, name text, value text, primary key (our_id, position))",
+			"CREATE INDEX header_name_index ON header (name)",
+		},
+	},
+	{
+		Version:     5,
+		Description: "epoch timestamps",
+		Statements: []string{
+			"ALTER TABLE email ADD COLUMN date_epoch integer",
+			"ALTER TABLE email ADD COLUMN date_offset integer",
+			"ALTER TABLE email ADD COLUMN internal_date_epoch integer",
+			// date holds time.Time.String(), e.g. "2020-04-18 00:25:36 +0200 CEST". Missing dates are "0001-01-01 ..."
+			`UPDATE email SET date_offset = (CASE substr(date, 21, 1) WHEN '-' THEN -1 ELSE 1 END) * (CAST(substr(date, 22, 2) AS integer) * 60 + CAST(substr(date, 24, 2) AS integer))
+			WHERE date GLOB '[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9] [0-9][0-9]:[0-9][0-9]:[0-9][0-9] [+-][0-9][0-9][0-9][0-9]*' AND substr(date, 1, 4) >= '1971'`,
+			"UPDATE email SET date_epoch = CAST(strftime('%s', substr(date, 1, 19)) AS integer) - date_offset * 60 WHERE date_offset IS NOT NULL",
+			"UPDATE email SET date_epoch = NULL, date_offset = NULL WHERE date_epoch > CAST(strftime('%s', 'now') AS integer) + 86400",
+			"CREATE INDEX email_date_epoch_index ON email (date_epoch)",
+			"CREATE INDEX email_internal_date_epoch_index ON email (internal_date_epoch)",
+		},
+	},
+	{
+		Version:     6,
+		Description: "threads",
+		Statements: []string{
+			"ALTER TABLE email ADD COLUMN message_references text",
+			"ALTER TABLE email ADD COLUMN gmail_thread_id text",
+			"ALTER TABLE email ADD COLUMN thread_id text",
+			"UPDATE email SET message_references = (SELECT value FROM header WHERE header.our_id = email.our_id AND header.name = 'references' ORDER BY position LIMIT 1)",
+			"UPDATE email SET gmail_thread_id = (SELECT trim(value) FROM header WHERE header.our_id = email.our_id AND header.name = 'x-gm-thrid' ORDER BY position LIMIT 1)",
+			"CREATE INDEX email_thread_id_index ON email (thread_id)",
+			"CREATE INDEX email_gmail_thread_id_index ON email (gmail_thread_id)",
+			// every message id seen in a thread, including those of referenced emails that aren't archived
+			"CREATE TABLE thread_message_id (message_id text primary key, thread_id text)",
+			"CREATE INDEX thread_message_id_thread_id_index ON thread_message_id (thread_id)",
+			"CREATE TABLE thread (thread_id text primary key, subject text, email_count integer, first_date_epoch integer, last_date_epoch integer)",
+			"CREATE INDEX thread_last_date_epoch_index ON thread (last_date_epoch)",
+		},
+	},
+	{
+		Version:     7,
+		Description: "retention log",
+		Statements: []string{
+			"CREATE TABLE retention_log (id integer primary key autoincrement, deleted_at integer, policy text, action text, our_id text, mailbox text, uid integer, message_id text, subject text, date_epoch integer)",
+			"CREATE INDEX retention_log_our_id_index ON retention_log (our_id)",
+		},
+	},
+	{
+		Version:     8,
+		Description: "incremental full text index",
+		Statements: []string{
+			"DROP TABLE IF EXISTS email_fts",
+			"DROP VIEW email_fts_content",
+			// encrypted values are left out here rather than when indexing, so that the rebuild and delete commands of
+			// fts5 see exactly what was indexed
+			`CREATE VIEW email_fts_content AS
+			SELECT
+				email.rowid AS email_rowid, our_id,
+				CASE WHEN text_content LIKE 'enc:v1:%' THEN NULL ELSE text_content END AS text_content,
+				subject, from_name_1, from_mailbox_1, from_host_1,
+				(SELECT group_concat(trim(coalesce(name, '') || ' ' || address), ' ') FROM email_address WHERE email_address.our_id = email.our_id) AS addresses,
+				(SELECT group_concat(name, ' ') FROM email_address WHERE email_address.our_id = email.our_id AND role = 'to' AND coalesce(name, '') != '') AS to_names,
+				(SELECT group_concat(name, ' ') FROM email_address WHERE email_address.our_id = email.our_id AND role = 'cc' AND coalesce(name, '') != '') AS cc_names,
+				-- fts5 can't read views that use table-valued functions like json_each, so the attachments are walked by position
+				CASE WHEN json_valid(attachments) THEN (
+					WITH RECURSIVE attachment(position) AS (SELECT 0 UNION ALL SELECT position + 1 FROM attachment WHERE position + 1 < json_array_length(email.attachments))
+					SELECT group_concat(json_extract(email.attachments, '$[' || position || '].FileName'), ' ') FROM attachment
+				) END AS attachment_names
+			FROM email`,
+			"CREATE VIRTUAL TABLE email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, content=email_fts_content, content_rowid=email_rowid)",
+			"INSERT INTO email_fts (email_fts) VALUES ('rebuild')",
+		},
+	},
+	{
+		Version:     9,
+		Description: "attachment text",
+		Statements: []string{
+			"CREATE TABLE attachment_text (our_id text, position int, file_name text, text text, primary key (our_id, position))",
+			"DROP TABLE email_fts",
+			"DROP VIEW email_fts_content",
+			// the texts are separated by form feeds, so the attachments a match is in can be told apart in its highlight
+			`CREATE VIEW email_fts_content AS
+			SELECT
+				email.rowid AS email_rowid, our_id,
+				CASE WHEN text_content LIKE 'enc:v1:%' THEN NULL ELSE text_content END AS text_content,
+				subject, from_name_1, from_mailbox_1, from_host_1,
+				(SELECT group_concat(trim(coalesce(name, '') || ' ' || address), ' ') FROM email_address WHERE email_address.our_id = email.our_id) AS addresses,
+				(SELECT group_concat(name, ' ') FROM email_address WHERE email_address.our_id = email.our_id AND role = 'to' AND coalesce(name, '') != '') AS to_names,
+				(SELECT group_concat(name, ' ') FROM email_address WHERE email_address.our_id = email.our_id AND role = 'cc' AND coalesce(name, '') != '') AS cc_names,
+				CASE WHEN json_valid(attachments) THEN (
+					WITH RECURSIVE attachment(position) AS (SELECT 0 UNION ALL SELECT position + 1 FROM attachment WHERE position + 1 < json_array_length(email.attachments))
+					SELECT group_concat(json_extract(email.attachments, '$[' || position || '].FileName'), ' ') FROM attachment
+				) END AS attachment_names,
+				(SELECT group_concat(text, char(12) ORDER BY position) FROM attachment_text WHERE attachment_text.our_id = email.our_id AND text != '' AND text NOT LIKE 'enc:v1:%') AS attachment_text
+			FROM email`,
+			"CREATE VIRTUAL TABLE email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, content=email_fts_content, content_rowid=email_rowid)",
+			"INSERT INTO email_fts (email_fts) VALUES ('rebuild')",
+		},
+	},
+	{
+		Version:     10,
+		Description: "saved queries",
+		Statements: []string{
+			"CREATE TABLE saved_query (name text primary key, kind text, query text, pinned integer, created_at integer, updated_at integer)",
+		},
+	},
+	{
+		Version:     11,
+		Description: "options",
+		Statements: []string{
+			"CREATE TABLE option (name text primary key, value text)",
+		},
+	},
+	{
+		Version:     12,
+		Description: "tags and notes",
+		Statements: []string{
+			"CREATE TABLE tag (our_id text, name text, created_at integer, primary key (our_id, name))",
+			"CREATE INDEX tag_name_index ON tag (name)",
+			"CREATE TABLE note (our_id text primary key, text text, created_at integer, updated_at integer)",
+			"DROP TABLE email_fts",
+			"DROP VIEW email_fts_content",
+			`CREATE VIEW email_fts_content AS
+			SELECT
+				email.rowid AS email_rowid, our_id,
+				CASE WHEN text_content LIKE 'enc:v1:%' THEN NULL ELSE text_content END AS text_content,
+				subject, from_name_1, from_mailbox_1, from_host_1,
+				(SELECT group_concat(trim(coalesce(name, '') || ' ' || address), ' ') FROM email_address WHERE email_address.our_id = email.our_id) AS addresses,
+				(SELECT group_concat(name, ' ') FROM email_address WHERE email_address.our_id = email.our_id AND role = 'to' AND coalesce(name, '') != '') AS to_names,
+				(SELECT group_concat(name, ' ') FROM email_address WHERE email_address.our_id = email.our_id AND role = 'cc' AND coalesce(name, '') != '') AS cc_names,
+				CASE WHEN json_valid(attachments) THEN (
+					WITH RECURSIVE attachment(position) AS (SELECT 0 UNION ALL SELECT position + 1 FROM attachment WHERE position + 1 < json_array_length(email.attachments))
+					SELECT group_concat(json_extract(email.attachments, '$[' || position || '].FileName'), ' ') FROM attachment
+				) END AS attachment_names,
+				(SELECT group_concat(text, char(12) ORDER BY position) FROM attachment_text WHERE attachment_text.our_id = email.our_id AND text != '' AND text NOT LIKE 'enc:v1:%') AS attachment_text,
+				(SELECT group_concat(name, ' ' ORDER BY name) FROM tag WHERE tag.our_id = email.our_id) AS tags,
+				(SELECT text FROM note WHERE note.our_id = email.our_id AND text NOT LIKE 'enc:v1:%') AS note
+			FROM email`,
+			"CREATE VIRTUAL TABLE email_fts USING fts5(our_id unindexed, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, tags, note, content=email_fts_content, content_rowid=email_rowid)",
+			"INSERT INTO email_fts (email_fts) VALUES ('rebuild')",
+		},
+	},
+	{
+		Version:     13,
+		Description: "body hashes",
+		Statements: []string{
+			// NULL until computed, existing emails are hashed by the dedupe command
+			"ALTER TABLE email ADD COLUMN body_hash text",
+			"ALTER TABLE email ADD COLUMN body_simhash text",
+			"CREATE INDEX email_body_hash_index ON email (body_hash)",
+		},
+	},
+	{
+		Version:     14,
+		Description: "sync runs",
+		Statements: []string{
+			// mailboxes is a json list of models.SyncRunMailbox, finished_at stays NULL for a run that was interrupted
+			"CREATE TABLE sync_run (id integer primary key autoincrement, started_at integer, finished_at integer, status text, mailboxes text, added integer, removed integer, bytes integer, warnings integer, error text)",
+			"CREATE INDEX sync_run_started_at_index ON sync_run (started_at)",
+		},
+	},
+	{
+		Version:     15,
+		Description: "tombstones for emails deleted on the server",
+		Statements: []string{
+			// set instead of deleting the row when KEEP_DELETED_EMAILS is on and the uid is gone from the server
+			"ALTER TABLE message_to_mailbox ADD COLUMN removed_at integer",
+			// set by AggregateFolders when every mailbox membership of the email is removed
+			"ALTER TABLE email ADD COLUMN deleted_on_server_at integer",
+		},
+	},
+	{
+		Version:     16,
+		Description: "form feeds in attachment texts",
+		Statements: []string{
+			// email_fts_content separates the attachment texts with form feeds, so they can't be part of a text.
+			// the affected emails are removed from the index before their texts change, and indexed again after
+			`INSERT INTO email_fts (email_fts, rowid, our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, tags, note)
+			SELECT 'delete', email_rowid, our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, tags, note FROM email_fts_content
+			WHERE email_rowid IN (SELECT id FROM email_fts_docsize) AND our_id IN (SELECT our_id FROM attachment_text WHERE instr(text, char(12)) > 0 AND text NOT LIKE 'enc:v1:%')`,
+			"UPDATE attachment_text SET text = replace(text, char(12), ' ') WHERE instr(text, char(12)) > 0 AND text NOT LIKE 'enc:v1:%'",
+			`INSERT INTO email_fts (rowid, our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, tags, note)
+			SELECT email_rowid, our_id, text_content, subject, from_name_1, from_mailbox_1, from_host_1, addresses, to_names, cc_names, attachment_names, attachment_text, tags, note FROM email_fts_content
+			WHERE email_rowid NOT IN (SELECT id FROM email_fts_docsize)`,
+		},
+	},
+}
+
+var postgresMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "initial schema",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS email (
+				our_id text primary key,
+				parse_warning text,
+				parse_error text,
+				envelope jsonb,
+				flags jsonb,
+				mailboxes jsonb,
+				text_content text,
+				html_content text,
+				attachments jsonb,
+				message_id text,
+				date text,
+				subject text,
+				from_name_1 text,
+				from_mailbox_1 text,
+				from_host_1 text,
+				sender_name_1 text,
+				sender_mailbox_1 text,
+				sender_host_1 text,
+				reply_to_name_1 text,
+				reply_to_mailbox_1 text,
+				reply_to_host_1 text,
+				to_name_1 text,
+				to_mailbox_1 text,
+				to_host_1 text,
+				cc_name_1 text,
+				cc_mailbox_1 text,
+				cc_host_1 text,
+				bcc_name_1 text,
+				bcc_mailbox_1 text,
+				bcc_host_1 text,
+				in_reply_to text
+			)`,
+			"CREATE TABLE IF NOT EXISTS message_to_mailbox (mailbox_name text, our_id text, uid bigint, pending_sync integer, primary key (mailbox_name, uid))",
+			"CREATE INDEX IF NOT EXISTS our_id_index ON message_to_mailbox (our_id)",
+			"CREATE TABLE IF NOT EXISTS message_staging (uid bigint, mailbox_name text, primary key (mailbox_name, uid))",
+			"CREATE TABLE IF NOT EXISTS email_fts (our_id text primary key references email (our_id) on delete cascade, document tsvector)",
+			"CREATE INDEX IF NOT EXISTS email_fts_document_index ON email_fts USING gin (document)",
+			"CREATE TABLE IF NOT EXISTS persisted_frontend_state (state text, id text primary key default 'state_id')",
+			"CREATE TABLE IF NOT EXISTS mailbox (name text primary key, attributes jsonb, last_synced bigint, num_emails int)",
+		},
+	},
+	{
+		Version:     2,
+		Description: "email_address table",
+		Statements: []string{
+			"CREATE TABLE email_address (our_id text references email (our_id) on delete cascade, role text, position int, name text, mailbox text, host text, address text, primary key (our_id, role, position))",
+			"CREATE INDEX email_address_address_index ON email_address (address)",
+			"CREATE INDEX email_address_host_index ON email_address (host)",
+			`INSERT INTO email_address (our_id, role, position, name, mailbox, host, address)
+			SELECT email.our_id, roles.role, addresses.position, addresses.value->>'PersonalName', addresses.value->>'MailboxName', addresses.value->>'HostName',
+				lower(coalesce(addresses.value->>'MailboxName', '') || CASE WHEN coalesce(addresses.value->>'HostName', '') = '' THEN '' ELSE '@' || (addresses.value->>'HostName') END)
+			FROM email
+			CROSS JOIN (VALUES ('from', 'From'), ('sender', 'Sender'), ('reply_to', 'ReplyTo'), ('to', 'To'), ('cc', 'Cc'), ('bcc', 'Bcc')) AS roles (role, field)
+			CROSS JOIN LATERAL jsonb_array_elements(CASE WHEN jsonb_typeof(email.envelope->roles.field) = 'array' THEN email.envelope->roles.field ELSE '[]'::jsonb END) WITH ORDINALITY AS addresses (value, position)
+			WHERE jsonb_typeof(addresses.value) = 'object'`,
+			// UpdateFTS only indexes emails without a document, so this makes it reindex everything with the addresses
+			"DELETE FROM email_fts",
+		},
+	},
+	{
+		Version:     3,
+		Description: "header table",
+		Statements: []string{
+			"CREATE TABLE header (our_id text references email (our_id) on delete cascade, position int, name text, value text, primary key (our_id, position))",
+			"CREATE INDEX header_name_index ON header (name)",
+		},
+	},
+	{
+		Version:     4,
+		Description: "epoch timestamps",
+		Statements: []string{
+			"ALTER TABLE email ADD COLUMN date_epoch bigint, ADD COLUMN date_offset integer, ADD COLUMN internal_date_epoch bigint",
+			`UPDATE email SET date_offset = (CASE substr(date, 21, 1) WHEN '-' THEN -1 ELSE 1 END) * (substr(date, 22, 2)::integer * 60 + substr(date, 24, 2)::integer)
+			WHERE date ~ '^[0-9]{4}-[0-9]{2}-[0-9]{2} [0-9]{2}:[0-9]{2}:[0-9]{2} [+-][0-9]{4}' AND substr(date, 1, 4) >= '1971'`,
+			"UPDATE email SET date_epoch = extract(epoch FROM substr(date, 1, 19)::timestamp)::bigint - date_offset * 60 WHERE date_offset IS NOT NULL",
+			"UPDATE email SET date_epoch = NULL, date_offset = NULL WHERE date_epoch > extract(epoch FROM now())::bigint + 86400",
+			"CREATE INDEX email_date_epoch_index ON email (date_epoch)",
+			"CREATE INDEX email_internal_date_epoch_index ON email (internal_date_epoch)",
+		},
+	},
+	{
+		Version:     5,
+		Description: "threads",
+		Statements: []string{
+			"ALTER TABLE email ADD COLUMN message_references text, ADD COLUMN gmail_thread_id text, ADD COLUMN thread_id text",
+			"UPDATE email SET message_references = (SELECT value FROM header WHERE header.our_id = email.our_id AND header.name = 'references' ORDER BY position LIMIT 1)",
+			"UPDATE email SET gmail_thread_id = (SELECT trim(value) FROM header WHERE header.our_id = email.our_id AND header.name = 'x-gm-thrid' ORDER BY position LIMIT 1)",
+			"CREATE INDEX email_thread_id_index ON email (thread_id)",
+			"CREATE INDEX email_gmail_thread_id_index ON email (gmail_thread_id)",
+			"CREATE TABLE thread_message_id (message_id text primary key, thread_id text)",
+			"CREATE INDEX thread_message_id_thread_id_index ON thread_message_id (thread_id)",
+			"CREATE TABLE thread (thread_id text primary key, subject text, email_count integer, first_date_epoch bigint, last_date_epoch bigint)",
+			"CREATE INDEX thread_last_date_epoch_index ON thread (last_date_epoch)",
+		},
+	},
+	{
+		Version:     6,
+		Description: "retention log",
+		Statements: []string{
+			"CREATE TABLE retention_log (id bigserial primary key, deleted_at bigint, policy text, action text, our_id text, mailbox text, uid bigint, message_id text, subject text, date_epoch bigint)",
+			"CREATE INDEX retention_log_our_id_index ON retention_log (our_id)",
+		},
+	},
+	{
+		Version:     7,
+		Description: "attachment names in the full text index",
+		Statements: []string{
+			// UpdateFTS only indexes emails without a document, so this makes it reindex everything with the attachment names
+			"DELETE FROM email_fts",
+		},
+	},
+	{
+		Version:     8,
+		Description: "attachment text",
+		Statements: []string{
+			"CREATE TABLE attachment_text (our_id text references email (our_id) on delete cascade, position int, file_name text, text text, primary key (our_id, position))",
+		},
+	},
+	{
+		Version:     9,
+		Description: "saved queries",
+		Statements: []string{
+			"CREATE TABLE saved_query (name text primary key, kind text, query text, pinned boolean, created_at bigint, updated_at bigint)",
+		},
+	},
+	{
+		Version:     10,
+		Description: "options",
+		Statements: []string{
+			"CREATE TABLE option (name text primary key, value text)",
+		},
+	},
+	{
+		Version:     11,
+		Description: "tags and notes",
+		Statements: []string{
+			"CREATE TABLE tag (our_id text references email (our_id) on delete cascade, name text, created_at bigint, primary key (our_id, name))",
+			"CREATE INDEX tag_name_index ON tag (name)",
+			"CREATE TABLE note (our_id text primary key references email (our_id) on delete cascade, text text, created_at bigint, updated_at bigint)",
+		},
+	},
+	{
+		Version:     12,
+		Description: "body hashes",
+		Statements: []string{
+			// NULL until computed, existing emails are hashed by the dedupe command
+			"ALTER TABLE email ADD COLUMN body_hash text, ADD COLUMN body_simhash text",
+			"CREATE INDEX email_body_hash_index ON email (body_hash)",
+		},
+	},
+	{
+		Version:     13,
+		Description: "sync runs",
+		Statements: []string{
+			// mailboxes is a json list of models.SyncRunMailbox, finished_at stays NULL for a run that was interrupted
+			"CREATE TABLE sync_run (id bigserial primary key, started_at bigint, finished_at bigint, status text, mailboxes jsonb, added bigint, removed bigint, bytes bigint, warnings bigint, error text)",
+			"CREATE INDEX sync_run_started_at_index ON sync_run (started_at)",
+		},
+	},
+	{
+		Version:     14,
+		Description: "tombstones for emails deleted on the server",
+		Statements: []string{
+			// set instead of deleting the row when KEEP_DELETED_EMAILS is on and the uid is gone from the server
+			"ALTER TABLE message_to_mailbox ADD COLUMN removed_at bigint",
+			// set by AggregateFolders when every mailbox membership of the email is removed
+			"ALTER TABLE email ADD COLUMN deleted_on_server_at bigint",
+		},
+	},
+}
+
+/*
+Migrate brings the archive described by options up to the latest schema version and returns the migrations it applied.
+With dryRun nothing is changed, the migrations that would be applied are returned instead.
+Migrations also run automatically when the db is opened, this is for inspecting or applying them explicitly.
+*/
+func Migrate(options models.Options, dryRun bool) ([]Migration, error) {
+	driver, dataSource, migrations := "sqlite3", options.GetDBPath(), sqliteMigrations
+	if options.GetDBBackend() == models.PostgresBackend {
+		driver, dataSource, migrations = "postgres", options.GetPostgresURL(), postgresMigrations
+	} else if _, err := os.Stat(dataSource); err != nil && dryRun {
+		// a new archive, don't create the file just to find out that everything is pending
+		return migrations, nil
+	}
+
+	db, err := sqlx.Connect(driver, dataSource)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to open db", err)
+	}
+	defer db.Close()
+	if dryRun {
+		version, err := schemaVersion(db)
+		if err != nil {
+			return nil, err
+		}
+		return pendingMigrations(migrations, version), nil
+	}
+	return applyMigrations(db, migrations)
+}
+
+func pendingMigrations(migrations []Migration, version int) []Migration {
+	pending := []Migration{}
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// returns 0 if no migration was ever applied
+func schemaVersion(querier sqlx.Queryer) (int, error) {
+	tableExistsQuery := "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'"
+	if isPostgres(querier) {
+		tableExistsQuery = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_version'"
+	}
+	tables := 0
+	err := sqlx.Get(querier, &tables, tableExistsQuery)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to check for the schema_version table", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	version := 0
+	err = sqlx.Get(querier, &version, "SELECT COALESCE(MAX(version), 0) FROM schema_version")
+	return version, utils.JoinErrors("failed to get schema version", err)
+}
+
+func isPostgres(querier sqlx.Queryer) bool {
+	switch typed := querier.(type) {
+	case *sqlx.DB:
+		return typed.DriverName() == "postgres"
+	case *sqlx.Tx:
+		return typed.DriverName() == "postgres"
+	}
+	return false
+}
+
+func applyMigrations(db *sqlx.DB, migrations []Migration) ([]Migration, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version integer primary key, description text, applied_at bigint)")
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create schema_version table", err)
+	}
+
+	applied := []Migration{}
+	for _, migration := range migrations {
+		ran, err := applyMigration(db, migration)
+		if err != nil {
+			return applied, utils.JoinErrors(fmt.Sprintf("failed to apply migration %d (%s)", migration.Version, migration.Description), err)
+		}
+		if ran {
+			utils.DebugPrintln("applied migration", migration.Version, migration.Description)
+			applied = append(applied, migration)
+		}
+	}
+	return applied, nil
+}
+
+// returns false if the migration had already been applied, e.g. by another process
+func applyMigration(db *sqlx.DB, migration Migration) (bool, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return false, utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	if isPostgres(tx) {
+		// serializes processes that start at the same time, released on commit
+		_, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", postgresMigrationLockId)
+		if err != nil {
+			return false, utils.JoinErrors("failed to lock schema_version", err)
+		}
+	}
+	version, err := schemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if version >= migration.Version {
+		return false, nil
+	}
+
+	for _, statement := range migration.Statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return false, utils.JoinErrors(fmt.Sprintf("failed to execute %q", statement), err)
+		}
+	}
+	_, err = tx.Exec(tx.Rebind("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)"), migration.Version, migration.Description, time.Now().UTC().Unix())
+	if err != nil {
+		return false, utils.JoinErrors("failed to record schema version", err)
+	}
+	return true, utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
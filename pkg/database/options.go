@@ -0,0 +1,59 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/utils"
+)
+
+/*
+reads the stored options the same way for sqlite and postgres. decrypt is nil when the values are never encrypted, the
+sqlite backend encrypts them since the imap password is one of them.
+*/
+func getOptions(db *sqlx.DB, decrypt func(string) (string, error)) (map[string]string, error) {
+	type option struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}
+	rows := []option{}
+	err := db.Select(&rows, "SELECT name, value FROM option")
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get options", err)
+	}
+	options := map[string]string{}
+	for _, row := range rows {
+		if decrypt != nil {
+			row.Value, err = decrypt(row.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		options[row.Name] = row.Value
+	}
+	return options, nil
+}
+
+func setOptions(db *sqlx.DB, options map[string]string, encrypt func(string) (string, error)) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+	for name, value := range options {
+		if value == "" {
+			_, err = tx.Exec(tx.Rebind("DELETE FROM option WHERE name = ?"), name)
+			if err != nil {
+				return utils.JoinErrors("failed to delete option", err)
+			}
+			continue
+		}
+		value, err = encrypt(value)
+		if err != nil {
+			return utils.JoinErrors("failed to encrypt option", err)
+		}
+		_, err = tx.Exec(tx.Rebind("INSERT INTO option (name, value) VALUES (?, ?) ON CONFLICT (name) DO UPDATE SET value = excluded.value"), name, value)
+		if err != nil {
+			return utils.JoinErrors("failed to set option", err)
+		}
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
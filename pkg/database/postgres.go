@@ -0,0 +1,801 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/skamensky/email-archiver/pkg/blobstore"
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/query"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"strings"
+	"time"
+)
+
+/*
+PostgresDB stores the archive in postgres so that a team can share it.
+The schema mirrors the sqlite one, except that json columns are jsonb and full text search uses a tsvector table
+instead of fts5.
+*/
+type PostgresDB struct {
+	options  models.Options
+	db       *sqlx.DB
+	blobs    *blobstore.Store
+	syncRuns liveSyncRuns
+}
+
+const postgresTextSearchConfig = models.PostgresTextSearchConfig
+
+// the same markup the sqlite backend's highlight() produces, with single quotes since ts_headline options are double quoted
+const postgresHighlightOptions = `StartSel="<span class='bg-yellow-200 text-black'>", StopSel=</span>, HighlightAll=true`
+
+// tsvectors are limited to 1MB, so only the start of very long bodies is indexed
+const postgresMaxIndexedChars = 200000
+
+func newPostgres(options models.Options) (*PostgresDB, error) {
+	if options.GetEncryptionPassphrase() != "" || options.GetEncryptionKeyFile() != "" {
+		return nil, errors.New("encryption at rest is only supported by the sqlite backend, use the disk encryption of the postgres server instead")
+	}
+	db, err := openPostgres(options.GetPostgresURL())
+	if err != nil {
+		return nil, err
+	}
+	pgWrap := &PostgresDB{options: options, db: db}
+	if options.GetBlobStorePath() != "" {
+		pgWrap.blobs = blobstore.New(options.GetBlobStorePath(), nil)
+	}
+	return pgWrap, nil
+}
+
+// connects and applies any pending migrations
+func openPostgres(url string) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to connect to postgres", err)
+	}
+	_, err = applyMigrations(db, postgresMigrations)
+	if err != nil {
+		db.Close()
+		return nil, utils.JoinErrors("failed to migrate postgres schema", err)
+	}
+	return db, nil
+}
+
+// postgres rejects NUL characters and invalid utf-8 in text columns, both of which show up in real world mail
+func pgText(value string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(value, "\x00", ""), "�")
+}
+
+// jsonb rejects \u0000, which json.Marshal produces for NUL characters
+func pgJSON(value string) string {
+	if !strings.Contains(value, `\u0000`) {
+		return value
+	}
+	builder := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			builder.WriteByte(value[i])
+			continue
+		}
+		if strings.HasPrefix(value[i:], `\u0000`) {
+			i += len(`\u0000`) - 1
+			continue
+		}
+		// copy the escape as a whole so an escaped backslash isn't mistaken for the start of another escape
+		builder.WriteString(value[i : i+2])
+		i++
+	}
+	return builder.String()
+}
+
+// lib/pq returns jsonb and some other types as []byte, the email package expects strings
+func normalizePostgresRow(rowData map[string]interface{}) {
+	for column, value := range rowData {
+		if asBytes, ok := value.([]byte); ok {
+			rowData[column] = string(asBytes)
+		}
+	}
+}
+
+func (pgWrap *PostgresDB) SaveMailboxRecord(mailbox models.MailboxRecord) error {
+	now := time.Now().UTC().Unix()
+	attributesAsJson, err := json.Marshal(mailbox.Attributes)
+	if err != nil {
+		return utils.JoinErrors("failed to marshal attributes", err)
+	}
+
+	_, err = pgWrap.db.Exec("INSERT INTO mailbox (name,attributes,last_synced) VALUES ($1, $2, $3) ON CONFLICT(name) DO UPDATE SET attributes = excluded.attributes, last_synced = excluded.last_synced", pgText(mailbox.Name), pgJSON(string(attributesAsJson)), now)
+	return utils.JoinErrors("failed to insert mailbox record", err)
+}
+
+func (pgWrap *PostgresDB) GetAllMailboxRecords() ([]models.MailboxRecord, error) {
+	rows, err := pgWrap.db.Query("SELECT name, attributes, last_synced, num_emails FROM mailbox")
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get all mailbox records", err)
+	}
+	defer rows.Close()
+
+	var records []models.MailboxRecord
+	for rows.Next() {
+		var name string
+		var attributes sql.NullString
+		var lastSynced sql.NullInt64
+		var numEmails sql.NullInt64
+		err = rows.Scan(&name, &attributes, &lastSynced, &numEmails)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to scan mailbox record", err)
+		}
+
+		attributesAsList := []string{}
+		if attributes.Valid {
+			err = json.Unmarshal([]byte(attributes.String), &attributesAsList)
+			if err != nil {
+				return nil, utils.JoinErrors("failed to unmarshal attributes", err)
+			}
+		}
+
+		records = append(records, models.MailboxRecord{
+			Name:       name,
+			Attributes: attributesAsList,
+			LastSynced: lastSynced.Int64,
+			NumEmails:  int(numEmails.Int64),
+		})
+	}
+	return records, utils.JoinErrors("failed to get all mailbox records", rows.Err())
+}
+
+func (pgWrap *PostgresDB) AddEmails(mailbox string, emails []models.Email) (int, error) {
+	tx, err := pgWrap.db.Beginx()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	insertEmailStmnt, err := tx.Prepare(`INSERT INTO email (our_id,parse_warning ,parse_error ,envelope ,flags ,text_content ,html_content ,attachments ,message_id ,date ,subject ,from_name_1 ,from_mailbox_1 ,from_host_1 ,sender_name_1 ,sender_mailbox_1 ,sender_host_1 ,reply_to_name_1 ,reply_to_mailbox_1 ,reply_to_host_1 ,to_name_1 ,to_mailbox_1 ,to_host_1 ,cc_name_1 ,cc_mailbox_1 ,cc_host_1 ,bcc_name_1 ,bcc_mailbox_1 ,bcc_host_1 ,in_reply_to ,date_epoch ,date_offset ,internal_date_epoch ,message_references ,gmail_thread_id ,body_hash ,body_simhash )
+		VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27,$28,$29,$30,$31,$32,$33,$34,$35,$36,$37)
+		ON CONFLICT (our_id) DO NOTHING
+	`)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertEmailStmnt.Close()
+
+	insertFolderStmnt, err := tx.Prepare(`
+		INSERT INTO message_to_mailbox (mailbox_name, our_id, uid, pending_sync)
+		VALUES ($1, $2, $3, 0)
+		ON CONFLICT (mailbox_name, uid) DO UPDATE SET our_id = excluded.our_id, pending_sync = 0
+	`)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertFolderStmnt.Close()
+
+	insertAddressStmnt, err := tx.Prepare("INSERT INTO email_address (our_id, role, position, name, mailbox, host, address) VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT DO NOTHING")
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertAddressStmnt.Close()
+
+	insertHeaderStmnt, err := tx.Prepare("INSERT INTO header (our_id, position, name, value) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING")
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertHeaderStmnt.Close()
+
+	insertAttachmentTextStmnt, err := tx.Prepare("INSERT INTO attachment_text (our_id, position, file_name, text) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING")
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertAttachmentTextStmnt.Close()
+
+	added := 0
+	raws := map[string][]byte{}
+	for _, mail := range emails {
+		ourId, parseWarning, err := collisionFreeOurId(tx, mail)
+		if err != nil {
+			return 0, err
+		}
+		inserted, err := insertEmailStmnt.Exec(pgText(ourId), pgText(parseWarning), pgText(mail.GetParseError()), pgJSON(utils.MustJSON(mail.GetEnvelope())), pgJSON(utils.MustJSON(mail.GetFlags())), pgText(mail.GetTextContent()), pgText(mail.GetHTMLContent()), pgJSON(utils.MustJSON(mail.GetAttachments())), pgText(mail.GetMessageId()), pgText(mail.GetDate()), pgText(mail.GetSubject()), pgText(mail.GetFromName1()), pgText(mail.GetFromMailbox1()), pgText(mail.GetFromHost1()), pgText(mail.GetSenderName1()), pgText(mail.GetSenderMailbox1()), pgText(mail.GetSenderHost1()), pgText(mail.GetReplyToName1()), pgText(mail.GetReplyToMailbox1()), pgText(mail.GetReplyToHost1()), pgText(mail.GetToName1()), pgText(mail.GetToMailbox1()), pgText(mail.GetToHost1()), pgText(mail.GetCcName1()), pgText(mail.GetCcMailbox1()), pgText(mail.GetCcHost1()), pgText(mail.GetBccName1()), pgText(mail.GetBccMailbox1()), pgText(mail.GetBccHost1()), pgText(mail.GetInReplyTo()), epochOrNull(mail.GetDateEpoch()), dateOffsetOrNull(mail), epochOrNull(mail.GetInternalDateEpoch()), pgText(mail.GetReferences()), pgText(mail.GetGmailThreadId()), pgText(mail.GetBodyHash()), pgText(mail.GetBodySimhash()))
+		if err != nil {
+			return 0, utils.JoinErrors(fmt.Sprintf("failed to insert email %s", ourId), err)
+		}
+		isNew, err := inserted.RowsAffected()
+		if err != nil {
+			return 0, utils.JoinErrors(fmt.Sprintf("failed to insert email %s", ourId), err)
+		}
+		added += int(isNew)
+		_, err = insertFolderStmnt.Exec(pgText(mailbox), pgText(ourId), mail.GetUID())
+		if err != nil {
+			return 0, utils.JoinErrors("failed to insert folder", err)
+		}
+		for _, address := range mail.GetAddresses() {
+			_, err = insertAddressStmnt.Exec(pgText(ourId), address.Role, address.Position, pgText(address.Name), pgText(address.Mailbox), pgText(address.Host), pgText(address.Address))
+			if err != nil {
+				return 0, utils.JoinErrors("failed to insert address", err)
+			}
+		}
+		for _, header := range mail.GetHeaders() {
+			_, err = insertHeaderStmnt.Exec(pgText(ourId), header.Position, pgText(header.Name), pgText(header.Value))
+			if err != nil {
+				return 0, utils.JoinErrors("failed to insert header", err)
+			}
+		}
+		for _, attachmentText := range mail.GetAttachmentTexts() {
+			_, err = insertAttachmentTextStmnt.Exec(pgText(ourId), attachmentText.Position, pgText(attachmentText.FileName), pgText(attachmentText.Text))
+			if err != nil {
+				return 0, utils.JoinErrors("failed to insert attachment text", err)
+			}
+		}
+		if pgWrap.blobs != nil && mail.GetRaw() != nil {
+			raws[ourId] = mail.GetRaw()
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to commit transaction", err)
+	}
+	// only once the emails are stored, a failed commit shouldn't leave blobs of emails that don't exist behind
+	for ourId, raw := range raws {
+		err = pgWrap.blobs.Put(ourId, raw)
+		if err != nil {
+			return 0, utils.JoinErrors("failed to store raw message", err)
+		}
+	}
+	return added, nil
+}
+
+func (pgWrap *PostgresDB) ReplaceEmail(mail models.Email) error {
+	tx, err := pgWrap.db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	ourId := mail.GetOurID()
+	err = checkEmailExists(tx, ourId)
+	if err != nil {
+		return err
+	}
+	err = postgresReindexer.unindex(tx, ourId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE email SET parse_warning = $1, parse_error = $2, text_content = $3, html_content = $4, attachments = $5, body_hash = $6, body_simhash = $7 WHERE our_id = $8",
+		pgText(mail.GetParseWarning()), pgText(mail.GetParseError()), pgText(mail.GetTextContent()), pgText(mail.GetHTMLContent()), pgJSON(utils.MustJSON(mail.GetAttachments())), pgText(mail.GetBodyHash()), pgText(mail.GetBodySimhash()), ourId)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to update email %s", ourId), err)
+	}
+	for _, table := range []string{"header", "attachment_text"} {
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE our_id = $1", table), ourId)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to remove the old rows of %s from %s", ourId, table), err)
+		}
+	}
+	for _, header := range mail.GetHeaders() {
+		_, err = tx.Exec("INSERT INTO header (our_id, position, name, value) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING", ourId, header.Position, pgText(header.Name), pgText(header.Value))
+		if err != nil {
+			return utils.JoinErrors("failed to insert header", err)
+		}
+	}
+	for _, attachmentText := range mail.GetAttachmentTexts() {
+		_, err = tx.Exec("INSERT INTO attachment_text (our_id, position, file_name, text) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING", ourId, attachmentText.Position, pgText(attachmentText.FileName), pgText(attachmentText.Text))
+		if err != nil {
+			return utils.JoinErrors("failed to insert attachment text", err)
+		}
+	}
+	err = postgresReindexer.index(tx, ourId)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.JoinErrors("failed to commit transaction", err)
+	}
+	if pgWrap.blobs != nil && mail.GetRaw() != nil {
+		return utils.JoinErrors("failed to store raw message", pgWrap.blobs.Put(ourId, mail.GetRaw()))
+	}
+	return nil
+}
+
+func (pgWrap *PostgresDB) AddMailboxMemberships(mailbox string, ourIdToUid map[string]uint32) error {
+	tx, err := pgWrap.db.Begin()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	insertFolderStmnt, err := tx.Prepare(`
+		INSERT INTO message_to_mailbox (mailbox_name, our_id, uid, pending_sync)
+		VALUES ($1, $2, $3, 0)
+		ON CONFLICT (mailbox_name, uid) DO UPDATE SET our_id = excluded.our_id, pending_sync = 0
+	`)
+	if err != nil {
+		return utils.JoinErrors("failed to prepare insert statement", err)
+	}
+	defer insertFolderStmnt.Close()
+
+	for ourId, uid := range ourIdToUid {
+		_, err = insertFolderStmnt.Exec(pgText(mailbox), pgText(ourId), uid)
+		if err != nil {
+			return utils.JoinErrors("failed to insert folder", err)
+		}
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
+
+func (pgWrap *PostgresDB) AggregateFolders() error {
+	_, err := pgWrap.db.Exec(`
+		UPDATE mailbox
+		SET num_emails = (
+		SELECT COUNT(*)
+		FROM message_to_mailbox
+		WHERE message_to_mailbox.mailbox_name = mailbox.name AND removed_at IS NULL
+		)
+	`)
+	if err != nil {
+		return utils.JoinErrors("failed to update mailbox table", err)
+	}
+
+	now := time.Now().Unix()
+	_, err = pgWrap.db.Exec(pgWrap.db.Rebind(updateDeletedOnServerQuery), now, now)
+	if err != nil {
+		return utils.JoinErrors("failed to update deleted emails", err)
+	}
+
+	_, err = pgWrap.db.Exec(fmt.Sprintf(`
+		UPDATE email
+		SET mailboxes = subtable.mailboxes
+		FROM
+			(
+				SELECT jsonb_agg(mailbox_name ORDER BY mailbox_name) mailboxes, our_id
+				FROM message_to_mailbox
+				WHERE our_id IS NOT NULL AND %s
+				GROUP BY our_id
+			) subtable
+		WHERE email.our_id = subtable.our_id
+	`, query.CurrentMembershipCondition))
+	if err != nil {
+		return utils.JoinErrors("failed to update email table", err)
+	}
+
+	_, err = pgWrap.db.Exec(`UPDATE email SET mailboxes = '[]'::jsonb
+		WHERE mailboxes IS DISTINCT FROM '[]'::jsonb AND NOT EXISTS (SELECT 1 FROM message_to_mailbox WHERE message_to_mailbox.our_id = email.our_id)`)
+	return utils.JoinErrors("failed to clear the mailboxes of emails that are in none", err)
+}
+
+func (pgWrap *PostgresDB) GetMessagesPendingSync(mailbox models.Mailbox) ([]uint32, error) {
+	pendingUIDs := []uint32{}
+	err := pgWrap.db.Select(&pendingUIDs, "SELECT uid FROM message_to_mailbox WHERE pending_sync = 1 AND mailbox_name = $1 AND removed_at IS NULL", mailbox.Name())
+	return pendingUIDs, utils.JoinErrors("failed to get messages pending sync", err)
+}
+
+func (pgWrap *PostgresDB) GetMailboxUids(mailbox string) (map[string]uint32, error) {
+	rows, err := pgWrap.db.Query("SELECT our_id, uid FROM message_to_mailbox WHERE mailbox_name = $1 AND our_id IS NOT NULL AND removed_at IS NULL", mailbox)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get mailbox uids", err)
+	}
+	defer rows.Close()
+	ourIdToUid := map[string]uint32{}
+	for rows.Next() {
+		var ourId string
+		var uid uint32
+		err = rows.Scan(&ourId, &uid)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to scan row", err)
+		}
+		ourIdToUid[ourId] = uid
+	}
+	return ourIdToUid, utils.JoinErrors("failed to get mailbox uids", rows.Err())
+}
+
+// same semantics as the sqlite version, but in a single transaction and with COPY for the staging table
+func (pgWrap *PostgresDB) UpdateLocalMailboxState(mailbox models.Mailbox, allUids []uint32, keepDeleted bool) (int, error) {
+	tx, err := pgWrap.db.Begin()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM message_staging WHERE mailbox_name = $1", mailbox.Name())
+	if err != nil {
+		return 0, utils.JoinErrors("failed to truncate message_staging", err)
+	}
+
+	copyStmt, err := tx.Prepare(pq.CopyIn("message_staging", "uid", "mailbox_name"))
+	if err != nil {
+		return 0, utils.JoinErrors("failed to prepare copy into message_staging", err)
+	}
+	for _, uid := range allUids {
+		_, err = copyStmt.Exec(uid, mailbox.Name())
+		if err != nil {
+			copyStmt.Close()
+			return 0, utils.JoinErrors("failed to copy uid", err)
+		}
+	}
+	_, err = copyStmt.Exec()
+	if err != nil {
+		copyStmt.Close()
+		return 0, utils.JoinErrors("failed to flush copy into message_staging", err)
+	}
+	err = copyStmt.Close()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to close copy into message_staging", err)
+	}
+
+	// the made up uids of a takeout import were never on the server, see removeOrphanedEmailsFromMailbox
+	_, err = tx.Exec("DELETE FROM message_to_mailbox WHERE mailbox_name = $1 AND uid >= $2", mailbox.Name(), models.TakeoutUidFloor)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to remove takeout uids", err)
+	}
+
+	orphaned := `mailbox_name = $1 AND removed_at IS NULL AND NOT EXISTS (
+		SELECT 1 FROM message_staging WHERE message_staging.mailbox_name = $1 AND message_staging.uid = message_to_mailbox.uid
+	)`
+	tombstoned := int64(0)
+	if keepDeleted {
+		result, err := tx.Exec("UPDATE message_to_mailbox SET removed_at = $2 WHERE our_id IS NOT NULL AND "+orphaned, mailbox.Name(), time.Now().Unix())
+		if err != nil {
+			return 0, utils.JoinErrors("failed to mark orphaned emails as removed using staging", err)
+		}
+		tombstoned, err = result.RowsAffected()
+		if err != nil {
+			return 0, utils.JoinErrors("failed to count orphaned emails", err)
+		}
+		// uids that were never downloaded have nothing to remember
+		orphaned += " AND our_id IS NULL"
+	}
+
+	// after this runs, message_to_mailbox will only contain uids that are not in the mailbox if they're marked as removed.
+	result, err := tx.Exec("DELETE FROM message_to_mailbox WHERE "+orphaned, mailbox.Name())
+	if err != nil {
+		return 0, utils.JoinErrors("failed to remove orphaned emails using staging", err)
+	}
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to count orphaned emails", err)
+	}
+
+	// if the email is already in the db, the last value of pending_sync is preserved (usually 0).
+	// a removed uid that is back on the server is downloaded again, since the server may have reused it for another email
+	_, err = tx.Exec(`INSERT INTO message_to_mailbox (mailbox_name, uid, pending_sync) SELECT mailbox_name, uid, 1 FROM message_staging WHERE mailbox_name = $1
+		ON CONFLICT (mailbox_name, uid) DO UPDATE SET removed_at = NULL, pending_sync = 1 WHERE message_to_mailbox.removed_at IS NOT NULL`, mailbox.Name())
+	if err != nil {
+		return 0, utils.JoinErrors("failed to add missing emails", err)
+	}
+
+	return int(tombstoned + removed), utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
+
+func (pgWrap *PostgresDB) GetEmails(sqlQuery string, params ...interface{}) ([]models.Email, error) {
+	emails := []models.Email{}
+	err := pgWrap.StreamEmails(func(mail models.Email) error {
+		emails = append(emails, mail)
+		return nil
+	}, sqlQuery, params...)
+	if err != nil {
+		return nil, err
+	}
+	return emails, nil
+}
+
+/*
+queries built by the rest of the code base use ? placeholders, they are rebound to $1, $2... for postgres.
+Hand written queries without parameters are passed through untouched, so that a literal ? in them survives.
+*/
+func (pgWrap *PostgresDB) StreamEmails(handle func(models.Email) error, sqlQuery string, params ...interface{}) error {
+	if len(params) > 0 {
+		sqlQuery = pgWrap.db.Rebind(sqlQuery)
+	}
+	utils.DebugPrintln(fmt.Sprintf("executing query: %s", sqlQuery))
+
+	rows, err := pgWrap.db.Queryx(sqlQuery, params...)
+	if err != nil {
+		return utils.JoinErrors("failed to execute query", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		rowData := make(map[string]interface{})
+		err = rows.MapScan(rowData)
+		if err != nil {
+			return utils.JoinErrors("failed to scan row", err)
+		}
+		normalizePostgresRow(rowData)
+		mail, err := email.NewFromRowData(rowData)
+		if err != nil {
+			return utils.JoinErrors("failed to create email from db record", err)
+		}
+		err = handle(mail)
+		if err != nil {
+			return err
+		}
+	}
+	return utils.JoinErrors("failed to iterate over query results", rows.Err())
+}
+
+/*
+indexes the emails that aren't indexed yet. emails that change after they were indexed don't wait for this: ReplaceEmail,
+tags, notes and MergeDuplicates replace their email_fts row through postgresReindexer in the same transaction, and
+ExtractAttachmentTexts removes the row so that the next call indexes the email again
+*/
+func (pgWrap *PostgresDB) UpdateFTS() error {
+	_, err := pgWrap.db.Exec(postgresIndexStatement())
+	return utils.JoinErrors("failed to update email_fts", err)
+}
+
+func (pgWrap *PostgresDB) ExtractAttachmentTexts() (int, error) {
+	extracted, err := extractAttachmentTexts(pgWrap.db, pgWrap.blobs, pgWrap.options, nil, func(ourId string, texts []models.AttachmentText) error {
+		tx, err := pgWrap.db.Begin()
+		if err != nil {
+			return utils.JoinErrors("failed to begin transaction", err)
+		}
+		defer tx.Rollback()
+		for _, attachmentText := range texts {
+			_, err = tx.Exec("INSERT INTO attachment_text (our_id, position, file_name, text) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING", pgText(ourId), attachmentText.Position, pgText(attachmentText.FileName), pgText(attachmentText.Text))
+			if err != nil {
+				return utils.JoinErrors("failed to insert attachment text", err)
+			}
+		}
+		// UpdateFTS indexes it again
+		_, err = tx.Exec("DELETE FROM email_fts WHERE our_id = $1", pgText(ourId))
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to remove %s from the full text index", ourId), err)
+		}
+		return utils.JoinErrors("failed to commit transaction", tx.Commit())
+	})
+	if err != nil {
+		return extracted, err
+	}
+	return extracted, pgWrap.UpdateFTS()
+}
+
+// reindexes every email, e.g. after the indexed fields changed
+func (pgWrap *PostgresDB) RebuildFTS() error {
+	tx, err := pgWrap.db.Begin()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("DELETE FROM email_fts")
+	if err != nil {
+		return utils.JoinErrors("failed to clear email_fts", err)
+	}
+	_, err = tx.Exec(postgresIndexStatement())
+	if err != nil {
+		return utils.JoinErrors("failed to update email_fts", err)
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
+
+func postgresIndexStatement() string {
+	return fmt.Sprintf(`
+		INSERT INTO email_fts (our_id, document)
+		SELECT
+			our_id,
+			setweight(to_tsvector('%[1]s', coalesce(subject, '')), 'A') ||
+			setweight(to_tsvector('%[1]s', concat_ws(' ', from_name_1, from_mailbox_1, from_host_1)), 'B') ||
+			setweight(to_tsvector('%[1]s', coalesce((SELECT string_agg(concat_ws(' ', name, address), ' ') FROM email_address WHERE email_address.our_id = email.our_id), '')), 'C') ||
+			setweight(to_tsvector('%[1]s', coalesce((SELECT string_agg(attachment->>'FileName', ' ') FROM jsonb_array_elements(CASE WHEN jsonb_typeof(attachments) = 'array' THEN attachments ELSE '[]'::jsonb END) attachment), '')), 'C') ||
+			to_tsvector('%[1]s', left(coalesce(text_content, ''), %[2]d)) ||
+			to_tsvector('%[1]s', left(coalesce((SELECT string_agg(text, ' ') FROM attachment_text WHERE attachment_text.our_id = email.our_id), ''), %[2]d)) ||
+			setweight(to_tsvector('%[1]s', coalesce((SELECT string_agg(name, ' ') FROM tag WHERE tag.our_id = email.our_id), '')), 'B') ||
+			to_tsvector('%[1]s', coalesce((SELECT text FROM note WHERE note.our_id = email.our_id), ''))
+		FROM email
+		WHERE NOT EXISTS (SELECT 1 FROM email_fts WHERE email_fts.our_id = email.our_id)
+	`, postgresTextSearchConfig, postgresMaxIndexedChars)
+}
+
+func (pgWrap *PostgresDB) UpdateThreads() error {
+	return updateThreads(pgWrap.db)
+}
+
+func (pgWrap *PostgresDB) GetThreads(limit int, offset int) ([]models.Thread, error) {
+	return getThreads(pgWrap.db, limit, offset)
+}
+
+func (pgWrap *PostgresDB) GetOptions() (map[string]string, error) {
+	return getOptions(pgWrap.db, nil)
+}
+
+func (pgWrap *PostgresDB) SetOptions(options map[string]string) error {
+	// the postgres backend has no encryption at rest
+	return setOptions(pgWrap.db, options, func(value string) (string, error) { return value, nil })
+}
+
+func (pgWrap *PostgresDB) GetThreadEmailIds(threadId string) ([]string, error) {
+	return getThreadEmailIds(pgWrap.db, threadId)
+}
+
+// the email_fts row of an email has to be replaced whenever its content, tags or note change
+var postgresReindexer = reindexer{
+	unindex: func(tx *sqlx.Tx, ourId string) error {
+		_, err := tx.Exec("DELETE FROM email_fts WHERE our_id = $1", ourId)
+		return utils.JoinErrors(fmt.Sprintf("failed to remove %s from the full text index", ourId), err)
+	},
+	index: func(tx *sqlx.Tx, ourId string) error {
+		_, err := tx.Exec(postgresIndexStatement()+" AND email.our_id = $1", ourId)
+		return utils.JoinErrors(fmt.Sprintf("failed to index %s", ourId), err)
+	},
+}
+
+func (pgWrap *PostgresDB) AddTags(ourIds []string, tags []string) error {
+	return addTags(pgWrap.db, ourIds, tags, postgresReindexer)
+}
+
+func (pgWrap *PostgresDB) RemoveTags(ourIds []string, tags []string) (int, error) {
+	return removeTags(pgWrap.db, ourIds, tags, postgresReindexer)
+}
+
+func (pgWrap *PostgresDB) GetTags() ([]models.Tag, error) {
+	return getTags(pgWrap.db)
+}
+
+func (pgWrap *PostgresDB) SetNote(ourId string, text string) error {
+	// the postgres backend has no encryption at rest
+	return setNote(pgWrap.db, ourId, pgText(text), func(value string) (string, error) { return value, nil }, postgresReindexer)
+}
+
+func (pgWrap *PostgresDB) GetAnnotations(ourIds []string) (map[string]models.Annotations, error) {
+	return getAnnotations(pgWrap.db, ourIds, nil)
+}
+
+func (pgWrap *PostgresDB) GetMailboxMemberships(mailbox string) ([]models.MailboxMembership, error) {
+	return getMailboxMemberships(pgWrap.db, mailbox)
+}
+
+func (pgWrap *PostgresDB) MarkPendingSync(mailbox string, uids []uint32) error {
+	return markPendingSync(pgWrap.db, mailbox, uids)
+}
+
+func (pgWrap *PostgresDB) UpdateBodyHashes() (int, error) {
+	return updateBodyHashes(pgWrap.db, nil)
+}
+
+func (pgWrap *PostgresDB) GetFingerprints() ([]models.Fingerprint, error) {
+	return getFingerprints(pgWrap.db)
+}
+
+func (pgWrap *PostgresDB) MergeDuplicates(keep string, duplicates []string) error {
+	return mergeDuplicates(pgWrap.db, keep, duplicates, func(value string) (string, error) { return value, nil }, nil, postgresReindexer)
+}
+
+func (pgWrap *PostgresDB) SaveQuery(saved models.SavedQuery) error {
+	return saveQuery(pgWrap.db, saved)
+}
+
+func (pgWrap *PostgresDB) GetSavedQueries() ([]models.SavedQuery, error) {
+	return getSavedQueries(pgWrap.db)
+}
+
+func (pgWrap *PostgresDB) GetSavedQuery(name string) (*models.SavedQuery, error) {
+	return getSavedQuery(pgWrap.db, name)
+}
+
+func (pgWrap *PostgresDB) DeleteSavedQuery(name string) (bool, error) {
+	return deleteSavedQuery(pgWrap.db, name)
+}
+
+func (pgWrap *PostgresDB) CountEmails(sqlQuery string, params ...interface{}) (int, error) {
+	return countEmails(pgWrap.db, sqlQuery, params...)
+}
+
+func (pgWrap *PostgresDB) StartSyncRun(run models.SyncRun) (int64, error) {
+	return startSyncRun(pgWrap.db, &pgWrap.syncRuns, run)
+}
+
+func (pgWrap *PostgresDB) FinishSyncRun(run models.SyncRun) error {
+	return finishSyncRun(pgWrap.db, &pgWrap.syncRuns, run)
+}
+
+func (pgWrap *PostgresDB) GetSyncRuns(limit int, failedOnly bool) ([]models.SyncRun, error) {
+	return getSyncRuns(pgWrap.db, limit, failedOnly)
+}
+
+func (pgWrap *PostgresDB) ApplyRetention(deletions []models.RetentionDeletion, keepDeleted bool) error {
+	return applyRetention(pgWrap.db, pgWrap.blobs, deletions, keepDeleted)
+}
+
+func (pgWrap *PostgresDB) FullTextSearch(highlight string, condition string, params ...interface{}) ([]models.Email, error) {
+	if highlight == "" {
+		return pgWrap.GetEmails(fmt.Sprintf("SELECT * FROM email WHERE %s ORDER BY coalesce(date_epoch, 0) DESC", condition), params...)
+	}
+	sqlQuery, err := pgWrap.fullTextSearchQuery(condition)
+	if err != nil {
+		return nil, err
+	}
+	highlighted, err := pgWrap.GetEmails(sqlQuery, append([]interface{}{highlight, postgresHighlightOptions}, params...)...)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := pgWrap.GetEmails(fmt.Sprintf("SELECT * FROM email WHERE (%s) AND our_id NOT IN (SELECT our_id FROM email_fts WHERE document @@ websearch_to_tsquery('%s', ?))", condition, postgresTextSearchConfig),
+		append(append([]interface{}{}, params...), highlight)...)
+	if err != nil {
+		return nil, err
+	}
+	return newestFirst(append(highlighted, rest...)), nil
+}
+
+func (pgWrap *PostgresDB) StreamFullTextSearch(searchTerm string, handle func(models.Email) error) error {
+	sqlQuery, err := pgWrap.fullTextSearchQuery("")
+	if err != nil {
+		return err
+	}
+	return pgWrap.StreamEmails(handle, sqlQuery, searchTerm, postgresHighlightOptions)
+}
+
+/*
+the search term uses websearch_to_tsquery syntax (e.g. `invoice -draft "due date"`), not fts5's.
+Like the sqlite version, the searched fields are returned with the matches highlighted. The parameters are the search
+term, the highlight options and the ones of condition, an optional extra condition on the email table.
+*/
+func (pgWrap *PostgresDB) fullTextSearchQuery(condition string) (string, error) {
+	allEmailColumns := []string{}
+	err := pgWrap.db.Select(&allEmailColumns, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'email' ORDER BY ordinal_position")
+	if err != nil {
+		return "", utils.JoinErrors("failed to get email table columns", err)
+	}
+	highlighted := utils.NewSet([]string{"text_content", "subject", "from_name_1", "from_mailbox_1", "from_host_1"})
+
+	columns := []string{}
+	for _, column := range allEmailColumns {
+		if highlighted.Contains(column) {
+			columns = append(columns, fmt.Sprintf("ts_headline('%s', coalesce(email.%s, ''), query, highlight.options) AS %s", postgresTextSearchConfig, column, column))
+		} else {
+			columns = append(columns, fmt.Sprintf("email.%s AS %s", column, column))
+		}
+	}
+	columns = append(columns, fmt.Sprintf(`(SELECT json_agg(file_name ORDER BY position) FROM attachment_text
+		WHERE attachment_text.our_id = email.our_id AND to_tsvector('%s', left(text, %d)) @@ query) AS matched_attachments`, postgresTextSearchConfig, postgresMaxIndexedChars))
+
+	where := "email_fts.document @@ query"
+	if condition != "" {
+		// the subquery keeps the columns of the condition from being ambiguous between email and email_fts
+		where += fmt.Sprintf(" AND email.our_id IN (SELECT our_id FROM email WHERE %s)", condition)
+	}
+	// the highlight options are used by every ts_headline call, so they are selected once, in the order of the placeholders
+	sqlQuery := fmt.Sprintf(`
+		SELECT
+			%s
+		FROM email_fts
+		JOIN email ON email.our_id = email_fts.our_id,
+		websearch_to_tsquery('%s', ?) query,
+		(SELECT CAST(? AS text) AS options) highlight
+		WHERE %s
+		ORDER BY ts_rank(email_fts.document, query) DESC
+		`, strings.Join(columns, ",\n\t\t\t"), postgresTextSearchConfig, where)
+	return sqlQuery, nil
+}
+
+func (pgWrap *PostgresDB) Backend() string {
+	return models.PostgresBackend
+}
+
+func (pgWrap *PostgresDB) GetFrontendState() (string, error) {
+	var frontendState string
+	err := pgWrap.db.QueryRow("SELECT state FROM persisted_frontend_state").Scan(&frontendState)
+	if err != nil {
+		return "", utils.JoinErrors("failed to get frontend state", err)
+	}
+	return frontendState, nil
+}
+
+func (pgWrap *PostgresDB) SetFrontendState(state string) error {
+	_, err := pgWrap.db.Exec("INSERT INTO persisted_frontend_state(state,id) VALUES($1,'state_id') ON CONFLICT(id) DO UPDATE SET state = excluded.state", pgText(state))
+	return utils.JoinErrors("failed to set frontend state", err)
+}
+
+func (pgWrap *PostgresDB) GetRawMessage(ourId string) ([]byte, error) {
+	if pgWrap.blobs == nil {
+		return nil, nil
+	}
+	return pgWrap.blobs.Get(ourId)
+}
+
+func (pgWrap *PostgresDB) Rekey(newKeyMaterial []byte) error {
+	return errors.New("encryption at rest is only supported by the sqlite backend")
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/options"
+	"github.com/skamensky/email-archiver/pkg/query"
+)
+
+// creates a schema that is dropped after the test and returns a url that uses it
+func postgresTestSchema(t *testing.T, postgresUrl string) string {
+	t.Helper()
+	parsed, err := url.Parse(postgresUrl)
+	if err != nil {
+		t.Fatalf("POSTGRES_URL must be a url: %v", err)
+	}
+	db, err := sqlx.Connect("postgres", postgresUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fmt.Sprintf("email_archiver_test_%d", time.Now().UnixNano())
+	_, err = db.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		defer db.Close()
+		_, err := db.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	values := parsed.Query()
+	values.Set("search_path", schema)
+	parsed.RawQuery = values.Encode()
+	return parsed.String()
+}
+
+/*
+runs what a team moving to postgres does against a real server: migrate-db, import, search and retention.
+POSTGRES_URL must be a url of a database the test may create schemas in, the test is skipped without it.
+*/
+func TestPostgres(t *testing.T) {
+	postgresUrl := os.Getenv("POSTGRES_URL")
+	if postgresUrl == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+	postgresUrl = postgresTestSchema(t, postgresUrl)
+	dir := t.TempDir()
+	sqlitePath := filepath.Join(dir, "test.db")
+	opts, err := options.New(map[string]string{"DB_PATH": sqlitePath, "DB_BACKEND": "postgres", "POSTGRES_URL": postgresUrl})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// migrate-db
+	sqliteDB := &DB{options: opts}
+	err = sqliteDB.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	importEmls(t, sqliteDB, opts, 1, invoiceEml)
+	sqliteDB.writer.Close()
+	sqliteDB.reader.Close()
+	err = CopySQLiteToPostgres(sqlitePath, postgresUrl, func(string, int) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// import
+	pgWrap, err := newPostgres(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgWrap.db.Close()
+	importEmls(t, pgWrap, opts, 1, lunchEml)
+
+	// sync history
+	otherPgWrap, err := newPostgres(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherPgWrap.db.Close()
+	checkSyncRunsInterrupted(t, pgWrap, otherPgWrap)
+
+	type result struct {
+		Subject            string
+		Highlighted        bool
+		MatchedAttachments []string
+	}
+	search := func(searchQuery string) []result {
+		t.Helper()
+		condition, params, err := query.Compile(searchQuery, models.PostgresBackend, time.Now())
+		if err != nil {
+			t.Fatalf("%q: %v", searchQuery, err)
+		}
+		highlight, err := query.Highlight(searchQuery, models.PostgresBackend)
+		if err != nil {
+			t.Fatalf("%q: %v", searchQuery, err)
+		}
+		emails, err := pgWrap.FullTextSearch(highlight, condition, params...)
+		if err != nil {
+			t.Fatalf("%q: %v", searchQuery, err)
+		}
+		results := []result{}
+		for _, mail := range emails {
+			results = append(results, result{
+				Subject:            strings.NewReplacer(`<span class='bg-yellow-200 text-black'>`, "", "</span>", "").Replace(mail.GetSubject()),
+				Highlighted:        strings.Contains(mail.GetTextContent(), "<span"),
+				MatchedAttachments: mail.GetMatchedAttachments(),
+			})
+		}
+		return results
+	}
+
+	tests := []struct {
+		query    string
+		expected []result
+	}{
+		{"invoice", []result{{"Lunch about the invoice", false, nil}, {"Your invoice", true, []string{"december.txt"}}}},
+		{`"due in 30 days"`, []result{{"Your invoice", false, []string{"december.txt"}}}},
+		{"from:bob OR december", []result{{"Lunch about the invoice", false, nil}, {"Your invoice", true, nil}}},
+		{"invoice -from:acme.com", []result{{"Lunch about the invoice", false, nil}}},
+	}
+	for _, test := range tests {
+		got := search(test.query)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q: got %+v, expected %+v", test.query, got, test.expected)
+		}
+	}
+
+	// retention apply
+	invoiceId := email.OurIdFromRaw(crlf(invoiceEml))
+	err = pgWrap.ApplyRetention([]models.RetentionDeletion{{Policy: "old invoices", Action: "purge_local", OurId: invoiceId}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := search("invoice")
+	expected := []result{{"Lunch about the invoice", false, nil}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("after the purge got %+v, expected %+v", got, expected)
+	}
+	logged := 0
+	err = pgWrap.db.Get(&logged, "SELECT COUNT(*) FROM retention_log WHERE our_id = $1", invoiceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged != 1 {
+		t.Errorf("logged %d deletions, expected 1", logged)
+	}
+	uids, err := pgWrap.GetMailboxUids("Imported")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the purged email keeps its membership so that a sync doesn't download it again
+	if len(uids) != 2 {
+		t.Errorf("got uids %v, expected 2", uids)
+	}
+}
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/blobstore"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"time"
+)
+
+/*
+logs the deletions of retention policies in retention_log, the same way for sqlite and postgres.
+delete_remote deletions are already gone from the server, only their mailbox membership is forgotten so the email itself
+stays archived. With keepDeleted the membership is marked as removed instead, like a sync with KEEP_DELETED_EMAILS does. purge_local deletions remove the email with its addresses, headers, attachment texts, tags, note and blob, but keep its mailbox
+memberships so that a sync doesn't download it again while it's still on the server.
+*/
+func applyRetention(db *sqlx.DB, blobs *blobstore.Store, deletions []models.RetentionDeletion, keepDeleted bool) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	deletedAt := time.Now().Unix()
+	purged := []string{}
+	threadIds := utils.NewSet([]string{})
+	for i := range deletions {
+		deletion := &deletions[i]
+		deletion.DeletedAt = deletedAt
+		switch deletion.Action {
+		case "delete_remote":
+			if keepDeleted {
+				_, err = tx.Exec(tx.Rebind("UPDATE message_to_mailbox SET removed_at = ? WHERE mailbox_name = ? AND uid = ?"), deletedAt, deletion.Mailbox, deletion.Uid)
+			} else {
+				_, err = tx.Exec(tx.Rebind("DELETE FROM message_to_mailbox WHERE mailbox_name = ? AND uid = ?"), deletion.Mailbox, deletion.Uid)
+			}
+			if err != nil {
+				return utils.JoinErrors("failed to remove mailbox membership", err)
+			}
+		case "purge_local":
+			found := []string{}
+			err = tx.Select(&found, tx.Rebind("SELECT thread_id FROM email WHERE our_id = ? AND thread_id IS NOT NULL"), deletion.OurId)
+			if err != nil {
+				return utils.JoinErrors("failed to get thread", err)
+			}
+			for _, threadId := range found {
+				threadIds.Add(threadId)
+			}
+			if !isPostgres(tx) {
+				err = unindexEmail(tx, deletion.OurId)
+				if err != nil {
+					return err
+				}
+			}
+			for _, table := range []string{"email_address", "header", "attachment_text", "tag", "note", "email"} {
+				_, err = tx.Exec(tx.Rebind(fmt.Sprintf("DELETE FROM %s WHERE our_id = ?", table)), deletion.OurId)
+				if err != nil {
+					return utils.JoinErrors(fmt.Sprintf("failed to purge %s from %s", deletion.OurId, table), err)
+				}
+			}
+			purged = append(purged, deletion.OurId)
+		default:
+			return fmt.Errorf("unknown retention action %q", deletion.Action)
+		}
+		_, err = tx.NamedExec(`INSERT INTO retention_log (deleted_at, policy, action, our_id, mailbox, uid, message_id, subject, date_epoch)
+			VALUES (:deleted_at, :policy, :action, :our_id, :mailbox, :uid, :message_id, :subject, :date_epoch)`, deletion)
+		if err != nil {
+			return utils.JoinErrors("failed to log deletion", err)
+		}
+	}
+
+	err = refreshThreads(tx, threadIds.ToSlice())
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.JoinErrors("failed to commit transaction", err)
+	}
+
+	if blobs == nil {
+		return nil
+	}
+	for _, ourId := range purged {
+		err = blobs.Delete(ourId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/query"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"strings"
+	"time"
+)
+
+func validateSavedQuery(db *sqlx.DB, saved models.SavedQuery) error {
+	if strings.TrimSpace(saved.Name) == "" {
+		return errors.New("a saved query needs a name")
+	}
+	if strings.TrimSpace(saved.Query) == "" {
+		return fmt.Errorf("saved query %q: the query is empty", saved.Name)
+	}
+	switch saved.Kind {
+	case models.SavedQuerySQL:
+		// preparing compiles the query without running it, wrapped the way it's counted so that only queries selecting rows pass
+		statement, err := db.Preparex(fmt.Sprintf("SELECT count(*) FROM (%s) counted", strings.TrimSuffix(strings.TrimSpace(saved.Query), ";")))
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("saved query %q is not a valid sql query", saved.Name), err)
+		}
+		return statement.Close()
+	case models.SavedQuerySearch:
+		// syntax errors are caught when saving rather than every time the smart folder is counted
+		_, err := query.Parse(saved.Query)
+		return err
+	}
+	return fmt.Errorf("saved query %q: kind must be %q or %q", saved.Name, models.SavedQuerySQL, models.SavedQuerySearch)
+}
+
+// saves the query the same way for sqlite and postgres, the creation time of a replaced query is kept
+func saveQuery(db *sqlx.DB, saved models.SavedQuery) error {
+	err := validateSavedQuery(db, saved)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	_, err = db.Exec(db.Rebind(`INSERT INTO saved_query (name, kind, query, pinned, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET kind = excluded.kind, query = excluded.query, pinned = excluded.pinned, updated_at = excluded.updated_at`),
+		saved.Name, saved.Kind, saved.Query, saved.Pinned, now, now)
+	return utils.JoinErrors(fmt.Sprintf("failed to save query %q", saved.Name), err)
+}
+
+func getSavedQueries(db *sqlx.DB) ([]models.SavedQuery, error) {
+	saved := []models.SavedQuery{}
+	err := db.Select(&saved, "SELECT name, kind, query, pinned, created_at, updated_at FROM saved_query ORDER BY name")
+	return saved, utils.JoinErrors("failed to get saved queries", err)
+}
+
+func getSavedQuery(db *sqlx.DB, name string) (*models.SavedQuery, error) {
+	saved := &models.SavedQuery{}
+	err := db.Get(saved, db.Rebind("SELECT name, kind, query, pinned, created_at, updated_at FROM saved_query WHERE name = ?"), name)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, utils.JoinErrors(fmt.Sprintf("failed to get saved query %q", name), err)
+	}
+	return saved, nil
+}
+
+func deleteSavedQuery(db *sqlx.DB, name string) (bool, error) {
+	result, err := db.Exec(db.Rebind("DELETE FROM saved_query WHERE name = ?"), name)
+	if err != nil {
+		return false, utils.JoinErrors(fmt.Sprintf("failed to delete saved query %q", name), err)
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, utils.JoinErrors("failed to get the number of deleted saved queries", err)
+}
+
+func countEmails(db *sqlx.DB, sqlQuery string, params ...interface{}) (int, error) {
+	sqlQuery = fmt.Sprintf("SELECT count(*) FROM (%s) counted", strings.TrimSuffix(strings.TrimSpace(sqlQuery), ";"))
+	// like StreamEmails, a query without params is left alone in case it has a ? in a string literal
+	if len(params) > 0 {
+		sqlQuery = db.Rebind(sqlQuery)
+	}
+	count := 0
+	err := db.Get(&count, sqlQuery, params...)
+	return count, utils.JoinErrors("failed to count emails", err)
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"sync"
+)
+
+// the error of a run that was still running when another one started, e.g. because the process was killed
+const interruptedSyncRunError = "interrupted"
+
+// a row of sync_run
+type syncRunRow struct {
+	models.SyncRun
+	FinishedAt sql.NullInt64  `db:"finished_at"`
+	Mailboxes  string         `db:"mailboxes"`
+	Error      sql.NullString `db:"error"`
+}
+
+/*
+the runs this process started and hasn't finished yet. A sync can run while another one started from the web ui is
+still going, so only the running runs that aren't in here were interrupted
+*/
+type liveSyncRuns struct {
+	mutex sync.Mutex
+	ids   map[int64]bool
+}
+
+// marks the runs that are still running but weren't started by this process as failed before logging run
+func startSyncRun(db *sqlx.DB, live *liveSyncRuns, run models.SyncRun) (int64, error) {
+	mailboxes, err := json.Marshal(run.Mailboxes)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to marshal mailboxes", err)
+	}
+	live.mutex.Lock()
+	defer live.mutex.Unlock()
+	if live.ids == nil {
+		live.ids = map[int64]bool{}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+	running := []int64{}
+	err = tx.Select(&running, tx.Rebind("SELECT id FROM sync_run WHERE status = ?"), models.SyncRunRunning)
+	if err != nil {
+		return 0, utils.JoinErrors("failed to get running sync runs", err)
+	}
+	for _, id := range running {
+		if live.ids[id] {
+			continue
+		}
+		_, err = tx.Exec(tx.Rebind("UPDATE sync_run SET status = ?, error = ? WHERE id = ?"), models.SyncRunFailed, interruptedSyncRunError, id)
+		if err != nil {
+			return 0, utils.JoinErrors(fmt.Sprintf("failed to mark sync run %d as interrupted", id), err)
+		}
+	}
+	id := int64(0)
+	err = tx.Get(&id, tx.Rebind("INSERT INTO sync_run (started_at, status, mailboxes, added, removed, bytes, warnings) VALUES (?, ?, ?, 0, 0, 0, 0) RETURNING id"),
+		run.StartedAt, run.Status, pgJSON(string(mailboxes)))
+	if err != nil {
+		return 0, utils.JoinErrors("failed to log sync run", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, utils.JoinErrors("failed to commit transaction", err)
+	}
+	live.ids[id] = true
+	return id, nil
+}
+
+func finishSyncRun(db *sqlx.DB, live *liveSyncRuns, run models.SyncRun) error {
+	live.mutex.Lock()
+	delete(live.ids, run.Id)
+	live.mutex.Unlock()
+	mailboxes, err := json.Marshal(run.Mailboxes)
+	if err != nil {
+		return utils.JoinErrors("failed to marshal mailboxes", err)
+	}
+	_, err = db.Exec(db.Rebind("UPDATE sync_run SET finished_at = ?, status = ?, mailboxes = ?, added = ?, removed = ?, bytes = ?, warnings = ?, error = ? WHERE id = ?"),
+		run.FinishedAt, run.Status, pgJSON(string(mailboxes)), run.Added, run.Removed, run.Bytes, run.Warnings, run.Error, run.Id)
+	return utils.JoinErrors(fmt.Sprintf("failed to log the end of sync run %d", run.Id), err)
+}
+
+func getSyncRuns(db *sqlx.DB, limit int, failedOnly bool) ([]models.SyncRun, error) {
+	query := "SELECT id, started_at, finished_at, status, mailboxes, added, removed, bytes, warnings, error FROM sync_run"
+	params := []interface{}{}
+	if failedOnly {
+		query += " WHERE status = ?"
+		params = append(params, models.SyncRunFailed)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	params = append(params, limit)
+	rows := []syncRunRow{}
+	err := db.Select(&rows, db.Rebind(query), params...)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get sync runs", err)
+	}
+	runs := []models.SyncRun{}
+	for _, row := range rows {
+		run := row.SyncRun
+		run.FinishedAt = row.FinishedAt.Int64
+		run.Error = row.Error.String
+		run.Mailboxes = []models.SyncRunMailbox{}
+		err = json.Unmarshal([]byte(row.Mailboxes), &run.Mailboxes)
+		if err != nil {
+			return nil, utils.JoinErrors(fmt.Sprintf("failed to unmarshal the mailboxes of sync run %d", row.Id), err)
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
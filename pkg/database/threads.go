@@ -0,0 +1,222 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// keeps IN lists well below the parameter limits of sqlite and postgres
+const threadBatchSize = 500
+
+var messageIdPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// the message ids in a Message-ID, In-Reply-To or References value
+func messageIds(value string) []string {
+	ids := messageIdPattern.FindAllString(value, -1)
+	value = strings.TrimSpace(value)
+	if len(ids) == 0 && value != "" && !strings.ContainsAny(value, " \t<>") {
+		// some senders leave out the angle brackets, the emails replying to them usually don't
+		ids = []string{"<" + value + ">"}
+	}
+	return ids
+}
+
+/*
+threads the emails that have no thread_id yet, the same way for sqlite and postgres.
+Emails are linked through the message ids in their Message-ID, In-Reply-To and References headers like the containers of
+JWZ threading (https://www.jwz.org/doc/threading.html), and emails with the same gmail thread id always share a thread.
+Unlike JWZ, emails are never grouped by subject alone.
+Every message id seen in a thread is kept in thread_message_id, including those of referenced emails that aren't
+archived, so threads only ever grow or merge and nothing has to be rebuilt when new emails arrive.
+A thread is identified by the our_id of the email that started it, merged threads keep the id of the earliest one.
+*/
+func updateThreads(db *sqlx.DB) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+
+	type pendingEmail struct {
+		OurId         string         `db:"our_id"`
+		MessageId     sql.NullString `db:"message_id"`
+		InReplyTo     sql.NullString `db:"in_reply_to"`
+		References    sql.NullString `db:"message_references"`
+		GmailThreadId sql.NullString `db:"gmail_thread_id"`
+	}
+	pending := []pendingEmail{}
+	// oldest first, so that a thread is named after its first email whenever the whole thread arrives at once
+	err = tx.Select(&pending, "SELECT our_id, message_id, in_reply_to, message_references, gmail_thread_id FROM email WHERE thread_id IS NULL ORDER BY coalesce(date_epoch, 0), our_id")
+	if err != nil {
+		return utils.JoinErrors("failed to get unthreaded emails", err)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	touched := utils.NewSet([]string{})
+	for _, email := range pending {
+		ids := messageIds(email.MessageId.String)
+		ids = append(ids, messageIds(email.InReplyTo.String)...)
+		ids = append(ids, messageIds(email.References.String)...)
+
+		linked, err := linkedThreads(tx, ids, email.GmailThreadId.String)
+		if err != nil {
+			return err
+		}
+		threadId := email.OurId
+		if len(linked) > 0 {
+			threadId, err = mergeThreads(tx, linked)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(tx.Rebind("UPDATE email SET thread_id = ? WHERE our_id = ?"), threadId, email.OurId)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to set the thread of %s", email.OurId), err)
+		}
+		for _, id := range ids {
+			_, err = tx.Exec(tx.Rebind("INSERT INTO thread_message_id (message_id, thread_id) VALUES (?, ?) ON CONFLICT (message_id) DO NOTHING"), id, threadId)
+			if err != nil {
+				return utils.JoinErrors("failed to save message id", err)
+			}
+		}
+		touched.Add(threadId)
+	}
+
+	err = refreshThreads(tx, touched.ToSlice())
+	if err != nil {
+		return err
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
+
+// the threads that already contain one of the message ids or the gmail thread, sorted
+func linkedThreads(tx *sqlx.Tx, ids []string, gmailThreadId string) ([]string, error) {
+	threadIds := utils.NewSet([]string{})
+	err := inBatches(ids, func(batch []string) error {
+		query, args, err := sqlx.In("SELECT DISTINCT thread_id FROM thread_message_id WHERE message_id IN (?)", batch)
+		if err != nil {
+			return err
+		}
+		found := []string{}
+		err = tx.Select(&found, tx.Rebind(query), args...)
+		for _, threadId := range found {
+			threadIds.Add(threadId)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, utils.JoinErrors("failed to look up message ids", err)
+	}
+
+	if gmailThreadId != "" {
+		found := []string{}
+		err = tx.Select(&found, tx.Rebind("SELECT DISTINCT thread_id FROM email WHERE gmail_thread_id = ? AND thread_id IS NOT NULL"), gmailThreadId)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to look up gmail thread", err)
+		}
+		for _, threadId := range found {
+			threadIds.Add(threadId)
+		}
+	}
+
+	sorted := threadIds.ToSlice()
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// merges the threads into the one whose first email is the oldest and returns its id
+func mergeThreads(tx *sqlx.Tx, threadIds []string) (string, error) {
+	if len(threadIds) == 1 {
+		return threadIds[0], nil
+	}
+	query, args, err := sqlx.In("SELECT thread_id FROM email WHERE thread_id IN (?) ORDER BY coalesce(date_epoch, 0), our_id LIMIT 1", threadIds)
+	if err != nil {
+		return "", err
+	}
+	keep := threadIds[0]
+	err = tx.Get(&keep, tx.Rebind(query), args...)
+	if err != nil && err != sql.ErrNoRows {
+		return "", utils.JoinErrors("failed to find the oldest thread", err)
+	}
+
+	others := utils.NewSet(threadIds).Minus(utils.NewSet([]string{keep})).ToSlice()
+	for _, statement := range []string{
+		"UPDATE email SET thread_id = ? WHERE thread_id IN (?)",
+		"UPDATE thread_message_id SET thread_id = ? WHERE thread_id IN (?)",
+	} {
+		query, args, err := sqlx.In(statement, keep, others)
+		if err != nil {
+			return "", err
+		}
+		_, err = tx.Exec(tx.Rebind(query), args...)
+		if err != nil {
+			return "", utils.JoinErrors("failed to merge threads", err)
+		}
+	}
+	query, args, err = sqlx.In("DELETE FROM thread WHERE thread_id IN (?)", others)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(tx.Rebind(query), args...)
+	return keep, utils.JoinErrors("failed to delete merged threads", err)
+}
+
+// recomputes the thread table rows of the threads, dropping those that no longer have any emails
+func refreshThreads(tx *sqlx.Tx, threadIds []string) error {
+	return inBatches(threadIds, func(batch []string) error {
+		query, args, err := sqlx.In(`INSERT INTO thread (thread_id, subject, email_count, first_date_epoch, last_date_epoch)
+			SELECT thread_id, (SELECT subject FROM email earliest WHERE earliest.thread_id = email.thread_id ORDER BY coalesce(date_epoch, 0), our_id LIMIT 1), count(*), min(date_epoch), max(date_epoch)
+			FROM email WHERE thread_id IN (?) GROUP BY thread_id
+			ON CONFLICT (thread_id) DO UPDATE SET subject = excluded.subject, email_count = excluded.email_count, first_date_epoch = excluded.first_date_epoch, last_date_epoch = excluded.last_date_epoch`, batch)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(tx.Rebind(query), args...)
+		if err != nil {
+			return utils.JoinErrors("failed to update threads", err)
+		}
+		query, args, err = sqlx.In("DELETE FROM thread WHERE thread_id IN (?) AND NOT EXISTS (SELECT 1 FROM email WHERE email.thread_id = thread.thread_id)", batch)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(tx.Rebind(query), args...)
+		return utils.JoinErrors("failed to delete empty threads", err)
+	})
+}
+
+func getThreads(db *sqlx.DB, limit int, offset int) ([]models.Thread, error) {
+	threads := []models.Thread{}
+	query := db.Rebind(`SELECT thread_id, coalesce(subject, '') AS subject, email_count, coalesce(first_date_epoch, 0) AS first_date_epoch, coalesce(last_date_epoch, 0) AS last_date_epoch
+		FROM thread ORDER BY coalesce(last_date_epoch, 0) DESC, thread_id LIMIT ? OFFSET ?`)
+	err := db.Select(&threads, query, limit, offset)
+	return threads, utils.JoinErrors("failed to get threads", err)
+}
+
+func getThreadEmailIds(db *sqlx.DB, threadId string) ([]string, error) {
+	ourIds := []string{}
+	err := db.Select(&ourIds, db.Rebind("SELECT our_id FROM email WHERE thread_id = ? ORDER BY coalesce(date_epoch, 0), our_id"), threadId)
+	return ourIds, utils.JoinErrors(fmt.Sprintf("failed to get the emails of thread %s", threadId), err)
+}
+
+func inBatches(values []string, handle func([]string) error) error {
+	for start := 0; start < len(values); start += threadBatchSize {
+		end := start + threadBatchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		err := handle(values[start:end])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
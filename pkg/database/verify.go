@@ -0,0 +1,31 @@
+package database
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+)
+
+func getMailboxMemberships(db *sqlx.DB, mailbox string) ([]models.MailboxMembership, error) {
+	memberships := []models.MailboxMembership{}
+	err := db.Select(&memberships, db.Rebind(`SELECT uid, coalesce(our_id, '') AS our_id, pending_sync = 1 AS pending_sync,
+		EXISTS (SELECT 1 FROM email WHERE email.our_id = message_to_mailbox.our_id) AS archived,
+		EXISTS (SELECT 1 FROM retention_log WHERE retention_log.our_id = message_to_mailbox.our_id AND action = 'purge_local') AS purged
+		FROM message_to_mailbox WHERE mailbox_name = ? AND removed_at IS NULL ORDER BY uid`), mailbox)
+	return memberships, utils.JoinErrors("failed to get mailbox memberships", err)
+}
+
+func markPendingSync(db *sqlx.DB, mailbox string, uids []uint32) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return utils.JoinErrors("failed to begin transaction", err)
+	}
+	defer tx.Rollback()
+	for _, uid := range uids {
+		_, err = tx.Exec(tx.Rebind("UPDATE message_to_mailbox SET pending_sync = 1 WHERE mailbox_name = ? AND uid = ?"), mailbox, uid)
+		if err != nil {
+			return utils.JoinErrors("failed to mark uid pending", err)
+		}
+	}
+	return utils.JoinErrors("failed to commit transaction", tx.Commit())
+}
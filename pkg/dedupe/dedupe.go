@@ -0,0 +1,296 @@
+package dedupe
+
+import (
+	"errors"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/retention"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Kind string
+
+const (
+	// the same words and attachments
+	KindExact Kind = "exact"
+	// a simhash that differs in at most the given number of bits
+	KindNear Kind = "near"
+)
+
+// the policy name merged duplicates are logged under in the retention_log table
+const Policy = "dedupe"
+
+// beyond this many bits unrelated emails, e.g. newsletters of the same sender, start to look alike
+const MaxDistance = 12
+
+type Duplicate struct {
+	models.Fingerprint
+	Kind Kind `json:"kind"`
+	// the number of simhash bits the duplicate differs in from the email that is kept, 0 for exact duplicates
+	Distance int `json:"distance"`
+}
+
+// an email that is kept together with its duplicates
+type Group struct {
+	Keep       models.Fingerprint `json:"keep"`
+	Duplicates []Duplicate        `json:"duplicates"`
+}
+
+func (group Group) duplicateIds() []string {
+	ourIds := []string{}
+	for _, duplicate := range group.Duplicates {
+		ourIds = append(ourIds, duplicate.OurId)
+	}
+	return ourIds
+}
+
+/*
+exact duplicates have the same key. A short body like "thanks!" says little about the email, so emails without a
+simhash also need the same subject and sender to be duplicates
+*/
+func exactKey(fingerprint models.Fingerprint) string {
+	if fingerprint.BodySimhash != "" {
+		return fingerprint.BodyHash
+	}
+	return strings.Join([]string{fingerprint.BodyHash, strings.ToLower(strings.TrimSpace(fingerprint.Subject)), fingerprint.From}, "\x00")
+}
+
+// the email that is kept is the oldest, then the one in the most mailboxes
+func keepFirst(fingerprints []models.Fingerprint) {
+	sort.SliceStable(fingerprints, func(i, j int) bool {
+		a, b := fingerprints[i], fingerprints[j]
+		if (a.DateEpoch == 0) != (b.DateEpoch == 0) {
+			return a.DateEpoch != 0
+		}
+		if a.DateEpoch != b.DateEpoch {
+			return a.DateEpoch < b.DateEpoch
+		}
+		if len(a.Mailboxes) != len(b.Mailboxes) {
+			return len(a.Mailboxes) > len(b.Mailboxes)
+		}
+		return a.OurId < b.OurId
+	})
+}
+
+/*
+Find groups the duplicates in the archive, hashing the bodies of emails archived before body hashes were stored first.
+maxDistance is the number of simhash bits near duplicates may differ in, 0 only finds exact duplicates.
+Candidates are found by splitting the simhashes into maxDistance+1 bands: two simhashes that differ in at most
+maxDistance bits are the same in at least one band, so only emails that share a band are compared.
+*/
+func Find(db models.DB, maxDistance int) ([]Group, error) {
+	if maxDistance < 0 || maxDistance > MaxDistance {
+		return nil, fmt.Errorf("the distance must be between 0 and %d", MaxDistance)
+	}
+	_, err := db.UpdateBodyHashes()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to hash bodies", err)
+	}
+	fingerprints, err := db.GetFingerprints()
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make([]int, len(fingerprints))
+	for i := range parents {
+		parents[i] = i
+	}
+	var root func(i int) int
+	root = func(i int) int {
+		if parents[i] != i {
+			parents[i] = root(parents[i])
+		}
+		return parents[i]
+	}
+	union := func(i int, j int) {
+		parents[root(i)] = root(j)
+	}
+
+	firstWithKey := map[string]int{}
+	simhashes := make([]uint64, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		key := exactKey(fingerprint)
+		if first, ok := firstWithKey[key]; ok {
+			union(i, first)
+		} else {
+			firstWithKey[key] = i
+		}
+		if fingerprint.BodySimhash != "" {
+			simhashes[i], err = strconv.ParseUint(fingerprint.BodySimhash, 16, 64)
+			if err != nil {
+				return nil, fmt.Errorf("email %s has an invalid simhash %q", fingerprint.OurId, fingerprint.BodySimhash)
+			}
+		}
+	}
+
+	if maxDistance > 0 {
+		type bandKey struct {
+			band  int
+			value uint64
+		}
+		bands := maxDistance + 1
+		buckets := map[bandKey][]int{}
+		for i, fingerprint := range fingerprints {
+			if fingerprint.BodySimhash == "" {
+				continue
+			}
+			for band := 0; band < bands; band++ {
+				start, end := band*64/bands, (band+1)*64/bands
+				value := (simhashes[i] >> start) & (1<<(end-start) - 1)
+				buckets[bandKey{band, value}] = append(buckets[bandKey{band, value}], i)
+			}
+		}
+		for _, bucket := range buckets {
+			for a := 0; a < len(bucket); a++ {
+				for b := a + 1; b < len(bucket); b++ {
+					if bits.OnesCount64(simhashes[bucket[a]]^simhashes[bucket[b]]) <= maxDistance {
+						union(bucket[a], bucket[b])
+					}
+				}
+			}
+		}
+	}
+
+	components := map[int][]int{}
+	for i := range fingerprints {
+		components[root(i)] = append(components[root(i)], i)
+	}
+	groups := []Group{}
+	for _, component := range components {
+		if len(component) < 2 {
+			continue
+		}
+		members := []models.Fingerprint{}
+		for _, i := range component {
+			members = append(members, fingerprints[i])
+		}
+		keepFirst(members)
+		// near duplicates are chained together by the bands, so every duplicate is compared to the kept email again,
+		// and the rest form groups of their own
+		for len(members) > 1 {
+			keep := members[0]
+			keepSimhash, _ := strconv.ParseUint(keep.BodySimhash, 16, 64)
+			group := Group{Keep: keep, Duplicates: []Duplicate{}}
+			rest := []models.Fingerprint{}
+			for _, member := range members[1:] {
+				memberSimhash, _ := strconv.ParseUint(member.BodySimhash, 16, 64)
+				distance := bits.OnesCount64(keepSimhash ^ memberSimhash)
+				switch {
+				case exactKey(member) == exactKey(keep):
+					group.Duplicates = append(group.Duplicates, Duplicate{Fingerprint: member, Kind: KindExact})
+				case keep.BodySimhash != "" && member.BodySimhash != "" && distance <= maxDistance:
+					group.Duplicates = append(group.Duplicates, Duplicate{Fingerprint: member, Kind: KindNear, Distance: distance})
+				default:
+					rest = append(rest, member)
+				}
+			}
+			if len(group.Duplicates) > 0 {
+				groups = append(groups, group)
+			}
+			members = rest
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Keep.DateEpoch != groups[j].Keep.DateEpoch {
+			return groups[i].Keep.DateEpoch < groups[j].Keep.DateEpoch
+		}
+		return groups[i].Keep.OurId < groups[j].Keep.OurId
+	})
+	return groups, nil
+}
+
+/*
+Plan returns the deletions that merging the groups results in, without changing anything: every duplicate is purged
+locally, and with server also deleted from every mailbox it's in on the server. Near duplicates may differ in more than
+their headers, so they're only deleted from the server with serverNear as well, otherwise only their local copy goes.
+*/
+func Plan(db models.DB, groups []Group, server bool, serverNear bool) ([]models.RetentionDeletion, error) {
+	// maps our_id to uid, per mailbox
+	mailboxUids := map[string]map[string]uint32{}
+	serverMailboxes := []string{}
+	if server {
+		var err error
+		serverMailboxes, err = retention.ServerMailboxes(db)
+		if err != nil {
+			return nil, err
+		}
+		for _, mailbox := range serverMailboxes {
+			mailboxUids[mailbox], err = db.GetMailboxUids(mailbox)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	remote := []models.RetentionDeletion{}
+	local := []models.RetentionDeletion{}
+	for _, group := range groups {
+		for _, duplicate := range group.Duplicates {
+			deletion := models.RetentionDeletion{
+				Policy:    Policy,
+				Action:    string(retention.ActionPurgeLocal),
+				OurId:     duplicate.OurId,
+				MessageId: duplicate.MessageId,
+				Subject:   duplicate.Subject,
+				DateEpoch: duplicate.DateEpoch,
+			}
+			local = append(local, deletion)
+			if duplicate.Kind == KindNear && !serverNear {
+				continue
+			}
+			for _, mailbox := range serverMailboxes {
+				uid, ok := mailboxUids[mailbox][duplicate.OurId]
+				if !ok {
+					continue
+				}
+				deletion.Action = string(retention.ActionDeleteRemote)
+				deletion.Mailbox = mailbox
+				deletion.Uid = uid
+				remote = append(remote, deletion)
+			}
+		}
+	}
+	return append(remote, local...), nil
+}
+
+/*
+Merge merges the duplicates of every group into the email that is kept and carries out the deletions returned by Plan.
+The server copies are deleted first, then the tags, notes and remaining mailbox memberships of the duplicates are moved
+to the kept emails, and finally the duplicates are purged. Like retention.Apply, every batch is logged as soon as it's
+done, so an interrupted merge can simply be rerun.
+pool is only used to delete from the server and may be nil if the deletions don't include any.
+*/
+func Merge(db models.DB, pool models.ClientPool, groups []Group, deletions []models.RetentionDeletion, logged func([]models.RetentionDeletion)) error {
+	remote := []models.RetentionDeletion{}
+	local := []models.RetentionDeletion{}
+	for _, deletion := range deletions {
+		if deletion.Action == string(retention.ActionDeleteRemote) {
+			remote = append(remote, deletion)
+		} else {
+			local = append(local, deletion)
+		}
+	}
+	if len(remote) > 0 && pool == nil {
+		return errors.New("deleting from the server needs an imap connection")
+	}
+
+	err := retention.Apply(db, pool, remote, logged)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		err = db.MergeDuplicates(group.Keep.OurId, group.duplicateIds())
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to merge the duplicates of %s", group.Keep.OurId), err)
+		}
+	}
+	err = retention.Apply(db, nil, local, logged)
+	if err != nil {
+		return err
+	}
+	return utils.JoinErrors("failed to aggregate folders", db.AggregateFolders())
+}
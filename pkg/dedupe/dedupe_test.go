@@ -0,0 +1,192 @@
+package dedupe
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/skamensky/email-archiver/pkg/models"
+)
+
+// serves fingerprints and mailboxes from memory, the methods Find and Plan don't use panic
+type fakeDB struct {
+	models.DB
+	fingerprints []models.Fingerprint
+	// maps mailbox to our_id to uid
+	mailboxes map[string]map[string]uint32
+	imported  []string
+}
+
+func (db *fakeDB) UpdateBodyHashes() (int, error) {
+	return 0, nil
+}
+
+func (db *fakeDB) GetFingerprints() ([]models.Fingerprint, error) {
+	return db.fingerprints, nil
+}
+
+func (db *fakeDB) GetAllMailboxRecords() ([]models.MailboxRecord, error) {
+	records := []models.MailboxRecord{}
+	for name := range db.mailboxes {
+		records = append(records, models.MailboxRecord{Name: name})
+	}
+	for _, name := range db.imported {
+		records = append(records, models.MailboxRecord{Name: name, Attributes: []string{models.ImportedMailboxAttribute}})
+	}
+	return records, nil
+}
+
+func (db *fakeDB) GetMailboxUids(mailbox string) (map[string]uint32, error) {
+	return db.mailboxes[mailbox], nil
+}
+
+// a fingerprint with a long body, whose simhash has the given bits set
+func long(ourId string, dateEpoch int64, bodyHash string, simhashBits ...int) models.Fingerprint {
+	simhash := uint64(0)
+	for _, bit := range simhashBits {
+		simhash |= 1 << bit
+	}
+	return models.Fingerprint{OurId: ourId, BodyHash: bodyHash, BodySimhash: fmt.Sprintf("%016x", simhash), DateEpoch: dateEpoch}
+}
+
+func TestExactKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		a     models.Fingerprint
+		b     models.Fingerprint
+		equal bool
+	}{
+		{"long bodies only need the same hash", models.Fingerprint{BodyHash: "h", BodySimhash: "1", Subject: "Report", From: "a@example.com"}, models.Fingerprint{BodyHash: "h", BodySimhash: "1", Subject: "Fwd: Report", From: "b@example.com"}, true},
+		{"long bodies with different hashes", models.Fingerprint{BodyHash: "h", BodySimhash: "1"}, models.Fingerprint{BodyHash: "i", BodySimhash: "1"}, false},
+		{"short bodies with the same subject and sender", models.Fingerprint{BodyHash: "h", Subject: "Thanks", From: "a@example.com"}, models.Fingerprint{BodyHash: "h", Subject: " thanks ", From: "a@example.com"}, true},
+		{"short bodies with different subjects", models.Fingerprint{BodyHash: "h", Subject: "Thanks", From: "a@example.com"}, models.Fingerprint{BodyHash: "h", Subject: "Re: invoice", From: "a@example.com"}, false},
+		{"short bodies from different senders", models.Fingerprint{BodyHash: "h", Subject: "Thanks", From: "a@example.com"}, models.Fingerprint{BodyHash: "h", Subject: "Thanks", From: "b@example.com"}, false},
+		{"a short and a long body", models.Fingerprint{BodyHash: "h", Subject: "Thanks"}, models.Fingerprint{BodyHash: "h", BodySimhash: "1", Subject: "Thanks"}, false},
+	}
+	for _, test := range tests {
+		if equal := exactKey(test.a) == exactKey(test.b); equal != test.equal {
+			t.Errorf("%s: got equal keys %v, expected %v", test.name, equal, test.equal)
+		}
+	}
+}
+
+func TestKeepFirst(t *testing.T) {
+	tests := []struct {
+		name         string
+		fingerprints []models.Fingerprint
+		expected     []string
+	}{
+		{"oldest first", []models.Fingerprint{{OurId: "a", DateEpoch: 30}, {OurId: "b", DateEpoch: 10}, {OurId: "c", DateEpoch: 20}}, []string{"b", "c", "a"}},
+		{"unknown dates last", []models.Fingerprint{{OurId: "a", DateEpoch: 0}, {OurId: "b", DateEpoch: 10}}, []string{"b", "a"}},
+		{"then the most mailboxes", []models.Fingerprint{{OurId: "a", DateEpoch: 10, Mailboxes: []string{"INBOX"}}, {OurId: "b", DateEpoch: 10, Mailboxes: []string{"INBOX", "Archive"}}}, []string{"b", "a"}},
+		{"then our_id", []models.Fingerprint{{OurId: "b", DateEpoch: 10}, {OurId: "a", DateEpoch: 10}}, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		keepFirst(test.fingerprints)
+		got := []string{}
+		for _, fingerprint := range test.fingerprints {
+			got = append(got, fingerprint.OurId)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	type found struct {
+		keep string
+		// our_id, kind and distance
+		duplicates []string
+	}
+	tests := []struct {
+		name         string
+		maxDistance  int
+		fingerprints []models.Fingerprint
+		expected     []found
+	}{
+		{"exact duplicates", 0, []models.Fingerprint{long("a", 20, "h", 1), long("b", 10, "h", 1), long("c", 30, "i", 1)},
+			[]found{{"b", []string{"a exact 0"}}}},
+		{"near duplicates aren't found without a distance", 0, []models.Fingerprint{long("a", 10, "h"), long("b", 20, "i", 5)}, []found{}},
+		// 4 bands of 16 bits, b differs in one bit of three bands, c in three bits of the same band
+		{"near duplicates share a band", 3, []models.Fingerprint{long("a", 10, "h"), long("b", 20, "i", 0, 16, 32), long("c", 30, "j", 0, 1, 2)},
+			[]found{{"a", []string{"b near 3", "c near 3"}}}},
+		// 6 bands that start at bits 0, 10, 21, 32, 42 and 53, b differs in the last bit of all but the last band
+		{"uneven bands", 5, []models.Fingerprint{long("a", 10, "h"), long("b", 20, "i", 9, 20, 31, 41, 52)},
+			[]found{{"a", []string{"b near 5"}}}},
+		{"one bit in every band is too far", 3, []models.Fingerprint{long("a", 10, "h"), long("b", 20, "i", 0, 16, 32, 48)}, []found{}},
+		// b is near a and c, but c is too far from a, so it's left on its own
+		{"chained near duplicates are compared to the kept email", 3, []models.Fingerprint{long("a", 10, "h"), long("b", 20, "i", 0, 1), long("c", 30, "j", 0, 1, 2, 3, 4)},
+			[]found{{"a", []string{"b near 2"}}}},
+		{"short bodies have no simhash", 3, []models.Fingerprint{{OurId: "a", BodyHash: "h", DateEpoch: 10}, {OurId: "b", BodyHash: "i", DateEpoch: 20}}, []found{}},
+	}
+	for _, test := range tests {
+		groups, err := Find(&fakeDB{fingerprints: test.fingerprints}, test.maxDistance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []found{}
+		for _, group := range groups {
+			duplicates := []string{}
+			for _, duplicate := range group.Duplicates {
+				duplicates = append(duplicates, fmt.Sprintf("%s %s %d", duplicate.OurId, duplicate.Kind, duplicate.Distance))
+			}
+			got = append(got, found{group.Keep.OurId, duplicates})
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s: got %v, expected %v", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestFindDistance(t *testing.T) {
+	for _, maxDistance := range []int{-1, MaxDistance + 1} {
+		_, err := Find(&fakeDB{}, maxDistance)
+		if err == nil {
+			t.Errorf("distance %d: expected an error", maxDistance)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	groups := []Group{{
+		Keep: models.Fingerprint{OurId: "keep"},
+		Duplicates: []Duplicate{
+			{Fingerprint: models.Fingerprint{OurId: "exact"}, Kind: KindExact},
+			{Fingerprint: models.Fingerprint{OurId: "near"}, Kind: KindNear, Distance: 2},
+		},
+	}}
+	db := &fakeDB{
+		mailboxes: map[string]map[string]uint32{
+			"INBOX":   {"keep": 1, "exact": 2, "near": 3},
+			"Archive": {"near": 7},
+		},
+		imported: []string{"Imported"},
+	}
+	tests := []struct {
+		server     bool
+		serverNear bool
+		// action, our_id, mailbox and uid
+		expected []string
+	}{
+		{false, false, []string{"purge_local exact  0", "purge_local near  0"}},
+		{true, false, []string{"delete_remote exact INBOX 2", "purge_local exact  0", "purge_local near  0"}},
+		{true, true, []string{"delete_remote exact INBOX 2", "delete_remote near Archive 7", "delete_remote near INBOX 3", "purge_local exact  0", "purge_local near  0"}},
+	}
+	for _, test := range tests {
+		deletions, err := Plan(db, groups, test.server, test.serverNear)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, deletion := range deletions {
+			if deletion.Policy != Policy {
+				t.Errorf("got policy %q, expected %q", deletion.Policy, Policy)
+			}
+			got = append(got, fmt.Sprintf("%s %s %s %d", deletion.Action, deletion.OurId, deletion.Mailbox, deletion.Uid))
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("server %v, serverNear %v: got %q, expected %q", test.server, test.serverNear, got, test.expected)
+		}
+	}
+}
@@ -1,76 +1,176 @@
 package email
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
 	"github.com/jmoiron/sqlx"
 	"github.com/k3a/html2text"
 	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/textextract"
 	"github.com/skamensky/email-archiver/pkg/utils"
 	"io"
 	"log"
+	"mime"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Email struct {
-	MessageId       string                      `json:"message_id,omitempty" db:"message_id"`
-	Date            string                      `json:"date,omitempty" db:"date"`
-	Subject         string                      `json:"subject,omitempty" db:"subject"`
-	FromName1       string                      `json:"from_name_1,omitempty" db:"from_name_1"`
-	FromMailbox1    string                      `json:"from_mailbox_1,omitempty" db:"from_mailbox_1"`
-	FromHost1       string                      `json:"from_host_1,omitempty" db:"from_host_1"`
-	SenderName1     string                      `json:"sender_name_1,omitempty" db:"sender_name_1"`
-	SenderMailbox1  string                      `json:"sender_mailbox_1,omitempty" db:"sender_mailbox_1"`
-	SenderHost1     string                      `json:"sender_host_1,omitempty" db:"sender_host_1"`
-	ReplyToName1    string                      `json:"reply_to_name_1,omitempty" db:"reply_to_name_1"`
-	ReplyToMailbox1 string                      `json:"reply_to_mailbox_1,omitempty" db:"reply_to_mailbox_1"`
-	ReplyToHost1    string                      `json:"reply_to_host_1,omitempty" db:"reply_to_host_1"`
-	ToName1         string                      `json:"to_name_1,omitempty" db:"to_name_1"`
-	ToMailbox1      string                      `json:"to_mailbox_1,omitempty" db:"to_mailbox_1"`
-	ToHost1         string                      `json:"to_host_1,omitempty" db:"to_host_1"`
-	CcName1         string                      `json:"cc_name_1,omitempty" db:"cc_name_1"`
-	CcMailbox1      string                      `json:"cc_mailbox_1,omitempty" db:"cc_mailbox_1"`
-	CcHost1         string                      `json:"cc_host_1,omitempty" db:"cc_host_1"`
-	BccName1        string                      `json:"bcc_name_1,omitempty" db:"bcc_name_1"`
-	BccMailbox1     string                      `json:"bcc_mailbox_1,omitempty" db:"bcc_mailbox_1"`
-	BccHost1        string                      `json:"bcc_host_1,omitempty" db:"bcc_host_1"`
-	InReplyTo       string                      `json:"in_reply_to,omitempty" db:"in_reply_to"`
-	Mailboxes       []string                    `json:"mailboxes,omitempty" db:"mailboxes"`
-	ParseWarning    string                      `json:"parse_warning,omitempty" db:"parse_warning"`
-	ParseError      string                      `json:"parse_error,omitempty" db:"parse_error"`
-	OurId           string                      `json:"our_id,omitempty" db:"our_id"`
-	Envelope        *imap.Envelope              `json:"envelope,omitempty" db:"envelope"`
-	Flags           []string                    `json:"flags,omitempty" db:"flags"`
-	UID             uint32                      `json:"uid,omitempty" db:"uid"`
-	TextContent     string                      `json:"text_content,omitempty" db:"text_content"`
-	HTMLContent     string                      `json:"html_content,omitempty" db:"html_content"`
-	Attachments     []models.AttachmentMetaData `json:"attachments,omitempty" db:"attachments"`
-	client          models.Client
+	MessageId         string                      `json:"message_id,omitempty" db:"message_id"`
+	Date              string                      `json:"date,omitempty" db:"date"`
+	DateEpoch         int64                       `json:"date_epoch,omitempty" db:"date_epoch"`
+	DateOffset        int                         `json:"date_offset,omitempty" db:"date_offset"`
+	InternalDateEpoch int64                       `json:"internal_date_epoch,omitempty" db:"internal_date_epoch"`
+	Subject           string                      `json:"subject,omitempty" db:"subject"`
+	FromName1         string                      `json:"from_name_1,omitempty" db:"from_name_1"`
+	FromMailbox1      string                      `json:"from_mailbox_1,omitempty" db:"from_mailbox_1"`
+	FromHost1         string                      `json:"from_host_1,omitempty" db:"from_host_1"`
+	SenderName1       string                      `json:"sender_name_1,omitempty" db:"sender_name_1"`
+	SenderMailbox1    string                      `json:"sender_mailbox_1,omitempty" db:"sender_mailbox_1"`
+	SenderHost1       string                      `json:"sender_host_1,omitempty" db:"sender_host_1"`
+	ReplyToName1      string                      `json:"reply_to_name_1,omitempty" db:"reply_to_name_1"`
+	ReplyToMailbox1   string                      `json:"reply_to_mailbox_1,omitempty" db:"reply_to_mailbox_1"`
+	ReplyToHost1      string                      `json:"reply_to_host_1,omitempty" db:"reply_to_host_1"`
+	ToName1           string                      `json:"to_name_1,omitempty" db:"to_name_1"`
+	ToMailbox1        string                      `json:"to_mailbox_1,omitempty" db:"to_mailbox_1"`
+	ToHost1           string                      `json:"to_host_1,omitempty" db:"to_host_1"`
+	CcName1           string                      `json:"cc_name_1,omitempty" db:"cc_name_1"`
+	CcMailbox1        string                      `json:"cc_mailbox_1,omitempty" db:"cc_mailbox_1"`
+	CcHost1           string                      `json:"cc_host_1,omitempty" db:"cc_host_1"`
+	BccName1          string                      `json:"bcc_name_1,omitempty" db:"bcc_name_1"`
+	BccMailbox1       string                      `json:"bcc_mailbox_1,omitempty" db:"bcc_mailbox_1"`
+	BccHost1          string                      `json:"bcc_host_1,omitempty" db:"bcc_host_1"`
+	InReplyTo         string                      `json:"in_reply_to,omitempty" db:"in_reply_to"`
+	References        string                      `json:"references,omitempty" db:"message_references"`
+	GmailThreadId     string                      `json:"gmail_thread_id,omitempty" db:"gmail_thread_id"`
+	ThreadId          string                      `json:"thread_id,omitempty" db:"thread_id"`
+	BodyHash          string                      `json:"body_hash,omitempty" db:"body_hash"`
+	BodySimhash       string                      `json:"body_simhash,omitempty" db:"body_simhash"`
+	Mailboxes         []string                    `json:"mailboxes,omitempty" db:"mailboxes"`
+	DeletedOnServerAt int64                       `json:"deleted_on_server_at,omitempty" db:"deleted_on_server_at"`
+	ParseWarning      string                      `json:"parse_warning,omitempty" db:"parse_warning"`
+	ParseError        string                      `json:"parse_error,omitempty" db:"parse_error"`
+	OurId             string                      `json:"our_id,omitempty" db:"our_id"`
+	Envelope          *imap.Envelope              `json:"envelope,omitempty" db:"envelope"`
+	Flags             []string                    `json:"flags,omitempty" db:"flags"`
+	UID               uint32                      `json:"uid,omitempty" db:"uid"`
+	TextContent       string                      `json:"text_content,omitempty" db:"text_content"`
+	HTMLContent       string                      `json:"html_content,omitempty" db:"html_content"`
+	Attachments       []models.AttachmentMetaData `json:"attachments,omitempty" db:"attachments"`
+	Addresses         []models.EmailAddress       `json:"addresses,omitempty" db:"-"`
+	// file names of the attachments that matched a full text search
+	MatchedAttachments []string `json:"matched_attachments,omitempty" db:"-"`
+	headers            []models.Header
+	attachmentTexts    []models.AttachmentText
+	options            models.Options
+	raw                []byte
 }
 
 // assumes the currently selected mailbox is the mailbox this email is in
 func New(msg *imap.Message, client models.Client) models.Email {
 	emailWrap := &Email{
-		client: client,
+		options: client.Options(),
 	}
-	return emailWrap.parseMessage(msg)
+	email := emailWrap.parseMessage(msg.Envelope, msg.Flags, msg.Uid, msg.InternalDate, msg.GetBody(models.SectionToFetch))
+	if value, ok := msg.Items[models.GmailThreadIdFetchItem]; ok {
+		if gmailThreadId, err := imap.ParseString(value); err == nil {
+			email.GmailThreadId = gmailThreadId
+		}
+	}
+	return email
 }
 
-func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
-	emailWrap := &Email{}
+/*
+NewFromRaw parses a message that didn't come from an imap server (e.g. an mbox file).
+The envelope is built from the message headers the same way an imap server would, so the our_id of an imported
+message matches the our_id of the same message downloaded over imap.
+internalDate is the zero time if the source doesn't know when the message was delivered.
+*/
+func NewFromRaw(raw []byte, flags []string, uid uint32, internalDate time.Time, options models.Options) models.Email {
+	emailWrap := &Email{
+		options: options,
+	}
+	envelope, err := EnvelopeFromRaw(raw)
+	if err != nil {
+		utils.DebugPrintln("failed to build envelope from headers:", err)
+	}
+	email := emailWrap.parseMessage(envelope, flags, uid, internalDate, bytes.NewReader(raw))
+	if envelope == nil {
+		email.OurId = rawOurId(raw)
+	}
+	return email
+}
+
+// OurIdFromRaw computes the our_id of a raw message without parsing its body
+func OurIdFromRaw(raw []byte) string {
+	envelope, err := EnvelopeFromRaw(raw)
+	if err != nil {
+		return rawOurId(raw)
+	}
+	return ourId(envelope, 0)
+}
+
+func rawOurId(raw []byte) string {
+	// the uid of a raw message is only a position within its source, so hash the message instead
+	hasher := sha256.New()
+	hasher.Write(raw)
+	return "nil-envelope;sha256=" + hex.EncodeToString(hasher.Sum(nil))
+}
 
+// EnvelopeFromRaw mirrors what an imap server returns for the ENVELOPE fetch item
+func EnvelopeFromRaw(raw []byte) (*imap.Envelope, error) {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, utils.JoinErrors("failed to read message header", err)
+	}
+	envelope, err := backendutil.FetchEnvelope(header)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to build envelope", err)
+	}
+
+	// the imap client decodes encoded words in the envelope, so we do the same
+	decoder := &mime.WordDecoder{CharsetReader: charset.Reader}
+	if subject, err := decoder.DecodeHeader(envelope.Subject); err == nil {
+		envelope.Subject = subject
+	}
+	envelope.InReplyTo = strings.TrimSpace(envelope.InReplyTo)
+	envelope.MessageId = strings.TrimSpace(envelope.MessageId)
+
+	// servers return NIL for empty address lists, which the imap client parses as a nil slice
+	for _, addresses := range []*[]*imap.Address{&envelope.From, &envelope.Sender, &envelope.ReplyTo, &envelope.To, &envelope.Cc, &envelope.Bcc} {
+		if len(*addresses) == 0 {
+			*addresses = nil
+		}
+	}
+	return envelope, nil
+}
+
+func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 	rowData := make(map[string]interface{})
 	err := rows.MapScan(rowData)
 
 	if err != nil {
 		return nil, utils.JoinErrors("error mapping row to email", err)
 	}
+	return NewFromRowData(rowData)
+}
+
+// like NewFromDBRecord, for callers that need to look at or transform the column values first (e.g. to decrypt them)
+func NewFromRowData(rowData map[string]interface{}) (models.Email, error) {
+	emailWrap := &Email{}
+	var err error
 
 	if !utils.IsInterfaceNil(rowData["message_id"]) {
 		emailWrap.MessageId = rowData["message_id"].(string)
@@ -81,6 +181,15 @@ func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 	if !utils.IsInterfaceNil(rowData["subject"]) {
 		emailWrap.Subject = rowData["subject"].(string)
 	}
+	if !utils.IsInterfaceNil(rowData["date_epoch"]) {
+		emailWrap.DateEpoch = rowData["date_epoch"].(int64)
+	}
+	if !utils.IsInterfaceNil(rowData["date_offset"]) {
+		emailWrap.DateOffset = int(rowData["date_offset"].(int64))
+	}
+	if !utils.IsInterfaceNil(rowData["internal_date_epoch"]) {
+		emailWrap.InternalDateEpoch = rowData["internal_date_epoch"].(int64)
+	}
 	if !utils.IsInterfaceNil(rowData["from_name_1"]) {
 		emailWrap.FromName1 = rowData["from_name_1"].(string)
 	}
@@ -138,9 +247,27 @@ func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 	if !utils.IsInterfaceNil(rowData["in_reply_to"]) {
 		emailWrap.InReplyTo = rowData["in_reply_to"].(string)
 	}
+	if !utils.IsInterfaceNil(rowData["message_references"]) {
+		emailWrap.References = rowData["message_references"].(string)
+	}
+	if !utils.IsInterfaceNil(rowData["gmail_thread_id"]) {
+		emailWrap.GmailThreadId = rowData["gmail_thread_id"].(string)
+	}
+	if !utils.IsInterfaceNil(rowData["thread_id"]) {
+		emailWrap.ThreadId = rowData["thread_id"].(string)
+	}
+	if !utils.IsInterfaceNil(rowData["body_hash"]) {
+		emailWrap.BodyHash = rowData["body_hash"].(string)
+	}
+	if !utils.IsInterfaceNil(rowData["body_simhash"]) {
+		emailWrap.BodySimhash = rowData["body_simhash"].(string)
+	}
 	if !utils.IsInterfaceNil(rowData["mailboxes"]) {
 		emailWrap.Mailboxes = strings.Split(rowData["mailboxes"].(string), ",")
 	}
+	if !utils.IsInterfaceNil(rowData["deleted_on_server_at"]) {
+		emailWrap.DeletedOnServerAt = rowData["deleted_on_server_at"].(int64)
+	}
 	if !utils.IsInterfaceNil(rowData["parse_warning"]) {
 		emailWrap.ParseWarning = rowData["parse_warning"].(string)
 	}
@@ -151,7 +278,10 @@ func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 		emailWrap.OurId = rowData["our_id"].(string)
 	}
 	if !utils.IsInterfaceNil(rowData["flags"]) {
-		emailWrap.Flags = strings.Split(rowData["flags"].(string), ",")
+		err = json.Unmarshal([]byte(rowData["flags"].(string)), &emailWrap.Flags)
+		if err != nil {
+			return nil, utils.JoinErrors("error unmarshalling flags", err)
+		}
 	}
 	if !utils.IsInterfaceNil(rowData["uid"]) {
 		emailWrap.UID = rowData["uid"].(uint32)
@@ -162,6 +292,13 @@ func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 	if !utils.IsInterfaceNil(rowData["html_content"]) {
 		emailWrap.HTMLContent = rowData["html_content"].(string)
 	}
+	if !utils.IsInterfaceNil(rowData["envelope"]) {
+		err = json.Unmarshal([]byte(rowData["envelope"].(string)), &emailWrap.Envelope)
+		if err != nil {
+			return nil, utils.JoinErrors("error unmarshalling envelope", err)
+		}
+	}
+	emailWrap.Addresses = addressesFromEnvelope(emailWrap.Envelope)
 	emailWrap.Attachments = []models.AttachmentMetaData{}
 	emailWrap.Mailboxes = []string{}
 
@@ -179,6 +316,14 @@ func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 		}
 	}
 
+	// only selected by full text searches
+	if !utils.IsInterfaceNil(rowData["matched_attachments"]) {
+		err = json.Unmarshal([]byte(rowData["matched_attachments"].(string)), &emailWrap.MatchedAttachments)
+		if err != nil {
+			return nil, utils.JoinErrors("error unmarshalling matched attachments", err)
+		}
+	}
+
 	colNames := []string{}
 	for k, _ := range rowData {
 		colNames = append(colNames, k)
@@ -187,27 +332,175 @@ func NewFromDBRecord(rows *sqlx.Rows) (models.Email, error) {
 	return emailWrap, nil
 }
 
-func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
-	// our id is a hash because message-id isn't reliable
+// the text of an attachment for the full text index, attachments that aren't documents get an empty one
+func attachmentText(position int, attachment models.AttachmentMetaData, content []byte) models.AttachmentText {
+	attachmentText := models.AttachmentText{Position: position, FileName: attachment.FileName}
+	if !textextract.Supported(attachment.FileName, attachment.FileType) {
+		return attachmentText
+	}
+	text, err := textextract.Extract(attachment.FileName, attachment.FileType, content)
+	if err != nil {
+		// a broken attachment shouldn't keep the email from being archived
+		utils.DebugPrintln(err.Error())
+		return attachmentText
+	}
+	attachmentText.Text = text
+	return attachmentText
+}
+
+// our id is a hash because message-id isn't reliable
+func ourId(envelope *imap.Envelope, uid uint32) string {
+	if utils.IsInterfaceNil(envelope) {
+		// not much else we can do
+		return "nil-envelope;uid=" + strconv.Itoa(int(uid))
+	}
+
 	hashSources := []string{}
+	if !utils.IsInterfaceNil(envelope.Date) {
+		hashSources = append(hashSources, envelope.Date.String())
+	}
+	if !utils.IsInterfaceNil(envelope.Subject) {
+		hashSources = append(hashSources, envelope.Subject)
+	}
+	if !utils.IsInterfaceNil(envelope.From) {
+		hashSources = append(hashSources, utils.MustJSON(envelope.From))
+	}
+	if !utils.IsInterfaceNil(envelope.To) {
+		hashSources = append(hashSources, utils.MustJSON(envelope.To))
+	}
+	if !utils.IsInterfaceNil(envelope.Cc) {
+		hashSources = append(hashSources, utils.MustJSON(envelope.Cc))
+	}
+	if !utils.IsInterfaceNil(envelope.Bcc) {
+		hashSources = append(hashSources, utils.MustJSON(envelope.Bcc))
+	}
+	if !utils.IsInterfaceNil(envelope.ReplyTo) {
+		hashSources = append(hashSources, utils.MustJSON(envelope.ReplyTo))
+	}
+	if !utils.IsInterfaceNil(envelope.InReplyTo) {
+		hashSources = append(hashSources, envelope.InReplyTo)
+	}
+	if !utils.IsInterfaceNil(envelope.MessageId) {
+		hashSources = append(hashSources, envelope.MessageId)
+	}
 
+	// NOTE: the body isn't hashed, so that an email keeps its our_id however its body is parsed. different emails with
+	// 		 the same envelope do happen (e.g. automated mails without a message-id sent in the same second), the database
+	// 		 stores the second one under an our_id that includes its body hash, see database.collisionFreeOurId
+	hasher := sha256.New()
+	hasher.Write([]byte(strings.Join(hashSources, "")))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// the our_id of an email whose envelope is the same as that of a different, already stored email
+func CollidingOurId(ourId string, bodyHash string) string {
+	return ourId + ";body_hash=" + bodyHash
+}
+
+// every header field in the order it appears in the message, with encoded words decoded
+func headersFromRaw(raw []byte) ([]models.Header, error) {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return nil, utils.JoinErrors("failed to read message header", err)
+	}
+	headers := []models.Header{}
+	fields := (&message.Header{Header: header}).Fields()
+	for fields.Next() {
+		// on an unknown charset the undecoded value is returned along with the error, which is the best we can do
+		value, _ := fields.Text()
+		headers = append(headers, models.Header{
+			Name:     strings.ToLower(fields.Key()),
+			Value:    value,
+			Position: len(headers) + 1,
+		})
+	}
+	return headers, nil
+}
+
+// flattens the address lists of the envelope into the rows of the email_address table
+func addressesFromEnvelope(envelope *imap.Envelope) []models.EmailAddress {
+	addresses := []models.EmailAddress{}
+	if utils.IsInterfaceNil(envelope) {
+		return addresses
+	}
+	roles := []struct {
+		name      string
+		addresses []*imap.Address
+	}{
+		{"from", envelope.From},
+		{"sender", envelope.Sender},
+		{"reply_to", envelope.ReplyTo},
+		{"to", envelope.To},
+		{"cc", envelope.Cc},
+		{"bcc", envelope.Bcc},
+	}
+	for _, role := range roles {
+		for index, address := range role.addresses {
+			if address == nil {
+				continue
+			}
+			fullAddress := address.MailboxName
+			if address.HostName != "" {
+				fullAddress += "@" + address.HostName
+			}
+			addresses = append(addresses, models.EmailAddress{
+				Role:     role.name,
+				Position: index + 1,
+				Name:     address.PersonalName,
+				Mailbox:  address.MailboxName,
+				Host:     address.HostName,
+				Address:  strings.ToLower(fullAddress),
+			})
+		}
+	}
+	return addresses
+}
+
+// header dates further ahead of INTERNALDATE than this are bogus, e.g. spam or a sender with a broken clock
+const maxDateSkew = 24 * time.Hour
+
+// the Date header is bogus if it's missing (the zero time), from before 1971 or from the future
+func plausibleDate(date time.Time, internalDate time.Time) bool {
+	if date.Year() < 1971 {
+		return false
+	}
+	if internalDate.IsZero() {
+		internalDate = time.Now()
+	}
+	return !date.After(internalDate.Add(maxDateSkew))
+}
+
+func (email *Email) setTimestamps(headerDate time.Time, internalDate time.Time) {
+	if !internalDate.IsZero() {
+		email.InternalDateEpoch = internalDate.Unix()
+	}
+	date := headerDate
+	if !plausibleDate(headerDate, internalDate) {
+		if internalDate.IsZero() {
+			return
+		}
+		date = internalDate
+	}
+	_, offset := date.Zone()
+	email.DateEpoch = date.Unix()
+	email.DateOffset = offset / 60
+}
+
+func (emailWrap *Email) parseMessage(envelope *imap.Envelope, flags []string, uid uint32, internalDate time.Time, r io.Reader) *Email {
 	email := &Email{
-		Flags:    msg.Flags,
-		Envelope: msg.Envelope,
-		UID:      msg.Uid,
+		Flags:    flags,
+		Envelope: envelope,
+		UID:      uid,
 	}
 
 	if !utils.IsInterfaceNil(email.Envelope) {
 		if !utils.IsInterfaceNil(email.Envelope.Date) {
-			hashSources = append(hashSources, email.Envelope.Date.String())
 			email.Date = email.Envelope.Date.String()
 		}
 		if !utils.IsInterfaceNil(email.Envelope.Subject) {
-			hashSources = append(hashSources, email.Envelope.Subject)
 			email.Subject = email.Envelope.Subject
 		}
 		if !utils.IsInterfaceNil(email.Envelope.From) {
-			hashSources = append(hashSources, utils.MustJSON(email.Envelope.From))
 			if len(email.Envelope.From) > 0 {
 				email.FromName1 = email.Envelope.From[0].PersonalName
 				email.FromMailbox1 = email.Envelope.From[0].MailboxName
@@ -215,7 +508,6 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 		}
 		if !utils.IsInterfaceNil(email.Envelope.To) {
-			hashSources = append(hashSources, utils.MustJSON(email.Envelope.To))
 			if len(email.Envelope.To) > 0 {
 				email.ToName1 = email.Envelope.To[0].PersonalName
 				email.ToMailbox1 = email.Envelope.To[0].MailboxName
@@ -223,7 +515,6 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 		}
 		if !utils.IsInterfaceNil(email.Envelope.Cc) {
-			hashSources = append(hashSources, utils.MustJSON(email.Envelope.Cc))
 			if len(email.Envelope.Cc) > 0 {
 				email.CcName1 = email.Envelope.Cc[0].PersonalName
 				email.CcMailbox1 = email.Envelope.Cc[0].MailboxName
@@ -231,7 +522,6 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 		}
 		if !utils.IsInterfaceNil(email.Envelope.Bcc) {
-			hashSources = append(hashSources, utils.MustJSON(email.Envelope.Bcc))
 			if len(email.Envelope.Bcc) > 0 {
 				email.BccName1 = email.Envelope.Bcc[0].PersonalName
 				email.BccMailbox1 = email.Envelope.Bcc[0].MailboxName
@@ -239,7 +529,6 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 		}
 		if !utils.IsInterfaceNil(email.Envelope.ReplyTo) {
-			hashSources = append(hashSources, utils.MustJSON(email.Envelope.ReplyTo))
 			if len(email.Envelope.ReplyTo) > 0 {
 				email.ReplyToName1 = email.Envelope.ReplyTo[0].PersonalName
 				email.ReplyToMailbox1 = email.Envelope.ReplyTo[0].MailboxName
@@ -247,42 +536,62 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 		}
 		if !utils.IsInterfaceNil(email.Envelope.InReplyTo) {
-			hashSources = append(hashSources, email.Envelope.InReplyTo)
 			email.InReplyTo = email.Envelope.InReplyTo
 		}
 		if !utils.IsInterfaceNil(email.Envelope.MessageId) {
-			hashSources = append(hashSources, email.Envelope.MessageId)
 			email.MessageId = email.Envelope.MessageId
 		}
-	} else {
-		// not much else we can do
-		email.OurId = "nil-envelope;uid=" + strconv.Itoa(int(email.UID))
 	}
-
-	// NOTE: if needed in the future we can also hash the body, but I haven't seen any collisions yet,
-	// 		 so it seems overkill
-
-	if !strings.HasPrefix(email.OurId, "nil-envelope") {
-		hasher := sha256.New()
-		hasher.Write([]byte(strings.Join(hashSources, "")))
-		email.OurId = hex.EncodeToString(hasher.Sum(nil))
+	headerDate := time.Time{}
+	if !utils.IsInterfaceNil(email.Envelope) {
+		headerDate = email.Envelope.Date
 	}
+	email.setTimestamps(headerDate, internalDate)
+	email.OurId = ourId(email.Envelope, email.UID)
+	email.Addresses = addressesFromEnvelope(email.Envelope)
 
-	r := msg.GetBody(models.SectionToFetch)
 	if r == nil {
 		errorMsg := "Server didn't return a message body"
-		if emailWrap.client.Options().GetStrictMailParsing() {
+		if emailWrap.options.GetStrictMailParsing() {
 			log.Fatal(errorMsg)
 		} else {
 			email.ParseError = errorMsg
 			return email
 		}
 	}
+	// keep the original bytes around so they can be archived as-is
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		errorMessage := fmt.Sprintf("failed to read message body: %v", err)
+		if emailWrap.options.GetStrictMailParsing() {
+			log.Fatal(errorMessage, "\n")
+		} else {
+			email.ParseError = errorMessage
+			return email
+		}
+	}
+	email.raw = raw
+
+	// read separately from the mail reader below, so that a message with an unparseable body still gets its headers
+	email.headers, err = headersFromRaw(raw)
+	if err != nil {
+		utils.DebugPrintln("failed to read headers of", email.OurId, err)
+	}
+	for _, header := range email.headers {
+		if header.Name == "references" && email.References == "" {
+			email.References = strings.Join(strings.Fields(header.Value), " ")
+		}
+		// google takeout exports carry the gmail thread id as a header
+		if header.Name == "x-gm-thrid" && email.GmailThreadId == "" {
+			email.GmailThreadId = strings.TrimSpace(header.Value)
+		}
+	}
+
 	// Create a new mail reader
-	mr, err := mail.CreateReader(r)
+	mr, err := mail.CreateReader(bytes.NewReader(raw))
 	if err != nil {
 		errorMessage := fmt.Sprintf("failed to create mail reader: %v", err)
-		if emailWrap.client.Options().GetStrictMailParsing() {
+		if emailWrap.options.GetStrictMailParsing() {
 			log.Fatal(errorMessage, "\n")
 		} else {
 			email.ParseError = errorMessage
@@ -299,7 +608,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			if emailWrap.client.Options().GetStrictMailParsing() {
+			if emailWrap.options.GetStrictMailParsing() {
 				log.Fatal("failed to parse next part ", err)
 			} else {
 
@@ -308,7 +617,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 		}
 		// sometime part is nil, not sure why, we'll consider that an error
 		if part == nil {
-			if emailWrap.client.Options().GetStrictMailParsing() {
+			if emailWrap.options.GetStrictMailParsing() {
 				log.Fatal("part is nil")
 			} else {
 				email.ParseError = "received an empty message part from the mail parser"
@@ -321,7 +630,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			// can be plain-text , HTML, or inline attachments
 			contentType, params, err := h.ContentType()
 			if err != nil {
-				if emailWrap.client.Options().GetStrictMailParsing() {
+				if emailWrap.options.GetStrictMailParsing() {
 					log.Fatal("failed to get content type", err)
 				} else {
 					email.ParseError = err.Error()
@@ -330,7 +639,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 			content, contentErr := io.ReadAll(part.Body)
 			if contentErr != nil {
-				if emailWrap.client.Options().GetStrictMailParsing() {
+				if emailWrap.options.GetStrictMailParsing() {
 					log.Fatal("failed to read body", err)
 				} else {
 					email.ParseError = contentErr.Error()
@@ -391,6 +700,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 				attachment.FileName = fileName
 				attachment.FileSize = size
 				email.Attachments = append(email.Attachments, attachment)
+				email.attachmentTexts = append(email.attachmentTexts, attachmentText(len(email.Attachments), attachment, content))
 
 			} else {
 				email.ParseWarning = fmt.Sprintf("unknown inline content type: %v\n", contentType)
@@ -401,7 +711,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 
 			contentType, _, err := h.ContentType()
 			if err != nil {
-				if emailWrap.client.Options().GetStrictMailParsing() {
+				if emailWrap.options.GetStrictMailParsing() {
 					log.Fatal("failed to get content type", err)
 				} else {
 					email.ParseError = err.Error()
@@ -410,7 +720,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			}
 
 			content, contentErr := io.ReadAll(part.Body)
-			if contentErr != nil && emailWrap.client.Options().GetStrictMailParsing() {
+			if contentErr != nil && emailWrap.options.GetStrictMailParsing() {
 				log.Fatal("failed to read body", err)
 			}
 
@@ -426,6 +736,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			attachment.FileType = contentType
 			attachment.Disposition = models.DispositionAttachment
 			email.Attachments = append(email.Attachments, attachment)
+			email.attachmentTexts = append(email.attachmentTexts, attachmentText(len(email.Attachments), attachment, content))
 		}
 
 		reg, err := regexp.Compile("[^a-zA-Z0-9]+")
@@ -438,6 +749,7 @@ func (emailWrap *Email) parseMessage(msg *imap.Message) *Email {
 			email.TextContent = html2text.HTML2Text(email.HTMLContent)
 		}
 	}
+	email.setFingerprints()
 	return email
 }
 
@@ -564,3 +876,63 @@ func (emailWrap *Email) GetBccHost1() string {
 func (emailWrap *Email) GetInReplyTo() string {
 	return emailWrap.InReplyTo
 }
+
+func (emailWrap *Email) GetReferences() string {
+	return emailWrap.References
+}
+
+func (emailWrap *Email) GetGmailThreadId() string {
+	return emailWrap.GmailThreadId
+}
+
+func (emailWrap *Email) GetBodyHash() string {
+	return emailWrap.BodyHash
+}
+
+func (emailWrap *Email) GetBodySimhash() string {
+	return emailWrap.BodySimhash
+}
+
+func (emailWrap *Email) GetThreadId() string {
+	return emailWrap.ThreadId
+}
+
+func (emailWrap *Email) GetMailboxes() []string {
+	return emailWrap.Mailboxes
+}
+
+func (emailWrap *Email) GetDeletedOnServerAt() int64 {
+	return emailWrap.DeletedOnServerAt
+}
+
+func (emailWrap *Email) GetAddresses() []models.EmailAddress {
+	return emailWrap.Addresses
+}
+
+func (emailWrap *Email) GetDateEpoch() int64 {
+	return emailWrap.DateEpoch
+}
+
+func (emailWrap *Email) GetDateOffset() int {
+	return emailWrap.DateOffset
+}
+
+func (emailWrap *Email) GetInternalDateEpoch() int64 {
+	return emailWrap.InternalDateEpoch
+}
+
+func (emailWrap *Email) GetHeaders() []models.Header {
+	return emailWrap.headers
+}
+
+func (emailWrap *Email) GetAttachmentTexts() []models.AttachmentText {
+	return emailWrap.attachmentTexts
+}
+
+func (emailWrap *Email) GetMatchedAttachments() []string {
+	return emailWrap.MatchedAttachments
+}
+
+func (emailWrap *Email) GetRaw() []byte {
+	return emailWrap.raw
+}
@@ -0,0 +1,74 @@
+package email
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"hash/fnv"
+	"regexp"
+	"strings"
+)
+
+// bodies with fewer words than this get no simhash, a few words are too little to tell near duplicates apart
+const minSimhashWords = 10
+
+// the number of consecutive words that make up a simhash feature
+const shingleSize = 3
+
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+/*
+Fingerprints returns the body hash and the simhash of an email, from its text (the text of the html part if there is no
+plain text one) and attachments. The text is reduced to its lower cased words first, so that a message that was
+re-encoded, re-wrapped or had its whitespace changed on the way still hashes the same.
+The body hash is empty if the email has neither text nor attachments, the simhash is empty if the text is too short.
+*/
+func Fingerprints(text string, attachments []models.AttachmentMetaData) (string, string) {
+	words := wordPattern.FindAllString(strings.ToLower(text), -1)
+	return bodyHash(words, attachments), simhash(words)
+}
+
+// sha256 of the words and the name, type and size of every attachment
+func bodyHash(words []string, attachments []models.AttachmentMetaData) string {
+	if len(words) == 0 && len(attachments) == 0 {
+		return ""
+	}
+	hasher := sha256.New()
+	hasher.Write([]byte(strings.Join(words, " ")))
+	for _, attachment := range attachments {
+		hasher.Write([]byte(fmt.Sprintf("\x00%s\x00%s\x00%d", attachment.FileName, attachment.FileType, attachment.FileSize)))
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// 64 bit simhash over word shingles as 16 hex digits, texts that differ in a few words differ in a few bits
+func simhash(words []string) string {
+	if len(words) < minSimhashWords {
+		return ""
+	}
+	weights := [64]int{}
+	for i := 0; i+shingleSize <= len(words); i++ {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(strings.Join(words[i:i+shingleSize], " ")))
+		feature := hasher.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if feature&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	hash := uint64(0)
+	for bit := 0; bit < 64; bit++ {
+		if weights[bit] > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+func (email *Email) setFingerprints() {
+	email.BodyHash, email.BodySimhash = Fingerprints(email.TextContent, email.Attachments)
+}
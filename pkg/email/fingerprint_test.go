@@ -0,0 +1,74 @@
+package email
+
+import (
+	"math/bits"
+	"strconv"
+	"testing"
+
+	"github.com/skamensky/email-archiver/pkg/models"
+)
+
+const report = "Hello team, the quarterly report is attached. Revenue grew by ten percent and costs stayed flat, see the second page for details."
+
+func TestFingerprints(t *testing.T) {
+	pdf := []models.AttachmentMetaData{{FileName: "report.pdf", FileType: "application/pdf", FileSize: 1000}}
+	tests := []struct {
+		name         string
+		a            string
+		aAttachments []models.AttachmentMetaData
+		b            string
+		bAttachments []models.AttachmentMetaData
+		sameHash     bool
+		// the most simhash bits a and b may differ in, -1 if they aren't compared
+		maxDistance int
+	}{
+		{"case, whitespace and punctuation don't matter", report, nil, "HELLO team -- the quarterly report\n is attached; revenue grew by ten percent and costs stayed flat,\r\nsee the second page for details", nil, true, 0},
+		{"one word changed", report, nil, "Hello team, the quarterly report is attached. Revenue grew by eleven percent and costs stayed flat, see the second page for details.", nil, false, 12},
+		{"attachments are part of the hash", report, pdf, report, nil, false, 0},
+		{"attachment sizes are part of the hash", report, pdf, report, []models.AttachmentMetaData{{FileName: "report.pdf", FileType: "application/pdf", FileSize: 2000}}, false, 0},
+		{"short texts", "thanks!", nil, "Thanks", nil, true, -1},
+	}
+	for _, test := range tests {
+		aHash, aSimhash := Fingerprints(test.a, test.aAttachments)
+		bHash, bSimhash := Fingerprints(test.b, test.bAttachments)
+		if (aHash == bHash) != test.sameHash {
+			t.Errorf("%s: got hashes %s and %s, expected them to be the same: %v", test.name, aHash, bHash, test.sameHash)
+		}
+		if test.maxDistance < 0 {
+			continue
+		}
+		a, err := strconv.ParseUint(aSimhash, 16, 64)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		b, err := strconv.ParseUint(bSimhash, 16, 64)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if distance := bits.OnesCount64(a ^ b); distance > test.maxDistance {
+			t.Errorf("%s: the simhashes differ in %d bits, expected at most %d", test.name, distance, test.maxDistance)
+		}
+	}
+}
+
+func TestFingerprintsEmpty(t *testing.T) {
+	tests := []struct {
+		text         string
+		attachments  []models.AttachmentMetaData
+		emptyHash    bool
+		emptySimhash bool
+	}{
+		{"", nil, true, true},
+		{" -- \n", nil, true, true},
+		{"", []models.AttachmentMetaData{{FileName: "scan.jpg", FileType: "image/jpeg", FileSize: 1000}}, false, true},
+		// 9 words
+		{"one two three four five six seven eight nine", nil, false, true},
+		{"one two three four five six seven eight nine ten", nil, false, false},
+	}
+	for _, test := range tests {
+		hash, simhash := Fingerprints(test.text, test.attachments)
+		if (hash == "") != test.emptyHash || (simhash == "") != test.emptySimhash {
+			t.Errorf("%q: got hash %q and simhash %q, expected them to be empty: %v, %v", test.text, hash, simhash, test.emptyHash, test.emptySimhash)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"golang.org/x/crypto/scrypt"
+	"os"
+	"strings"
+)
+
+/*
+The archive uses envelope encryption: message contents are encrypted with a random data key, and the data key is
+stored in the db encrypted ("wrapped") with a key derived from the user's passphrase or key file.
+Changing the passphrase only re-wraps the data key, so it is instant no matter how large the archive is.
+*/
+
+// prefix of every encrypted column value, values without it are plaintext from before encryption was enabled
+const ColumnPrefix = "enc:v1:"
+
+// the first bytes of every encrypted blob
+var blobMagic = []byte("EMAIL-ARCHIVER-ENC-V1\n")
+
+const dataKeySize = 32
+
+// scrypt parameters recommended for interactive logins as of 2017, they are stored with the wrapped key so they can change
+const (
+	defaultScryptN = 1 << 15
+	defaultScryptR = 8
+	defaultScryptP = 1
+)
+
+var ErrWrongKey = errors.New("wrong passphrase or key file")
+
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(dataKey []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create aes cipher", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create gcm cipher", err)
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// returns nonce + ciphertext
+func (c *Cipher) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to generate nonce", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (c *Cipher) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to decrypt, the value was modified or encrypted with another key", err)
+	}
+	return plaintext, nil
+}
+
+func IsEncryptedString(value string) bool {
+	return strings.HasPrefix(value, ColumnPrefix)
+}
+
+func IsEncryptedBytes(value []byte) bool {
+	return bytes.HasPrefix(value, blobMagic)
+}
+
+// EncryptString encrypts a column value, already encrypted values are returned as-is
+func (c *Cipher) EncryptString(value string) (string, error) {
+	if IsEncryptedString(value) {
+		return value, nil
+	}
+	sealed, err := c.seal([]byte(value))
+	if err != nil {
+		return "", err
+	}
+	return ColumnPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptString decrypts a column value, plaintext values are returned as-is
+func (c *Cipher) DecryptString(value string) (string, error) {
+	if !IsEncryptedString(value) {
+		return value, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ColumnPrefix))
+	if err != nil {
+		return "", utils.JoinErrors("failed to decode encrypted value", err)
+	}
+	plaintext, err := c.open(sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptBytes encrypts a blob, already encrypted blobs are returned as-is
+func (c *Cipher) EncryptBytes(value []byte) ([]byte, error) {
+	if IsEncryptedBytes(value) {
+		return value, nil
+	}
+	sealed, err := c.seal(value)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, blobMagic...), sealed...), nil
+}
+
+// DecryptBytes decrypts a blob, plaintext blobs are returned as-is
+func (c *Cipher) DecryptBytes(value []byte) ([]byte, error) {
+	if !IsEncryptedBytes(value) {
+		return value, nil
+	}
+	return c.open(value[len(blobMagic):])
+}
+
+// WrappedKey is what gets stored in the db, the data key encrypted with a key derived from the passphrase
+type WrappedKey struct {
+	Kdf  string `json:"kdf"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+	Key  []byte `json:"key"`
+}
+
+func NewDataKey() ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to generate data key", err)
+	}
+	return dataKey, nil
+}
+
+func keyEncryptionCipher(keyMaterial []byte, wrapped WrappedKey) (*Cipher, error) {
+	if wrapped.Kdf != "scrypt" {
+		return nil, fmt.Errorf("unknown key derivation function %q", wrapped.Kdf)
+	}
+	derived, err := scrypt.Key(keyMaterial, wrapped.Salt, wrapped.N, wrapped.R, wrapped.P, dataKeySize)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to derive key", err)
+	}
+	return NewCipher(derived)
+}
+
+// Wrap encrypts dataKey with a key derived from keyMaterial and a fresh salt
+func Wrap(dataKey []byte, keyMaterial []byte) (WrappedKey, error) {
+	wrapped := WrappedKey{Kdf: "scrypt", N: defaultScryptN, R: defaultScryptR, P: defaultScryptP, Salt: make([]byte, 16)}
+	_, err := rand.Read(wrapped.Salt)
+	if err != nil {
+		return WrappedKey{}, utils.JoinErrors("failed to generate salt", err)
+	}
+	kek, err := keyEncryptionCipher(keyMaterial, wrapped)
+	if err != nil {
+		return WrappedKey{}, err
+	}
+	wrapped.Key, err = kek.seal(dataKey)
+	return wrapped, err
+}
+
+// Unwrap returns ErrWrongKey if keyMaterial is not what the key was wrapped with
+func Unwrap(wrapped WrappedKey, keyMaterial []byte) ([]byte, error) {
+	kek, err := keyEncryptionCipher(keyMaterial, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := kek.open(wrapped.Key)
+	if err != nil {
+		// gcm authenticates the wrapped key, so a failure means the derived key is wrong
+		return nil, ErrWrongKey
+	}
+	return dataKey, nil
+}
+
+// KeyMaterial returns the passphrase or the key file contents, or nil if encryption isn't configured
+func KeyMaterial(passphrase string, keyFile string) ([]byte, error) {
+	if passphrase != "" && keyFile != "" {
+		return nil, errors.New("only one of a passphrase or a key file can be given")
+	}
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+	material, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, utils.JoinErrors(fmt.Sprintf("failed to read key file %s", keyFile), err)
+	}
+	material = bytes.TrimSpace(material)
+	if len(material) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", keyFile)
+	}
+	return material, nil
+}
@@ -0,0 +1,413 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/mail"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/query"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the layout produced by time.Time.String(), which is how email.Date is stored
+const storedDateLayout = "2006-01-02 15:04:05 -0700 MST"
+
+// emails are exported to this pseudo mailbox when they have no mailbox membership
+const unfiledMailbox = "Unfiled"
+
+/*
+Selection describes which emails to export. At most one of SqlQuery, SearchQuery, Query, SavedQuery or Mailboxes
+should be set. SqlQuery is passed as-is to DB.StreamEmails, SearchQuery to DB.StreamFullTextSearch. Query is written in
+the search query language of the query package. SavedQuery is the name of a saved sql or search language query.
+Headers, After and Before narrow any other selection down to the emails matching every filter, on their own they
+select every matching email. They can't be combined with SearchQuery.
+*/
+type Selection struct {
+	SqlQuery    string
+	SearchQuery string
+	Query       string
+	SavedQuery  string
+	Mailboxes   []string
+	Headers     []HeaderFilter
+	// emails dated at or after After and before Before, see the date_epoch column. Ignored when zero
+	After  time.Time
+	Before time.Time
+}
+
+// HeaderFilter matches emails with a header field called Name whose value contains Value, both case insensitive
+type HeaderFilter struct {
+	Name string `json:"name"`
+	// any value matches when empty
+	Value string `json:"value"`
+}
+
+// ParseDate parses the After and Before of a Selection, either a day ("2020-01-31", midnight UTC) or RFC 3339
+func ParseDate(date string) (time.Time, error) {
+	if date == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse("2006-01-02", date)
+	if err == nil {
+		return parsed, nil
+	}
+	parsed, err = time.Parse(time.RFC3339, date)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a date like 2020-01-31 nor an RFC 3339 time like 2020-01-31T12:00:00+02:00", date)
+	}
+	return parsed, nil
+}
+
+func (selection Selection) hasFilters() bool {
+	return len(selection.Headers) > 0 || !selection.After.IsZero() || !selection.Before.IsZero()
+}
+
+// ParseHeaderFilter parses "List-Id: dev.example.org", or just "List-Id" to match any value
+func ParseHeaderFilter(filter string) HeaderFilter {
+	name, value, _ := strings.Cut(filter, ":")
+	return HeaderFilter{Name: strings.TrimSpace(name), Value: strings.TrimSpace(value)}
+}
+
+func (selection Selection) validate() error {
+	set := 0
+	if selection.SqlQuery != "" {
+		set++
+	}
+	if selection.SearchQuery != "" {
+		set++
+	}
+	if selection.Query != "" {
+		set++
+	}
+	if selection.SavedQuery != "" {
+		set++
+	}
+	if len(selection.Mailboxes) > 0 {
+		set++
+	}
+	if set > 1 || (set == 0 && !selection.hasFilters()) {
+		return errors.New("exactly one of a sql query, a search query, a query, a saved query or a list of mailboxes, or header or date filters, must be given")
+	}
+	if selection.SearchQuery != "" && selection.hasFilters() {
+		return errors.New("header and date filters can't be combined with a search query, use a sql query instead")
+	}
+	for _, filter := range selection.Headers {
+		if filter.Name == "" {
+			return errors.New("header filters need a header name")
+		}
+	}
+	return nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// returns a sql condition on the email columns that is true for emails matching every header and date filter
+func (selection Selection) filterCondition() (string, []interface{}) {
+	conditions := []string{}
+	params := []interface{}{}
+	if !selection.After.IsZero() {
+		conditions = append(conditions, "date_epoch >= ?")
+		params = append(params, selection.After.Unix())
+	}
+	if !selection.Before.IsZero() {
+		conditions = append(conditions, "date_epoch < ?")
+		params = append(params, selection.Before.Unix())
+	}
+	for _, filter := range selection.Headers {
+		if filter.Value == "" {
+			conditions = append(conditions, "our_id IN (SELECT our_id FROM header WHERE name = ?)")
+			params = append(params, strings.ToLower(filter.Name))
+			continue
+		}
+		conditions = append(conditions, `our_id IN (SELECT our_id FROM header WHERE name = ? AND lower(value) LIKE ? ESCAPE '\')`)
+		params = append(params, strings.ToLower(filter.Name), "%"+likeEscaper.Replace(strings.ToLower(filter.Value))+"%")
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// replaces SavedQuery with the sql or search query language query it names
+func (selection Selection) resolve(db models.DB) (Selection, error) {
+	if selection.SavedQuery == "" {
+		return selection, nil
+	}
+	saved, err := db.GetSavedQuery(selection.SavedQuery)
+	if err != nil {
+		return selection, err
+	}
+	if saved == nil {
+		return selection, fmt.Errorf("there is no saved query called %q", selection.SavedQuery)
+	}
+	selection.SavedQuery = ""
+	if saved.Kind == models.SavedQuerySQL {
+		selection.SqlQuery = saved.Query
+	} else {
+		selection.Query = saved.Query
+	}
+	return selection, nil
+}
+
+// the sql query selecting the emails of every selection except a SearchQuery
+func (selection Selection) sql(db models.DB) (string, []interface{}, error) {
+	filterCondition, filterParams := selection.filterCondition()
+	if selection.Query != "" {
+		condition, params, err := query.Compile(selection.Query, db.Backend(), time.Now())
+		if err != nil {
+			return "", nil, err
+		}
+		if filterCondition != "" {
+			condition += " AND " + filterCondition
+			params = append(params, filterParams...)
+		}
+		return fmt.Sprintf("SELECT * FROM email WHERE %s ORDER BY coalesce(date_epoch, 0) DESC", condition), params, nil
+	}
+	if selection.SqlQuery != "" {
+		if filterCondition == "" {
+			return selection.SqlQuery, nil, nil
+		}
+		sqlQuery := strings.TrimSuffix(strings.TrimSpace(selection.SqlQuery), ";")
+		return fmt.Sprintf("SELECT * FROM (%s) selected WHERE %s", sqlQuery, filterCondition), filterParams, nil
+	}
+	if len(selection.Mailboxes) == 0 {
+		return "SELECT * FROM email WHERE " + filterCondition, filterParams, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(selection.Mailboxes)), ",")
+	params := []interface{}{}
+	for _, mailbox := range selection.Mailboxes {
+		params = append(params, mailbox)
+	}
+	sqlQuery := fmt.Sprintf("SELECT * FROM email WHERE our_id IN (SELECT our_id FROM message_to_mailbox WHERE mailbox_name IN (%s) AND %s)", placeholders, query.CurrentMembershipCondition)
+	if filterCondition != "" {
+		sqlQuery += " AND " + filterCondition
+		params = append(params, filterParams...)
+	}
+	return sqlQuery, params, nil
+}
+
+// Stream hands the selected emails to handle one by one instead of loading them all into memory
+func (selection Selection) Stream(db models.DB, handle func(models.Email) error) error {
+	err := selection.validate()
+	if err != nil {
+		return err
+	}
+	selection, err = selection.resolve(db)
+	if err != nil {
+		return err
+	}
+	if selection.SearchQuery != "" {
+		return db.StreamFullTextSearch(selection.SearchQuery, handle)
+	}
+	sqlQuery, params, err := selection.sql(db)
+	if err != nil {
+		return err
+	}
+	return db.StreamEmails(handle, sqlQuery, params...)
+}
+
+// Count returns how many emails Stream would hand over, without reading them
+func (selection Selection) Count(db models.DB) (int, error) {
+	err := selection.validate()
+	if err != nil {
+		return 0, err
+	}
+	selection, err = selection.resolve(db)
+	if err != nil {
+		return 0, err
+	}
+	if selection.SearchQuery != "" {
+		count := 0
+		err = db.StreamFullTextSearch(selection.SearchQuery, func(models.Email) error {
+			count++
+			return nil
+		})
+		return count, err
+	}
+	sqlQuery, params, err := selection.sql(db)
+	if err != nil {
+		return 0, err
+	}
+	return db.CountEmails(sqlQuery, params...)
+}
+
+/*
+MailboxesFor returns the mailboxes an exported email should be filed under.
+When exporting whole mailboxes, only the selected mailboxes are considered.
+*/
+func (selection Selection) MailboxesFor(email models.Email) []string {
+	result := []string{}
+	if len(selection.Mailboxes) > 0 {
+		selected := utils.NewSet(selection.Mailboxes)
+		for _, mailbox := range email.GetMailboxes() {
+			if selected.Contains(mailbox) {
+				result = append(result, mailbox)
+			}
+		}
+	} else {
+		result = append(result, email.GetMailboxes()...)
+	}
+	if len(result) == 0 {
+		result = append(result, unfiledMailbox)
+	}
+	return result
+}
+
+/*
+MessageBytes returns the original bytes of the message if they were kept in the blob store,
+otherwise it reconstructs a message from the stored fields.
+Reconstructed messages carry an X-Email-Archiver-Reconstructed header and have no attachment content, since only
+attachment metadata is stored.
+*/
+func MessageBytes(db models.DB, email models.Email) ([]byte, error) {
+	raw, err := db.GetRawMessage(email.GetOurID())
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get raw message", err)
+	}
+	if raw != nil {
+		return raw, nil
+	}
+	return reconstruct(email)
+}
+
+// EmailDate returns the best known date of an email, or the zero time if there is none
+func EmailDate(email models.Email) time.Time {
+	if email.GetDateEpoch() != 0 {
+		return time.Unix(email.GetDateEpoch(), 0).In(time.FixedZone("", email.GetDateOffset()*60))
+	}
+	if envelope := email.GetEnvelope(); envelope != nil && !envelope.Date.IsZero() {
+		return envelope.Date
+	}
+	date, err := time.Parse(storedDateLayout, email.GetDate())
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+func toMailAddresses(addresses []*imap.Address) []*mail.Address {
+	result := []*mail.Address{}
+	for _, address := range addresses {
+		if address == nil || address.MailboxName == "" {
+			continue
+		}
+		result = append(result, &mail.Address{Name: address.PersonalName, Address: address.Address()})
+	}
+	return result
+}
+
+type bodyPart struct {
+	contentType string
+	content     string
+}
+
+func reconstruct(email models.Email) ([]byte, error) {
+	header := mail.Header{}
+	header.Set("X-Email-Archiver-Reconstructed", "true")
+	header.SetSubject(email.GetSubject())
+	if date := EmailDate(email); !date.IsZero() {
+		header.SetDate(date)
+	}
+	if email.GetMessageId() != "" {
+		header.Set("Message-Id", email.GetMessageId())
+	}
+	if email.GetInReplyTo() != "" {
+		header.Set("In-Reply-To", email.GetInReplyTo())
+	}
+
+	if envelope := email.GetEnvelope(); envelope != nil {
+		addressHeaders := []struct {
+			key       string
+			addresses []*imap.Address
+		}{
+			{"From", envelope.From},
+			{"Sender", envelope.Sender},
+			{"Reply-To", envelope.ReplyTo},
+			{"To", envelope.To},
+			{"Cc", envelope.Cc},
+			{"Bcc", envelope.Bcc},
+		}
+		for _, addressHeader := range addressHeaders {
+			if converted := toMailAddresses(addressHeader.addresses); len(converted) > 0 {
+				header.SetAddressList(addressHeader.key, converted)
+			}
+		}
+	} else if email.GetFromMailbox1() != "" {
+		// older records or parse failures may only have the flattened fields
+		header.SetAddressList("From", []*mail.Address{{
+			Name:    email.GetFromName1(),
+			Address: email.GetFromMailbox1() + "@" + email.GetFromHost1(),
+		}})
+	}
+
+	parts := []bodyPart{}
+	if email.GetTextContent() != "" {
+		parts = append(parts, bodyPart{"text/plain", email.GetTextContent()})
+	}
+	if email.GetHTMLContent() != "" {
+		parts = append(parts, bodyPart{"text/html", email.GetHTMLContent()})
+	}
+
+	buffer := &bytes.Buffer{}
+	if len(parts) <= 1 {
+		contentType, content := "text/plain", ""
+		if len(parts) == 1 {
+			contentType, content = parts[0].contentType, parts[0].content
+		}
+		header.SetContentType(contentType, map[string]string{"charset": "utf-8"})
+		writer, err := mail.CreateSingleInlineWriter(buffer, header)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to create message writer", err)
+		}
+		_, err = io.WriteString(writer, content)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to write message body", err)
+		}
+		err = writer.Close()
+		if err != nil {
+			return nil, utils.JoinErrors("failed to close message writer", err)
+		}
+		return buffer.Bytes(), nil
+	}
+
+	writer, err := mail.CreateInlineWriter(buffer, header)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to create message writer", err)
+	}
+	for _, part := range parts {
+		partHeader := mail.InlineHeader{}
+		partHeader.SetContentType(part.contentType, map[string]string{"charset": "utf-8"})
+		partWriter, err := writer.CreatePart(partHeader)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to create message part", err)
+		}
+		_, err = io.WriteString(partWriter, part.content)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to write message part", err)
+		}
+		err = partWriter.Close()
+		if err != nil {
+			return nil, utils.JoinErrors("failed to close message part", err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to close message writer", err)
+	}
+	return buffer.Bytes(), nil
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^a-zA-Z0-9 ._\-\[\]]+`)
+
+// turns a mailbox name such as "[Gmail]/Sent Mail" into something usable as a file name
+func safeFileName(mailboxName string) string {
+	name := unsafeFileNameChars.ReplaceAllString(mailboxName, "_")
+	name = strings.Trim(name, " .")
+	if name == "" {
+		name = "_"
+	}
+	return name
+}
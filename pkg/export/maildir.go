@@ -0,0 +1,176 @@
+package export
+
+import (
+	"errors"
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/utf7"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaildirMultiFolderMode controls what happens to an email that is in several mailboxes (e.g. gmail labels)
+type MaildirMultiFolderMode string
+
+const (
+	// the first copy is written and every other folder gets a hard link to it
+	MaildirHardLinks MaildirMultiFolderMode = "link"
+	// every folder gets its own copy
+	MaildirCopies MaildirMultiFolderMode = "copy"
+)
+
+// imap flags to maildir info flags, see https://cr.yp.to/proto/maildir.html
+var imapFlagToMaildirFlag = map[string]rune{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	"$Forwarded":      'P',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+/*
+Maildir materializes the selected emails as a Maildir++ tree rooted at outPath.
+INBOX is the root maildir, every other mailbox becomes a ".Folder.Sub" directory, where delimiter is the imap hierarchy
+delimiter used by the server (usually "/" for gmail).
+Returns the number of files written and the number of hard links created.
+*/
+func Maildir(db models.DB, selection Selection, outPath string, delimiter string, mode MaildirMultiFolderMode) (int, int, error) {
+	if mode != MaildirHardLinks && mode != MaildirCopies {
+		return 0, 0, fmt.Errorf("unknown multi folder mode %q, expected %q or %q", mode, MaildirHardLinks, MaildirCopies)
+	}
+	createdFolders := utils.NewSet([]string{})
+	written, linked := 0, 0
+	err := selection.Stream(db, func(email models.Email) error {
+		raw, err := MessageBytes(db, email)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to get message %s", email.GetOurID()), err)
+		}
+		fileName := maildirFileName(email)
+
+		firstCopy := ""
+		for _, mailbox := range selection.MailboxesFor(email) {
+			folder, err := maildirFolderPath(outPath, mailbox, delimiter)
+			if err != nil {
+				return err
+			}
+			if !createdFolders.Contains(folder) {
+				err = createMaildirFolder(outPath, folder)
+				if err != nil {
+					return err
+				}
+				createdFolders.Add(folder)
+			}
+
+			target := filepath.Join(folder, "cur", fileName)
+			if firstCopy != "" && mode == MaildirHardLinks {
+				err = os.Link(firstCopy, target)
+				if errors.Is(err, os.ErrExist) {
+					// left over from a previous export
+					err = os.Remove(target)
+					if err == nil {
+						err = os.Link(firstCopy, target)
+					}
+				}
+				if err == nil {
+					linked++
+					continue
+				}
+				// e.g. the file system doesn't support hard links, fall back to a copy
+				utils.DebugPrintln("failed to hard link", target, "falling back to copying:", err)
+			}
+
+			err = writeMaildirMessage(folder, fileName, raw)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to write message %s", email.GetOurID()), err)
+			}
+			written++
+			if firstCopy == "" {
+				firstCopy = target
+			}
+		}
+		return nil
+	})
+	return written, linked, utils.JoinErrors("failed to export emails", err)
+}
+
+func maildirFolderPath(root string, mailbox string, delimiter string) (string, error) {
+	if strings.EqualFold(mailbox, "INBOX") {
+		return root, nil
+	}
+
+	components := []string{mailbox}
+	if delimiter != "" {
+		components = strings.Split(mailbox, delimiter)
+	}
+	encoder := utf7.Encoding.NewEncoder()
+	for i, component := range components {
+		encoded, err := encoder.String(component)
+		if err != nil {
+			return "", utils.JoinErrors(fmt.Sprintf("failed to encode mailbox name %s", mailbox), err)
+		}
+		// "." is the Maildir++ hierarchy separator and "/" can't be part of a directory name
+		encoded = strings.NewReplacer(".", "_", "/", "_").Replace(encoded)
+		components[i] = encoded
+	}
+	return filepath.Join(root, "."+strings.Join(components, ".")), nil
+}
+
+func createMaildirFolder(root string, folder string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		err := os.MkdirAll(filepath.Join(folder, sub), 0700)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to create maildir folder %s", folder), err)
+		}
+	}
+	if folder == root {
+		return nil
+	}
+	// Maildir++ marks sub folders with an empty maildirfolder file
+	marker, err := os.OpenFile(filepath.Join(folder, "maildirfolder"), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("failed to create maildirfolder marker in %s", folder), err)
+	}
+	return marker.Close()
+}
+
+/*
+file names are derived from the our_id so that exporting twice produces the same tree and copies of the same email
+in different folders share a name. The info suffix encodes the imap flags.
+*/
+func maildirFileName(email models.Email) string {
+	date := EmailDate(email)
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+	uniq := email.GetOurID()
+	if len(uniq) > 32 {
+		uniq = uniq[:32]
+	}
+	uniq = strings.NewReplacer("/", "_", ":", "_", ";", "_", "=", "_").Replace(uniq)
+
+	flags := []string{}
+	for _, flag := range email.GetFlags() {
+		if maildirFlag, ok := imapFlagToMaildirFlag[flag]; ok {
+			flags = append(flags, string(maildirFlag))
+		}
+	}
+	// the info flags must be in ascii order
+	sort.Strings(flags)
+	return fmt.Sprintf("%d.%s.email-archiver:2,%s", date.Unix(), uniq, strings.Join(flags, ""))
+}
+
+// follows the maildir delivery protocol: write to tmp, then rename into cur
+func writeMaildirMessage(folder string, fileName string, raw []byte) error {
+	tmpPath := filepath.Join(folder, "tmp", fileName)
+	err := os.WriteFile(tmpPath, raw, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(folder, "cur", fileName))
+}
@@ -0,0 +1,134 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// mboxrd quotes every line that looks like a (possibly already quoted) From_ line, so that quoting is reversible
+var fromLine = regexp.MustCompile(`^>*From `)
+
+/*
+Mbox writes the selected emails as mboxrd to outPath.
+If perMailbox is true, outPath is a directory and one "<mailbox>.mbox" file is written per mailbox, an email that is
+in several mailboxes is written to each of them. Otherwise outPath is a single combined file.
+Returns the number of messages written.
+*/
+func Mbox(db models.DB, selection Selection, outPath string, perMailbox bool) (int, error) {
+	files := map[string]*os.File{}
+	writers := map[string]*bufio.Writer{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	getWriter := func(mailbox string) (*bufio.Writer, error) {
+		if writer, ok := writers[mailbox]; ok {
+			return writer, nil
+		}
+		path := outPath
+		if perMailbox {
+			path = filepath.Join(outPath, safeFileName(mailbox)+".mbox")
+		}
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, utils.JoinErrors("failed to create output directory", err)
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, utils.JoinErrors(fmt.Sprintf("failed to create %s", path), err)
+		}
+		files[mailbox] = file
+		writers[mailbox] = bufio.NewWriter(file)
+		return writers[mailbox], nil
+	}
+
+	written := 0
+	err := selection.Stream(db, func(email models.Email) error {
+		raw, err := MessageBytes(db, email)
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to get message %s", email.GetOurID()), err)
+		}
+
+		mailboxes := []string{""}
+		if perMailbox {
+			mailboxes = selection.MailboxesFor(email)
+		}
+		for _, mailbox := range mailboxes {
+			writer, err := getWriter(mailbox)
+			if err != nil {
+				return err
+			}
+			err = writeMboxrdMessage(writer, email, raw)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to write message %s", email.GetOurID()), err)
+			}
+			written++
+		}
+		return nil
+	})
+	if err != nil {
+		return written, utils.JoinErrors("failed to export emails", err)
+	}
+
+	for mailbox, writer := range writers {
+		err = writer.Flush()
+		if err != nil {
+			return written, utils.JoinErrors(fmt.Sprintf("failed to flush %s", files[mailbox].Name()), err)
+		}
+		err = files[mailbox].Close()
+		if err != nil {
+			return written, utils.JoinErrors(fmt.Sprintf("failed to close %s", files[mailbox].Name()), err)
+		}
+		delete(files, mailbox)
+	}
+	return written, nil
+}
+
+func mboxSender(email models.Email) string {
+	if email.GetFromMailbox1() == "" {
+		return "MAILER-DAEMON"
+	}
+	return email.GetFromMailbox1() + "@" + email.GetFromHost1()
+}
+
+func writeMboxrdMessage(writer *bufio.Writer, email models.Email, raw []byte) error {
+	date := EmailDate(email)
+	if date.IsZero() {
+		date = time.Unix(0, 0)
+	}
+	_, err := fmt.Fprintf(writer, "From %s %s\n", mboxSender(email), date.UTC().Format(time.ANSIC))
+	if err != nil {
+		return err
+	}
+
+	// mbox files use bare LF line endings
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.TrimSuffix(raw, []byte("\n"))
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		if fromLine.Match(line) {
+			err = writer.WriteByte('>')
+			if err != nil {
+				return err
+			}
+		}
+		_, err = writer.Write(line)
+		if err != nil {
+			return err
+		}
+		err = writer.WriteByte('\n')
+		if err != nil {
+			return err
+		}
+	}
+	// messages are separated by an empty line
+	return writer.WriteByte('\n')
+}
@@ -0,0 +1,357 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"strings"
+)
+
+type TableFormat string
+
+const (
+	TableFormatCSV     TableFormat = "csv"
+	TableFormatJSONL   TableFormat = "jsonl"
+	TableFormatParquet TableFormat = "parquet"
+)
+
+type columnKind int
+
+const (
+	textColumn columnKind = iota
+	intColumn
+	listColumn
+)
+
+type tableColumn struct {
+	name string
+	kind columnKind
+	// nil for the columns in annotationColumns
+	value func(models.Email) interface{}
+}
+
+// every column that can be exported, in the default order. attachment metadata and mailboxes are flattened
+var tableColumns = []tableColumn{
+	{"our_id", textColumn, func(e models.Email) interface{} { return e.GetOurID() }},
+	{"message_id", textColumn, func(e models.Email) interface{} { return e.GetMessageId() }},
+	{"date", textColumn, func(e models.Email) interface{} { return e.GetDate() }},
+	{"date_epoch", intColumn, func(e models.Email) interface{} { return e.GetDateEpoch() }},
+	{"date_offset", intColumn, func(e models.Email) interface{} { return int64(e.GetDateOffset()) }},
+	{"internal_date_epoch", intColumn, func(e models.Email) interface{} { return e.GetInternalDateEpoch() }},
+	{"subject", textColumn, func(e models.Email) interface{} { return e.GetSubject() }},
+	{"from_name_1", textColumn, func(e models.Email) interface{} { return e.GetFromName1() }},
+	{"from_mailbox_1", textColumn, func(e models.Email) interface{} { return e.GetFromMailbox1() }},
+	{"from_host_1", textColumn, func(e models.Email) interface{} { return e.GetFromHost1() }},
+	{"sender_name_1", textColumn, func(e models.Email) interface{} { return e.GetSenderName1() }},
+	{"sender_mailbox_1", textColumn, func(e models.Email) interface{} { return e.GetSenderMailbox1() }},
+	{"sender_host_1", textColumn, func(e models.Email) interface{} { return e.GetSenderHost1() }},
+	{"reply_to_name_1", textColumn, func(e models.Email) interface{} { return e.GetReplyToName1() }},
+	{"reply_to_mailbox_1", textColumn, func(e models.Email) interface{} { return e.GetReplyToMailbox1() }},
+	{"reply_to_host_1", textColumn, func(e models.Email) interface{} { return e.GetReplyToHost1() }},
+	{"to_name_1", textColumn, func(e models.Email) interface{} { return e.GetToName1() }},
+	{"to_mailbox_1", textColumn, func(e models.Email) interface{} { return e.GetToMailbox1() }},
+	{"to_host_1", textColumn, func(e models.Email) interface{} { return e.GetToHost1() }},
+	{"cc_name_1", textColumn, func(e models.Email) interface{} { return e.GetCcName1() }},
+	{"cc_mailbox_1", textColumn, func(e models.Email) interface{} { return e.GetCcMailbox1() }},
+	{"cc_host_1", textColumn, func(e models.Email) interface{} { return e.GetCcHost1() }},
+	{"bcc_name_1", textColumn, func(e models.Email) interface{} { return e.GetBccName1() }},
+	{"bcc_mailbox_1", textColumn, func(e models.Email) interface{} { return e.GetBccMailbox1() }},
+	{"bcc_host_1", textColumn, func(e models.Email) interface{} { return e.GetBccHost1() }},
+	{"in_reply_to", textColumn, func(e models.Email) interface{} { return e.GetInReplyTo() }},
+	{"message_references", textColumn, func(e models.Email) interface{} { return e.GetReferences() }},
+	{"thread_id", textColumn, func(e models.Email) interface{} { return e.GetThreadId() }},
+	{"to_addresses", listColumn, func(e models.Email) interface{} { return addressesOfRole(e, "to") }},
+	{"cc_addresses", listColumn, func(e models.Email) interface{} { return addressesOfRole(e, "cc") }},
+	{"bcc_addresses", listColumn, func(e models.Email) interface{} { return addressesOfRole(e, "bcc") }},
+	{"mailboxes", listColumn, func(e models.Email) interface{} { return nonNil(e.GetMailboxes()) }},
+	{"deleted_on_server_at", intColumn, func(e models.Email) interface{} { return e.GetDeletedOnServerAt() }},
+	{"flags", listColumn, func(e models.Email) interface{} { return nonNil(e.GetFlags()) }},
+	{"attachment_count", intColumn, func(e models.Email) interface{} { return int64(len(e.GetAttachments())) }},
+	{"attachment_total_size", intColumn, func(e models.Email) interface{} {
+		total := int64(0)
+		for _, attachment := range e.GetAttachments() {
+			total += int64(attachment.FileSize)
+		}
+		return total
+	}},
+	{"attachment_names", listColumn, func(e models.Email) interface{} {
+		names := []string{}
+		for _, attachment := range e.GetAttachments() {
+			names = append(names, attachment.FileName)
+		}
+		return names
+	}},
+	{"attachment_types", listColumn, func(e models.Email) interface{} {
+		types := []string{}
+		for _, attachment := range e.GetAttachments() {
+			types = append(types, attachment.FileType)
+		}
+		return types
+	}},
+	{"tags", listColumn, nil},
+	{"note", textColumn, nil},
+	{"parse_warning", textColumn, func(e models.Email) interface{} { return e.GetParseWarning() }},
+	{"parse_error", textColumn, func(e models.Email) interface{} { return e.GetParseError() }},
+	{"text_content", textColumn, func(e models.Email) interface{} { return e.GetTextContent() }},
+	{"html_content", textColumn, func(e models.Email) interface{} { return e.GetHTMLContent() }},
+}
+
+// the columns that come from the tags and note of an email, which are looked up separately
+var annotationColumns = map[string]func(models.Annotations) interface{}{
+	"tags": func(a models.Annotations) interface{} { return nonNil(a.Tags) },
+	"note": func(a models.Annotations) interface{} {
+		if a.Note == nil {
+			return ""
+		}
+		return a.Note.Text
+	},
+}
+
+// exported when no columns are requested, the bodies are left out since they make the files huge
+var DefaultTableColumns = []string{
+	"our_id", "date", "subject",
+	"from_name_1", "from_mailbox_1", "from_host_1",
+	"to_name_1", "to_mailbox_1", "to_host_1",
+	"mailboxes", "flags", "attachment_count", "attachment_total_size", "attachment_names",
+}
+
+func TableColumnNames() []string {
+	names := []string{}
+	for _, column := range tableColumns {
+		names = append(names, column.name)
+	}
+	return names
+}
+
+func addressesOfRole(e models.Email, role string) []string {
+	addresses := []string{}
+	for _, address := range e.GetAddresses() {
+		if address.Role == role {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	return addresses
+}
+
+func nonNil(slice []string) []string {
+	if slice == nil {
+		return []string{}
+	}
+	return slice
+}
+
+func resolveColumns(names []string) ([]tableColumn, error) {
+	if len(names) == 0 {
+		names = DefaultTableColumns
+	}
+	byName := map[string]tableColumn{}
+	for _, column := range tableColumns {
+		byName[column.name] = column
+	}
+	columns := []tableColumn{}
+	for _, name := range names {
+		column, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q, available columns are: %s", name, strings.Join(TableColumnNames(), ", "))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+// writes a single row, implemented once per format
+type rowWriter interface {
+	writeRow(values []interface{}) error
+	close() error
+}
+
+/*
+Table writes the selected emails to w as csv, jsonl or parquet, one row per email.
+Rows are streamed from the db, so the result never has to fit in memory. In csv, list columns are joined with "; ".
+Returns the number of rows written.
+*/
+func Table(db models.DB, selection Selection, w io.Writer, format TableFormat, columnNames []string) (int, error) {
+	columns, err := resolveColumns(columnNames)
+	if err != nil {
+		return 0, err
+	}
+
+	switch format {
+	case TableFormatCSV, TableFormatJSONL, TableFormatParquet:
+	default:
+		return 0, fmt.Errorf("unknown format %q, expected %q, %q or %q", format, TableFormatCSV, TableFormatJSONL, TableFormatParquet)
+	}
+	// created with the first row, so that nothing is written yet when the selection turns out to be invalid, e.g. a
+	// query with a syntax error, and the web api can still answer with an error status
+	var rows rowWriter
+	open := func() error {
+		if rows != nil {
+			return nil
+		}
+		var err error
+		switch format {
+		case TableFormatCSV:
+			rows, err = newCSVRowWriter(w, columns)
+		case TableFormatJSONL:
+			rows = &jsonlRowWriter{w: w, columns: columns}
+		case TableFormatParquet:
+			rows, err = newParquetRowWriter(w, columns)
+		}
+		return utils.JoinErrors(fmt.Sprintf("failed to create %s writer", format), err)
+	}
+
+	annotated := false
+	for _, column := range columns {
+		_, ok := annotationColumns[column.name]
+		annotated = annotated || ok
+	}
+
+	written := 0
+	err = selection.Stream(db, func(email models.Email) error {
+		annotations := models.Annotations{}
+		if annotated {
+			byOurId, err := db.GetAnnotations([]string{email.GetOurID()})
+			if err != nil {
+				return err
+			}
+			annotations = byOurId[email.GetOurID()]
+		}
+		values := []interface{}{}
+		for _, column := range columns {
+			if annotation, ok := annotationColumns[column.name]; ok {
+				values = append(values, annotation(annotations))
+				continue
+			}
+			values = append(values, column.value(email))
+		}
+		err := open()
+		if err != nil {
+			return err
+		}
+		written++
+		return rows.writeRow(values)
+	})
+	if err != nil {
+		return written, utils.JoinErrors("failed to export emails", err)
+	}
+	// an empty selection still gets a header, or an empty parquet file
+	err = open()
+	if err != nil {
+		return written, err
+	}
+	return written, utils.JoinErrors(fmt.Sprintf("failed to finish %s file", format), rows.close())
+}
+
+type csvRowWriter struct {
+	writer  *csv.Writer
+	columns []tableColumn
+}
+
+func newCSVRowWriter(w io.Writer, columns []tableColumn) (*csvRowWriter, error) {
+	rows := &csvRowWriter{writer: csv.NewWriter(w), columns: columns}
+	header := []string{}
+	for _, column := range columns {
+		header = append(header, column.name)
+	}
+	return rows, rows.writer.Write(header)
+}
+
+func (rows *csvRowWriter) writeRow(values []interface{}) error {
+	record := []string{}
+	for i, value := range values {
+		switch rows.columns[i].kind {
+		case listColumn:
+			record = append(record, strings.Join(value.([]string), "; "))
+		default:
+			record = append(record, fmt.Sprintf("%v", value))
+		}
+	}
+	return rows.writer.Write(record)
+}
+
+func (rows *csvRowWriter) close() error {
+	rows.writer.Flush()
+	return rows.writer.Error()
+}
+
+type jsonlRowWriter struct {
+	w       io.Writer
+	columns []tableColumn
+}
+
+func (rows *jsonlRowWriter) writeRow(values []interface{}) error {
+	// a slice of key/values keeps the column order, which a map wouldn't
+	parts := []string{}
+	for i, value := range values {
+		key, err := json.Marshal(rows.columns[i].name)
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, string(key)+":"+string(encoded))
+	}
+	_, err := io.WriteString(rows.w, "{"+strings.Join(parts, ",")+"}\n")
+	return err
+}
+
+func (rows *jsonlRowWriter) close() error {
+	return nil
+}
+
+type parquetRowWriter struct {
+	writer  *writer.JSONWriter
+	columns []tableColumn
+}
+
+func newParquetRowWriter(w io.Writer, columns []tableColumn) (*parquetRowWriter, error) {
+	type schemaField struct {
+		Tag    string         `json:"Tag"`
+		Fields []*schemaField `json:"Fields,omitempty"`
+	}
+	schema := &schemaField{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, column := range columns {
+		switch column.kind {
+		case textColumn:
+			schema.Fields = append(schema.Fields, &schemaField{Tag: fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL", column.name)})
+		case intColumn:
+			schema.Fields = append(schema.Fields, &schemaField{Tag: fmt.Sprintf("name=%s, type=INT64, repetitiontype=OPTIONAL", column.name)})
+		case listColumn:
+			schema.Fields = append(schema.Fields, &schemaField{
+				Tag:    fmt.Sprintf("name=%s, type=LIST, repetitiontype=OPTIONAL", column.name),
+				Fields: []*schemaField{{Tag: "name=element, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"}},
+			})
+		}
+	}
+	schemaJson, err := json.Marshal(schema)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to marshal parquet schema", err)
+	}
+	jsonWriter, err := writer.NewJSONWriterFromWriter(string(schemaJson), w, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetRowWriter{writer: jsonWriter, columns: columns}, nil
+}
+
+func (rows *parquetRowWriter) writeRow(values []interface{}) error {
+	row := map[string]interface{}{}
+	for i, value := range values {
+		row[rows.columns[i].name] = value
+	}
+	rowJson, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return rows.writer.Write(string(rowJson))
+}
+
+func (rows *parquetRowWriter) close() error {
+	return rows.writer.WriteStop()
+}
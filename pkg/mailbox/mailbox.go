@@ -62,17 +62,18 @@ func (mailboxWrap *Mailbox) Name() string {
 }
 
 /*
-assumes correct mailbox is selected
+assumes correct mailbox is selected. returns the number of uids that were gone from the server
 */
-func (mailboxWrap *Mailbox) SyncToLocalState() error {
+func (mailboxWrap *Mailbox) SyncToLocalState() (int, error) {
 
 	allUids, err := mailboxWrap.Client().ListAllUids(mailboxWrap)
 
 	if err != nil {
-		return utils.JoinErrors("could not list all uids", err)
+		return 0, utils.JoinErrors("could not list all uids", err)
 	}
 	db := database.GetDatabase()
-	return utils.JoinErrors("could not sync to local state", db.UpdateLocalMailboxState(mailboxWrap, allUids))
+	removed, err := db.UpdateLocalMailboxState(mailboxWrap, allUids, mailboxWrap.Client().Options().GetKeepDeletedEmails())
+	return removed, utils.JoinErrors("could not sync to local state", err)
 
 }
 
@@ -81,16 +82,33 @@ func (mailboxWrap *Mailbox) addMailboxEvent(eventType models.MailboxEvent) {
 	mailboxWrap.Client().Statuses() <- eventType
 }
 
+// FetchItems are the items fetched for every email that is downloaded
+func FetchItems(client models.Client) []imap.FetchItem {
+	items := []imap.FetchItem{
+		models.SectionToFetch.FetchItem(),
+		imap.FetchEnvelope,
+		imap.FetchFlags,
+		imap.FetchUid,
+		imap.FetchInternalDate,
+	}
+	if gmail, _ := client.Support("X-GM-EXT-1"); gmail {
+		items = append(items, models.GmailThreadIdFetchItem)
+	}
+	return items
+}
+
 // mailbox should be selected
 // relies on the mailbox being synced to local state
 // caller should have already run:
 // mailboxWrap.SyncToLocalState()
-func (mailboxWrap *Mailbox) DownloadEmails() error {
+// returns what was downloaded for the sync run, also when it fails part way
+func (mailboxWrap *Mailbox) DownloadEmails() (models.SyncRunMailbox, error) {
+	stats := models.SyncRunMailbox{Mailbox: mailboxWrap.Name(), Warnings: []string{}}
 
 	// sanity check that the correct mailbox is selected.
 	//This is the result of a nasty bug which cause downloading emails and associating them with the wrong mailbox
 	if mailboxWrap.Client().CurrentMailbox().Name() != mailboxWrap.Name() {
-		return fmt.Errorf("Attempted to download emails from mailbox %s, but mailbox %s is selected", mailboxWrap.Name(), mailboxWrap.Client().CurrentMailbox().Name())
+		return stats, fmt.Errorf("Attempted to download emails from mailbox %s, but mailbox %s is selected", mailboxWrap.Name(), mailboxWrap.Client().CurrentMailbox().Name())
 	}
 
 	mailboxWrap.addMailboxEvent(
@@ -102,7 +120,7 @@ func (mailboxWrap *Mailbox) DownloadEmails() error {
 	uidsToFetch, err := database.GetDatabase().GetMessagesPendingSync(mailboxWrap)
 
 	if err != nil {
-		return utils.JoinErrors("could not get messages pending sync", err)
+		return stats, utils.JoinErrors("could not get messages pending sync", err)
 	}
 
 	if len(uidsToFetch) == 0 {
@@ -114,7 +132,7 @@ func (mailboxWrap *Mailbox) DownloadEmails() error {
 			})
 		// mark as synced
 		err = database.GetDatabase().SaveMailboxRecord(mailboxWrap.mailboxRecord)
-		return utils.JoinErrors("failed to set next uid", err)
+		return stats, utils.JoinErrors("failed to set next uid", err)
 	}
 
 	emails := []models.Email{}
@@ -122,12 +140,7 @@ func (mailboxWrap *Mailbox) DownloadEmails() error {
 
 	go func() {
 
-		items := []imap.FetchItem{
-			models.SectionToFetch.FetchItem(),
-			imap.FetchEnvelope,
-			imap.FetchFlags,
-			imap.FetchUid,
-		}
+		items := FetchItems(mailboxWrap.Client())
 		// NOTE: we used to use uidValidity+nextUID. But relying on the uidValidity does not get us moved emails and I've seen other issues with it being unreliable
 		// so we just fetch all messages and then compare to what we have locally
 		doneChan <- mailboxWrap.Client().UidFetch(uidsToFetch, items, messages)
@@ -155,7 +168,8 @@ func (mailboxWrap *Mailbox) DownloadEmails() error {
 			if emailParsed.GetParseError() != "" {
 				warnings = append(warnings, "parse error: "+emailParsed.GetParseError())
 			}
-			warning := strings.Join(warnings, ", ")
+			warning := fmt.Sprintf("uid %d: %s", emailParsed.GetUID(), strings.Join(warnings, ", "))
+			stats.AddWarning(warning)
 			mailboxWrap.addMailboxEvent(
 				models.MailboxEvent{
 					EventType: models.MailboxSyncWarning,
@@ -167,23 +181,30 @@ func (mailboxWrap *Mailbox) DownloadEmails() error {
 	}
 
 	if err := <-doneChan; err != nil {
-		return utils.JoinErrors("failed to fetch", err)
+		return stats, utils.JoinErrors("failed to fetch", err)
+	}
+	added, err := database.GetDatabase().AddEmails(mailboxWrap.Name(), emails)
+	if err != nil {
+		return stats, utils.JoinErrors("failed to add to db", err)
 	}
-	if err := database.GetDatabase().AddEmails(mailboxWrap.Name(), emails); err != nil {
-		return utils.JoinErrors("failed to add to db", err)
+	stats.Added = added
+	for _, mail := range emails {
+		stats.Bytes += int64(len(mail.GetRaw()))
 	}
 
 	err = database.GetDatabase().SaveMailboxRecord(mailboxWrap.mailboxRecord)
 	if err != nil {
-		return utils.JoinErrors("failed to set next uid", err)
+		return stats, utils.JoinErrors("failed to set next uid", err)
 	}
 
 	if messagesProcessed < len(uidsToFetch) {
 		// I haven't gotten to the bottom of why this happens.
+		warning := fmt.Sprintf("tried to fetch %d messages but only got %d, the rest stay pending until the next sync. run the verify command to list them", len(uidsToFetch), messagesProcessed)
+		stats.AddWarning(warning)
 		mailboxWrap.addMailboxEvent(
 			models.MailboxEvent{
 				EventType:       models.MailboxSyncWarning,
-				Warning:         fmt.Sprintf("tried to fetch %d messages but only got %d", len(uidsToFetch), messagesProcessed),
+				Warning:         warning,
 				TotalDownloaded: messagesProcessed,
 				TotalToDownload: len(uidsToFetch),
 			},
@@ -197,5 +218,5 @@ func (mailboxWrap *Mailbox) DownloadEmails() error {
 			TotalToDownload: len(uidsToFetch),
 		})
 
-	return nil
+	return stats, nil
 }
@@ -14,6 +14,24 @@ const (
 	DispositionUnknown    Disposition = ""
 )
 
+// marks mailboxes that only exist locally because they were created by an import
+const ImportedMailboxAttribute = "\\EmailArchiverImported"
+
+/*
+memberships created from takeout labels get uids at or above this floor. Real gmail uids are far below it, so the made up
+uids never collide with the ones the server hands out. The next imap sync of a mailbox replaces them with the real uids.
+*/
+const TakeoutUidFloor = 1 << 31
+
+// values of Options.GetDBBackend
+const (
+	SQLiteBackend   = "sqlite"
+	PostgresBackend = "postgres"
+)
+
+// 'simple' doesn't stem, archives are usually multilingual and stemming with the wrong language does more harm than good
+const PostgresTextSearchConfig = "simple"
+
 type MailboxRecord struct {
 	Name       string   `json:"name"`
 	LastSynced int64    `json:"last_synced"`
@@ -52,6 +70,9 @@ var AllEventTypes = []MailboxEventType{
 // TODO: find a better place for this
 var SectionToFetch = &imap.BodySectionName{}
 
+// gmail's thread id, only fetched from servers that advertise X-GM-EXT-1
+const GmailThreadIdFetchItem imap.FetchItem = "X-GM-THRID"
+
 // shared by options and utils which would cause circular dependency
 const DEBUG_ENVIRONMENT_KEY = "DEBUG"
 
@@ -77,6 +98,190 @@ type AttachmentMetaData struct {
 	Disposition Disposition
 }
 
+// the text of one attachment, as stored in the attachment_text table
+type AttachmentText struct {
+	// 1 for the first entry of GetAttachments
+	Position int    `json:"position" db:"position"`
+	FileName string `json:"file_name" db:"file_name"`
+	// empty for attachments without any text, e.g. images, or whose text couldn't be extracted
+	Text string `json:"text" db:"text"`
+}
+
+// one of the addresses of an email, as stored in the email_address table
+type EmailAddress struct {
+	// from, sender, reply_to, to, cc or bcc, the same prefixes as the _1 columns of the email table
+	Role string `json:"role" db:"role"`
+	// 1 for the first address of the role, so position 1 matches the _1 columns
+	Position int    `json:"position" db:"position"`
+	Name     string `json:"name,omitempty" db:"name"`
+	Mailbox  string `json:"mailbox,omitempty" db:"mailbox"`
+	Host     string `json:"host,omitempty" db:"host"`
+	// mailbox@host in lower case
+	Address string `json:"address" db:"address"`
+}
+
+// one header field of an email, as stored in the header table
+type Header struct {
+	// lower case, since header names are case insensitive
+	Name  string `json:"name" db:"name"`
+	Value string `json:"value" db:"value"`
+	// 1 for the first field of the message
+	Position int `json:"position" db:"position"`
+}
+
+// a conversation, as stored in the thread table
+type Thread struct {
+	ThreadId string `json:"thread_id" db:"thread_id"`
+	// the subject of the first email
+	Subject        string `json:"subject" db:"subject"`
+	EmailCount     int    `json:"email_count" db:"email_count"`
+	FirstDateEpoch int64  `json:"first_date_epoch" db:"first_date_epoch"`
+	LastDateEpoch  int64  `json:"last_date_epoch" db:"last_date_epoch"`
+}
+
+// values of SavedQuery.Kind
+const (
+	// a sql query selecting rows from the email table
+	SavedQuerySQL = "sql"
+	// a query in the search query language, e.g. "from:example.com has:attachment"
+	SavedQuerySearch = "query"
+)
+
+// a named filter, pinned ones are shown as smart folders next to the mailboxes
+type SavedQuery struct {
+	Name   string `json:"name" db:"name"`
+	Kind   string `json:"kind" db:"kind"`
+	Query  string `json:"query" db:"query"`
+	Pinned bool   `json:"pinned" db:"pinned"`
+	// unix seconds, set when the query is saved
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+	UpdatedAt int64 `json:"updated_at" db:"updated_at"`
+}
+
+// a private tag on archived emails, tags are never sent to the imap server
+type Tag struct {
+	// lower case, without spaces
+	Name      string `json:"name" db:"name"`
+	NumEmails int    `json:"num_emails" db:"num_emails"`
+}
+
+// a private free text note on an archived email, notes are never sent to the imap server
+type Note struct {
+	OurId string `json:"our_id" db:"our_id"`
+	Text  string `json:"text" db:"text"`
+	// unix seconds
+	CreatedAt int64 `json:"created_at" db:"created_at"`
+	UpdatedAt int64 `json:"updated_at" db:"updated_at"`
+}
+
+// the tags and note of an email
+type Annotations struct {
+	Tags []string `json:"tags"`
+	// nil if the email has no note
+	Note *Note `json:"note"`
+}
+
+// a row of message_to_mailbox: an email on the server, by its uid in the mailbox
+type MailboxMembership struct {
+	Uid uint32 `json:"uid" db:"uid"`
+	// empty until the email is downloaded
+	OurId       string `json:"our_id" db:"our_id"`
+	PendingSync bool   `json:"pending_sync" db:"pending_sync"`
+	// whether the email is in the email table
+	Archived bool `json:"archived" db:"archived"`
+	// whether the email was purged on purpose, by a retention policy or dedupe
+	Purged bool `json:"purged" db:"purged"`
+}
+
+// what is needed to find the duplicates of an email and to tell them apart in a report
+type Fingerprint struct {
+	OurId string `json:"our_id" db:"our_id"`
+	// see email.Fingerprints
+	BodyHash    string   `json:"body_hash" db:"body_hash"`
+	BodySimhash string   `json:"body_simhash" db:"body_simhash"`
+	MessageId   string   `json:"message_id" db:"message_id"`
+	Subject     string   `json:"subject" db:"subject"`
+	From        string   `json:"from" db:"from_address"`
+	DateEpoch   int64    `json:"date_epoch" db:"date_epoch"`
+	Mailboxes   []string `json:"mailboxes" db:"-"`
+}
+
+/*
+BackupPolicy says which backup snapshots are kept when old ones are rotated: the newest KeepLast, and the newest one of
+each of the last KeepDaily days, KeepWeekly weeks and KeepMonthly months that have snapshots. A snapshot is kept if any of
+them keeps it, and nothing is rotated if they're all 0.
+*/
+type BackupPolicy struct {
+	KeepLast    int `json:"keep_last"`
+	KeepDaily   int `json:"keep_daily"`
+	KeepWeekly  int `json:"keep_weekly"`
+	KeepMonthly int `json:"keep_monthly"`
+}
+
+const (
+	SyncRunRunning   = "running"
+	SyncRunSucceeded = "succeeded"
+	SyncRunFailed    = "failed"
+)
+
+// what a sync run did in one mailbox
+type SyncRunMailbox struct {
+	Mailbox string `json:"mailbox"`
+	// the number of new emails stored, messages that were already archived from another mailbox aren't counted
+	Added int `json:"added"`
+	// the number of uids that were gone from the server
+	Removed int `json:"removed"`
+	// the size of the messages downloaded
+	Bytes int64 `json:"bytes"`
+	// the number of warnings, only the first MaxSyncRunWarnings are kept
+	WarningCount int      `json:"warning_count"`
+	Warnings     []string `json:"warnings"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// the number of warnings kept per mailbox of a sync run
+const MaxSyncRunWarnings = 100
+
+// AddWarning counts a warning and keeps it unless there are too many already
+func (mailbox *SyncRunMailbox) AddWarning(warning string) {
+	mailbox.WarningCount++
+	if len(mailbox.Warnings) < MaxSyncRunWarnings {
+		mailbox.Warnings = append(mailbox.Warnings, warning)
+	}
+}
+
+// a download of mailboxes, as logged in the sync_run table. The totals are the sums over the mailboxes
+type SyncRun struct {
+	Id int64 `json:"id" db:"id"`
+	// unix seconds
+	StartedAt int64 `json:"started_at" db:"started_at"`
+	// 0 while the run is running, or if it was interrupted
+	FinishedAt int64            `json:"finished_at" db:"finished_at"`
+	Status     string           `json:"status" db:"status"`
+	Mailboxes  []SyncRunMailbox `json:"mailboxes" db:"-"`
+	Added      int              `json:"added" db:"added"`
+	Removed    int              `json:"removed" db:"removed"`
+	Bytes      int64            `json:"bytes" db:"bytes"`
+	Warnings   int              `json:"warnings" db:"warnings"`
+	Error      string           `json:"error,omitempty" db:"error"`
+}
+
+// an email removed by a retention policy, as logged in the retention_log table
+type RetentionDeletion struct {
+	Policy string `json:"policy" db:"policy"`
+	// delete_remote or purge_local
+	Action string `json:"action" db:"action"`
+	OurId  string `json:"our_id" db:"our_id"`
+	// where the email was deleted from on the server, empty for local purges
+	Mailbox   string `json:"mailbox,omitempty" db:"mailbox"`
+	Uid       uint32 `json:"uid,omitempty" db:"uid"`
+	MessageId string `json:"message_id,omitempty" db:"message_id"`
+	Subject   string `json:"subject,omitempty" db:"subject"`
+	DateEpoch int64  `json:"date_epoch,omitempty" db:"date_epoch"`
+	// unix seconds, set when the deletion is logged
+	DeletedAt int64 `json:"deleted_at" db:"deleted_at"`
+}
+
 type Email interface {
 	GetParseWarning() string
 	GetParseError() string
@@ -89,6 +294,12 @@ type Email interface {
 	GetAttachments() []AttachmentMetaData
 	GetMessageId() string
 	GetDate() string
+	// unix seconds of the Date header, or of INTERNALDATE when the header is missing or bogus, 0 if neither is known
+	GetDateEpoch() int64
+	// the offset from UTC in minutes that GetDateEpoch was written in
+	GetDateOffset() int
+	// unix seconds of when the server received the email, 0 if unknown
+	GetInternalDateEpoch() int64
 	GetSubject() string
 	GetFromName1() string
 	GetFromMailbox1() string
@@ -109,19 +320,64 @@ type Email interface {
 	GetBccMailbox1() string
 	GetBccHost1() string
 	GetInReplyTo() string
+	// the References header with whitespace collapsed
+	GetReferences() string
+	// X-GM-THRID, empty for emails that didn't come from gmail
+	GetGmailThreadId() string
+	// empty until the email has been threaded, see DB.UpdateThreads
+	GetThreadId() string
+	// see email.Fingerprints, empty for emails archived before body hashes that haven't been hashed yet
+	GetBodyHash() string
+	GetBodySimhash() string
+	GetMailboxes() []string
+	// unix seconds of when the email was removed from the last of its mailboxes on the server, 0 while it's still on
+	// the server. only set with KEEP_DELETED_EMAILS, see DB.UpdateLocalMailboxState
+	GetDeletedOnServerAt() int64
+	// every address of every role, in envelope order
+	GetAddresses() []EmailAddress
+	// every header field in message order, only populated for freshly downloaded emails
+	GetHeaders() []Header
+	// one entry per attachment, only populated for freshly downloaded emails
+	GetAttachmentTexts() []AttachmentText
+	// the file names of the attachments whose text matched, only populated for full text search results
+	GetMatchedAttachments() []string
+	// the original message bytes, only populated for freshly downloaded emails
+	GetRaw() []byte
 }
 
 type Mailbox interface {
-	DownloadEmails() error
+	// returns what was downloaded, also when it fails part way
+	DownloadEmails() (SyncRunMailbox, error)
 	Name() string
 	Client() Client
 	SetClient(Client)
-	SyncToLocalState() error
+	// returns the number of uids that were gone from the server
+	SyncToLocalState() (int, error)
 	HasAttribute(string) bool
 	MailboxRecord() MailboxRecord
 	SetMailboxRecord(MailboxRecord)
 }
 
+// a message read from a Source rather than from an imap server
+type RawMessage struct {
+	Raw   []byte
+	Flags []string
+	// position of the message within its source, sources have no imap uids
+	Position int
+	// when the message was delivered, the zero time if the source doesn't know
+	InternalDate time.Time
+}
+
+// Source is a non-imap origin of messages, such as an mbox file or a maildir
+type Source interface {
+	// a human readable description, e.g. the path being imported
+	Name() string
+	// number of messages that Messages will send, used for progress reporting
+	Count() (int, error)
+	// sends every message to the channel and closes it when done, like Client.UidFetch
+	Messages(chan *RawMessage) error
+}
+
 type Options interface {
 	GetImapServer() string
 	GetEmail() string
@@ -131,8 +387,19 @@ type Options interface {
 	GetDebug() bool
 	GetLimitToMailboxes() []string
 	GetSkipMailboxes() []string
+	GetDBBackend() string
+	GetPostgresURL() string
 	GetDBPath() string
 	GetMaxPoolSize() int
+	GetBlobStorePath() string
+	GetEncryptionPassphrase() string
+	GetEncryptionKeyFile() string
+	GetBackupDir() string
+	// 0 when backups aren't scheduled
+	GetBackupInterval() time.Duration
+	GetBackupPolicy() BackupPolicy
+	// whether a sync keeps the mailbox memberships of emails deleted on the server as tombstones
+	GetKeepDeletedEmails() bool
 }
 
 type ClientPool interface {
@@ -143,6 +410,8 @@ type ClientPool interface {
 	SyncMailboxMessageStates([]Mailbox) error
 	Close()
 	SetEventHandler(func(*MailboxEvent))
+	// connections opened from now on use the options, the open ones are replaced once they're idle
+	SetOptions(Options)
 }
 
 type Client interface {
@@ -155,28 +424,100 @@ type Client interface {
 	ListMailboxInfos() ([]*imap.MailboxInfo, error)
 	CopyToMailbox(fromMailbox Mailbox, toMailbox Mailbox, uids []uint32) error
 	MoveToMailbox(fromMailbox Mailbox, toMailbox Mailbox, uids []uint32) error
+	DeleteFromMailbox(mailbox Mailbox, uids []uint32) error
 	DownloadMailbox(Mailbox) error
 	LastPing() time.Time
 	RawSelect(mailboxName string, readOnly bool) (*imap.MailboxStatus, error)
 	Select(mailboxName string, readOnly bool) error
+	Support(capability string) (bool, error)
 	Id() int
 }
 
 type DB interface {
+	// SQLiteBackend or PostgresBackend
+	Backend() string
 	SaveMailboxRecord(MailboxRecord) error
 	GetAllMailboxRecords() ([]MailboxRecord, error)
-	AddEmails(mailbox string, emails []Email) error
+	// returns the number of emails that were new, the others were already stored and only get their membership of mailbox
+	AddEmails(mailbox string, emails []Email) (int, error)
+	AddMailboxMemberships(mailbox string, ourIdToUid map[string]uint32) error
 	AggregateFolders() error
-	UpdateLocalMailboxState(Mailbox, []uint32) error
+	// returns the number of uids that were removed because they're gone from the server. with keepDeleted, the ones of
+	// downloaded emails get a removed_at instead of being deleted, so the email remembers its mailboxes
+	UpdateLocalMailboxState(mailbox Mailbox, allUids []uint32, keepDeleted bool) (int, error)
 	GetMessagesPendingSync(Mailbox) ([]uint32, error)
+	// maps our_id to uid for every email in the mailbox
+	GetMailboxUids(mailbox string) (map[string]uint32, error)
 	GetEmails(sqlQuery string, params ...interface{}) ([]Email, error)
+	StreamEmails(handle func(Email) error, sqlQuery string, params ...interface{}) error
+	// indexes the emails that aren't part of the full text index yet
 	UpdateFTS() error
-	FullTextSearch(string) ([]Email, error)
+	// recreates the full text index from scratch
+	RebuildFTS() error
+	// extracts the attachment texts of emails archived before they were stored, from the blob store. Returns how many emails got texts
+	ExtractAttachmentTexts() (int, error)
+	// threads the emails that aren't in a thread yet
+	UpdateThreads() error
+	// the threads with the most recent activity first
+	GetThreads(limit int, offset int) ([]Thread, error)
+	// the emails matching condition (see query.Compile), newest first. The fields of the ones whose full text index entry
+	// matches highlight (see query.Highlight) are highlighted and their matched_attachments are set
+	FullTextSearch(highlight string, condition string, params ...interface{}) ([]Email, error)
+	StreamFullTextSearch(searchTerm string, handle func(Email) error) error
 	SetFrontendState(string) error
 	GetFrontendState() (string, error)
-	// todo: allow for options to be set and retrieved in DB in addition to env vars
-	//GetOptions() (Options, error)
-	//SetOptions(Options) error
-
-	// todo: allow for saving and loading queries
+	// returns nil if the original message bytes were not kept
+	GetRawMessage(ourId string) ([]byte, error)
+	// logs the deletions, forgetting the server copies of delete_remote ones and purging the emails of purge_local ones.
+	// with keepDeleted, the server copies are marked as removed instead of forgotten
+	ApplyRetention(deletions []RetentionDeletion, keepDeleted bool) error
+	// encrypts the archive with a new passphrase or key file, see the README
+	Rekey(newKeyMaterial []byte) error
+	// creates the saved query, or replaces the one with the same name
+	SaveQuery(SavedQuery) error
+	// sorted by name
+	GetSavedQueries() ([]SavedQuery, error)
+	// returns nil if there is no saved query with the name
+	GetSavedQuery(name string) (*SavedQuery, error)
+	// returns false if there was no saved query with the name
+	DeleteSavedQuery(name string) (bool, error)
+	// the number of rows sqlQuery returns
+	CountEmails(sqlQuery string, params ...interface{}) (int, error)
+	// the options stored in the db, by their environment variable name
+	GetOptions() (map[string]string, error)
+	// stores the options by their environment variable name, an empty value removes one
+	SetOptions(map[string]string) error
+	// the our_ids of the emails in the thread, oldest first
+	GetThreadEmailIds(threadId string) ([]string, error)
+	// tags every email in ourIds with every tag. tags are lower cased and can't contain spaces
+	AddTags(ourIds []string, tags []string) error
+	// returns how many tags were removed
+	RemoveTags(ourIds []string, tags []string) (int, error)
+	// every tag with the number of emails it's on, sorted by name
+	GetTags() ([]Tag, error)
+	// replaces the note of an email, an empty text removes it
+	SetNote(ourId string, text string) error
+	// by our_id, emails without tags or a note are left out
+	GetAnnotations(ourIds []string) (map[string]Annotations, error)
+	// hashes the bodies of the emails archived before body hashes were stored, returns how many were hashed
+	UpdateBodyHashes() (int, error)
+	// the fingerprints of every email that has a body
+	GetFingerprints() ([]Fingerprint, error)
+	// every row of message_to_mailbox for the mailbox that isn't marked as removed, by uid
+	GetMailboxMemberships(mailbox string) ([]MailboxMembership, error)
+	// makes the next download of the mailbox fetch the uids again
+	MarkPendingSync(mailbox string, uids []uint32) error
+	// replaces the contents, headers and attachment texts of an archived email with those of a fresh download of it
+	ReplaceEmail(Email) error
+	// moves the tags, note and mailbox memberships of the duplicates to the email that is kept, the duplicates are left
+	// without them, ready to be purged
+	MergeDuplicates(keep string, duplicates []string) error
+	// writes a consistent copy of the db to path while it's in use, which must not exist yet
+	Snapshot(path string) error
+	// logs a sync run that just started and returns its id
+	StartSyncRun(SyncRun) (int64, error)
+	// updates the logged run with the same id
+	FinishSyncRun(SyncRun) error
+	// the newest runs first, at most limit of them, only the failed ones with failedOnly
+	GetSyncRuns(limit int, failedOnly bool) ([]SyncRun, error)
 }
@@ -2,19 +2,23 @@ package options
 
 import (
 	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/skamensky/email-archiver/pkg/models"
 	"github.com/skamensky/email-archiver/pkg/utils"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Options struct {
-	Email             string `json:"email,omitempty"`
-	Password          string `json:"password,omitempty"`
+	Email string `json:"email,omitempty"`
+	// never sent to the frontend
+	Password          string `json:"-"`
 	ImapServer        string `json:"imap_server,omitempty"`
 	StrictMailParsing bool   `json:"strict_mail_parsing,omitempty"`
 	// WARNING: setting DEBUG to true creates a huge Debug.txt file
@@ -25,82 +29,398 @@ type Options struct {
 	// The final result is GetLimitToMailboxes - GetSkipMailboxes
 	LimitToMailboxes []string `json:"limit_to_mailboxes,omitempty"`
 	SkipMailboxes    []string `json:"skip_mailboxes,omitempty"`
-	DBPath           string   `json:"db_path,omitempty"`
-	MaxPoolSize      int      `json:"max_pool_size,omitempty"`
+	// "sqlite" (the default) or "postgres"
+	DBBackend string `json:"db_backend,omitempty"`
+	DBPath    string `json:"db_path,omitempty"`
+	// only used by the postgres backend. never sent to the frontend since it usually contains a password
+	PostgresURL string `json:"-"`
+	MaxPoolSize int    `json:"max_pool_size,omitempty"`
+	// optional. when set, the original bytes of every downloaded message are kept in this directory
+	BlobStorePath string `json:"blob_store_path,omitempty"`
+	// optional, at most one of them. when set, email bodies, attachment metadata and blobs are encrypted at rest
+	// the passphrase is never sent to the frontend
+	EncryptionPassphrase string `json:"-"`
+	EncryptionKeyFile    string `json:"encryption_key_file,omitempty"`
+	// optional. where the backup command and scheduled backups put their snapshots
+	BackupDir string `json:"backup_dir,omitempty"`
+	// when set, serve takes a snapshot this often
+	BackupInterval time.Duration       `json:"backup_interval,omitempty"`
+	BackupPolicy   models.BackupPolicy `json:"backup_policy"`
+	// when set, emails that are deleted on the server stay in their mailboxes with a removed_at, instead of being forgotten
+	KeepDeletedEmails bool `json:"keep_deleted_emails,omitempty"`
+
+	// the values from the environment and flags by key, with where each of them comes from
+	overrides       map[string]string
+	overrideSources map[string]string
+	// the values stored in the db by key
+	stored map[string]string
+	// the value of every option that isn't a default, and where every option comes from
+	values  map[string]string
+	sources map[string]string
+}
+
+// where the value of an option comes from, later ones take precedence
+const (
+	SourceDefault     = "default"
+	SourceDB          = "db"
+	SourceEnvironment = "environment"
+	SourceFlag        = "flag"
+)
+
+// Definition describes an option
+type Definition struct {
+	// the environment variable, also the name the option is stored under in the db
+	Key string
+	// the command line flag that overrides the environment, empty for secrets so they don't end up in the shell history
+	Flag  string
+	Usage string
+	// false for the options needed to open the db, which can't be read from it
+	Storable bool
+	// never shown by the api or the options command
+	Secret bool
+	// only stored in encrypted archives, it would be readable in the db file, its backups and migrated copies otherwise
+	EncryptedOnly bool
+	// only read when the imap connections are set up, so a running serve picks up a change after a restart
+	Restart bool
+}
+
+var Definitions = []Definition{
+	{Key: "EMAIL", Flag: "email", Usage: "the imap login", Storable: true},
+	{Key: "PASSWORD", Usage: "the imap password", Storable: true, Secret: true, EncryptedOnly: true},
+	{Key: "IMAP_SERVER", Flag: "imap-server", Usage: "host:port of the imap server, the port defaults to 993", Storable: true},
+	{Key: "STRICT_MAIL_PARSING", Flag: "strict-mail-parsing", Usage: "fail on emails that can't be parsed completely", Storable: true},
+	{Key: "IMAP_CLIENT_DEBUG", Flag: "imap-client-debug", Usage: "log the imap traffic of every connection to imap_debug", Storable: true},
+	{Key: models.DEBUG_ENVIRONMENT_KEY, Usage: "print debug output"},
+	{Key: "LIMIT_TO_MAILBOXES", Flag: "limit-to-mailboxes", Usage: "only download these mailboxes, separated by %", Storable: true},
+	{Key: "SKIP_MAILBOXES", Flag: "skip-mailboxes", Usage: "don't download these mailboxes, separated by %", Storable: true},
+	{Key: "DB_BACKEND", Flag: "db-backend", Usage: `"sqlite" (the default) or "postgres"`},
+	{Key: "DB_PATH", Flag: "db-path", Usage: "the sqlite db"},
+	{Key: "POSTGRES_URL", Usage: "the postgres connection url", Secret: true},
+	{Key: "MAX_POOL_SIZE", Flag: "max-pool-size", Usage: "the number of imap connections, 3 by default", Storable: true, Restart: true},
+	{Key: "BLOB_STORE_PATH", Flag: "blob-store-path", Usage: "keep the original bytes of every message in this directory"},
+	{Key: "ENCRYPTION_PASSPHRASE", Usage: "encrypt the archive at rest with this passphrase", Secret: true},
+	{Key: "ENCRYPTION_KEY_FILE", Flag: "encryption-key-file", Usage: "encrypt the archive at rest with the key in this file"},
+	{Key: "BACKUP_DIR", Flag: "backup-dir", Usage: "put backup snapshots in this directory"},
+	{Key: "BACKUP_INTERVAL", Flag: "backup-interval", Usage: "take a backup snapshot this often while serving, e.g. 24h", Storable: true},
+	{Key: "BACKUP_KEEP_LAST", Flag: "backup-keep-last", Usage: "keep this many of the newest backup snapshots", Storable: true},
+	{Key: "BACKUP_KEEP_DAILY", Flag: "backup-keep-daily", Usage: "keep the newest backup snapshot of this many days", Storable: true},
+	{Key: "BACKUP_KEEP_WEEKLY", Flag: "backup-keep-weekly", Usage: "keep the newest backup snapshot of this many weeks", Storable: true},
+	{Key: "BACKUP_KEEP_MONTHLY", Flag: "backup-keep-monthly", Usage: "keep the newest backup snapshot of this many months", Storable: true},
+	{Key: "KEEP_DELETED_EMAILS", Flag: "keep-deleted-emails", Usage: "remember the mailboxes of emails that are deleted on the server", Storable: true},
 }
 
-func New() (models.Options, error) {
+func definition(key string) (Definition, bool) {
+	for _, definition := range Definitions {
+		if definition.Key == key {
+			return definition, true
+		}
+	}
+	return Definition{}, false
+}
+
+/*
+New reads the options from the environment, loading a .env file first if there is one. flags maps keys to the values of
+command line flags, which take precedence over the environment.
+Options stored in the db are added with WithStored once it's open, since the options needed to open it can't be stored.
+*/
+func New(flags map[string]string) (*Options, error) {
 	err := godotenv.Load()
-	if err != nil {
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return nil, utils.JoinErrors("Error loading .env file", err)
 	}
-	options := &Options{}
+	overrides := map[string]string{}
+	overrideSources := map[string]string{}
 	for _, enivronVal := range os.Environ() {
-		kv := strings.Split(enivronVal, "=")
+		// values such as passphrases may contain "="
+		kv := strings.SplitN(enivronVal, "=", 2)
 		if len(kv) != 2 {
 			continue
 		}
-		key := kv[0]
-		value := kv[1]
-		switch strings.ToUpper(key) {
-		case "EMAIL":
-			options.Email = value
-		case "PASSWORD":
-			options.Password = value
-		case "IMAP_SERVER":
-			options.ImapServer = value
-			if !strings.Contains(value, ":") {
-				options.ImapServer = value + ":993"
-			}
-		case "STRICT_MAIL_PARSING":
-			options.StrictMailParsing, _ = strconv.ParseBool(value)
-		case "IMAP_CLIENT_DEBUG":
-			options.ImapClientDebug, _ = strconv.ParseBool(value)
-		case models.DEBUG_ENVIRONMENT_KEY:
-			options.Debug, _ = strconv.ParseBool(value)
-		case "SKIP_MAILBOXES":
-			// we use a % as a delimiter because it's not a valid character in most iamp server setup
-			options.SkipMailboxes = strings.Split(value, "%")
-		case "LIMIT_TO_MAILBOXES":
-			options.LimitToMailboxes = strings.Split(value, "%")
-		case "DB_PATH":
-			// if the path isn't absolute, make it absolute relative to the current working directory
-			if !filepath.IsAbs(value) {
-				wd, err := os.Getwd()
-				if err != nil {
-					return nil, utils.JoinErrors("unable to get working directory", err)
-				}
-				value = filepath.Join(wd, value)
-			}
-			options.DBPath = value
-		case "MAX_POOL_SIZE":
-			maxPoolSize, err := strconv.Atoi(value)
-			if err != nil {
-				return nil, utils.JoinErrors("unable to parse MAX_POOL_SIZE", err)
-			}
-			if maxPoolSize < 1 {
-				return nil, errors.New("MAX_POOL_SIZE must be greater than 0")
-			}
-			options.MaxPoolSize = maxPoolSize
+		key := strings.ToUpper(kv[0])
+		if _, ok := definition(key); ok {
+			overrides[key] = kv[1]
+			overrideSources[key] = SourceEnvironment
+		}
+	}
+	for key, value := range flags {
+		overrides[key] = value
+		overrideSources[key] = SourceFlag
+	}
+	options := &Options{overrides: overrides, overrideSources: overrideSources}
+	return options.withStored(map[string]string{})
+}
+
+// WithStored returns the options with the ones stored in db filled in, the environment and flags still take precedence
+func (options *Options) WithStored(db models.DB) (*Options, error) {
+	stored, err := db.GetOptions()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get the options stored in the db", err)
+	}
+	return options.withStored(stored)
+}
+
+func (options *Options) withStored(stored map[string]string) (*Options, error) {
+	result := &Options{
+		overrides:       options.overrides,
+		overrideSources: options.overrideSources,
+		stored:          stored,
+		values:          map[string]string{},
+		sources:         map[string]string{},
+	}
+	for _, definition := range Definitions {
+		value, source := "", SourceDefault
+		if storedValue, ok := stored[definition.Key]; ok && definition.Storable {
+			value, source = storedValue, SourceDB
+		}
+		if override, ok := options.overrides[definition.Key]; ok {
+			value, source = override, options.overrideSources[definition.Key]
+		}
+		result.sources[definition.Key] = source
+		if source == SourceDefault {
+			continue
 		}
+		result.values[definition.Key] = value
+		err := result.set(definition.Key, value)
+		if err != nil {
+			return nil, utils.JoinErrors(fmt.Sprintf("invalid %s from the %s", definition.Key, source), err)
+		}
+	}
+
+	switch result.DBBackend {
+	case "":
+		result.DBBackend = models.SQLiteBackend
+		fallthrough
+	case models.SQLiteBackend:
+		if result.DBPath == "" {
+			return nil, errors.New("missing DB_PATH")
+		}
+	case models.PostgresBackend:
+		if result.PostgresURL == "" {
+			return nil, errors.New("missing POSTGRES_URL")
+		}
+	default:
+		return nil, fmt.Errorf("unknown DB_BACKEND %q, expected %q or %q", result.DBBackend, models.SQLiteBackend, models.PostgresBackend)
+	}
+	if result.EncryptionPassphrase != "" && result.EncryptionKeyFile != "" {
+		return nil, errors.New("only one of ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE can be set")
+	}
+	if result.MaxPoolSize == 0 {
+		result.MaxPoolSize = 3
+	}
+	return result, nil
+}
+
+// parses the value of the option called key
+func (options *Options) set(key string, value string) error {
+	var err error
+	switch key {
+	case "EMAIL":
+		options.Email = value
+	case "PASSWORD":
+		options.Password = value
+	case "IMAP_SERVER":
+		options.ImapServer = value
+		if value != "" && !strings.Contains(value, ":") {
+			options.ImapServer = value + ":993"
+		}
+	case "STRICT_MAIL_PARSING":
+		options.StrictMailParsing, err = parseBool(value)
+	case "IMAP_CLIENT_DEBUG":
+		options.ImapClientDebug, err = parseBool(value)
+	case models.DEBUG_ENVIRONMENT_KEY:
+		options.Debug, err = parseBool(value)
+	case "SKIP_MAILBOXES":
+		// we use a % as a delimiter because it's not a valid character in most iamp server setup
+		options.SkipMailboxes = splitMailboxes(value)
+	case "LIMIT_TO_MAILBOXES":
+		options.LimitToMailboxes = splitMailboxes(value)
+	case "DB_PATH":
+		// if the path isn't absolute, make it absolute relative to the current working directory
+		options.DBPath, err = absolutePath(value)
+	case "DB_BACKEND":
+		options.DBBackend = strings.ToLower(value)
+	case "POSTGRES_URL":
+		options.PostgresURL = value
+	case "BLOB_STORE_PATH":
+		options.BlobStorePath, err = absolutePath(value)
+	case "ENCRYPTION_PASSPHRASE":
+		options.EncryptionPassphrase = value
+	case "ENCRYPTION_KEY_FILE":
+		options.EncryptionKeyFile, err = absolutePath(value)
+	case "BACKUP_DIR":
+		options.BackupDir, err = absolutePath(value)
+	case "BACKUP_INTERVAL":
+		options.BackupInterval, err = parseInterval(value)
+	case "BACKUP_KEEP_LAST":
+		options.BackupPolicy.KeepLast, err = parseCount(value)
+	case "BACKUP_KEEP_DAILY":
+		options.BackupPolicy.KeepDaily, err = parseCount(value)
+	case "BACKUP_KEEP_WEEKLY":
+		options.BackupPolicy.KeepWeekly, err = parseCount(value)
+	case "BACKUP_KEEP_MONTHLY":
+		options.BackupPolicy.KeepMonthly, err = parseCount(value)
+	case "KEEP_DELETED_EMAILS":
+		options.KeepDeletedEmails, err = parseBool(value)
+	case "MAX_POOL_SIZE":
+		options.MaxPoolSize, err = strconv.Atoi(value)
+		if err == nil && options.MaxPoolSize < 1 {
+			err = errors.New("MAX_POOL_SIZE must be greater than 0")
+		}
+	}
+	return err
+}
+
+func parseBool(value string) (bool, error) {
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+func parseCount(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	count, err := strconv.Atoi(value)
+	if err == nil && count < 0 {
+		err = errors.New("must not be negative")
+	}
+	return count, err
+}
+
+// an empty value or 0 disables what the interval schedules
+func parseInterval(value string) (time.Duration, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err == nil && interval < time.Minute {
+		err = errors.New("must be at least a minute")
+	}
+	return interval, err
+}
+
+func splitMailboxes(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, "%")
+}
+
+func absolutePath(value string) (string, error) {
+	if value == "" || filepath.IsAbs(value) {
+		return value, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", utils.JoinErrors("unable to get working directory", err)
 	}
+	return filepath.Join(wd, value), nil
+}
+
+// ValidateImap checks that everything needed to connect to the imap server is set
+func (options *Options) ValidateImap() error {
 	if options.Email == "" {
-		return nil, errors.New("missing EMAIL")
+		return errors.New("missing EMAIL")
 	}
 	if options.Password == "" {
-		return nil, errors.New("missing PASSWORD")
+		return errors.New("missing PASSWORD")
 	}
 	if options.ImapServer == "" {
-		return nil, errors.New("missing IMAP_SERVER")
+		return errors.New("missing IMAP_SERVER")
 	}
-	if options.DBPath == "" {
-		return nil, errors.New("missing DB_PATH")
+	return nil
+}
+
+/*
+Update validates changes to the options stored in the db, by key, and returns the options they result in. An empty value
+removes a stored option so that its default is used again. Nothing is stored, see DB.SetOptions.
+*/
+func (options *Options) Update(changes map[string]string) (*Options, error) {
+	stored := map[string]string{}
+	for key, value := range options.stored {
+		stored[key] = value
 	}
-	if options.MaxPoolSize == 0 {
-		options.MaxPoolSize = 3
+	for key, value := range changes {
+		definition, ok := definition(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown option %s", key)
+		}
+		if !definition.Storable {
+			return nil, fmt.Errorf("%s is needed to open the db, so it can only be set in the environment", key)
+		}
+		if definition.EncryptedOnly && value != "" && !options.encrypted() {
+			return nil, fmt.Errorf("%s is only stored in encrypted archives, set it in the environment or encrypt the archive with ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE", key)
+		}
+		if value == "" {
+			delete(stored, key)
+		} else {
+			stored[key] = value
+		}
+	}
+	return options.withStored(stored)
+}
+
+// whether values stored in the db are encrypted, only the sqlite backend encrypts them
+func (options *Options) encrypted() bool {
+	return options.EncryptionPassphrase != "" || options.EncryptionKeyFile != ""
+}
+
+/*
+CheckAccount refuses updated options that log in to another account than options do once the archive has emails,
+since the emails of both accounts would end up in the same mailboxes.
+*/
+func (options *Options) CheckAccount(updated *Options, db models.DB) error {
+	if strings.EqualFold(updated.Email, options.Email) && strings.EqualFold(updated.ImapServer, options.ImapServer) {
+		return nil
+	}
+	count, err := db.CountEmails("SELECT our_id FROM email")
+	if err != nil {
+		return utils.JoinErrors("failed to count the emails in the archive", err)
 	}
-	return options, nil
+	if count > 0 {
+		return fmt.Errorf("the archive already has %d emails of %s on %s, archive another account in a new db instead of changing EMAIL or IMAP_SERVER", count, options.Email, options.ImapServer)
+	}
+	return nil
+}
+
+// an option as shown by the api and the options command
+type Value struct {
+	Key string `json:"key"`
+	// always empty for secrets, their source tells whether they are set
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	// whether a stored value is used, it isn't when the environment or a flag sets the option
+	Editable bool `json:"editable"`
+	// false for options that can't be stored in this archive, e.g. PASSWORD in an unencrypted one
+	Storable bool `json:"storable"`
+	Secret   bool `json:"secret"`
+	// whether a change only takes effect after a restart
+	Restart bool   `json:"restart"`
+	Usage   string `json:"usage"`
 }
+
+// Values lists every option with where its value comes from, without the values of secrets
+func (options *Options) Values() []Value {
+	values := []Value{}
+	for _, definition := range Definitions {
+		value := Value{
+			Key:      definition.Key,
+			Source:   options.sources[definition.Key],
+			Storable: definition.Storable && (!definition.EncryptedOnly || options.encrypted()),
+			Secret:   definition.Secret,
+			Restart:  definition.Restart,
+			Usage:    definition.Usage,
+		}
+		value.Editable = value.Storable && (value.Source == SourceDefault || value.Source == SourceDB)
+		if !definition.Secret {
+			value.Value = options.values[definition.Key]
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
 func (options *Options) GetImapServer() string {
 	return options.ImapServer
 }
@@ -129,6 +449,14 @@ func (options *Options) GetLimitToMailboxes() []string {
 func (options *Options) GetSkipMailboxes() []string {
 	return options.SkipMailboxes
 }
+func (options *Options) GetDBBackend() string {
+	return options.DBBackend
+}
+
+func (options *Options) GetPostgresURL() string {
+	return options.PostgresURL
+}
+
 func (options *Options) GetDBPath() string {
 	return options.DBPath
 }
@@ -136,3 +464,31 @@ func (options *Options) GetDBPath() string {
 func (options *Options) GetMaxPoolSize() int {
 	return options.MaxPoolSize
 }
+
+func (options *Options) GetBlobStorePath() string {
+	return options.BlobStorePath
+}
+
+func (options *Options) GetEncryptionPassphrase() string {
+	return options.EncryptionPassphrase
+}
+
+func (options *Options) GetEncryptionKeyFile() string {
+	return options.EncryptionKeyFile
+}
+
+func (options *Options) GetBackupDir() string {
+	return options.BackupDir
+}
+
+func (options *Options) GetBackupInterval() time.Duration {
+	return options.BackupInterval
+}
+
+func (options *Options) GetBackupPolicy() models.BackupPolicy {
+	return options.BackupPolicy
+}
+
+func (options *Options) GetKeepDeletedEmails() bool {
+	return options.KeepDeletedEmails
+}
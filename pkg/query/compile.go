@@ -0,0 +1,240 @@
+package query
+
+import (
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"strings"
+	"time"
+)
+
+// the sql that differs between the sqlite and postgres backends
+type dialect struct {
+	// a condition on the email table for emails whose full text index entry contains the phrase
+	fullText func(phrase string) (string, []interface{})
+	// a full text search expression that matches any of the phrases, for highlighting them
+	highlight func(phrases []string) string
+	// the total size of an email's attachments in bytes
+	attachmentSize string
+}
+
+var dialects = map[string]dialect{
+	models.SQLiteBackend: {
+		fullText: func(phrase string) (string, []interface{}) {
+			return "rowid IN (SELECT rowid FROM email_fts WHERE email_fts MATCH ?)", []interface{}{sqliteFullTextPhrase(phrase)}
+		},
+		highlight: func(phrases []string) string {
+			quoted := []string{}
+			for _, phrase := range phrases {
+				quoted = append(quoted, sqliteFullTextPhrase(phrase))
+			}
+			return strings.Join(quoted, " OR ")
+		},
+		attachmentSize: "(SELECT coalesce(sum(json_extract(value, '$.FileSize')), 0) FROM json_each(CASE WHEN json_valid(attachments) THEN attachments ELSE '[]' END))",
+	},
+	models.PostgresBackend: {
+		fullText: func(phrase string) (string, []interface{}) {
+			return fmt.Sprintf("our_id IN (SELECT our_id FROM email_fts WHERE document @@ phraseto_tsquery('%s', ?))", models.PostgresTextSearchConfig), []interface{}{phrase}
+		},
+		highlight: func(phrases []string) string {
+			// websearch_to_tsquery syntax, a quote in a phrase would end it early
+			quoted := []string{}
+			for _, phrase := range phrases {
+				quoted = append(quoted, `"`+strings.ReplaceAll(phrase, `"`, " ")+`"`)
+			}
+			return strings.Join(quoted, " or ")
+		},
+		attachmentSize: "(SELECT coalesce(sum((attachment->>'FileSize')::bigint), 0) FROM jsonb_array_elements(CASE WHEN jsonb_typeof(attachments) = 'array' THEN attachments ELSE '[]'::jsonb END) attachment)",
+	},
+}
+
+/*
+CurrentMembershipCondition selects the rows of message_to_mailbox that count for in:, label:, exports and the mailboxes
+of an email: the ones still on the server, and every mailbox an email was in when it was deleted on the server. An email
+that was moved is only in its new mailbox.
+*/
+const CurrentMembershipCondition = "(removed_at IS NULL OR our_id IN (SELECT our_id FROM email WHERE deleted_on_server_at IS NOT NULL))"
+
+// special use mailboxes, matched by their attribute as well as by name so that in:sent finds "[Gmail]/Sent Mail"
+var specialUseMailboxes = map[string]string{
+	"sent":   `\Sent`,
+	"drafts": `\Drafts`,
+	"trash":  `\Trash`,
+	"spam":   `\Junk`,
+	"junk":   `\Junk`,
+	"all":    `\All`,
+}
+
+// quoted, so that fts5 operators and column filters in the phrase are searched for literally
+func sqliteFullTextPhrase(phrase string) string {
+	return `"` + strings.ReplaceAll(phrase, `"`, `""`) + `"`
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// a LIKE pattern matching values that contain value, case insensitively when compared to a lower cased column
+func containsPattern(value string) string {
+	return "%" + likeEscaper.Replace(strings.ToLower(value)) + "%"
+}
+
+// a LIKE pattern matching json lists with the string value, as stored in the flags and attributes columns
+func jsonStringPattern(value string) string {
+	return "%" + likeEscaper.Replace(`"`+strings.ReplaceAll(value, `\`, `\\`)+`"`) + "%"
+}
+
+/*
+Compile parses query and turns it into a condition on the email table with ? placeholders, for the sqlite or postgres
+backend. now is what older_than and newer_than are relative to.
+*/
+func Compile(query string, backend string, now time.Time) (string, []interface{}, error) {
+	node, err := Parse(query)
+	if err != nil {
+		return "", nil, err
+	}
+	dialect, ok := dialects[backend]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown backend %q", backend)
+	}
+	condition, params := node.condition(dialect, now)
+	return condition, params, nil
+}
+
+/*
+Highlight returns a full text search expression for the backend that matches any of the words and phrases of query
+that aren't negated, for DB.FullTextSearch to highlight them. It is empty when query only has operators.
+*/
+func Highlight(query string, backend string) (string, error) {
+	node, err := Parse(query)
+	if err != nil {
+		return "", err
+	}
+	dialect, ok := dialects[backend]
+	if !ok {
+		return "", fmt.Errorf("unknown backend %q", backend)
+	}
+	phrases := node.phrases()
+	if len(phrases) == 0 {
+		return "", nil
+	}
+	return dialect.highlight(phrases), nil
+}
+
+func joinPhrases(terms []Node) []string {
+	phrases := []string{}
+	for _, term := range terms {
+		phrases = append(phrases, term.phrases()...)
+	}
+	return phrases
+}
+
+func (node and) phrases() []string {
+	return joinPhrases(node.terms)
+}
+
+func (node or) phrases() []string {
+	return joinPhrases(node.terms)
+}
+
+func (node not) phrases() []string {
+	return nil
+}
+
+func (node text) phrases() []string {
+	return []string{node.text}
+}
+
+func (node operator) phrases() []string {
+	return nil
+}
+
+func joinConditions(terms []Node, separator string, dialect dialect, now time.Time) (string, []interface{}) {
+	conditions := []string{}
+	params := []interface{}{}
+	for _, term := range terms {
+		condition, termParams := term.condition(dialect, now)
+		conditions = append(conditions, condition)
+		params = append(params, termParams...)
+	}
+	return "(" + strings.Join(conditions, separator) + ")", params
+}
+
+func (node and) condition(dialect dialect, now time.Time) (string, []interface{}) {
+	return joinConditions(node.terms, " AND ", dialect, now)
+}
+
+func (node or) condition(dialect dialect, now time.Time) (string, []interface{}) {
+	return joinConditions(node.terms, " OR ", dialect, now)
+}
+
+func (node not) condition(dialect dialect, now time.Time) (string, []interface{}) {
+	condition, params := node.term.condition(dialect, now)
+	// unlike NOT, this also matches emails where the condition is NULL, e.g. -subject:invoice for emails without a subject
+	return fmt.Sprintf("(%s) IS NOT TRUE", condition), params
+}
+
+func (node text) condition(dialect dialect, now time.Time) (string, []interface{}) {
+	return dialect.fullText(node.text)
+}
+
+func (node operator) condition(dialect dialect, now time.Time) (string, []interface{}) {
+	value := node.value
+	switch node.name {
+	case "from", "to", "cc", "bcc":
+		return `our_id IN (SELECT our_id FROM email_address WHERE role = ? AND (address LIKE ? ESCAPE '\' OR lower(name) LIKE ? ESCAPE '\'))`,
+			[]interface{}{node.name, containsPattern(value), containsPattern(value)}
+	case "subject":
+		return `lower(subject) LIKE ? ESCAPE '\'`, []interface{}{containsPattern(value)}
+	case "has":
+		switch strings.ToLower(value) {
+		case "tag":
+			return "our_id IN (SELECT our_id FROM tag)", nil
+		case "note":
+			return "our_id IN (SELECT our_id FROM note)", nil
+		}
+		// attachment_text has a row per attachment even when the attachments column is encrypted
+		return "(CAST(attachments AS text) LIKE '[{%' OR our_id IN (SELECT our_id FROM attachment_text))", nil
+	case "filename":
+		return `(our_id IN (SELECT our_id FROM attachment_text WHERE lower(file_name) LIKE ? ESCAPE '\') OR lower(CAST(attachments AS text)) LIKE ? ESCAPE '\')`,
+			[]interface{}{containsPattern(value), containsPattern(value)}
+	case "larger":
+		return dialect.attachmentSize + " > ?", []interface{}{node.size}
+	case "smaller":
+		return dialect.attachmentSize + " < ?", []interface{}{node.size}
+	case "before":
+		return "date_epoch < ?", []interface{}{node.time.Unix()}
+	case "after":
+		return "date_epoch >= ?", []interface{}{node.time.Unix()}
+	case "older_than":
+		return "date_epoch < ?", []interface{}{node.age.before(now).Unix()}
+	case "newer_than":
+		return "date_epoch >= ?", []interface{}{node.age.before(now).Unix()}
+	case "in", "label":
+		attribute, ok := specialUseMailboxes[strings.ToLower(value)]
+		if !ok {
+			return "our_id IN (SELECT our_id FROM message_to_mailbox WHERE lower(mailbox_name) = ? AND " + CurrentMembershipCondition + ")", []interface{}{strings.ToLower(value)}
+		}
+		return `our_id IN (SELECT our_id FROM message_to_mailbox WHERE (lower(mailbox_name) = ? OR mailbox_name IN (SELECT name FROM mailbox WHERE CAST(attributes AS text) LIKE ? ESCAPE '\')) AND ` + CurrentMembershipCondition + ")",
+			[]interface{}{strings.ToLower(value), jsonStringPattern(attribute)}
+	case "is":
+		if condition, ok := isConditions[strings.ToLower(value)]; ok {
+			return condition, nil
+		}
+		flag := isValues[strings.ToLower(value)]
+		if flag.set {
+			return `CAST(flags AS text) LIKE ? ESCAPE '\'`, []interface{}{jsonStringPattern(flag.flag)}
+		}
+		return `coalesce(CAST(flags AS text), '') NOT LIKE ? ESCAPE '\'`, []interface{}{jsonStringPattern(flag.flag)}
+	case "tag":
+		// tags are stored lower cased
+		return "our_id IN (SELECT our_id FROM tag WHERE name = ?)", []interface{}{strings.ToLower(value)}
+	case "note":
+		return `our_id IN (SELECT our_id FROM note WHERE lower(text) LIKE ? ESCAPE '\')`, []interface{}{containsPattern(value)}
+	case "list":
+		return `our_id IN (SELECT our_id FROM header WHERE name = 'list-id' AND lower(value) LIKE ? ESCAPE '\')`, []interface{}{containsPattern(value)}
+	}
+	// Parse only accepts the operators handled above
+	panic(fmt.Sprintf("unhandled operator %s", node.name))
+}
+
+func (age age) before(now time.Time) time.Time {
+	return now.AddDate(-age.years, -age.months, -age.days)
+}
@@ -0,0 +1,473 @@
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+SyntaxError is returned for queries that can't be parsed. Position is the byte offset in the query the problem was found
+at, Message explains it in terms of the query language.
+*/
+type SyntaxError struct {
+	Position int
+	Message  string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("invalid query at position %d: %s", err.Position+1, err.Message)
+}
+
+func syntaxError(position int, format string, args ...interface{}) *SyntaxError {
+	return &SyntaxError{Position: position, Message: fmt.Sprintf(format, args...)}
+}
+
+// Node is a parsed query, see Parse
+type Node interface {
+	condition(dialect dialect, now time.Time) (string, []interface{})
+	// the words and phrases that have to be found in the full text index, i.e. the ones that aren't negated
+	phrases() []string
+}
+
+// every term has to match
+type and struct {
+	terms []Node
+}
+
+// one of the terms has to match
+type or struct {
+	terms []Node
+}
+
+type not struct {
+	term Node
+}
+
+// a word or "quoted phrase" searched for in the full text index
+type text struct {
+	text string
+}
+
+type operator struct {
+	name  string
+	value string
+	// set for the operators that take a date, size or age
+	time time.Time
+	size int64
+	age  age
+}
+
+// a relative age like 3d, 2m or 1y of older_than and newer_than
+type age struct {
+	days   int
+	months int
+	years  int
+}
+
+var operatorUsage = map[string]string{
+	"from":       "from:alice@example.com, from:example.com or from:alice",
+	"to":         "to:bob@example.com",
+	"cc":         "cc:bob@example.com",
+	"bcc":        "bcc:bob@example.com",
+	"subject":    `subject:invoice or subject:"quarterly report"`,
+	"has":        "has:attachment, has:tag or has:note",
+	"filename":   "filename:pdf or filename:report.docx",
+	"larger":     "larger:5M, larger:500K or larger:1000000",
+	"smaller":    "smaller:5M, smaller:500K or smaller:1000000",
+	"before":     "before:2021-01-31 or before:2021/01/31",
+	"after":      "after:2021-01-31 or after:2021/01/31",
+	"older_than": "older_than:30d, older_than:6m or older_than:1y",
+	"newer_than": "newer_than:30d, newer_than:6m or newer_than:1y",
+	"in":         "in:INBOX or in:sent",
+	"label":      "label:Receipts",
+	"is":         "is:unread, is:read, is:starred, is:answered, is:draft or is:deleted",
+	"list":       "list:dev.example.org",
+	"tag":        "tag:tax-2023",
+	"note":       `note:lawyer or note:"call back"`,
+}
+
+// the imap flag each is: value checks, and whether it has to be set
+var isValues = map[string]struct {
+	flag string
+	set  bool
+}{
+	"unread":   {`\Seen`, false},
+	"read":     {`\Seen`, true},
+	"starred":  {`\Flagged`, true},
+	"flagged":  {`\Flagged`, true},
+	"answered": {`\Answered`, true},
+	"replied":  {`\Answered`, true},
+	"draft":    {`\Draft`, true},
+}
+
+// the is: values that check the state of the archive instead of an imap flag, with their condition
+var isConditions = map[string]string{
+	// removed from every mailbox on the server while KEEP_DELETED_EMAILS was on
+	"deleted": "deleted_on_server_at IS NOT NULL",
+}
+
+// the values of has:
+var hasValues = map[string]bool{"attachment": true, "tag": true, "note": true}
+
+func operatorNames() []string {
+	names := []string{}
+	for name := range operatorUsage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Parse parses a gmail like query, e.g. `from:acme.com has:attachment larger:5M before:2021-01-01 in:INBOX is:unread
+"exact phrase" -label:Receipts`.
+Terms separated by spaces all have to match, OR between two terms matches either of them, a leading - negates a term
+and parentheses group terms. Words and "quoted phrases" are looked up in the full text index.
+Errors are *SyntaxError.
+*/
+func Parse(query string) (Node, error) {
+	tokens, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	parser := &parser{tokens: tokens, end: len(query)}
+	if len(tokens) == 0 {
+		return nil, syntaxError(0, "the query is empty")
+	}
+	node, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !parser.done() {
+		// parseOr only stops early at a closing parenthesis
+		return nil, syntaxError(parser.peek().position, "unexpected ), there is no ( it closes")
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	wordToken tokenKind = iota
+	phraseToken
+	operatorToken
+	openToken
+	closeToken
+	negateToken
+	orToken
+)
+
+type token struct {
+	kind     tokenKind
+	position int
+	// the word or phrase, or the value of an operator
+	text string
+	// the name of an operator
+	name string
+}
+
+func tokenize(query string) ([]token, error) {
+	tokens := []token{}
+	position := 0
+	for position < len(query) {
+		char := query[position]
+		switch {
+		case isSpace(char):
+			position++
+		case char == '(':
+			tokens = append(tokens, token{kind: openToken, position: position})
+			position++
+		case char == ')':
+			tokens = append(tokens, token{kind: closeToken, position: position})
+			position++
+		case char == '-' && position+1 < len(query) && !isSpace(query[position+1]):
+			tokens = append(tokens, token{kind: negateToken, position: position})
+			position++
+		case char == '"':
+			phrase, end, err := readPhrase(query, position)
+			if err != nil {
+				return nil, err
+			}
+			if strings.TrimSpace(phrase) == "" {
+				return nil, syntaxError(position, "the quotes are empty")
+			}
+			tokens = append(tokens, token{kind: phraseToken, position: position, text: phrase})
+			position = end
+		default:
+			start := position
+			for position < len(query) && !isSpace(query[position]) && !strings.ContainsRune(`()"`, rune(query[position])) {
+				position++
+			}
+			word := query[start:position]
+			name, value, isOperator := strings.Cut(word, ":")
+			name = strings.ToLower(name)
+			if word == "OR" {
+				tokens = append(tokens, token{kind: orToken, position: start})
+				continue
+			}
+			// AND is what separating terms means anyway
+			if word == "AND" {
+				continue
+			}
+			if !isOperator || name == "" {
+				tokens = append(tokens, token{kind: wordToken, position: start, text: word})
+				continue
+			}
+			if _, ok := operatorUsage[name]; !ok {
+				if suggestion := closestOperator(name); suggestion != "" {
+					return nil, syntaxError(start, "unknown operator %s:, did you mean %s:?", name, suggestion)
+				}
+				// e.g. a pasted url, searched for like any other word
+				tokens = append(tokens, token{kind: wordToken, position: start, text: word})
+				continue
+			}
+			if value == "" && position < len(query) && query[position] == '"' {
+				phrase, end, err := readPhrase(query, position)
+				if err != nil {
+					return nil, err
+				}
+				value = phrase
+				position = end
+			}
+			if strings.TrimSpace(value) == "" {
+				return nil, syntaxError(start, "%s: needs a value, e.g. %s", name, operatorUsage[name])
+			}
+			tokens = append(tokens, token{kind: operatorToken, position: start, name: name, text: value})
+		}
+	}
+	return tokens, nil
+}
+
+// only ascii whitespace separates terms, so the bytes of multibyte characters never do
+func isSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r'
+}
+
+// reads the phrase whose opening quote is at start, returns it and the position after the closing quote
+func readPhrase(query string, start int) (string, int, error) {
+	end := strings.IndexByte(query[start+1:], '"')
+	if end == -1 {
+		return "", 0, syntaxError(start, `the quote is never closed, add a " at the end of the phrase`)
+	}
+	return query[start+1 : start+1+end], start + end + 2, nil
+}
+
+// the known operator a misspelled one was most likely meant to be, if any is close enough
+func closestOperator(name string) string {
+	best, bestDistance := "", 3
+	for _, candidate := range operatorNames() {
+		distance := editDistance(name, candidate)
+		if distance < bestDistance && distance < len(candidate)/2+1 {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+type parser struct {
+	tokens []token
+	next   int
+	// the length of the query, where errors about a missing term point to
+	end int
+}
+
+func (parser *parser) done() bool {
+	return parser.next >= len(parser.tokens)
+}
+
+func (parser *parser) peek() token {
+	return parser.tokens[parser.next]
+}
+
+func (parser *parser) parseOr() (Node, error) {
+	terms := []Node{}
+	for {
+		term, err := parser.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+		if parser.done() || parser.peek().kind != orToken {
+			break
+		}
+		orPosition := parser.peek().position
+		parser.next++
+		if parser.done() || parser.peek().kind == closeToken || parser.peek().kind == orToken {
+			return nil, syntaxError(orPosition, "OR needs a term on both sides")
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return or{terms: terms}, nil
+}
+
+func (parser *parser) parseAnd() (Node, error) {
+	terms := []Node{}
+	for !parser.done() && parser.peek().kind != orToken && parser.peek().kind != closeToken {
+		term, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		position := parser.end
+		if !parser.done() {
+			position = parser.peek().position
+		}
+		if !parser.done() && parser.peek().kind == orToken {
+			return nil, syntaxError(position, "OR needs a term on both sides")
+		}
+		return nil, syntaxError(position, "expected a term")
+	}
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+	return and{terms: terms}, nil
+}
+
+func (parser *parser) parseTerm() (Node, error) {
+	current := parser.peek()
+	parser.next++
+	switch current.kind {
+	case negateToken:
+		if parser.done() || parser.peek().kind == closeToken || parser.peek().kind == orToken {
+			return nil, syntaxError(current.position, "- has to be followed by the term it excludes, e.g. -label:Receipts")
+		}
+		term, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return not{term: term}, nil
+	case openToken:
+		if !parser.done() && parser.peek().kind == closeToken {
+			return nil, syntaxError(current.position, "the parentheses are empty")
+		}
+		group, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.done() {
+			return nil, syntaxError(current.position, "the ( is never closed")
+		}
+		parser.next++
+		return group, nil
+	case wordToken, phraseToken:
+		return text{text: current.text}, nil
+	case operatorToken:
+		return parseOperator(current)
+	}
+	return nil, syntaxError(current.position, "unexpected token")
+}
+
+func parseOperator(current token) (Node, error) {
+	parsed := operator{name: current.name, value: current.text}
+	invalid := func(problem string) error {
+		return syntaxError(current.position, "%s:%s %s, use e.g. %s", current.name, current.text, problem, operatorUsage[current.name])
+	}
+	var err error
+	switch current.name {
+	case "larger", "smaller":
+		parsed.size, err = parseSize(current.text)
+		if err != nil {
+			return nil, invalid("is not a size")
+		}
+	case "before", "after":
+		parsed.time, err = parseDay(current.text)
+		if err != nil {
+			return nil, invalid("is not a date")
+		}
+	case "older_than", "newer_than":
+		parsed.age, err = parseAge(current.text)
+		if err != nil {
+			return nil, invalid("is not an age")
+		}
+	case "is":
+		_, isFlag := isValues[strings.ToLower(current.text)]
+		_, isCondition := isConditions[strings.ToLower(current.text)]
+		if !isFlag && !isCondition {
+			return nil, invalid("is not supported")
+		}
+	case "has":
+		if !hasValues[strings.ToLower(current.text)] {
+			return nil, invalid("is not supported")
+		}
+	}
+	return parsed, nil
+}
+
+// 5M, 500K, 2G or a number of bytes
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	switch strings.ToUpper(size[len(size)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		size = size[:len(size)-1]
+	}
+	number, err := strconv.ParseFloat(size, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// a day at midnight UTC, like the dates of the export selections. gmail writes them with slashes
+func parseDay(day string) (time.Time, error) {
+	return time.Parse("2006-01-02", strings.ReplaceAll(day, "/", "-"))
+}
+
+func parseAge(value string) (age, error) {
+	if len(value) < 2 {
+		return age{}, fmt.Errorf("invalid age %q", value)
+	}
+	number, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || number < 0 {
+		return age{}, fmt.Errorf("invalid age %q", value)
+	}
+	switch strings.ToLower(value[len(value)-1:]) {
+	case "d":
+		return age{days: number}, nil
+	case "m":
+		return age{months: number}, nil
+	case "y":
+		return age{years: number}, nil
+	}
+	return age{}, fmt.Errorf("invalid age %q", value)
+}
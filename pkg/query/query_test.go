@@ -0,0 +1,163 @@
+package query
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/skamensky/email-archiver/pkg/models"
+)
+
+var testNow = time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+
+const (
+	sqliteFullText   = "rowid IN (SELECT rowid FROM email_fts WHERE email_fts MATCH ?)"
+	postgresFullText = "our_id IN (SELECT our_id FROM email_fts WHERE document @@ phraseto_tsquery('simple', ?))"
+	addressCondition = `our_id IN (SELECT our_id FROM email_address WHERE role = ? AND (address LIKE ? ESCAPE '\' OR lower(name) LIKE ? ESCAPE '\'))`
+	mailboxCondition = "our_id IN (SELECT our_id FROM message_to_mailbox WHERE lower(mailbox_name) = ? AND " + CurrentMembershipCondition + ")"
+	specialCondition = `our_id IN (SELECT our_id FROM message_to_mailbox WHERE (lower(mailbox_name) = ? OR mailbox_name IN (SELECT name FROM mailbox WHERE CAST(attributes AS text) LIKE ? ESCAPE '\')) AND ` + CurrentMembershipCondition + ")"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		query string
+		// empty for both backends
+		backend   string
+		condition string
+		params    []interface{}
+	}{
+		{"invoice", models.SQLiteBackend, sqliteFullText, []interface{}{`"invoice"`}},
+		{"invoice", models.PostgresBackend, postgresFullText, []interface{}{"invoice"}},
+		// fts5 syntax is searched for literally
+		{"foo* NEAR", models.SQLiteBackend, "(" + sqliteFullText + " AND " + sqliteFullText + ")", []interface{}{`"foo*"`, `"NEAR"`}},
+		{`say"hi"`, models.SQLiteBackend, "(" + sqliteFullText + " AND " + sqliteFullText + ")", []interface{}{`"say"`, `"hi"`}},
+		{`"quarterly report"`, models.PostgresBackend, postgresFullText, []interface{}{"quarterly report"}},
+		// not an operator, so a plain word
+		{"http://example.com", models.SQLiteBackend, sqliteFullText, []interface{}{`"http://example.com"`}},
+		{"from:Acme.com", "", addressCondition, []interface{}{"from", "%acme.com%", "%acme.com%"}},
+		{`to:"Jane Doe"`, "", addressCondition, []interface{}{"to", "%jane doe%", "%jane doe%"}},
+		{"subject:50%_off", "", `lower(subject) LIKE ? ESCAPE '\'`, []interface{}{`%50\%\_off%`}},
+		{"larger:5M", models.SQLiteBackend, dialects[models.SQLiteBackend].attachmentSize + " > ?", []interface{}{int64(5 << 20)}},
+		{"smaller:1.5K", models.PostgresBackend, dialects[models.PostgresBackend].attachmentSize + " < ?", []interface{}{int64(1536)}},
+		{"before:2021/01/31", "", "date_epoch < ?", []interface{}{time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC).Unix()}},
+		{"after:2021-01-31", "", "date_epoch >= ?", []interface{}{time.Date(2021, 1, 31, 0, 0, 0, 0, time.UTC).Unix()}},
+		{"older_than:30d", "", "date_epoch < ?", []interface{}{time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Unix()}},
+		{"newer_than:1y", "", "date_epoch >= ?", []interface{}{time.Date(2023, 3, 31, 12, 0, 0, 0, time.UTC).Unix()}},
+		{"in:INBOX", "", mailboxCondition, []interface{}{"inbox"}},
+		{"label:Sent", "", specialCondition, []interface{}{"sent", `%"\\\\Sent"%`}},
+		{"is:unread", "", `coalesce(CAST(flags AS text), '') NOT LIKE ? ESCAPE '\'`, []interface{}{`%"\\\\Seen"%`}},
+		{"IS:Starred", "", `CAST(flags AS text) LIKE ? ESCAPE '\'`, []interface{}{`%"\\\\Flagged"%`}},
+		{"is:deleted", "", "deleted_on_server_at IS NOT NULL", nil},
+		{"has:attachment", "", "(CAST(attachments AS text) LIKE '[{%' OR our_id IN (SELECT our_id FROM attachment_text))", nil},
+		{"has:note", "", "our_id IN (SELECT our_id FROM note)", nil},
+		{"tag:Tax-2023", "", "our_id IN (SELECT our_id FROM tag WHERE name = ?)", []interface{}{"tax-2023"}},
+		{"list:dev.example.org", "", `our_id IN (SELECT our_id FROM header WHERE name = 'list-id' AND lower(value) LIKE ? ESCAPE '\')`, []interface{}{"%dev.example.org%"}},
+		{"-is:deleted", "", "(deleted_on_server_at IS NOT NULL) IS NOT TRUE", nil},
+		{"has:tag AND has:note", "", "(our_id IN (SELECT our_id FROM tag) AND our_id IN (SELECT our_id FROM note))", nil},
+		{
+			"(from:alice OR from:bob) -in:trash", "",
+			"((" + addressCondition + " OR " + addressCondition + ") AND (" + specialCondition + ") IS NOT TRUE)",
+			[]interface{}{"from", "%alice%", "%alice%", "from", "%bob%", "%bob%", "trash", `%"\\\\Trash"%`},
+		},
+	}
+	for _, test := range tests {
+		backends := []string{models.SQLiteBackend, models.PostgresBackend}
+		if test.backend != "" {
+			backends = []string{test.backend}
+		}
+		for _, backend := range backends {
+			condition, params, err := Compile(test.query, backend, testNow)
+			if err != nil {
+				t.Errorf("%s: Compile(%q) failed: %v", backend, test.query, err)
+				continue
+			}
+			if condition != test.condition {
+				t.Errorf("%s: Compile(%q) condition\n got: %s\nwant: %s", backend, test.query, condition, test.condition)
+			}
+			if (len(params) > 0 || len(test.params) > 0) && !reflect.DeepEqual(params, test.params) {
+				t.Errorf("%s: Compile(%q) params\n got: %#v\nwant: %#v", backend, test.query, params, test.params)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		// 1 based, like the error message
+		position int
+		message  string
+	}{
+		{"", 1, "the query is empty"},
+		{"   ", 1, "the query is empty"},
+		{"form:alice", 1, "unknown operator form:, did you mean from:?"},
+		{"invoice sbject:tax", 9, "unknown operator sbject:, did you mean subject:?"},
+		{`a "abc`, 3, `the quote is never closed, add a " at the end of the phrase`},
+		{`""`, 1, "the quotes are empty"},
+		{"(a", 1, "the ( is never closed"},
+		{"a)", 2, "unexpected ), there is no ( it closes"},
+		{"()", 1, "the parentheses are empty"},
+		{"a OR", 3, "OR needs a term on both sides"},
+		{"OR a", 1, "OR needs a term on both sides"},
+		{"a OR OR b", 3, "OR needs a term on both sides"},
+		{"(a -)", 4, "- has to be followed by the term it excludes, e.g. -label:Receipts"},
+		{"from:", 1, "from: needs a value, e.g. from:alice@example.com, from:example.com or from:alice"},
+		{`subject:""`, 1, `subject: needs a value, e.g. subject:invoice or subject:"quarterly report"`},
+		{"larger:5X", 1, "larger:5X is not a size, use e.g. larger:5M, larger:500K or larger:1000000"},
+		{"before:2021-13-01", 1, "before:2021-13-01 is not a date, use e.g. before:2021-01-31 or before:2021/01/31"},
+		{"older_than:3w", 1, "older_than:3w is not an age, use e.g. older_than:30d, older_than:6m or older_than:1y"},
+		{"is:gone", 1, "is:gone is not supported, use e.g. is:unread, is:read, is:starred, is:answered, is:draft or is:deleted"},
+		{"has:pdf", 1, "has:pdf is not supported, use e.g. has:attachment, has:tag or has:note"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.query)
+		syntaxErr := &SyntaxError{}
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) returned %v, want a *SyntaxError", test.query, err)
+			continue
+		}
+		if syntaxErr.Position+1 != test.position || syntaxErr.Message != test.message {
+			t.Errorf("Parse(%q) error\n got: %v\nwant: invalid query at position %d: %s", test.query, err, test.position, test.message)
+		}
+		// the web api and the cli show Error() as is
+		_, _, compileErr := Compile(test.query, models.SQLiteBackend, testNow)
+		if compileErr == nil || compileErr.Error() != err.Error() {
+			t.Errorf("Compile(%q) returned %v, want %v", test.query, compileErr, err)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	tests := []struct {
+		query     string
+		backend   string
+		highlight string
+	}{
+		{"invoice", models.SQLiteBackend, `"invoice"`},
+		{`invoice OR "due date" from:acme.com`, models.SQLiteBackend, `"invoice" OR "due date"`},
+		{`say"hi" NEAR`, models.SQLiteBackend, `"say" OR "hi" OR "NEAR"`},
+		// negated terms aren't in the results, so there is nothing to highlight
+		{"invoice -draft -(paid OR void)", models.SQLiteBackend, `"invoice"`},
+		{"from:acme.com has:attachment", models.SQLiteBackend, ""},
+		{`invoice OR "due date"`, models.PostgresBackend, `"invoice" or "due date"`},
+		{"-invoice", models.PostgresBackend, ""},
+	}
+	for _, test := range tests {
+		highlight, err := Highlight(test.query, test.backend)
+		if err != nil {
+			t.Errorf("Highlight(%q, %s) returned %v", test.query, test.backend, err)
+			continue
+		}
+		if highlight != test.highlight {
+			t.Errorf("Highlight(%q, %s)\n got: %s\nwant: %s", test.query, test.backend, highlight, test.highlight)
+		}
+	}
+}
+
+func TestCompileUnknownBackend(t *testing.T) {
+	_, _, err := Compile("invoice", "mysql", testNow)
+	if err == nil || err.Error() != `unknown backend "mysql"` {
+		t.Errorf("Compile with an unknown backend returned %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/export"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"sort"
+	"time"
+)
+
+type Action string
+
+const (
+	// deletes the emails from the server, the local copies are kept
+	ActionDeleteRemote Action = "delete_remote"
+	// deletes the local copies, the server isn't touched
+	ActionPurgeLocal Action = "purge_local"
+)
+
+// how many uids are deleted from the server and logged at once
+const batchSize = 500
+
+/*
+Policy selects emails older than OlderThanDays, by their date_epoch, either in Mailboxes, matching SqlQuery or matching
+the saved query called SavedQuery, optionally narrowed down by Headers, and deletes them according to Action.
+*/
+type Policy struct {
+	Name          string                `json:"name"`
+	Action        Action                `json:"action"`
+	Mailboxes     []string              `json:"mailboxes,omitempty"`
+	SqlQuery      string                `json:"sql_query,omitempty"`
+	SavedQuery    string                `json:"saved_query,omitempty"`
+	Headers       []export.HeaderFilter `json:"headers,omitempty"`
+	OlderThanDays int                   `json:"older_than_days"`
+}
+
+func (policy Policy) validate() error {
+	if policy.Name == "" {
+		return errors.New("every policy needs a name")
+	}
+	if policy.Action != ActionDeleteRemote && policy.Action != ActionPurgeLocal {
+		return fmt.Errorf("policy %q: action must be %q or %q", policy.Name, ActionDeleteRemote, ActionPurgeLocal)
+	}
+	set := 0
+	for _, given := range []bool{len(policy.Mailboxes) > 0, policy.SqlQuery != "", policy.SavedQuery != ""} {
+		if given {
+			set++
+		}
+	}
+	if set != 1 {
+		return fmt.Errorf("policy %q: exactly one of mailboxes, sql_query or saved_query must be given", policy.Name)
+	}
+	// a missing or zero age would select everything, which is never what was meant
+	if policy.OlderThanDays <= 0 {
+		return fmt.Errorf("policy %q: older_than_days must be greater than 0", policy.Name)
+	}
+	return nil
+}
+
+func (policy Policy) selection(now time.Time) export.Selection {
+	return export.Selection{
+		SqlQuery:   policy.SqlQuery,
+		SavedQuery: policy.SavedQuery,
+		Mailboxes:  policy.Mailboxes,
+		Headers:    policy.Headers,
+		Before:     now.AddDate(0, 0, -policy.OlderThanDays),
+	}
+}
+
+// LoadPolicies reads a json list of policies
+func LoadPolicies(path string) ([]Policy, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, utils.JoinErrors("failed to read retention policies", err)
+	}
+	policies := []Policy{}
+	err = json.Unmarshal(contents, &policies)
+	if err != nil {
+		return nil, utils.JoinErrors(fmt.Sprintf("failed to parse retention policies in %s", path), err)
+	}
+	names := utils.NewSet([]string{})
+	for _, policy := range policies {
+		err = policy.validate()
+		if err != nil {
+			return nil, err
+		}
+		if names.Contains(policy.Name) {
+			return nil, fmt.Errorf("policy %q is defined twice", policy.Name)
+		}
+		names.Add(policy.Name)
+	}
+	return policies, nil
+}
+
+/*
+Plan returns what applying the policies would delete, without changing anything.
+delete_remote policies yield one deletion per mailbox the email is in on the server, limited to the policy's mailboxes if
+it has any. An email matched by several policies is only deleted once, by the first of them.
+*/
+func Plan(db models.DB, policies []Policy, now time.Time) ([]models.RetentionDeletion, error) {
+	deletions := []models.RetentionDeletion{}
+	purged := utils.NewSet([]string{})
+	type membership struct {
+		mailbox string
+		uid     uint32
+	}
+	deletedRemotely := utils.NewSet([]membership{})
+
+	serverMailboxes, err := ServerMailboxes(db)
+	if err != nil {
+		return nil, err
+	}
+	onServer := utils.NewSet(serverMailboxes)
+
+	// maps our_id to uid, per mailbox
+	mailboxUids := map[string]map[string]uint32{}
+	for _, mailbox := range serverMailboxes {
+		mailboxUids[mailbox], err = db.GetMailboxUids(mailbox)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, policy := range policies {
+		mailboxes := serverMailboxes
+		if len(policy.Mailboxes) > 0 {
+			mailboxes = []string{}
+			for _, mailbox := range policy.Mailboxes {
+				if onServer.Contains(mailbox) {
+					mailboxes = append(mailboxes, mailbox)
+				}
+			}
+		}
+		err = policy.selection(now).Stream(db, func(email models.Email) error {
+			deletion := models.RetentionDeletion{
+				Policy:    policy.Name,
+				Action:    string(policy.Action),
+				OurId:     email.GetOurID(),
+				MessageId: email.GetMessageId(),
+				Subject:   email.GetSubject(),
+				DateEpoch: email.GetDateEpoch(),
+			}
+			if policy.Action == ActionPurgeLocal {
+				if !purged.Contains(deletion.OurId) {
+					purged.Add(deletion.OurId)
+					deletions = append(deletions, deletion)
+				}
+				return nil
+			}
+			for _, mailbox := range mailboxes {
+				uid, ok := mailboxUids[mailbox][deletion.OurId]
+				if !ok || deletedRemotely.Contains(membership{mailbox, uid}) {
+					continue
+				}
+				deletedRemotely.Add(membership{mailbox, uid})
+				deletion.Mailbox = mailbox
+				deletion.Uid = uid
+				deletions = append(deletions, deletion)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, utils.JoinErrors(fmt.Sprintf("failed to select the emails of policy %q", policy.Name), err)
+		}
+	}
+	return deletions, nil
+}
+
+// ServerMailboxes returns the names of the mailboxes that exist on the server, sorted. imported pseudo mailboxes only
+// exist locally, so there is nothing to delete from the server
+func ServerMailboxes(db models.DB) ([]string, error) {
+	serverMailboxes := []string{}
+	records, err := db.GetAllMailboxRecords()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get mailboxes", err)
+	}
+	for _, record := range records {
+		if !utils.NewSet(record.Attributes).Contains(models.ImportedMailboxAttribute) {
+			serverMailboxes = append(serverMailboxes, record.Name)
+		}
+	}
+	sort.Strings(serverMailboxes)
+	return serverMailboxes, nil
+}
+
+// NeedsServer reports whether applying the deletions deletes anything from the server
+func NeedsServer(deletions []models.RetentionDeletion) bool {
+	for _, deletion := range deletions {
+		if deletion.Action == string(ActionDeleteRemote) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Apply carries out the deletions returned by Plan. Server deletions go first, mailbox by mailbox, and each batch is logged
+as soon as the server confirmed it, so an interrupted run never logs a deletion that didn't happen.
+pool is only used for delete_remote deletions and may be nil if there are none.
+logged is called with every batch of deletions once it's logged.
+*/
+func Apply(db models.DB, pool models.ClientPool, deletions []models.RetentionDeletion, logged func([]models.RetentionDeletion)) error {
+	remote := map[string][]models.RetentionDeletion{}
+	local := []models.RetentionDeletion{}
+	for _, deletion := range deletions {
+		if deletion.Action == string(ActionDeleteRemote) {
+			remote[deletion.Mailbox] = append(remote[deletion.Mailbox], deletion)
+		} else {
+			local = append(local, deletion)
+		}
+	}
+
+	if len(remote) > 0 {
+		if pool == nil {
+			return errors.New("deleting from the server needs an imap connection")
+		}
+		err := applyRemote(db, pool, remote, logged)
+		if err != nil {
+			return err
+		}
+		err = db.AggregateFolders()
+		if err != nil {
+			return utils.JoinErrors("failed to aggregate folders", err)
+		}
+	}
+
+	for start := 0; start < len(local); start += batchSize {
+		batch := local[start:min(start+batchSize, len(local))]
+		err := db.ApplyRetention(batch, false)
+		if err != nil {
+			return utils.JoinErrors("failed to purge emails", err)
+		}
+		logged(batch)
+	}
+	return nil
+}
+
+func applyRemote(db models.DB, pool models.ClientPool, remote map[string][]models.RetentionDeletion, logged func([]models.RetentionDeletion)) error {
+	mailboxes, err := pool.ListMailboxes()
+	if err != nil {
+		return utils.JoinErrors("failed to list mailboxes", err)
+	}
+	byName := map[string]models.Mailbox{}
+	for _, mailbox := range mailboxes {
+		byName[mailbox.Name()] = mailbox
+	}
+
+	client, err := pool.Get()
+	if err != nil {
+		return utils.JoinErrors("failed to get client", err)
+	}
+	defer pool.Put(client)
+
+	names := []string{}
+	for name := range remote {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mailbox, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("mailbox %q no longer exists on the server", name)
+		}
+		deletions := remote[name]
+		for start := 0; start < len(deletions); start += batchSize {
+			batch := deletions[start:min(start+batchSize, len(deletions))]
+			uids := []uint32{}
+			for _, deletion := range batch {
+				uids = append(uids, deletion.Uid)
+			}
+			err = client.DeleteFromMailbox(mailbox, uids)
+			if err != nil {
+				return utils.JoinErrors(fmt.Sprintf("failed to delete emails from %s", name), err)
+			}
+			err = db.ApplyRetention(batch, client.Options().GetKeepDeletedEmails())
+			if err != nil {
+				return utils.JoinErrors("failed to log deletions", err)
+			}
+			logged(batch)
+		}
+	}
+	return nil
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package source
+
+import (
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Eml reads a single .eml file or every .eml file below a directory
+type Eml struct {
+	path string
+}
+
+func NewEml(path string) *Eml {
+	return &Eml{path: path}
+}
+
+func (eml *Eml) Name() string {
+	return eml.path
+}
+
+func (eml *Eml) files() ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(eml.path, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() && strings.EqualFold(filepath.Ext(path), ".eml") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, utils.JoinErrors("failed to list eml files", err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (eml *Eml) Count() (int, error) {
+	files, err := eml.files()
+	return len(files), err
+}
+
+func (eml *Eml) Messages(ch chan *models.RawMessage) error {
+	defer close(ch)
+	files, err := eml.files()
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return utils.JoinErrors("failed to read eml file", err)
+		}
+		ch <- &models.RawMessage{
+			Raw:      raw,
+			Flags:    []string{},
+			Position: i + 1,
+		}
+	}
+	return nil
+}
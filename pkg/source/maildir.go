@@ -0,0 +1,106 @@
+package source
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maildir info flags to imap flags, the inverse of export.imapFlagToMaildirFlag
+var maildirFlagToImapFlag = map[rune]string{
+	'D': imap.DraftFlag,
+	'F': imap.FlaggedFlag,
+	'P': "$Forwarded",
+	'R': imap.AnsweredFlag,
+	'S': imap.SeenFlag,
+	'T': imap.DeletedFlag,
+}
+
+// Maildir reads the cur and new directories of a single maildir folder. Maildir++ sub folders are not descended into
+type Maildir struct {
+	path string
+}
+
+func NewMaildir(path string) *Maildir {
+	return &Maildir{path: path}
+}
+
+func isMaildir(path string) bool {
+	info, err := os.Stat(filepath.Join(path, "cur"))
+	return err == nil && info.IsDir()
+}
+
+func (maildir *Maildir) Name() string {
+	return maildir.path
+}
+
+func (maildir *Maildir) files() ([]string, error) {
+	files := []string{}
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(maildir.path, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, utils.JoinErrors("failed to list maildir", err)
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(maildir.path, sub, entry.Name()))
+			}
+		}
+	}
+	// maildir file names start with the delivery time, so this is roughly chronological
+	sort.Strings(files)
+	return files, nil
+}
+
+func (maildir *Maildir) Count() (int, error) {
+	files, err := maildir.files()
+	return len(files), err
+}
+
+func (maildir *Maildir) Messages(ch chan *models.RawMessage) error {
+	defer close(ch)
+	files, err := maildir.files()
+	if err != nil {
+		return err
+	}
+	for i, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return utils.JoinErrors("failed to read maildir message", err)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return utils.JoinErrors("failed to stat maildir message", err)
+		}
+		ch <- &models.RawMessage{
+			Raw:   raw,
+			Flags: maildirFlags(filepath.Base(file)),
+			// delivery agents and imap servers (e.g. dovecot's received date) use the mtime as the delivery time
+			InternalDate: info.ModTime(),
+			Position:     i + 1,
+		}
+	}
+	return nil
+}
+
+// flags are encoded in the info suffix of the file name, e.g. "1577930645.abc.host:2,FS"
+func maildirFlags(fileName string) []string {
+	flags := []string{}
+	_, info, found := strings.Cut(fileName, ":2,")
+	if !found {
+		return flags
+	}
+	for _, char := range info {
+		if flag, ok := maildirFlagToImapFlag[char]; ok {
+			flags = append(flags, flag)
+		}
+	}
+	return flags
+}
@@ -0,0 +1,166 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/emersion/go-imap"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// mboxrd quoting, see export.fromLine. Reading as mboxrd is also correct for the far more common mboxo files
+// except for the rare body line that legitimately started with ">From "
+var quotedFromLine = regexp.MustCompile(`^>+From `)
+
+type Mbox struct {
+	path string
+}
+
+func NewMbox(path string) *Mbox {
+	return &Mbox{path: path}
+}
+
+func (mbox *Mbox) Name() string {
+	return mbox.path
+}
+
+func (mbox *Mbox) Count() (int, error) {
+	count := 0
+	err := mbox.scan(func(fromLine []byte, lines [][]byte) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (mbox *Mbox) Messages(ch chan *models.RawMessage) error {
+	defer close(ch)
+	position := 0
+	return mbox.scan(func(fromLine []byte, lines [][]byte) error {
+		position++
+		raw := bytes.Join(lines, []byte("\n"))
+		ch <- &models.RawMessage{
+			Raw:          raw,
+			Flags:        mboxFlags(raw),
+			Position:     position,
+			InternalDate: fromLineDate(fromLine),
+		}
+		return nil
+	})
+}
+
+// the From_ line is "From <sender> <asctime date in UTC>", e.g. "From MAILER-DAEMON Mon Jan  2 15:04:05 2006"
+func fromLineDate(fromLine []byte) time.Time {
+	fields := strings.Fields(string(fromLine))
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+	// some writers append a time zone or other fields after the year
+	date, err := time.Parse(time.ANSIC, strings.Join(fields[2:7], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// calls handle with the From_ separator line and the unquoted lines of every message
+func (mbox *Mbox) scan(handle func([]byte, [][]byte) error) error {
+	file, err := os.Open(mbox.path)
+	if err != nil {
+		return utils.JoinErrors("failed to open mbox", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 1024*1024)
+	var fromLine []byte
+	var lines [][]byte
+	inMessage := false
+	previousBlank := true
+	flush := func() error {
+		if !inMessage {
+			return nil
+		}
+		// the blank line before the next From_ line belongs to the mbox format, not to the message
+		if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+			lines = lines[:len(lines)-1]
+		}
+		return handle(fromLine, lines)
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return utils.JoinErrors("failed to read mbox", err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if previousBlank && bytes.HasPrefix(line, []byte("From ")) {
+			flushErr := flush()
+			if flushErr != nil {
+				return flushErr
+			}
+			fromLine = line
+			lines = [][]byte{}
+			inMessage = true
+			previousBlank = false
+		} else {
+			if quotedFromLine.Match(line) {
+				line = line[1:]
+			}
+			lines = append(lines, line)
+			previousBlank = len(line) == 0
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return flush()
+}
+
+var xStatusFlags = []struct {
+	char string
+	flag string
+}{
+	{"A", imap.AnsweredFlag},
+	{"F", imap.FlaggedFlag},
+	{"D", imap.DeletedFlag},
+	{"T", imap.DraftFlag},
+}
+
+// mbox writers store flags in the Status and X-Status headers
+func mboxFlags(raw []byte) []string {
+	flags := []string{}
+	headerEnd := bytes.Index(raw, []byte("\n\n"))
+	if headerEnd == -1 {
+		headerEnd = len(raw)
+	}
+	for _, line := range strings.Split(string(raw[:headerEnd]), "\n") {
+		name, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(name) {
+		case "status":
+			if strings.Contains(value, "R") {
+				flags = append(flags, imap.SeenFlag)
+			}
+		case "x-status":
+			for _, xStatusFlag := range xStatusFlags {
+				if strings.Contains(value, xStatusFlag.char) {
+					flags = append(flags, xStatusFlag.flag)
+				}
+			}
+		}
+	}
+	return flags
+}
@@ -0,0 +1,303 @@
+package source
+
+import (
+	"fmt"
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type Format string
+
+const (
+	FormatAuto    Format = ""
+	FormatMbox    Format = "mbox"
+	FormatMaildir Format = "maildir"
+	FormatEml     Format = "eml"
+)
+
+// emails are written to the db in batches so that huge sources don't have to fit in memory
+const importBatchSize = 500
+
+// Open detects the format of path if format is FormatAuto and returns the matching source
+func Open(path string, format Format) (models.Source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, utils.JoinErrors(fmt.Sprintf("could not open %s", path), err)
+	}
+	if format == FormatAuto {
+		switch {
+		case !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".eml"):
+			format = FormatEml
+		case !info.IsDir():
+			format = FormatMbox
+		case isMaildir(path):
+			format = FormatMaildir
+		default:
+			format = FormatEml
+		}
+	}
+
+	switch format {
+	case FormatMbox:
+		return NewMbox(path), nil
+	case FormatMaildir:
+		return NewMaildir(path), nil
+	case FormatEml:
+		return NewEml(path), nil
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+/*
+Import parses every message of src with the same parser used for imap downloads and stores it under the pseudo mailbox
+mailboxName. Messages that are already in that mailbox (by our_id) are skipped, so importing the same source twice is
+harmless. Messages of src with the same envelope as an earlier one but a different body are kept, under the our_id
+email.CollidingOurId gives them. Messages that were already downloaded over imap are not duplicated, they just gain the pseudo mailbox.
+Progress is reported through eventHandler the same way imap downloads report it. Returns the number of imported messages.
+*/
+func Import(db models.DB, src models.Source, mailboxName string, options models.Options, eventHandler func(*models.MailboxEvent)) (int, error) {
+	err := db.SaveMailboxRecord(models.MailboxRecord{
+		Name:       mailboxName,
+		Attributes: []string{models.ImportedMailboxAttribute},
+	})
+	if err != nil {
+		return 0, utils.JoinErrors("failed to save mailbox record", err)
+	}
+	route := func(msg *models.RawMessage) ([]string, []string) {
+		return []string{mailboxName}, msg.Flags
+	}
+	return runImport(db, src, mailboxName, route, 0, options, eventHandler)
+}
+
+// decides which mailboxes and flags an imported message gets. No mailboxes means the message is skipped
+type router func(msg *models.RawMessage) (mailboxes []string, flags []string)
+
+type membership struct {
+	mailbox string
+	uid     uint32
+}
+
+/*
+uids are made up for imported messages since they don't come from an imap server. They continue after the highest uid
+at or above uidFloor that is already in the mailbox.
+*/
+type uidAllocator struct {
+	db         models.DB
+	uidFloor   uint32
+	ourIdToUid map[string]map[string]uint32
+	nextUid    map[string]uint32
+}
+
+func (allocator *uidAllocator) load(mailbox string) error {
+	if _, ok := allocator.ourIdToUid[mailbox]; ok {
+		return nil
+	}
+	ourIdToUid, err := allocator.db.GetMailboxUids(mailbox)
+	if err != nil {
+		return utils.JoinErrors(fmt.Sprintf("could not get existing uids of %s", mailbox), err)
+	}
+	nextUid := allocator.uidFloor + 1
+	for _, uid := range ourIdToUid {
+		if uid >= nextUid {
+			nextUid = uid + 1
+		}
+	}
+	allocator.ourIdToUid[mailbox] = ourIdToUid
+	allocator.nextUid[mailbox] = nextUid
+	return nil
+}
+
+// returns false if the email is already in the mailbox
+func (allocator *uidAllocator) allocate(mailbox string, ourId string) (uint32, bool, error) {
+	err := allocator.load(mailbox)
+	if err != nil {
+		return 0, false, err
+	}
+	if _, ok := allocator.ourIdToUid[mailbox][ourId]; ok {
+		return 0, false, nil
+	}
+	uid := allocator.nextUid[mailbox]
+	allocator.ourIdToUid[mailbox][ourId] = uid
+	allocator.nextUid[mailbox]++
+	return uid, true, nil
+}
+
+// shared by Import and ImportTakeout, eventMailbox is only used to label progress events
+func runImport(db models.DB, src models.Source, eventMailbox string, route router, uidFloor uint32, options models.Options, eventHandler func(*models.MailboxEvent)) (int, error) {
+	if eventHandler == nil {
+		eventHandler = func(event *models.MailboxEvent) {}
+	}
+	addEvent := func(event models.MailboxEvent) {
+		event.Mailbox = eventMailbox
+		eventHandler(&event)
+	}
+
+	total, err := src.Count()
+	if err != nil {
+		return 0, utils.JoinErrors(fmt.Sprintf("could not count messages in %s", src.Name()), err)
+	}
+	addEvent(models.MailboxEvent{
+		EventType:       models.MailboxDownloadStarted,
+		TotalToDownload: total,
+	})
+
+	allocator := &uidAllocator{
+		db:         db,
+		uidFloor:   uidFloor,
+		ourIdToUid: map[string]map[string]uint32{},
+		nextUid:    map[string]uint32{},
+	}
+	// emails are added to the db under the first mailbox they are new to, other memberships are added separately
+	batches := map[string][]models.Email{}
+	extraMemberships := map[string]map[string]uint32{}
+	// the body hashes of the messages parsed so far, to tell duplicates from different messages with the same envelope
+	parsedBodyHashes := map[string]string{}
+	batchSize := 0
+	imported := 0
+	flush := func() error {
+		for mailbox, emails := range batches {
+			_, err := db.AddEmails(mailbox, emails)
+			if err != nil {
+				return utils.JoinErrors("failed to add to db", err)
+			}
+		}
+		for mailbox, ourIdToUid := range extraMemberships {
+			err := db.AddMailboxMemberships(mailbox, ourIdToUid)
+			if err != nil {
+				return utils.JoinErrors("failed to add mailbox memberships", err)
+			}
+		}
+		imported += batchSize
+		batches = map[string][]models.Email{}
+		extraMemberships = map[string]map[string]uint32{}
+		batchSize = 0
+		return nil
+	}
+
+	doneChan := make(chan error, 1)
+	messages := make(chan *models.RawMessage)
+	go func() {
+		doneChan <- src.Messages(messages)
+	}()
+
+	var importErr error
+	processed := 0
+	for msg := range messages {
+		if importErr != nil {
+			// keep draining so the source can finish
+			continue
+		}
+		processed++
+		addEvent(models.MailboxEvent{
+			EventType:       models.MailboxDownloadProgress,
+			TotalDownloaded: processed,
+			TotalToDownload: total,
+		})
+
+		mailboxes, flags := route(msg)
+		ourId := email.OurIdFromRaw(msg.Raw)
+		allocate := func() []membership {
+			newMemberships := []membership{}
+			for _, mailbox := range mailboxes {
+				uid, isNew, err := allocator.allocate(mailbox, ourId)
+				if err != nil {
+					importErr = err
+					return nil
+				}
+				if isNew {
+					newMemberships = append(newMemberships, membership{mailbox, uid})
+				}
+			}
+			return newMemberships
+		}
+		newMemberships := allocate()
+		if importErr != nil {
+			continue
+		}
+		if bodyHash, ok := parsedBodyHashes[ourId]; ok && len(newMemberships) == 0 {
+			// a message of this run already has this our_id, it's only a duplicate if its body is the same too
+			otherBodyHash := email.NewFromRaw(msg.Raw, flags, 0, msg.InternalDate, options).GetBodyHash()
+			if otherBodyHash != "" && bodyHash != "" && otherBodyHash != bodyHash {
+				ourId = email.CollidingOurId(ourId, otherBodyHash)
+				newMemberships = allocate()
+				if importErr != nil {
+					continue
+				}
+				// the first one has to be stored before this one, which is then stored next to it
+				importErr = flush()
+				if importErr != nil {
+					continue
+				}
+			}
+		}
+		if len(newMemberships) == 0 {
+			utils.DebugPrintln(fmt.Sprintf("skipping message %d of %s, already imported", msg.Position, src.Name()))
+			continue
+		}
+
+		emailParsed := email.NewFromRaw(msg.Raw, flags, newMemberships[0].uid, msg.InternalDate, options)
+		if _, ok := parsedBodyHashes[ourId]; !ok {
+			parsedBodyHashes[ourId] = emailParsed.GetBodyHash()
+		}
+		if emailParsed.GetParseWarning() != "" || emailParsed.GetParseError() != "" {
+			warnings := []string{fmt.Sprintf("message %d of %s", msg.Position, src.Name())}
+			if emailParsed.GetParseWarning() != "" {
+				warnings = append(warnings, "parse warning: "+emailParsed.GetParseWarning())
+			}
+			if emailParsed.GetParseError() != "" {
+				warnings = append(warnings, "parse error: "+emailParsed.GetParseError())
+			}
+			addEvent(models.MailboxEvent{
+				EventType: models.MailboxSyncWarning,
+				Warning:   strings.Join(warnings, ", "),
+			})
+		}
+
+		batches[newMemberships[0].mailbox] = append(batches[newMemberships[0].mailbox], emailParsed)
+		for _, extra := range newMemberships[1:] {
+			if extraMemberships[extra.mailbox] == nil {
+				extraMemberships[extra.mailbox] = map[string]uint32{}
+			}
+			extraMemberships[extra.mailbox][ourId] = extra.uid
+		}
+		batchSize++
+		if batchSize >= importBatchSize {
+			importErr = flush()
+		}
+	}
+
+	err = <-doneChan
+	if importErr == nil && err != nil {
+		importErr = utils.JoinErrors(fmt.Sprintf("failed to read %s", src.Name()), err)
+	}
+	if importErr == nil {
+		importErr = flush()
+	}
+	if importErr == nil {
+		importErr = utils.JoinErrors("failed to aggregate folders", db.AggregateFolders())
+	}
+	if importErr == nil {
+		importErr = utils.JoinErrors("failed to update full text search", db.UpdateFTS())
+	}
+	if importErr == nil {
+		importErr = utils.JoinErrors("failed to update threads", db.UpdateThreads())
+	}
+	if importErr != nil {
+		addEvent(models.MailboxEvent{
+			EventType: models.MailboxDownloadError,
+			Error:     importErr.Error(),
+		})
+		return imported, importErr
+	}
+
+	addEvent(models.MailboxEvent{
+		EventType:       models.MailboxDownloadCompleted,
+		TotalDownloaded: processed,
+		TotalToDownload: total,
+	})
+	return imported, nil
+}
@@ -0,0 +1,108 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/charset"
+	"github.com/emersion/go-message/textproto"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"mime"
+	"strings"
+)
+
+/*
+ImportTakeout imports a Google Takeout mbox. Every message carries an X-Gmail-Labels header, which is mapped onto the
+mailboxes gmail exposes over imap (prefix is "[Gmail]" or "[Google Mail]" depending on the account's locale), so the
+mailboxes column ends up the same as after an imap sync. Messages already downloaded over imap are matched by our_id
+and only gain the memberships they were missing. Chats are skipped since gmail doesn't expose them over imap.
+*/
+func ImportTakeout(db models.DB, src models.Source, prefix string, options models.Options, eventHandler func(*models.MailboxEvent)) (int, error) {
+	route := func(msg *models.RawMessage) ([]string, []string) {
+		return takeoutMailboxes(gmailLabels(msg.Raw), prefix, msg.Flags)
+	}
+	return runImport(db, src, "Takeout "+src.Name(), route, models.TakeoutUidFloor, options, eventHandler)
+}
+
+func gmailLabels(raw []byte) []string {
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return []string{}
+	}
+	value := header.Get("X-Gmail-Labels")
+	if value == "" {
+		return []string{}
+	}
+	decoder := &mime.WordDecoder{CharsetReader: charset.Reader}
+	if decoded, err := decoder.DecodeHeader(value); err == nil {
+		value = decoded
+	}
+
+	// labels are comma separated, labels containing a comma are quoted
+	reader := csv.NewReader(strings.NewReader(value))
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	labels, err := reader.Read()
+	if err != nil {
+		return strings.Split(value, ",")
+	}
+	return labels
+}
+
+// maps takeout labels to imap mailboxes and flags
+func takeoutMailboxes(labels []string, prefix string, flags []string) ([]string, []string) {
+	systemLabels := map[string]string{
+		"Inbox":     "INBOX",
+		"Sent":      prefix + "/Sent Mail",
+		"Drafts":    prefix + "/Drafts",
+		"Spam":      prefix + "/Spam",
+		"Trash":     prefix + "/Trash",
+		"Starred":   prefix + "/Starred",
+		"Important": prefix + "/Important",
+	}
+
+	mailboxes := []string{}
+	inAllMail := true
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		switch {
+		case label == "":
+		case label == "Chat":
+			return []string{}, flags
+		case label == "Opened":
+			flags = appendUnique(flags, imap.SeenFlag)
+		case label == "Unread", label == "Archived":
+			// unread is the absence of \Seen, archived is the absence of Inbox
+		case strings.HasPrefix(label, "Category "):
+			// inbox categories aren't exposed over imap
+		case systemLabels[label] != "":
+			mailboxes = append(mailboxes, systemLabels[label])
+			if label == "Spam" || label == "Trash" {
+				inAllMail = false
+			}
+			if label == "Starred" {
+				flags = appendUnique(flags, imap.FlaggedFlag)
+			}
+			if label == "Drafts" {
+				flags = appendUnique(flags, imap.DraftFlag)
+			}
+		default:
+			// user labels are exposed as mailboxes with the same name
+			mailboxes = append(mailboxes, label)
+		}
+	}
+	if inAllMail {
+		mailboxes = append(mailboxes, prefix+"/All Mail")
+	}
+	return mailboxes, flags
+}
+
+func appendUnique(slice []string, value string) []string {
+	for _, existing := range slice {
+		if existing == value {
+			return slice
+		}
+	}
+	return append(slice, value)
+}
@@ -0,0 +1,345 @@
+package textextract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/k3a/html2text"
+	"github.com/ledongthuc/pdf"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the text kept per attachment, so that a single huge spreadsheet doesn't dominate the index
+const maxTextLength = 1 << 20
+
+// office documents are zip files, their entries are only read up to this size so a zip bomb can't exhaust memory
+const maxEntrySize = 64 << 20
+
+var ErrUnsupported = errors.New("unsupported attachment type")
+
+var contentTypeFormats = map[string]string{
+	"application/pdf": "pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       "xlsx",
+	"application/vnd.oasis.opendocument.text":                                 "opendocument",
+	"application/vnd.oasis.opendocument.spreadsheet":                          "opendocument",
+	"application/vnd.oasis.opendocument.presentation":                         "opendocument",
+	"text/plain":                "text",
+	"text/csv":                  "text",
+	"text/tab-separated-values": "text",
+	"text/markdown":             "text",
+	"text/html":                 "html",
+}
+
+// many senders label every attachment application/octet-stream, those are recognized by their extension instead
+var extensionFormats = map[string]string{
+	".pdf":  "pdf",
+	".docx": "docx",
+	".xlsx": "xlsx",
+	".odt":  "opendocument",
+	".ods":  "opendocument",
+	".odp":  "opendocument",
+	".txt":  "text",
+	".csv":  "text",
+	".tsv":  "text",
+	".md":   "text",
+	".log":  "text",
+	".htm":  "html",
+	".html": "html",
+}
+
+func format(fileName string, contentType string) string {
+	if format, ok := contentTypeFormats[strings.ToLower(contentType)]; ok {
+		return format
+	}
+	return extensionFormats[strings.ToLower(filepath.Ext(fileName))]
+}
+
+// Supported reports whether Extract knows how to read an attachment, without looking at its contents
+func Supported(fileName string, contentType string) bool {
+	return format(fileName, contentType) != ""
+}
+
+/*
+Extract returns the text of a PDF, DOCX, XLSX, OpenDocument, plain text, CSV or HTML attachment, recognized by its
+content type or file name. It returns ErrUnsupported for anything else, e.g. images.
+*/
+func Extract(fileName string, contentType string, content []byte) (text string, err error) {
+	defer func() {
+		// the pdf reader panics on some malformed files
+		if recovered := recover(); recovered != nil {
+			text = ""
+			err = fmt.Errorf("failed to extract text from %q: %v", fileName, recovered)
+		}
+	}()
+
+	switch format(fileName, contentType) {
+	case "pdf":
+		text, err = pdfText(content)
+	case "docx":
+		text, err = zipXmlText(content, "word/document.xml", docxRules)
+	case "xlsx":
+		text, err = xlsxText(content)
+	case "opendocument":
+		text, err = zipXmlText(content, "content.xml", openDocumentRules)
+	case "text":
+		text = string(content)
+	case "html":
+		text = html2text.HTML2Text(string(content))
+	default:
+		return "", ErrUnsupported
+	}
+	if err != nil {
+		return "", utils.JoinErrors(fmt.Sprintf("failed to extract text from %q", fileName), err)
+	}
+	return clean(text), nil
+}
+
+// drops what can't be stored or indexed and caps the length. Form feeds, e.g. the page breaks of pdfs, become spaces
+// since the full text index separates the texts of the attachments of an email with them
+func clean(text string) string {
+	if len(text) > maxTextLength {
+		text = text[:maxTextLength]
+	}
+	text = strings.ToValidUTF8(text, "")
+	text = strings.ReplaceAll(text, "\x00", "")
+	text = strings.ReplaceAll(text, "\f", " ")
+	return strings.TrimSpace(text)
+}
+
+func pdfText(content []byte) (string, error) {
+	reader, err := pdf.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", err
+	}
+	plain, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	text, err := io.ReadAll(io.LimitReader(plain, maxTextLength))
+	return string(text), err
+}
+
+// how the text of an xml document is read
+type xmlRules struct {
+	// only character data inside these elements is kept
+	text map[string]bool
+	// these elements end a line
+	lineEnds map[string]bool
+	// these empty elements stand for a character
+	chars map[string]string
+}
+
+var docxRules = xmlRules{
+	text:     map[string]bool{"t": true},
+	lineEnds: map[string]bool{"p": true},
+	chars:    map[string]string{"tab": "\t", "br": "\n", "cr": "\n"},
+}
+
+var openDocumentRules = xmlRules{
+	text:     map[string]bool{"p": true, "h": true},
+	lineEnds: map[string]bool{"p": true, "h": true},
+	chars:    map[string]string{"tab": "\t", "s": " ", "line-break": "\n"},
+}
+
+func zipEntry(archive *zip.Reader, name string) ([]byte, error) {
+	for _, file := range archive.File {
+		if file.Name != name {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(io.LimitReader(reader, maxEntrySize))
+	}
+	return nil, fmt.Errorf("%s is missing", name)
+}
+
+func zipXmlText(content []byte, entry string, rules xmlRules) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", err
+	}
+	document, err := zipEntry(archive, entry)
+	if err != nil {
+		return "", err
+	}
+
+	text := strings.Builder{}
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	// the number of open elements whose character data is kept
+	inText := 0
+	for text.Len() < maxTextLength {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if rules.text[token.Name.Local] {
+				inText++
+			}
+			text.WriteString(rules.chars[token.Name.Local])
+		case xml.EndElement:
+			if rules.text[token.Name.Local] {
+				inText--
+			}
+			if rules.lineEnds[token.Name.Local] {
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText > 0 {
+				text.Write(token)
+			}
+		}
+	}
+	return text.String(), nil
+}
+
+// one line per row with tab separated cells, sheet after sheet
+func xlsxText(content []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return "", err
+	}
+
+	// most cells only hold an index into the shared strings
+	sharedStrings := []string{}
+	shared, err := zipEntry(archive, "xl/sharedStrings.xml")
+	if err == nil {
+		sharedStrings, err = xlsxSharedStrings(shared)
+		if err != nil {
+			return "", utils.JoinErrors("failed to read shared strings", err)
+		}
+	}
+
+	sheets := []string{}
+	for _, file := range archive.File {
+		if strings.HasPrefix(file.Name, "xl/worksheets/sheet") && strings.HasSuffix(file.Name, ".xml") {
+			sheets = append(sheets, file.Name)
+		}
+	}
+	// sheet2.xml before sheet10.xml
+	sort.Slice(sheets, func(i, j int) bool {
+		if len(sheets[i]) != len(sheets[j]) {
+			return len(sheets[i]) < len(sheets[j])
+		}
+		return sheets[i] < sheets[j]
+	})
+
+	text := strings.Builder{}
+	for _, sheet := range sheets {
+		if text.Len() >= maxTextLength {
+			break
+		}
+		document, err := zipEntry(archive, sheet)
+		if err != nil {
+			return "", err
+		}
+		err = xlsxSheetText(document, sharedStrings, &text)
+		if err != nil {
+			return "", utils.JoinErrors(fmt.Sprintf("failed to read %s", sheet), err)
+		}
+	}
+	return text.String(), nil
+}
+
+func xlsxSharedStrings(document []byte) ([]string, error) {
+	strs := []string{}
+	current := strings.Builder{}
+	inText := false
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return strs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			if token.Name.Local == "si" {
+				current.Reset()
+			}
+			inText = token.Name.Local == "t"
+		case xml.EndElement:
+			if token.Name.Local == "si" {
+				strs = append(strs, current.String())
+			}
+			inText = false
+		case xml.CharData:
+			if inText {
+				current.Write(token)
+			}
+		}
+	}
+}
+
+func xlsxSheetText(document []byte, sharedStrings []string, text *strings.Builder) error {
+	cellType := ""
+	value := strings.Builder{}
+	inValue := false
+	decoder := xml.NewDecoder(bytes.NewReader(document))
+	for text.Len() < maxTextLength {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "c":
+				cellType = ""
+				for _, attr := range token.Attr {
+					if attr.Name.Local == "t" {
+						cellType = attr.Value
+					}
+				}
+				value.Reset()
+			case "v", "t":
+				inValue = true
+			}
+		case xml.EndElement:
+			switch token.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "c":
+				cell := value.String()
+				if cellType == "s" {
+					index, err := strconv.Atoi(strings.TrimSpace(cell))
+					if err != nil || index < 0 || index >= len(sharedStrings) {
+						continue
+					}
+					cell = sharedStrings[index]
+				}
+				if cell != "" {
+					text.WriteString(cell)
+					text.WriteString("\t")
+				}
+			case "row":
+				text.WriteString("\n")
+			}
+		case xml.CharData:
+			if inValue {
+				value.Write(token)
+			}
+		}
+	}
+	return nil
+}
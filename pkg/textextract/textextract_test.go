@@ -0,0 +1,157 @@
+package textextract
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// a zip file with the given entries, like the office formats are
+func zipped(t *testing.T, entries map[string]string) []byte {
+	t.Helper()
+	buffer := bytes.Buffer{}
+	archive := zip.NewWriter(&buffer)
+	for name, content := range entries {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = writer.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// a one page pdf showing text, with the byte offsets its cross reference table needs
+func onePagePdf(text string) []byte {
+	stream := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	document := bytes.Buffer{}
+	document.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, object := range objects {
+		offsets = append(offsets, document.Len())
+		fmt.Fprintf(&document, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := document.Len()
+	fmt.Fprintf(&document, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&document, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&document, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return document.Bytes()
+}
+
+const docxDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Invoice</w:t><w:tab/><w:t>42</w:t></w:r></w:p>
+<w:p><w:r><w:t xml:space="preserve">Due </w:t></w:r><w:r><w:t>in 30 days</w:t><w:br/><w:t>Thanks</w:t></w:r></w:p>
+</w:body></w:document>`
+
+const odtContent = `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:text>
+<text:h>Minutes</text:h>
+<text:p>Budget<text:s/>approved<text:line-break/>Next meeting in <text:span>May</text:span></text:p>
+</office:text></office:body></office:document-content>`
+
+const xlsxSharedStringsDocument = `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><si><t>Customer</t></si><si><t>Amount</t></si><si><r><t>Acme </t></r><r><t>Corp</t></r></si></sst>`
+
+func xlsxSheet(rows string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` + rows + `</sheetData></worksheet>`
+}
+
+func TestExtract(t *testing.T) {
+	xlsx := zipped(t, map[string]string{
+		"xl/sharedStrings.xml": xlsxSharedStringsDocument,
+		"xl/worksheets/sheet1.xml": xlsxSheet(`<row><c t="s"><v>0</v></c><c t="s"><v>1</v></c></row>` +
+			`<row><c t="s"><v>2</v></c><c><v>1250.5</v></c></row>`),
+		// after sheet2, not between sheet1 and sheet2
+		"xl/worksheets/sheet10.xml": xlsxSheet(`<row><c t="inlineStr"><is><t>tenth</t></is></c></row>`),
+		"xl/worksheets/sheet2.xml":  xlsxSheet(`<row><c t="s"><v>99</v></c><c t="b"><v>1</v></c></row>`),
+	})
+	tests := []struct {
+		fileName    string
+		contentType string
+		content     []byte
+		expected    string
+	}{
+		{"notes.txt", "text/plain", []byte("  page one\fpage two\x00 \xff\n"), "page one page two"},
+		{"export.csv", "application/octet-stream", []byte("name,amount\nacme,42\n"), "name,amount\nacme,42"},
+		{"README", "text/markdown", []byte("# Title"), "# Title"},
+		{"mail.html", "text/html", []byte("<html><body><p>Hello <b>there</b></p></body></html>"), "Hello there"},
+		{"letter.docx", "application/octet-stream", zipped(t, map[string]string{"word/document.xml": docxDocument}), "Invoice\t42\nDue in 30 days\nThanks"},
+		{"minutes.odt", "application/vnd.oasis.opendocument.text", zipped(t, map[string]string{"content.xml": odtContent}), "Minutes\nBudget approved\nNext meeting in May"},
+		{"report.xlsx", "application/octet-stream", xlsx, "Customer\tAmount\t\nAcme Corp\t1250.5\t\n1\t\ntenth"},
+		{"scan.pdf", "application/pdf", onePagePdf("quarterly report"), "quarterly report"},
+	}
+	for _, test := range tests {
+		if !Supported(test.fileName, test.contentType) {
+			t.Errorf("%s: not supported", test.fileName)
+		}
+		text, err := Extract(test.fileName, test.contentType, test.content)
+		if err != nil {
+			t.Errorf("%s: %v", test.fileName, err)
+			continue
+		}
+		if text != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.fileName, text, test.expected)
+		}
+	}
+}
+
+func TestExtractErrors(t *testing.T) {
+	tests := []struct {
+		fileName    string
+		contentType string
+		content     []byte
+		unsupported bool
+	}{
+		{"photo.jpg", "image/jpeg", []byte{0xff, 0xd8}, true},
+		{"archive.zip", "application/zip", zipped(t, map[string]string{"a.txt": "a"}), true},
+		{"letter.docx", "application/octet-stream", []byte("not a zip"), false},
+		{"letter.docx", "application/octet-stream", zipped(t, map[string]string{"word/other.xml": "<a/>"}), false},
+		{"letter.docx", "application/octet-stream", zipped(t, map[string]string{"word/document.xml": "<w:t>unclosed"}), false},
+		{"broken.pdf", "application/pdf", []byte("%PDF-1.4\nnot really"), false},
+		{"truncated.pdf", "application/pdf", onePagePdf("report")[:200], false},
+	}
+	for _, test := range tests {
+		if Supported(test.fileName, test.contentType) == test.unsupported {
+			t.Errorf("%s: got supported %v", test.fileName, !test.unsupported)
+		}
+		text, err := Extract(test.fileName, test.contentType, test.content)
+		if err == nil {
+			t.Errorf("%s: got %q, expected an error", test.fileName, text)
+			continue
+		}
+		if errors.Is(err, ErrUnsupported) != test.unsupported {
+			t.Errorf("%s: got %v, expected unsupported: %v", test.fileName, err, test.unsupported)
+		}
+	}
+}
+
+func TestExtractLength(t *testing.T) {
+	text, err := Extract("big.txt", "text/plain", bytes.Repeat([]byte("a"), maxTextLength+100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(text) != maxTextLength {
+		t.Errorf("got %d bytes, expected %d", len(text), maxTextLength)
+	}
+}
@@ -0,0 +1,341 @@
+package verify
+
+import (
+	"fmt"
+	"github.com/emersion/go-imap"
+	"github.com/skamensky/email-archiver/pkg/client"
+	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/mailbox"
+	"github.com/skamensky/email-archiver/pkg/models"
+	"github.com/skamensky/email-archiver/pkg/utils"
+	"sort"
+	"time"
+)
+
+type Kind string
+
+const (
+	// a mailbox that was synced before but no longer exists on the server
+	KindMailboxNotOnServer Kind = "mailbox_not_on_server"
+	// the server's message count differs from the number of uids it lists
+	KindCountMismatch Kind = "count_mismatch"
+	// a uid on the server that the archive doesn't know about
+	KindMissingLocally Kind = "missing_locally"
+	// a uid the archive knows about that is gone from the server
+	KindNotOnServer Kind = "not_on_server"
+	// a uid that was never downloaded, e.g. because the server didn't return it
+	KindPendingSync Kind = "pending_sync"
+	// a uid that was downloaded, but whose email isn't archived and wasn't purged either
+	KindMissingEmail Kind = "missing_email"
+	KindParseError   Kind = "parse_error"
+	// an email without text, html or attachments
+	KindMissingBody Kind = "missing_body"
+)
+
+type Discrepancy struct {
+	Kind    Kind   `json:"kind"`
+	Mailbox string `json:"mailbox,omitempty"`
+	Uid     uint32 `json:"uid,omitempty"`
+	OurId   string `json:"our_id,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+	// whether it was gone when the archive was verified again after fixing it
+	Fixed bool `json:"fixed"`
+}
+
+// uniquely identifies a discrepancy between two runs
+func (discrepancy Discrepancy) key() string {
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%s", discrepancy.Kind, discrepancy.Mailbox, discrepancy.Uid, discrepancy.OurId)
+}
+
+// a fetch problem can be fixed by downloading the mailbox again
+func (discrepancy Discrepancy) fetchProblem() bool {
+	switch discrepancy.Kind {
+	case KindMissingLocally, KindNotOnServer, KindPendingSync, KindMissingEmail:
+		return true
+	}
+	return false
+}
+
+type MailboxSummary struct {
+	Mailbox string `json:"mailbox"`
+	// the number of messages the server reported when the mailbox was selected
+	ServerMessages uint32 `json:"server_messages"`
+	ServerUids     int    `json:"server_uids"`
+	LocalUids      int    `json:"local_uids"`
+	// the local uids whose email is archived, or was purged on purpose
+	Archived int `json:"archived"`
+}
+
+type Report struct {
+	// unix seconds
+	VerifiedAt    int64            `json:"verified_at"`
+	Mailboxes     []MailboxSummary `json:"mailboxes"`
+	Discrepancies []Discrepancy    `json:"discrepancies"`
+}
+
+/*
+Run compares every mailbox that is synced with the server: the uids the server lists with the rows of
+message_to_mailbox, and the number of messages the server reports with the number of uids it lists. It also reports the
+archived emails that have a parse error or no body. Nothing is changed, see Fix.
+*/
+func Run(db models.DB, pool models.ClientPool, options models.Options) (*Report, error) {
+	report := &Report{VerifiedAt: time.Now().Unix(), Mailboxes: []MailboxSummary{}, Discrepancies: []Discrepancy{}}
+
+	mailboxes, err := pool.ListMailboxes()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to list mailboxes", err)
+	}
+	toSync := client.MailboxesToSync(options, mailboxes)
+	onServer := utils.NewSet([]string{})
+	for _, mbox := range mailboxes {
+		onServer.Add(mbox.Name())
+	}
+	records, err := db.GetAllMailboxRecords()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get mailboxes", err)
+	}
+	for _, record := range records {
+		if onServer.Contains(record.Name) || utils.NewSet(record.Attributes).Contains(models.ImportedMailboxAttribute) {
+			continue
+		}
+		report.Discrepancies = append(report.Discrepancies, Discrepancy{Kind: KindMailboxNotOnServer, Mailbox: record.Name})
+	}
+
+	sort.Slice(mailboxes, func(i, j int) bool {
+		return mailboxes[i].Name() < mailboxes[j].Name()
+	})
+	// where each email can be fetched from again
+	fetchableFrom := map[string]Discrepancy{}
+	for _, mbox := range mailboxes {
+		if !toSync.Contains(mbox.Name()) {
+			continue
+		}
+		summary, discrepancies, err := verifyMailbox(db, pool, mbox)
+		if err != nil {
+			return nil, utils.JoinErrors(fmt.Sprintf("failed to verify %s", mbox.Name()), err)
+		}
+		report.Mailboxes = append(report.Mailboxes, summary.summary)
+		report.Discrepancies = append(report.Discrepancies, discrepancies...)
+		for ourId, uid := range summary.fetchable {
+			if _, ok := fetchableFrom[ourId]; !ok {
+				fetchableFrom[ourId] = Discrepancy{Mailbox: mbox.Name(), Uid: uid}
+			}
+		}
+	}
+
+	// the body hashes tell which emails have no body
+	_, err = db.UpdateBodyHashes()
+	if err != nil {
+		return nil, utils.JoinErrors("failed to hash bodies", err)
+	}
+	broken, err := db.GetEmails("SELECT our_id, subject, parse_error, body_hash FROM email WHERE coalesce(parse_error, '') != '' OR body_hash = '' ORDER BY our_id")
+	if err != nil {
+		return nil, utils.JoinErrors("failed to get emails with parse errors", err)
+	}
+	for _, mail := range broken {
+		discrepancy := Discrepancy{Kind: KindParseError, OurId: mail.GetOurID(), Subject: mail.GetSubject(), Detail: mail.GetParseError()}
+		if mail.GetParseError() == "" {
+			discrepancy.Kind = KindMissingBody
+		}
+		if from, ok := fetchableFrom[mail.GetOurID()]; ok {
+			discrepancy.Mailbox = from.Mailbox
+			discrepancy.Uid = from.Uid
+		}
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+	}
+	return report, nil
+}
+
+type mailboxState struct {
+	summary MailboxSummary
+	// maps the our_id of every archived email in the mailbox to its uid
+	fetchable map[string]uint32
+}
+
+func verifyMailbox(db models.DB, pool models.ClientPool, mbox models.Mailbox) (*mailboxState, []Discrepancy, error) {
+	imapClient, err := pool.Get()
+	if err != nil {
+		return nil, nil, utils.JoinErrors("failed to get client", err)
+	}
+	defer pool.Put(imapClient)
+	status, err := imapClient.RawSelect(mbox.Name(), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverUids, err := imapClient.ListAllUids(mbox)
+	if err != nil {
+		return nil, nil, err
+	}
+	memberships, err := db.GetMailboxMemberships(mbox.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := &mailboxState{
+		summary: MailboxSummary{
+			Mailbox:        mbox.Name(),
+			ServerMessages: status.Messages,
+			ServerUids:     len(serverUids),
+			LocalUids:      len(memberships),
+		},
+		fetchable: map[string]uint32{},
+	}
+	discrepancies := []Discrepancy{}
+	if int(status.Messages) != len(serverUids) {
+		discrepancies = append(discrepancies, Discrepancy{
+			Kind:    KindCountMismatch,
+			Mailbox: mbox.Name(),
+			Detail:  fmt.Sprintf("the server reports %d messages but lists %d uids", status.Messages, len(serverUids)),
+		})
+	}
+
+	onServer := utils.NewSet(serverUids)
+	local := utils.NewSet([]uint32{})
+	for _, membership := range memberships {
+		local.Add(membership.Uid)
+		discrepancy := Discrepancy{Mailbox: mbox.Name(), Uid: membership.Uid, OurId: membership.OurId}
+		switch {
+		case !onServer.Contains(membership.Uid):
+			discrepancy.Kind = KindNotOnServer
+		case membership.PendingSync:
+			discrepancy.Kind = KindPendingSync
+		case membership.Archived:
+			state.summary.Archived++
+			state.fetchable[membership.OurId] = membership.Uid
+			continue
+		case membership.Purged:
+			state.summary.Archived++
+			continue
+		default:
+			discrepancy.Kind = KindMissingEmail
+		}
+		discrepancies = append(discrepancies, discrepancy)
+	}
+	for _, uid := range serverUids {
+		if !local.Contains(uid) {
+			discrepancies = append(discrepancies, Discrepancy{Kind: KindMissingLocally, Mailbox: mbox.Name(), Uid: uid})
+		}
+	}
+	return state, discrepancies, nil
+}
+
+/*
+Fix re-fetches what the report found missing: the mailboxes with missing, stale or pending uids are synced and
+downloaded again, and the emails with a parse error or no body that are still on the server are downloaded again and
+replace the archived copy if the new one parses. Verify the archive again afterwards to see what is left, see MarkFixed.
+*/
+func Fix(db models.DB, pool models.ClientPool, report *Report) error {
+	toDownload := utils.NewSet([]string{})
+	missingEmails := map[string][]uint32{}
+	// maps the uid of every email that is downloaded again to its our_id, per mailbox
+	toRefetch := map[string]map[uint32]string{}
+	for _, discrepancy := range report.Discrepancies {
+		switch {
+		case discrepancy.fetchProblem():
+			toDownload.Add(discrepancy.Mailbox)
+			if discrepancy.Kind == KindMissingEmail {
+				missingEmails[discrepancy.Mailbox] = append(missingEmails[discrepancy.Mailbox], discrepancy.Uid)
+			}
+		case (discrepancy.Kind == KindParseError || discrepancy.Kind == KindMissingBody) && discrepancy.Mailbox != "":
+			if toRefetch[discrepancy.Mailbox] == nil {
+				toRefetch[discrepancy.Mailbox] = map[uint32]string{}
+			}
+			toRefetch[discrepancy.Mailbox][discrepancy.Uid] = discrepancy.OurId
+		}
+	}
+
+	for mailboxName, uids := range missingEmails {
+		err := db.MarkPendingSync(mailboxName, uids)
+		if err != nil {
+			return err
+		}
+	}
+	if len(toDownload) > 0 {
+		mailboxes, err := pool.ListMailboxes()
+		if err != nil {
+			return utils.JoinErrors("failed to list mailboxes", err)
+		}
+		download := []models.Mailbox{}
+		for _, mbox := range mailboxes {
+			if toDownload.Contains(mbox.Name()) {
+				download = append(download, mbox)
+			}
+		}
+		err = pool.DownloadMailboxes(download)
+		if err != nil {
+			return err
+		}
+	}
+
+	mailboxNames := []string{}
+	for mailboxName := range toRefetch {
+		mailboxNames = append(mailboxNames, mailboxName)
+	}
+	sort.Strings(mailboxNames)
+	for _, mailboxName := range mailboxNames {
+		err := refetch(db, pool, mailboxName, toRefetch[mailboxName])
+		if err != nil {
+			return utils.JoinErrors(fmt.Sprintf("failed to download emails from %s again", mailboxName), err)
+		}
+	}
+	return nil
+}
+
+// downloads the emails again, replacing the archived copies that now parse and have a body
+func refetch(db models.DB, pool models.ClientPool, mailboxName string, uidToOurId map[uint32]string) error {
+	imapClient, err := pool.Get()
+	if err != nil {
+		return utils.JoinErrors("failed to get client", err)
+	}
+	defer pool.Put(imapClient)
+	err = imapClient.Select(mailboxName, true)
+	if err != nil {
+		return err
+	}
+
+	uids := []uint32{}
+	for uid := range uidToOurId {
+		uids = append(uids, uid)
+	}
+	messages := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- imapClient.UidFetch(uids, mailbox.FetchItems(imapClient), messages)
+	}()
+	fetched := []models.Email{}
+	for msg := range messages {
+		fetched = append(fetched, email.New(msg, imapClient))
+	}
+	err = <-done
+	if err != nil {
+		return err
+	}
+	for _, mail := range fetched {
+		// the uid was reused for another message since the mailbox was verified
+		if mail.GetOurID() != uidToOurId[mail.GetUID()] {
+			utils.DebugPrintln("uid", mail.GetUID(), "of", mailboxName, "is no longer", uidToOurId[mail.GetUID()])
+			continue
+		}
+		if mail.GetParseError() != "" || mail.GetBodyHash() == "" {
+			utils.DebugPrintln("email", mail.GetOurID(), "is still broken after downloading it again")
+			continue
+		}
+		err = db.ReplaceEmail(mail)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkFixed marks the discrepancies of before that are gone in after as fixed
+func MarkFixed(before *Report, after *Report) {
+	remaining := utils.NewSet([]string{})
+	for _, discrepancy := range after.Discrepancies {
+		remaining.Add(discrepancy.key())
+	}
+	for i := range before.Discrepancies {
+		before.Discrepancies[i].Fixed = !remaining.Contains(before.Discrepancies[i].key())
+	}
+}
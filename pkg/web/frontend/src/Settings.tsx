@@ -1,16 +1,18 @@
-import {getOptions} from "./api";
-import {Options} from "./goGeneratedModels";
+import {getOptionValues, OptionValue, setOptions} from "./api";
 import {useEffect, useState} from "react";
 import {toast} from "react-toastify";
 import {asError} from "./utils";
 
 export const Settings = () => {
 
-    const [options, setOptions] = useState<Options | null>(null);
+    const [values, setValues] = useState<OptionValue[] | null>(null);
+    // the values being edited by key, they aren't overwritten by the periodic update
+    const [edits, setEdits] = useState<Record<string, string>>({});
+    const [saving, setSaving] = useState<boolean>(false);
     const [lastUpdateNSecondsAgo, setLastUpdateNSecondsAgo] = useState<number | null>(null);
     useEffect(() => {
-        getOptions().then((options) => {
-            setOptions(options);
+        getOptionValues().then((values) => {
+            setValues(values);
             setLastUpdateNSecondsAgo(0);
         }).catch((err) => {
             toast.error(asError(err).message);
@@ -18,8 +20,8 @@ export const Settings = () => {
 
         // 30 seconds
         const updateInterval = setInterval(() => {
-            getOptions().then((options) => {
-                setOptions(options);
+            getOptionValues().then((values) => {
+                setValues(values);
                 setLastUpdateNSecondsAgo(0);
             }).catch((err) => {
                 console.error(err);
@@ -43,17 +45,25 @@ export const Settings = () => {
 
     }, []);
 
-    const labelToValue = {
-        "Email":options?.email,
-        "Password":options?.password,
-        "IMAP Server":options?.imap_server,
-        "Strict Mail Parsing":options?.strict_mail_parsing,
-        "IMAP Client Debug":options?.imap_client_debug,
-        "Debug":options?.debug,
-        "Limit to Mailboxes":options?.limit_to_mailboxes,
-        "Skip Mailboxes":options?.skip_mailboxes,
-        "DB Path":options?.db_path,
-        "Max Pool Size":options?.max_pool_size
+    const save = () => {
+        const changes: Record<string, string> = {};
+        for (const option of values || []) {
+            // an emptied secret keeps the stored one rather than removing it
+            if (option.key in edits && !(option.secret && edits[option.key] === "")) {
+                changes[option.key] = edits[option.key];
+            }
+        }
+        setSaving(true);
+        setOptions(changes).then((values) => {
+            setValues(values);
+            setEdits({});
+            setLastUpdateNSecondsAgo(0);
+            toast.success("Settings saved");
+        }).catch((err) => {
+            toast.error(asError(err).message);
+        }).finally(() => {
+            setSaving(false);
+        })
     }
 
     let updatedNSecondsAgoString = "Never"
@@ -62,25 +72,35 @@ export const Settings = () => {
     }
 
 
-    const keyValues = Object.entries(labelToValue).map(([key, value]) =>
+    const keyValues = (values || []).map((option) =>
         {
 
-            const noVal = value === null || value === undefined
+            const noVal = option.source === "default"
 
             const valueColor = noVal ? "text-gray-600 font-light" : "text-gray-800 font-medium"
-            let valueText = noVal ? "Not Set" : value
-            if(key==="Password"){
+            let valueText = noVal ? "Not Set" : option.value
+            if(option.secret && !noVal){
                 valueText = "********"
             }
-            // if type is array, join with comma
-            if(Array.isArray(value) && !noVal){
-                valueText = value.join(", ")
+
+            let value = <span className={valueColor}>{valueText}</span>
+            if(option.editable){
+                // secrets start out empty since their value is never sent, leaving them empty keeps the stored one
+                value = <input
+                    className="border border-gray-300 rounded px-2 py-1"
+                    type={option.secret ? "password" : "text"}
+                    placeholder={option.secret && !noVal ? "********" : option.usage}
+                    value={edits[option.key] ?? (option.secret ? "" : option.value)}
+                    onChange={(e) => setEdits({...edits, [option.key]: e.target.value})}
+                />
             }
 
         return (
-            <div key={key} className="flex items-center space-x-2 border-b border-gray-200 py-2">
-            <span className="text-gray-600">{key}</span>
-            <span className={valueColor}>{valueText}</span>
+            <div key={option.key} className="flex items-center space-x-2 border-b border-gray-200 py-2" title={option.usage}>
+            <span className="text-gray-600">{option.key}</span>
+            {value}
+            <span className="text-gray-400 text-sm">{option.source}</span>
+            {option.restart && <span className="text-gray-400 text-sm">applies after a restart</span>}
         </div>)}
     )
 
@@ -93,6 +113,18 @@ export const Settings = () => {
             <div className="bg-white shadow-md rounded-lg p-4">
                 {keyValues}
     </div>
+        <p className="mt-2 text-gray-500 text-sm max-w-xl">
+            PASSWORD is only stored in encrypted archives (ENCRYPTION_PASSPHRASE or ENCRYPTION_KEY_FILE), otherwise it
+            would be readable in the database, its backups and migrated copies, so set it in the environment instead.
+            EMAIL and IMAP_SERVER can't be changed once the archive has emails, archive another account in a new database.
+        </p>
+        <button
+            className="mt-4 bg-blue-500 hover:bg-blue-700 text-white font-bold py-1 px-2 rounded disabled:opacity-50"
+            disabled={saving || Object.keys(edits).length === 0}
+            onClick={save}
+        >
+            Save
+        </button>
     </div>
 );
-}
\ No newline at end of file
+}
@@ -17,6 +17,47 @@ export const getOptions = async (): Promise<Options> => {
     return new Options(json);
 }
 
+// an option with where its value comes from, the values of secrets are never sent
+export interface OptionValue {
+    key: string;
+    value: string;
+    source: string;
+    editable: boolean;
+    storable: boolean;
+    secret: boolean;
+    // a change only takes effect after a restart
+    restart: boolean;
+    usage: string;
+}
+
+export const getOptionValues = async (): Promise<OptionValue[]> => {
+    const response = await fetch(`${server}/api/options`, {
+
+    })
+    const json = await response.json();
+
+    if (json.error) {
+        console.error(json.error)
+        throw new Error(json.error);
+    }
+    return json.values;
+}
+
+// stores the changed options by key, an empty value removes a stored option. the server logs in with a changed login before storing it
+export const setOptions = async (changes: Record<string, string>): Promise<OptionValue[]> => {
+    const response = await fetch(`${server}/api/set_options`, {
+        method:'POST',
+        body:JSON.stringify({changes})
+    })
+
+    const json = await response.json();
+    if (json.error) {
+        console.error(json.error)
+        throw new Error(json.error);
+    }
+    return json.values;
+}
+
 export const getEmails = async (sqlQuery:string):Promise<Email[]> => {
     const response = await fetch(`${server}/api/emails`, {
         method:'POST',
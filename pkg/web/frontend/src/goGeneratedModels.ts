@@ -12,7 +12,6 @@ export enum MailboxEventType {
 }
 export class Options {
     email?: string;
-    password?: string;
     imap_server?: string;
     strict_mail_parsing?: boolean;
     imap_client_debug?: boolean;
@@ -25,7 +24,6 @@ export class Options {
     constructor(source: any = {}) {
         if ('string' === typeof source) source = JSON.parse(source);
         this.email = source["email"];
-        this.password = source["password"];
         this.imap_server = source["imap_server"];
         this.strict_mail_parsing = source["strict_mail_parsing"];
         this.imap_client_debug = source["imap_client_debug"];
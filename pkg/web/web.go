@@ -3,18 +3,25 @@ package web
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/skamensky/email-archiver/pkg/backup"
+	"github.com/skamensky/email-archiver/pkg/client"
 	"github.com/skamensky/email-archiver/pkg/database"
 	"github.com/skamensky/email-archiver/pkg/email"
+	"github.com/skamensky/email-archiver/pkg/export"
 	"github.com/skamensky/email-archiver/pkg/models"
 	"github.com/skamensky/email-archiver/pkg/options"
+	"github.com/skamensky/email-archiver/pkg/query"
 	"github.com/skamensky/email-archiver/pkg/utils"
 	"io/fs"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
+	"time"
 )
 
 //go:embed frontend/build
@@ -30,6 +37,10 @@ var lastId int64 = 0
 
 var pool models.ClientPool
 
+// the options the pool uses, replaced when they're changed through the api
+var currentOptions *options.Options
+var optionsMutex = &sync.Mutex{}
+
 type successResponse struct {
 	Success bool `json:"success"`
 }
@@ -143,13 +154,67 @@ func websocketHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// the options with every value and where it comes from, secrets are left out
+func writeOptions(w http.ResponseWriter, ops *options.Options) (int, error) {
+	type getResponse struct {
+		*options.Options
+		Values []options.Value `json:"values"`
+	}
+	_, err := w.Write([]byte(utils.MustJSON(getResponse{ops, ops.Values()})))
+	return http.StatusOK, err
+}
+
 func getOptions(w http.ResponseWriter, r *http.Request) (int, error) {
-	ops, err := options.New()
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	return writeOptions(w, currentOptions)
+}
+
+/*
+changes the options stored in the db and applies them to the running pool. The changes are validated first, changed
+imap credentials by logging in with them, so a typo can't lock the pool out of the server. Another account can't be set
+once the archive has emails, see options.CheckAccount.
+*/
+func setOptions(w http.ResponseWriter, r *http.Request) (int, error) {
+	type postBody struct {
+		// by environment variable name, an empty value removes a stored option
+		Changes map[string]string `json:"changes"`
+	}
+
+	var body postBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+
+	optionsMutex.Lock()
+	defer optionsMutex.Unlock()
+	updated, err := currentOptions.Update(body.Changes)
 	if err != nil {
-		return http.StatusInternalServerError, err
+		return http.StatusBadRequest, err
 	}
-	_, err = w.Write([]byte(utils.MustJSON(ops)))
-	return http.StatusOK, err
+	err = updated.ValidateImap()
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	err = currentOptions.CheckAccount(updated, database.GetDatabase())
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if updated.GetImapServer() != currentOptions.GetImapServer() || updated.GetEmail() != currentOptions.GetEmail() || updated.GetPassword() != currentOptions.GetPassword() {
+		err = client.CheckLogin(updated)
+		if err != nil {
+			return http.StatusBadRequest, utils.JoinErrors("failed to log in with the new options", err)
+		}
+	}
+
+	err = database.GetDatabase().SetOptions(body.Changes)
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error storing options", err)
+	}
+	pool.SetOptions(updated)
+	currentOptions = updated
+	return writeOptions(w, currentOptions)
 }
 
 /*
@@ -163,11 +228,29 @@ type SQLWhereCondition struct {
 }
 */
 
+// parses the after and before of a request body, see export.ParseDate
+func parseDateRange(after string, before string) (time.Time, time.Time, error) {
+	afterTime, err := export.ParseDate(after)
+	if err != nil {
+		return time.Time{}, time.Time{}, utils.JoinErrors("invalid after", err)
+	}
+	beforeTime, err := export.ParseDate(before)
+	if err != nil {
+		return time.Time{}, time.Time{}, utils.JoinErrors("invalid before", err)
+	}
+	return afterTime, beforeTime, nil
+}
+
 func getEmails(w http.ResponseWriter, r *http.Request) (int, error) {
 	// parse array of conditions from body:
 	// read json frombody:
 	type postBody struct {
-		SqlQuery string `json:"sqlQuery"`
+		SqlQuery   string                `json:"sqlQuery"`
+		Query      string                `json:"query"`
+		SavedQuery string                `json:"savedQuery"`
+		Headers    []export.HeaderFilter `json:"headers"`
+		After      string                `json:"after"`
+		Before     string                `json:"before"`
 	}
 
 	type postResponse struct {
@@ -184,18 +267,25 @@ func getEmails(w http.ResponseWriter, r *http.Request) (int, error) {
 		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
 	}
 
-	if body.SqlQuery == "" {
-		return http.StatusBadRequest, utils.JoinErrors("sqlQuery is required", nil)
+	if body.SqlQuery == "" && body.Query == "" && body.SavedQuery == "" && len(body.Headers) == 0 && body.After == "" && body.Before == "" {
+		return http.StatusBadRequest, utils.JoinErrors("sqlQuery, query, savedQuery, headers, after or before is required", nil)
 	}
-	emailsMod, err := database.GetDatabase().GetEmails(body.SqlQuery)
+	selection := export.Selection{SqlQuery: body.SqlQuery, Query: body.Query, SavedQuery: body.SavedQuery, Headers: body.Headers}
+	selection.After, selection.Before, err = parseDateRange(body.After, body.Before)
 	if err != nil {
-		return http.StatusInternalServerError, utils.JoinErrors("error getting emails", err)
+		return http.StatusBadRequest, err
 	}
-
 	emails := []*email.Email{}
-	for _, e := range emailsMod {
+	err = selection.Stream(database.GetDatabase(), func(e models.Email) error {
 		emails = append(emails, e.(*email.Email))
-
+		return nil
+	})
+	syntaxError := &query.SyntaxError{}
+	if errors.As(err, &syntaxError) {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error getting emails", err)
 	}
 
 	response := postResponse{emails}
@@ -231,7 +321,22 @@ func searchEmails(w http.ResponseWriter, r *http.Request) (int, error) {
 		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
 	}
 
-	emailsMod, err := database.GetDatabase().FullTextSearch(body.SearchQuery)
+	// the same query language as the search command, words and phrases are still looked up in the full text index
+	db := database.GetDatabase()
+	condition, params, err := query.Compile(body.SearchQuery, db.Backend(), time.Now())
+	syntaxError := &query.SyntaxError{}
+	if errors.As(err, &syntaxError) {
+		return http.StatusBadRequest, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error compiling query", err)
+	}
+	// the words and phrases are highlighted in the results, and the attachments they were found in are listed
+	highlight, err := query.Highlight(body.SearchQuery, db.Backend())
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error compiling query", err)
+	}
+	emailsMod, err := db.FullTextSearch(highlight, condition, params...)
 	if err != nil {
 		return http.StatusInternalServerError, utils.JoinErrors("error getting emails", err)
 	}
@@ -254,20 +359,162 @@ func searchEmails(w http.ResponseWriter, r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
 
+func exportTable(w http.ResponseWriter, r *http.Request) (int, error) {
+	type postBody struct {
+		SqlQuery    string                `json:"sqlQuery"`
+		SearchQuery string                `json:"searchQuery"`
+		Query       string                `json:"query"`
+		SavedQuery  string                `json:"savedQuery"`
+		Mailboxes   []string              `json:"mailboxes"`
+		Headers     []export.HeaderFilter `json:"headers"`
+		After       string                `json:"after"`
+		Before      string                `json:"before"`
+		Format      string                `json:"format"`
+		Columns     []string              `json:"columns"`
+	}
+
+	var body postBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+
+	format := export.TableFormat(body.Format)
+	if format == "" {
+		format = export.TableFormatCSV
+	}
+	contentType, ok := map[export.TableFormat]string{
+		export.TableFormatCSV:     "text/csv; charset=utf-8",
+		export.TableFormatJSONL:   "application/x-ndjson",
+		export.TableFormatParquet: "application/vnd.apache.parquet",
+	}[format]
+	if !ok {
+		return http.StatusBadRequest, fmt.Errorf("unknown format %q", body.Format)
+	}
+	selection := export.Selection{SqlQuery: body.SqlQuery, SearchQuery: body.SearchQuery, Query: body.Query, SavedQuery: body.SavedQuery, Mailboxes: body.Mailboxes, Headers: body.Headers}
+	selection.After, selection.Before, err = parseDateRange(body.After, body.Before)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"emails.%s\"", format))
+	// rows are written as they are read, so once the first row is out errors can no longer change the status code
+	writer := &firstWriteTracker{writer: w}
+	_, err = export.Table(database.GetDatabase(), selection, writer, format, body.Columns)
+	if err != nil {
+		if !writer.written {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Del("Content-Disposition")
+			return http.StatusBadRequest, utils.JoinErrors("error exporting emails", err)
+		}
+		log.Printf("error exporting emails after the response was started: %v", err)
+	}
+	return http.StatusOK, nil
+}
+
+// remembers whether anything was sent to the client yet
+type firstWriteTracker struct {
+	writer  http.ResponseWriter
+	written bool
+}
+
+func (tracker *firstWriteTracker) Write(p []byte) (int, error) {
+	tracker.written = true
+	return tracker.writer.Write(p)
+}
+
+// lists the threads, or the emails of one thread oldest first when threadId is set
+func getThreads(w http.ResponseWriter, r *http.Request) (int, error) {
+	type postBody struct {
+		ThreadId string `json:"threadId"`
+		Limit    int    `json:"limit"`
+		Offset   int    `json:"offset"`
+	}
+
+	type postResponse struct {
+		Threads []models.Thread `json:"threads,omitempty"`
+		Emails  []*email.Email  `json:"emails,omitempty"`
+	}
+
+	var body postBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+
+	response := postResponse{}
+	db := database.GetDatabase()
+	if body.ThreadId != "" {
+		emailsMod, err := db.GetEmails("SELECT * FROM email WHERE thread_id = ? ORDER BY coalesce(date_epoch, 0), our_id", body.ThreadId)
+		if err != nil {
+			return http.StatusInternalServerError, utils.JoinErrors("error getting emails", err)
+		}
+		response.Emails = []*email.Email{}
+		for _, e := range emailsMod {
+			response.Emails = append(response.Emails, e.(*email.Email))
+		}
+	} else {
+		if body.Limit <= 0 {
+			body.Limit = 100
+		}
+		response.Threads, err = db.GetThreads(body.Limit, body.Offset)
+		if err != nil {
+			return http.StatusInternalServerError, utils.JoinErrors("error getting threads", err)
+		}
+	}
+
+	respJson, err := json.Marshal(response)
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+
+	return http.StatusOK, nil
+}
+
 func getMailboxes(w http.ResponseWriter, r *http.Request) (int, error) {
 	mailboxes, err := pool.ListMailboxes()
 	if err != nil {
 		return http.StatusInternalServerError, utils.JoinErrors("error getting mailboxes", err)
 	}
+	// a pinned saved query, listed next to the mailboxes
+	type smartFolder struct {
+		models.SavedQuery
+		NumEmails int `json:"num_emails"`
+		// set instead of NumEmails when the query fails, e.g. a sql query using a column that was renamed
+		Error string `json:"error,omitempty"`
+	}
 	type postResponse struct {
-		Mailboxes []models.MailboxRecord `json:"mailboxes"`
+		Mailboxes    []models.MailboxRecord `json:"mailboxes"`
+		SmartFolders []smartFolder          `json:"smart_folders"`
 	}
 
-	response := postResponse{}
+	response := postResponse{SmartFolders: []smartFolder{}}
 	for _, m := range mailboxes {
 		response.Mailboxes = append(response.Mailboxes, m.MailboxRecord())
 	}
 
+	db := database.GetDatabase()
+	savedQueries, err := db.GetSavedQueries()
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error getting saved queries", err)
+	}
+	for _, saved := range savedQueries {
+		if !saved.Pinned {
+			continue
+		}
+		folder := smartFolder{SavedQuery: saved}
+		// counted on every request, so the counts are always live
+		folder.NumEmails, err = export.Selection{SavedQuery: saved.Name}.Count(db)
+		if err != nil {
+			folder.Error = err.Error()
+		}
+		response.SmartFolders = append(response.SmartFolders, folder)
+	}
+
 	respJson, err := json.Marshal(response)
 	if err != nil {
 		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
@@ -279,6 +526,285 @@ func getMailboxes(w http.ResponseWriter, r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
 
+func getSavedQueries(w http.ResponseWriter, r *http.Request) (int, error) {
+	savedQueries, err := database.GetDatabase().GetSavedQueries()
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error getting saved queries", err)
+	}
+
+	type getResponse struct {
+		SavedQueries []models.SavedQuery `json:"saved_queries"`
+	}
+
+	respJson, err := json.Marshal(getResponse{savedQueries})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+// creates a saved query, or replaces the one with the same name
+func saveQuery(w http.ResponseWriter, r *http.Request) (int, error) {
+	var body models.SavedQuery
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+
+	err = database.GetDatabase().SaveQuery(body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error saving query", err)
+	}
+
+	respJson, err := json.Marshal(successResponse{true})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+func deleteSavedQuery(w http.ResponseWriter, r *http.Request) (int, error) {
+	type postBody struct {
+		Name string `json:"name"`
+	}
+
+	var body postBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+
+	deleted, err := database.GetDatabase().DeleteSavedQuery(body.Name)
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error deleting saved query", err)
+	}
+	if !deleted {
+		return http.StatusNotFound, fmt.Errorf("there is no saved query called %q", body.Name)
+	}
+
+	respJson, err := json.Marshal(successResponse{true})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+// the emails a tag or note request is about, either given by our_id or every email of a thread
+func annotatedEmails(ourIds []string, threadId string) ([]string, error) {
+	if threadId == "" {
+		return ourIds, nil
+	}
+	if len(ourIds) > 0 {
+		return nil, errors.New("only one of ourIds or threadId can be given")
+	}
+	threadEmailIds, err := database.GetDatabase().GetThreadEmailIds(threadId)
+	if err != nil {
+		return nil, err
+	}
+	if len(threadEmailIds) == 0 {
+		return nil, fmt.Errorf("there is no thread %s", threadId)
+	}
+	return threadEmailIds, nil
+}
+
+func getTags(w http.ResponseWriter, r *http.Request) (int, error) {
+	tags, err := database.GetDatabase().GetTags()
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error getting tags", err)
+	}
+
+	type getResponse struct {
+		Tags []models.Tag `json:"tags"`
+	}
+
+	respJson, err := json.Marshal(getResponse{tags})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+// the newest sync runs first, ?limit=50 by default and ?failed=true for only the failed ones
+func getSyncHistory(w http.ResponseWriter, r *http.Request) (int, error) {
+	limit := defaultSyncHistoryLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return http.StatusBadRequest, fmt.Errorf("invalid limit %q", value)
+		}
+	}
+	failedOnly := r.URL.Query().Get("failed") == "true"
+	runs, err := database.GetDatabase().GetSyncRuns(limit, failedOnly)
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error getting sync history", err)
+	}
+
+	type getResponse struct {
+		Runs []models.SyncRun `json:"runs"`
+	}
+
+	respJson, err := json.Marshal(getResponse{runs})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+// the tags and notes of the emails, by our_id
+func getAnnotations(w http.ResponseWriter, r *http.Request) (int, error) {
+	type postBody struct {
+		OurIds   []string `json:"ourIds"`
+		ThreadId string   `json:"threadId"`
+	}
+
+	var body postBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+	ourIds, err := annotatedEmails(body.OurIds, body.ThreadId)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	annotations, err := database.GetDatabase().GetAnnotations(ourIds)
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error getting tags and notes", err)
+	}
+
+	type postResponse struct {
+		Annotations map[string]models.Annotations `json:"annotations"`
+	}
+
+	respJson, err := json.Marshal(postResponse{annotations})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+type tagsPostBody struct {
+	OurIds   []string `json:"ourIds"`
+	ThreadId string   `json:"threadId"`
+	Tags     []string `json:"tags"`
+}
+
+func addTags(w http.ResponseWriter, r *http.Request) (int, error) {
+	var body tagsPostBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+	ourIds, err := annotatedEmails(body.OurIds, body.ThreadId)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err = database.GetDatabase().AddTags(ourIds, body.Tags)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error adding tags", err)
+	}
+
+	respJson, err := json.Marshal(successResponse{true})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+func removeTags(w http.ResponseWriter, r *http.Request) (int, error) {
+	var body tagsPostBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+	ourIds, err := annotatedEmails(body.OurIds, body.ThreadId)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	removed, err := database.GetDatabase().RemoveTags(ourIds, body.Tags)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error removing tags", err)
+	}
+
+	type postResponse struct {
+		Removed int `json:"removed"`
+	}
+
+	respJson, err := json.Marshal(postResponse{removed})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
+// the note of a thread is the note of its first email
+func setNote(w http.ResponseWriter, r *http.Request) (int, error) {
+	type postBody struct {
+		OurId    string `json:"ourId"`
+		ThreadId string `json:"threadId"`
+		// an empty text removes the note
+		Text string `json:"text"`
+	}
+
+	var body postBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error decoding json", err)
+	}
+	ourIds := []string{}
+	if body.OurId != "" {
+		ourIds = append(ourIds, body.OurId)
+	}
+	ourIds, err = annotatedEmails(ourIds, body.ThreadId)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if len(ourIds) == 0 {
+		return http.StatusBadRequest, errors.New("one of ourId or threadId must be given")
+	}
+
+	err = database.GetDatabase().SetNote(ourIds[0], body.Text)
+	if err != nil {
+		return http.StatusBadRequest, utils.JoinErrors("error setting note", err)
+	}
+
+	respJson, err := json.Marshal(successResponse{true})
+	if err != nil {
+		return http.StatusInternalServerError, utils.JoinErrors("error marshalling response", err)
+	} else {
+		_, err = w.Write(respJson)
+		utils.PanicIfError(err)
+	}
+	return http.StatusOK, nil
+}
+
 func ImapEventHandler(event *models.MailboxEvent) {
 	broadcast <- event
 }
@@ -377,21 +903,78 @@ func getFrontEndState(w http.ResponseWriter, r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
 
-func Start(imapConnPool models.ClientPool) error {
+// the number of sync runs /api/sync_history returns without a limit
+const defaultSyncHistoryLimit = 50
+
+// how often scheduled backups check whether a snapshot is due, so that a changed BACKUP_INTERVAL takes effect soon
+const backupCheckInterval = time.Minute
+
+/*
+takes a backup snapshot whenever BACKUP_INTERVAL has passed since the newest one in BACKUP_DIR, so restarting serve
+doesn't delay or repeat a backup, then rotates the old snapshots
+*/
+func scheduleBackups() {
+	for {
+		time.Sleep(backupCheckInterval)
+		optionsMutex.Lock()
+		ops := currentOptions
+		optionsMutex.Unlock()
+		if ops.GetBackupInterval() == 0 || ops.GetBackupDir() == "" {
+			continue
+		}
+		snapshots, err := backup.List(ops.GetBackupDir())
+		if err != nil {
+			log.Printf("scheduled backup failed: %v", err)
+			continue
+		}
+		if len(snapshots) > 0 && time.Since(snapshots[0].CreatedAt) < ops.GetBackupInterval() {
+			continue
+		}
+		snapshot, err := backup.Create(database.GetDatabase(), ops.GetBackupDir(), ops.GetBlobStorePath())
+		if err != nil {
+			log.Printf("scheduled backup failed: %v", err)
+			continue
+		}
+		log.Printf("created backup snapshot %s", snapshot.Path)
+		removed, err := backup.Rotate(ops.GetBackupDir(), ops.GetBackupPolicy())
+		for _, snapshot := range removed {
+			log.Printf("removed backup snapshot %s", snapshot.Path)
+		}
+		if err != nil {
+			log.Printf("rotating backups failed: %v", err)
+		}
+	}
+}
+
+func Start(imapConnPool models.ClientPool, ops *options.Options) error {
 	pool = imapConnPool
+	currentOptions = ops
 
 	flag.Parse()
 	log.SetFlags(0)
 	http.HandleFunc("/ws", websocketHandler)
 	http.HandleFunc("/api/options", allowedMethodsDec(apiDec(getOptions), http.MethodGet, http.MethodOptions))
+	http.HandleFunc("/api/set_options", allowedMethodsDec(apiDec(setOptions), http.MethodPost, http.MethodOptions))
 	http.HandleFunc("/api/emails", allowedMethodsDec(apiDec(getEmails), http.MethodPost, http.MethodOptions))
 	http.HandleFunc("/api/mailboxes", allowedMethodsDec(apiDec(getMailboxes), http.MethodGet, http.MethodOptions))
 	http.HandleFunc("/api/sync", allowedMethodsDec(apiDec(syncMailboxes), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/sync_history", allowedMethodsDec(apiDec(getSyncHistory), http.MethodGet, http.MethodOptions))
+	http.HandleFunc("/api/threads", allowedMethodsDec(apiDec(getThreads), http.MethodPost, http.MethodOptions))
 	http.HandleFunc("/api/search", allowedMethodsDec(apiDec(searchEmails), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/export", allowedMethodsDec(apiDec(exportTable), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/saved_queries", allowedMethodsDec(apiDec(getSavedQueries), http.MethodGet, http.MethodOptions))
+	http.HandleFunc("/api/save_query", allowedMethodsDec(apiDec(saveQuery), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/delete_saved_query", allowedMethodsDec(apiDec(deleteSavedQuery), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/tags", allowedMethodsDec(apiDec(getTags), http.MethodGet, http.MethodOptions))
+	http.HandleFunc("/api/annotations", allowedMethodsDec(apiDec(getAnnotations), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/tag", allowedMethodsDec(apiDec(addTags), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/untag", allowedMethodsDec(apiDec(removeTags), http.MethodPost, http.MethodOptions))
+	http.HandleFunc("/api/set_note", allowedMethodsDec(apiDec(setNote), http.MethodPost, http.MethodOptions))
 	http.HandleFunc("/api/set_frontend_state", allowedMethodsDec(apiDec(setFrontEndState), http.MethodPost, http.MethodOptions))
 	http.HandleFunc("/api/get_frontend_state", allowedMethodsDec(apiDec(getFrontEndState), http.MethodGet, http.MethodOptions))
 
 	go handleMessages()
+	go scheduleBackups()
 	// hydrate mailbox cache on startup since it's an operation that takes a while
 	go pool.ListMailboxes()
 
@@ -0,0 +1,202 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/skamensky/email-archiver/pkg/database"
+	"github.com/skamensky/email-archiver/pkg/options"
+	"github.com/skamensky/email-archiver/pkg/source"
+)
+
+const invoiceEml = `From: Acme Billing <billing@acme.com>
+To: Jane Doe <jane@example.com>
+Subject: Your invoice
+Date: Tue, 02 Jan 2024 10:00:00 +0000
+Message-ID: <invoice@acme.com>
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="b"
+
+--b
+Content-Type: text/plain; charset=utf-8
+
+The invoice for December is attached.
+--b
+Content-Type: text/plain; charset=utf-8
+Content-Disposition: attachment; filename="december.txt"
+
+invoice number 42, due in 30 days
+--b--
+`
+
+const lunchEml = `From: Bob <bob@example.com>
+To: Jane Doe <jane@example.com>
+Subject: Lunch
+Date: Wed, 03 Jan 2024 12:00:00 +0000
+Message-ID: <lunch@example.com>
+MIME-Version: 1.0
+Content-Type: text/plain; charset=utf-8
+
+Lunch tomorrow?
+`
+
+// the database is a global, so every test in the package shares the archive set up here
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "web-test")
+	if err != nil {
+		panic(err)
+	}
+	code := func() int {
+		defer os.RemoveAll(dir)
+		emlDir := filepath.Join(dir, "eml")
+		err = os.Mkdir(emlDir, 0700)
+		if err != nil {
+			panic(err)
+		}
+		for name, content := range map[string]string{"invoice.eml": invoiceEml, "lunch.eml": lunchEml} {
+			err = os.WriteFile(filepath.Join(emlDir, name), []byte(strings.ReplaceAll(content, "\n", "\r\n")), 0600)
+			if err != nil {
+				panic(err)
+			}
+		}
+		opts, err := options.New(map[string]string{"DB_PATH": filepath.Join(dir, "test.db")})
+		if err != nil {
+			panic(err)
+		}
+		db, err := database.New(opts)
+		if err != nil {
+			panic(err)
+		}
+		_, err = source.Import(db, source.NewEml(emlDir), "Imported", opts, nil)
+		if err != nil {
+			panic(err)
+		}
+		return m.Run()
+	}()
+	os.Exit(code)
+}
+
+type searchResult struct {
+	Subject            string   `json:"subject"`
+	TextContent        string   `json:"text_content"`
+	MatchedAttachments []string `json:"matched_attachments"`
+}
+
+func search(t *testing.T, searchQuery string) (int, []searchResult) {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"searchQuery": searchQuery})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	status, err := searchEmails(recorder, httptest.NewRequest(http.MethodPost, "/api/search", strings.NewReader(string(body))))
+	if status != http.StatusOK {
+		return status, nil
+	}
+	if err != nil {
+		t.Fatalf("%q: %v", searchQuery, err)
+	}
+	response := struct {
+		Emails []searchResult `json:"emails"`
+	}{}
+	err = json.Unmarshal(recorder.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("%q: %v", searchQuery, err)
+	}
+	return status, response.Emails
+}
+
+func TestSearchEmails(t *testing.T) {
+	const mark = `<span class="bg-yellow-200 text-black">`
+	unmark := strings.NewReplacer(mark, "", "</span>", "")
+	tests := []struct {
+		query string
+		// newest first
+		subjects []string
+		// the subjects of the results with highlights in their text
+		highlighted []string
+		// the matched_attachments of the invoice
+		matchedAttachments []string
+	}{
+		{"invoice", []string{"Your invoice"}, []string{"Your invoice"}, []string{"december.txt"}},
+		{"from:acme.com", []string{"Your invoice"}, []string{}, nil},
+		// only in the attachment
+		{`"due in 30 days" from:acme.com`, []string{"Your invoice"}, []string{}, []string{"december.txt"}},
+		{"december -number", []string{}, []string{}, nil},
+		{"invoice OR from:bob", []string{"Lunch", "Your invoice"}, []string{"Your invoice"}, []string{"december.txt"}},
+		{"-invoice", []string{"Lunch"}, []string{}, nil},
+	}
+	for _, test := range tests {
+		status, emails := search(t, test.query)
+		if status != http.StatusOK {
+			t.Errorf("%q: status %d", test.query, status)
+			continue
+		}
+		subjects := []string{}
+		highlighted := []string{}
+		var matchedAttachments []string
+		for _, mail := range emails {
+			subject := unmark.Replace(mail.Subject)
+			subjects = append(subjects, subject)
+			if strings.Contains(mail.TextContent, mark) {
+				highlighted = append(highlighted, subject)
+			}
+			if subject == "Your invoice" {
+				matchedAttachments = mail.MatchedAttachments
+			}
+		}
+		if !reflect.DeepEqual(subjects, test.subjects) {
+			t.Errorf("%q: got subjects %q, expected %q", test.query, subjects, test.subjects)
+		}
+		if !reflect.DeepEqual(highlighted, test.highlighted) {
+			t.Errorf("%q: got highlights in %q, expected %q", test.query, highlighted, test.highlighted)
+		}
+		if !reflect.DeepEqual(matchedAttachments, test.matchedAttachments) {
+			t.Errorf("%q: got matched_attachments %q, expected %q", test.query, matchedAttachments, test.matchedAttachments)
+		}
+	}
+}
+
+func TestSearchEmailsSyntaxError(t *testing.T) {
+	status, _ := search(t, "from:")
+	if status != http.StatusBadRequest {
+		t.Errorf("got status %d, expected %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestExportTable(t *testing.T) {
+	tests := []struct {
+		body   map[string]interface{}
+		status int
+		// the start of the exported file
+		prefix string
+	}{
+		{map[string]interface{}{"query": "from:acme.com", "format": "parquet"}, http.StatusOK, "PAR1"},
+		{map[string]interface{}{"query": "from:nobody", "format": "csv", "columns": []string{"subject"}}, http.StatusOK, "subject\n"},
+		// invalid selections are only noticed once the emails are read, before anything is written
+		{map[string]interface{}{"sqlQuery": "SELEC * FROM email", "format": "parquet"}, http.StatusBadRequest, ""},
+		{map[string]interface{}{"query": "from:", "format": "parquet"}, http.StatusBadRequest, ""},
+		{map[string]interface{}{"savedQuery": "missing", "format": "csv"}, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		body, err := json.Marshal(test.body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		status, err := exportTable(recorder, httptest.NewRequest(http.MethodPost, "/api/export", strings.NewReader(string(body))))
+		if status != test.status {
+			t.Errorf("%s: got status %d (%v), expected %d", body, status, err, test.status)
+			continue
+		}
+		if !strings.HasPrefix(recorder.Body.String(), test.prefix) || (test.prefix == "" && recorder.Body.Len() > 0) {
+			t.Errorf("%s: got %q, expected it to start with %q", body, recorder.Body.String(), test.prefix)
+		}
+	}
+}